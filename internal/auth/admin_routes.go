@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"path"
+)
+
+// adminRoutes are the operator endpoints, they move funds, change merchant settings or expose the outbox.
+// They are only served on the admin listener, see AdminRouteMiddleware.
+var adminRoutes = []string{
+	"/api/payment/*/refund",
+	"/api/payment/*/retry",
+	"/api/payments/quarantined",
+	"/api/late-payment",
+	"/api/late-payment/*/honor",
+	"/api/late-payment/*/refund",
+	"/api/merchant/*/settings",
+	"/api/merchant/*/ledger",
+	"/api/outbox",
+	"/api/outbox/*/retry",
+}
+
+// IsAdminRoute reports whether the path is one of the operator endpoints
+func IsAdminRoute(urlPath string) bool {
+	cleaned := path.Clean("/" + urlPath)
+	for _, pattern := range adminRoutes {
+		if matched, _ := path.Match(pattern, cleaned); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminRouteMiddleware hides the operator endpoints on the public port.
+// The admin listener on ADMIN_ADDRESS serves the router without it.
+func AdminRouteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsAdminRoute(r.URL.Path) {
+			log.Printf("rejected %s from %s on the public port", r.URL.Path, r.RemoteAddr)
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminRouteMiddleware(t *testing.T) {
+	// Arrange
+	handler := AdminRouteMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tests := []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodPost, "/api/payment", http.StatusOK},
+		{http.MethodGet, "/api/payment/8c1b2f4e-0d7a-4c52-9f0e-2b7d0f1c3a11", http.StatusOK},
+		{http.MethodPost, "/api/notification/walletnotify?tx_id=abc&mode=test", http.StatusOK},
+		{http.MethodPost, "/api/payment/8c1b2f4e-0d7a-4c52-9f0e-2b7d0f1c3a11/refund", http.StatusNotFound},
+		{http.MethodPost, "/api/payment/8c1b2f4e-0d7a-4c52-9f0e-2b7d0f1c3a11/retry", http.StatusNotFound},
+		{http.MethodGet, "/api/payments/quarantined", http.StatusNotFound},
+		{http.MethodGet, "/api/late-payment?status=pending", http.StatusNotFound},
+		{http.MethodPost, "/api/late-payment/8c1b2f4e-0d7a-4c52-9f0e-2b7d0f1c3a11/honor", http.StatusNotFound},
+		{http.MethodPost, "/api/late-payment/8c1b2f4e-0d7a-4c52-9f0e-2b7d0f1c3a11/refund", http.StatusNotFound},
+		{http.MethodPut, "/api/merchant/tb1qwallet/settings", http.StatusNotFound},
+		{http.MethodGet, "/api/merchant/tb1qwallet/ledger", http.StatusNotFound},
+		{http.MethodGet, "/api/outbox", http.StatusNotFound},
+		{http.MethodPost, "/api/outbox/8c1b2f4e-0d7a-4c52-9f0e-2b7d0f1c3a11/retry", http.StatusNotFound},
+		{http.MethodPost, "/api/payment/x/../8c1b2f4e-0d7a-4c52-9f0e-2b7d0f1c3a11/refund", http.StatusNotFound},
+		{http.MethodPost, "/api//late-payment/8c1b2f4e-0d7a-4c52-9f0e-2b7d0f1c3a11/honor", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		// Act
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(test.method, test.target, nil))
+
+		// Assert
+		if recorder.Code != test.status {
+			t.Errorf("Expected status %d for %s %s, but got %d", test.status, test.method, test.target, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+)
+
+const (
+	NotificationPathPrefix = "/api/notification/"
+	TimestampHeader        = "X-Chaingate-Timestamp"
+	SignatureHeader        = "X-Chaingate-Signature"
+)
+
+// RejectedNotifications counts the rejected notification calls per authenticator
+var RejectedNotifications = expvar.NewMap("notification_auth_rejected")
+
+// Authenticator decides whether a node notification request is allowed
+type Authenticator interface {
+	Name() string
+	Authenticate(r *http.Request) error
+}
+
+// NewNotificationAuthenticators creates the authenticators which are enabled in the opts.
+// A request has to pass all of them.
+func NewNotificationAuthenticators(opts *utils.OptsType) ([]Authenticator, error) {
+	var authenticators []Authenticator
+
+	if opts.NotificationAllowedIps != "" {
+		allowlist, err := NewIpAllowlistAuthenticator(opts.NotificationAllowedIps)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, allowlist)
+	}
+
+	if opts.NotificationHmacSecret != "" {
+		maxSkew := time.Duration(opts.NotificationMaxClockSkew) * time.Second
+		authenticators = append(authenticators, NewHmacAuthenticator(opts.NotificationHmacSecret, maxSkew))
+	}
+
+	if opts.NotificationClientCa != "" {
+		authenticators = append(authenticators, NewClientCertAuthenticator())
+	}
+
+	return authenticators, nil
+}
+
+// NotificationAuthMiddleware rejects unauthenticated calls to the notification endpoints.
+// All other endpoints are passed through.
+func NotificationAuthMiddleware(authenticators []Authenticator) func(http.Handler) http.Handler {
+	if len(authenticators) == 0 {
+		log.Println("WARNING: notification endpoints are not authenticated")
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, NotificationPathPrefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			for _, authenticator := range authenticators {
+				err := authenticator.Authenticate(r)
+				if err != nil {
+					RejectedNotifications.Add(authenticator.Name(), 1)
+					log.Printf("rejected %s from %s by %s: %v", r.URL.Path, r.RemoteAddr, authenticator.Name(), err)
+					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type hmacAuthenticator struct {
+	secret  []byte
+	maxSkew time.Duration
+	now     func() time.Time
+}
+
+// NewHmacAuthenticator checks the SignatureHeader, a hex encoded HMAC-SHA256 of NotificationMessage
+func NewHmacAuthenticator(secret string, maxSkew time.Duration) Authenticator {
+	return &hmacAuthenticator{secret: []byte(secret), maxSkew: maxSkew, now: time.Now}
+}
+
+func (a *hmacAuthenticator) Name() string {
+	return "hmac"
+}
+
+func (a *hmacAuthenticator) Authenticate(r *http.Request) error {
+	timestamp := r.Header.Get(TimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid timestamp")
+	}
+
+	skew := a.now().Sub(time.Unix(unix, 0))
+	if skew > a.maxSkew || skew < -a.maxSkew {
+		return fmt.Errorf("timestamp is %s off", skew)
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+
+	if !hmac.Equal(signature, Sign(a.secret, NotificationMessage(r, timestamp))) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// NotificationMessage is the signed content: timestamp, path and the sorted query params
+func NotificationMessage(r *http.Request, timestamp string) string {
+	return timestamp + "\n" + r.URL.Path + "?" + r.URL.Query().Encode()
+}
+
+func Sign(secret []byte, message string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+type ipAllowlistAuthenticator struct {
+	networks []*net.IPNet
+}
+
+// NewIpAllowlistAuthenticator takes a comma separated list of IPs and CIDRs
+func NewIpAllowlistAuthenticator(allowlist string) (Authenticator, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(allowlist, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip in allowlist: %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr in allowlist: %s", entry)
+		}
+		networks = append(networks, network)
+	}
+	return &ipAllowlistAuthenticator{networks}, nil
+}
+
+func (a *ipAllowlistAuthenticator) Name() string {
+	return "ip_allowlist"
+}
+
+// only the direct peer is checked, forwarded headers can be forged
+func (a *ipAllowlistAuthenticator) Authenticate(r *http.Request) error {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid remote address %s", r.RemoteAddr)
+	}
+	for _, network := range a.networks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not allowed", ip)
+}
+
+type clientCertAuthenticator struct{}
+
+// NewClientCertAuthenticator requires a client certificate which was verified by the tls server against NotificationClientCa
+func NewClientCertAuthenticator() Authenticator {
+	return &clientCertAuthenticator{}
+}
+
+func (a *clientCertAuthenticator) Name() string {
+	return "mtls"
+}
+
+func (a *clientCertAuthenticator) Authenticate(r *http.Request) error {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return errors.New("no verified client certificate")
+	}
+	return nil
+}
+
+// LoadClientCaPool reads the pem encoded CA certificates of the notifying nodes
+func LoadClientCaPool(pem []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in client ca")
+	}
+	return pool, nil
+}
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newSignedRequest(secret string, timestamp time.Time, url string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, url, nil)
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	r.Header.Set(TimestampHeader, ts)
+	r.Header.Set(SignatureHeader, hex.EncodeToString(Sign([]byte(secret), NotificationMessage(r, ts))))
+	return r
+}
+
+func TestHmacAuthenticator(t *testing.T) {
+	authenticator := NewHmacAuthenticator("secret", time.Minute)
+	url := "/api/notification/walletnotify?tx_id=abc&mode=test"
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		valid   bool
+	}{
+		{"valid", newSignedRequest("secret", time.Now(), url), true},
+		{"wrong secret", newSignedRequest("other", time.Now(), url), false},
+		{"expired", newSignedRequest("secret", time.Now().Add(-2*time.Minute), url), false},
+		{"future", newSignedRequest("secret", time.Now().Add(2*time.Minute), url), false},
+		{"missing", httptest.NewRequest(http.MethodPost, url, nil), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authenticator.Authenticate(tt.request)
+			if tt.valid && err != nil {
+				t.Errorf("Expected request to be accepted, but got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("Expected request to be rejected, but it was accepted")
+			}
+		})
+	}
+}
+
+func TestHmacAuthenticator_TamperedQuery(t *testing.T) {
+	// Arrange
+	authenticator := NewHmacAuthenticator("secret", time.Minute)
+	signed := newSignedRequest("secret", time.Now(), "/api/notification/walletnotify?tx_id=abc&mode=test")
+	tampered := httptest.NewRequest(http.MethodPost, "/api/notification/walletnotify?tx_id=def&mode=test", nil)
+	tampered.Header = signed.Header
+
+	// Act
+	err := authenticator.Authenticate(tampered)
+
+	// Assert
+	if err == nil {
+		t.Errorf("Expected tampered query to be rejected, but it was accepted")
+	}
+}
+
+func TestIpAllowlistAuthenticator(t *testing.T) {
+	authenticator, err := NewIpAllowlistAuthenticator("10.0.0.0/8, 192.168.1.5,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		valid      bool
+	}{
+		{"10.1.2.3:1234", true},
+		{"192.168.1.5:1234", true},
+		{"[::1]:1234", true},
+		{"192.168.1.6:1234", false},
+		{"11.0.0.1:1234", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/notification/blocknotify", nil)
+			r.RemoteAddr = tt.remoteAddr
+			err := authenticator.Authenticate(r)
+			if tt.valid && err != nil {
+				t.Errorf("Expected %s to be allowed, but got %v", tt.remoteAddr, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("Expected %s to be rejected, but it was allowed", tt.remoteAddr)
+			}
+		})
+	}
+}
+
+func TestNewIpAllowlistAuthenticator_Invalid(t *testing.T) {
+	_, err := NewIpAllowlistAuthenticator("10.0.0.0/33")
+	if err == nil {
+		t.Errorf("Expected invalid cidr to fail")
+	}
+}
+
+func TestClientCertAuthenticator(t *testing.T) {
+	authenticator := NewClientCertAuthenticator()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/notification/blocknotify", nil)
+	if authenticator.Authenticate(r) == nil {
+		t.Errorf("Expected plain http request to be rejected")
+	}
+
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{&x509.Certificate{}}}}
+	if err := authenticator.Authenticate(r); err != nil {
+		t.Errorf("Expected verified client certificate to be accepted, but got %v", err)
+	}
+}
+
+func TestNotificationAuthMiddleware(t *testing.T) {
+	// Arrange
+	handler := NotificationAuthMiddleware([]Authenticator{NewHmacAuthenticator("secret", time.Minute)})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	rejectedBefore := rejectedCount("hmac")
+
+	// Act
+	notification := httptest.NewRecorder()
+	handler.ServeHTTP(notification, httptest.NewRequest(http.MethodPost, "/api/notification/blocknotify?block_hash=abc&mode=test", nil))
+	payment := httptest.NewRecorder()
+	handler.ServeHTTP(payment, httptest.NewRequest(http.MethodPost, "/api/payment", nil))
+	signed := httptest.NewRecorder()
+	handler.ServeHTTP(signed, newSignedRequest("secret", time.Now(), "/api/notification/blocknotify?block_hash=abc&mode=test"))
+
+	// Assert
+	if notification.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, but got %d", http.StatusUnauthorized, notification.Code)
+	}
+	if payment.Code != http.StatusOK {
+		t.Errorf("Expected status %d for other endpoints, but got %d", http.StatusOK, payment.Code)
+	}
+	if signed.Code != http.StatusOK {
+		t.Errorf("Expected status %d, but got %d", http.StatusOK, signed.Code)
+	}
+	if rejectedCount("hmac") != rejectedBefore+1 {
+		t.Errorf("Expected rejected counter %d, but got %d", rejectedBefore+1, rejectedCount("hmac"))
+	}
+}
+
+func rejectedCount(name string) int64 {
+	counter := RejectedNotifications.Get(name)
+	if counter == nil {
+		return 0
+	}
+	return counter.(*expvar.Int).Value()
+}
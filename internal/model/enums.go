@@ -0,0 +1,207 @@
+package model
+
+import (
+	"strings"
+
+	"github.com/CHainGate/backend/pkg/enum"
+)
+
+type NotificationStatus int
+
+const (
+	NotificationPending NotificationStatus = iota + 1
+	NotificationDelivered
+	NotificationDead
+)
+
+func (n NotificationStatus) String() string {
+	return [...]string{"pending", "delivered", "dead"}[n-1]
+}
+
+func ParseStringToNotificationStatusEnum(str string) (NotificationStatus, bool) {
+	capabilitiesMap := map[string]NotificationStatus{
+		"pending":   NotificationPending,
+		"delivered": NotificationDelivered,
+		"dead":      NotificationDead,
+	}
+	c, ok := capabilitiesMap[strings.ToLower(str)]
+	return c, ok
+}
+
+// LatePaymentStatus tracks what an operator decided about funds which arrived after a payment expired
+type LatePaymentStatus int
+
+const (
+	LatePaymentPending LatePaymentStatus = iota + 1
+	LatePaymentHonored
+	LatePaymentRefunded
+)
+
+func (l LatePaymentStatus) String() string {
+	return [...]string{"pending", "honored", "refunded"}[l-1]
+}
+
+// PaymentState is the state the backend is notified with. The late funds are not part of the expired payment,
+// so the update must not look like another expired update of it.
+func (l LatePaymentStatus) PaymentState() string {
+	return [...]string{"late_paid", "late_forwarded", "late_refunded"}[l-1]
+}
+
+// Event names the late payment update sent to the backend, the payment itself stays expired
+func (l LatePaymentStatus) Event() string {
+	return "late_payment_" + l.String()
+}
+
+func ParseStringToLatePaymentStatusEnum(str string) (LatePaymentStatus, bool) {
+	capabilitiesMap := map[string]LatePaymentStatus{
+		"pending":  LatePaymentPending,
+		"honored":  LatePaymentHonored,
+		"refunded": LatePaymentRefunded,
+	}
+	c, ok := capabilitiesMap[strings.ToLower(str)]
+	return c, ok
+}
+
+// RefundStatus tracks a refund from the request until the refund transaction is confirmed
+type RefundStatus int
+
+const (
+	RefundPending RefundStatus = iota + 1
+	RefundSent
+	RefundConfirmed
+	RefundFailed
+)
+
+func (r RefundStatus) String() string {
+	return [...]string{"pending", "sent", "confirmed", "failed"}[r-1]
+}
+
+// Event names the refund update sent to the backend with the status of the refund, the payment keeps its state
+func (r RefundStatus) Event() string {
+	return "refund_" + r.String()
+}
+
+func ParseStringToRefundStatusEnum(str string) (RefundStatus, bool) {
+	capabilitiesMap := map[string]RefundStatus{
+		"pending":   RefundPending,
+		"sent":      RefundSent,
+		"confirmed": RefundConfirmed,
+		"failed":    RefundFailed,
+	}
+	c, ok := capabilitiesMap[strings.ToLower(str)]
+	return c, ok
+}
+
+// OverpaymentPolicy decides what happens to the surplus of an overpaid payment.
+// The surplus is credited if it can't be refunded, the merchant is paid its share of the credit with the payment.
+type OverpaymentPolicy int
+
+const (
+	OverpaymentCredit OverpaymentPolicy = iota + 1
+	OverpaymentForward
+	OverpaymentRefund
+)
+
+func (o OverpaymentPolicy) String() string {
+	return [...]string{"credit", "forward", "refund"}[o-1]
+}
+
+// Event names the surplus update in the outbox, the backend is notified with the state of the payment
+func (o OverpaymentPolicy) Event() string {
+	return "overpayment_" + o.String()
+}
+
+func ParseStringToOverpaymentPolicyEnum(str string) (OverpaymentPolicy, bool) {
+	capabilitiesMap := map[string]OverpaymentPolicy{
+		"credit":  OverpaymentCredit,
+		"forward": OverpaymentForward,
+		"refund":  OverpaymentRefund,
+	}
+	c, ok := capabilitiesMap[strings.ToLower(str)]
+	return c, ok
+}
+
+// PayoutSchedule decides when the confirmed payments of a merchant are paid out.
+// The scheduled payouts wait until the balance reaches the minimum payout of the merchant.
+type PayoutSchedule int
+
+const (
+	PayoutImmediate PayoutSchedule = iota + 1
+	PayoutDaily
+	PayoutWeekly
+	PayoutThreshold
+)
+
+func (p PayoutSchedule) String() string {
+	return [...]string{"immediate", "daily", "weekly", "threshold"}[p-1]
+}
+
+func ParseStringToPayoutScheduleEnum(str string) (PayoutSchedule, bool) {
+	capabilitiesMap := map[string]PayoutSchedule{
+		"immediate": PayoutImmediate,
+		"daily":     PayoutDaily,
+		"weekly":    PayoutWeekly,
+		"threshold": PayoutThreshold,
+	}
+	c, ok := capabilitiesMap[strings.ToLower(str)]
+	return c, ok
+}
+
+// LedgerEntryKind is the reason the balance of a merchant changed
+type LedgerEntryKind int
+
+const (
+	LedgerCredit LedgerEntryKind = iota + 1
+	LedgerPayout
+	LedgerReversal
+)
+
+func (l LedgerEntryKind) String() string {
+	return [...]string{"credit", "payout", "reversal"}[l-1]
+}
+
+// RiskLevel is how likely the unconfirmed transactions of a payment are replaced or double spent
+type RiskLevel int
+
+const (
+	RiskLow RiskLevel = iota + 1
+	RiskMedium
+	RiskHigh
+)
+
+func (r RiskLevel) String() string {
+	return [...]string{"low", "medium", "high"}[r-1]
+}
+
+// Network is the bitcoin chain a payment is made on. Only mainnet payments are real money.
+type Network int
+
+const (
+	Regtest Network = iota + 1
+	Signet
+	Testnet
+	Mainnet
+)
+
+func (n Network) String() string {
+	return [...]string{"regtest", "signet", "testnet", "mainnet"}[n-1]
+}
+
+// Mode is the backend mode payments on the network belong to
+func (n Network) Mode() enum.Mode {
+	if n == Mainnet {
+		return enum.Main
+	}
+	return enum.Test
+}
+
+func ParseStringToNetworkEnum(str string) (Network, bool) {
+	capabilitiesMap := map[string]Network{
+		"regtest": Regtest,
+		"signet":  Signet,
+		"testnet": Testnet,
+		"mainnet": Mainnet,
+	}
+	c, ok := capabilitiesMap[strings.ToLower(str)]
+	return c, ok
+}
@@ -21,27 +21,46 @@ type Base struct {
 
 type Account struct {
 	Base
-	Address   string `gorm:"type:varchar"`
-	Used      bool
-	Mode      enum.Mode
-	Remainder *BigInt `gorm:"type:numeric(30);default:0"`
-	Payments  []Payment
+	Address         string `gorm:"type:varchar"`
+	Used            bool
+	Mode            enum.Mode
+	Network         Network `gorm:"index;uniqueIndex:idx_accounts_network_derivation_index"`
+	DerivationIndex *int64  `gorm:"uniqueIndex:idx_accounts_network_derivation_index"` // receive address index of the account xpub, nil for node wallet addresses
+	Remainder       *BigInt `gorm:"type:numeric(30);default:0"`
+	Payments        []Payment
 }
 
 type Payment struct {
 	Base
 	Account                   *Account
-	AccountID                 uuid.UUID `gorm:"type:uuid"`
+	AccountID                 uuid.UUID  `gorm:"type:uuid"`
+	OpenAccountID             *uuid.UUID `gorm:"type:uuid;uniqueIndex"` // set while the payment holds the account
 	MerchantWallet            string
 	Mode                      enum.Mode
+	Network                   Network `gorm:"index"`
 	PriceAmount               float64 `gorm:"type:numeric(30,15);default:0"`
 	PriceCurrency             enum.FiatCurrency
+	ExpiresAt                 time.Time         `gorm:"index"`
+	OverpaymentPolicy         OverpaymentPolicy `gorm:"default:1"`
+	RefundAddress             string
+	UnderpaymentTolerance     *BigInt        `gorm:"type:numeric(30);default:0"`
+	Shortfall                 *BigInt        `gorm:"type:numeric(30);default:0"`
+	CreditedSurplus           *BigInt        `gorm:"type:numeric(30);default:0"` // surplus kept for the merchant once the payment is confirmed
 	CurrentPaymentStateId     *uuid.UUID     `gorm:"type:uuid"`
 	CurrentPaymentState       PaymentState   `gorm:"<-:false;foreignKey:CurrentPaymentStateId"`
 	PaymentStates             []PaymentState // in eth service this one is <-:false
 	ReceivedConfirmations     *int64
 	ForwardingTransactionHash *string
 	ForwardingConfirmations   *int64
+	ForwardingBlockHash       *string
+	PayoutBatchID             *uuid.UUID `gorm:"type:uuid;index"`
+	ForwardingFee             *BigInt    `gorm:"type:numeric(30);default:0"` // share of the network fee of a payout batch
+	Risk                      RiskLevel  `gorm:"default:1"`
+	IdempotencyKey            *string    `gorm:"uniqueIndex"`
+	RequestFingerprint        string     // hash of the request which created the payment with the idempotency key
+	ProcessingFailures        int        `gorm:"default:0"` // failed block runs in a row
+	LastProcessingError       string
+	QuarantinedAt             *time.Time `gorm:"index"` // set once the block runs skip the payment
 }
 
 type PaymentState struct {
@@ -50,6 +69,125 @@ type PaymentState struct {
 	AmountReceived *BigInt `gorm:"type:numeric(30);default:0"`
 	StateID        enum.State
 	PaymentID      uuid.UUID `gorm:"type:uuid"`
+	Overpaid       bool      `gorm:"default:false"`
+	Surplus        *BigInt   `gorm:"type:numeric(30);default:0"`
+}
+
+// MerchantSettings are the settings of the merchant owning the wallet
+type MerchantSettings struct {
+	Base
+	Wallet            string `gorm:"uniqueIndex"`
+	OverpaymentPolicy OverpaymentPolicy
+	PayoutSchedule    PayoutSchedule `gorm:"default:1"`
+	MinimumPayout     *BigInt        `gorm:"type:numeric(30);default:0"`
+}
+
+// MerchantLedgerEntry changes the balance of a merchant wallet on a network, the balance is the sum of the amounts.
+// A confirmed payment is credited with its forward amount, which is debited again when it is paid out
+// or when a reorg takes the confirmation away.
+type MerchantLedgerEntry struct {
+	Base
+	Wallet    string    `gorm:"index:idx_merchant_ledger_entries_wallet_network"`
+	Network   Network   `gorm:"index:idx_merchant_ledger_entries_wallet_network"`
+	PaymentID uuid.UUID `gorm:"type:uuid;index"`
+	Kind      LedgerEntryKind
+	Amount    *BigInt `gorm:"type:numeric(30);default:0"`
+	TxHash    *string // transaction of a payout
+}
+
+type OutboxNotification struct {
+	Base
+	Sequence      int64     `gorm:"autoIncrement;index"`
+	PaymentID     uuid.UUID `gorm:"type:uuid;index"`
+	PayAmount     string
+	ActuallyPaid  string
+	PaymentState  string
+	TxHash        *string
+	RiskLevel     string
+	Event         string // late payment, refund or overpayment update, empty for a state of the payment
+	Surplus       string
+	LateAmount    string     // funds of a late payment update, ActuallyPaid stays the amount received before the expiry
+	RefundID      *uuid.UUID `gorm:"type:uuid"`
+	RefundStatus  string
+	RefundAmount  string
+	RefundTxHash  *string
+	Status        NotificationStatus `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+}
+
+// LatePayment are funds which arrived on the address of a payment after it expired.
+// The account stays in use until the late payment is honored or refunded.
+type LatePayment struct {
+	Base
+	Payment                  *Payment
+	PaymentID                uuid.UUID `gorm:"type:uuid;index"`
+	AccountID                uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_late_payments_account_tx"`
+	Address                  string
+	TxHash                   string `gorm:"uniqueIndex:idx_late_payments_account_tx"`
+	Network                  Network
+	Amount                   *BigInt           `gorm:"type:numeric(30);default:0"`
+	Status                   LatePaymentStatus `gorm:"index"`
+	RefundAddress            string
+	ResolvingTransactionHash *string
+}
+
+// IncomingTransaction is a transaction of the buyer to the address of a payment.
+// BlockHash is the block it confirmed in, a different or missing block later means it was reorged out.
+type IncomingTransaction struct {
+	Base
+	PaymentID uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_incoming_transactions_payment_tx"`
+	TxHash    string    `gorm:"uniqueIndex:idx_incoming_transactions_payment_tx"`
+	BlockHash *string
+}
+
+// ForwardingTransaction is a version of the transaction forwarding a payment to the merchant.
+// A stuck version is replaced by one with a higher fee, any of the versions may confirm.
+type ForwardingTransaction struct {
+	Base
+	PaymentID uuid.UUID `gorm:"type:uuid;index"`
+	TxHash    string
+	Height    int32 // best block when the version was sent
+}
+
+// PayoutBatch forwards several confirmed payments in one transaction with one output per merchant wallet.
+// The network fee is subtracted from the outputs and attributed to the payments by their forwarded amount.
+type PayoutBatch struct {
+	Base
+	Network Network `gorm:"index"`
+	TxHash  *string
+	Fee     *BigInt `gorm:"type:numeric(30);default:0"`
+}
+
+// Refund sends funds received for a payment back to the buyer.
+// The network fee is paid from the refund, the change goes back to the address of the payment.
+type Refund struct {
+	Base
+	Payment              *Payment
+	PaymentID            uuid.UUID `gorm:"type:uuid;index"`
+	Address              string
+	RefundAddress        string
+	Network              Network
+	Amount               *BigInt     `gorm:"type:numeric(30);default:0"`
+	CurrentRefundStateId *uuid.UUID  `gorm:"type:uuid"`
+	CurrentRefundState   RefundState `gorm:"<-:false;foreignKey:CurrentRefundStateId"`
+	RefundStates         []RefundState
+	TransactionHash      *string
+	Confirmations        *int64
+}
+
+type RefundState struct {
+	Base
+	RefundID uuid.UUID `gorm:"type:uuid"`
+	Status   RefundStatus
+}
+
+// ChainCursor remembers the last block the reconciler processed for a network
+type ChainCursor struct {
+	Base
+	Network       Network `gorm:"uniqueIndex"`
+	LastBlockHash string
 }
 
 // TODO: could be outsourced to backend public library. ETH and BTC service use it.
@@ -0,0 +1,73 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// BitcoinNode is the part of the bitcoind rpc api the service uses.
+// It is implemented by *rpcclient.Client and by SimulatedNode for tests.
+type BitcoinNode interface {
+	GetTransaction(txHash *chainhash.Hash) (*btcjson.GetTransactionResult, error)
+	ListUnspentMinMaxAddresses(minConf, maxConf int, addrs []btcutil.Address) ([]btcjson.ListUnspentResult, error)
+	CreateRawTransaction(inputs []btcjson.TransactionInput, amounts map[btcutil.Address]btcutil.Amount, lockTime *int64) (*wire.MsgTx, error)
+	FundRawTransaction(tx *wire.MsgTx, opts btcjson.FundRawTransactionOpts, isWitness *bool) (*btcjson.FundRawTransactionResult, error)
+	SignRawTransactionWithWallet(tx *wire.MsgTx) (*wire.MsgTx, bool, error)
+	SendRawTransaction(tx *wire.MsgTx, allowHighFees bool) (*chainhash.Hash, error)
+	EstimateSmartFee(confTarget int64, mode *btcjson.EstimateSmartFeeMode) (*btcjson.EstimateSmartFeeResult, error)
+	GetNewAddress(account string) (btcutil.Address, error)
+	ListTransactions(account string) ([]btcjson.ListTransactionsResult, error)
+	ListSinceBlock(blockHash *chainhash.Hash) (*btcjson.ListSinceBlockResult, error)
+	GetBlockChainInfo() (*btcjson.GetBlockChainInfoResult, error)
+	WalletPassphrase(passphrase string, timeoutSecs int64) error
+	WalletLock() error
+	RawRequest(method string, params []json.RawMessage) (json.RawMessage, error)
+}
+
+var _ BitcoinNode = (*rpcclient.Client)(nil)
+
+// ImportDescriptorRequest is one descriptor of importdescriptors, which rpcclient does not implement
+type ImportDescriptorRequest struct {
+	Descriptor string      `json:"desc"`
+	Range      []int64     `json:"range,omitempty"`
+	Timestamp  interface{} `json:"timestamp"` // "now" or a unix timestamp to rescan from
+	Internal   bool        `json:"internal"`
+}
+
+type importDescriptorResult struct {
+	Success bool              `json:"success"`
+	Error   *btcjson.RPCError `json:"error,omitempty"`
+}
+
+// ImportDescriptors adds the descriptors to the wallet of the node, e.g. the watch-only payment addresses of an xpub
+func ImportDescriptors(client BitcoinNode, requests []ImportDescriptorRequest) error {
+	param, err := json.Marshal(requests)
+	if err != nil {
+		return err
+	}
+	response, err := client.RawRequest("importdescriptors", []json.RawMessage{param})
+	if err != nil {
+		return err
+	}
+
+	var results []importDescriptorResult
+	err = json.Unmarshal(response, &results)
+	if err != nil {
+		return err
+	}
+	for i, result := range results {
+		if !result.Success {
+			if result.Error != nil {
+				return fmt.Errorf("import of %s failed: %s", requests[i].Descriptor, result.Error.Message)
+			}
+			return fmt.Errorf("import of %s failed", requests[i].Descriptor)
+		}
+	}
+	return nil
+}
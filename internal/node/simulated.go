@@ -0,0 +1,1139 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+)
+
+const (
+	simulatedStartTime     = 1600000000
+	simulatedBlockInterval = 10 * time.Minute
+
+	// sequence numbers below this signal BIP125 replaceability
+	rbfSequence = wire.MaxTxInSequenceNum - 1
+)
+
+// ErrSimulated can be passed to FailNext when the kind of error does not matter
+var ErrSimulated = errors.New("simulated node failure")
+
+type simulatedBlock struct {
+	hash   chainhash.Hash
+	prev   chainhash.Hash
+	height int32
+	time   time.Time
+	txIds  []chainhash.Hash
+}
+
+type simulatedTx struct {
+	tx         *wire.MsgTx
+	hash       chainhash.Hash
+	received   time.Time
+	conflicted bool
+}
+
+// simulatedChain is the chain state shared by the wallets of a simulated node
+type simulatedChain struct {
+	mu            sync.Mutex
+	params        *chaincfg.Params
+	blocks        map[chainhash.Hash]*simulatedBlock
+	chain         []*simulatedBlock
+	confirmedIn   map[chainhash.Hash]*simulatedBlock
+	txs           map[chainhash.Hash]*simulatedTx
+	txOrder       []chainhash.Hash
+	mempool       []chainhash.Hash
+	externalCount uint32
+	feeRate       float64
+	miningFeeRate float64
+}
+
+// SimulatedNode is a deterministic in-memory chain with a wallet.
+// Blocks are only mined on request, so tests control confirmations, reorgs and double spends.
+// Scripts are not evaluated, a transaction is valid when all its inputs exist and are unspent.
+type SimulatedNode struct {
+	*simulatedChain
+	walletAddresses     map[string]bool // false for watch-only addresses the wallet has no key for
+	addressCount        uint32
+	passphrase          string
+	unlocked            bool
+	privateKeysDisabled bool
+	failures            map[string][]error
+}
+
+// NewSimulatedNode creates a chain with only the genesis block of params.
+// feeRate in BTC/kvB is returned by EstimateSmartFee, 0 means no estimate is available.
+func NewSimulatedNode(params *chaincfg.Params, feeRate float64, passphrase string) *SimulatedNode {
+	genesis := &simulatedBlock{
+		hash:   *params.GenesisHash,
+		height: 0,
+		time:   time.Unix(simulatedStartTime, 0),
+	}
+	return &SimulatedNode{
+		simulatedChain: &simulatedChain{
+			params:      params,
+			blocks:      map[chainhash.Hash]*simulatedBlock{genesis.hash: genesis},
+			chain:       []*simulatedBlock{genesis},
+			confirmedIn: make(map[chainhash.Hash]*simulatedBlock),
+			txs:         make(map[chainhash.Hash]*simulatedTx),
+			feeRate:     feeRate,
+		},
+		walletAddresses: make(map[string]bool),
+		passphrase:      passphrase,
+		failures:        make(map[string][]error),
+	}
+}
+
+// NewWatchOnlyWallet creates a second wallet on the chain of the node,
+// like createwallet with disable_private_keys=true. It has no keys and no passphrase.
+func (s *SimulatedNode) NewWatchOnlyWallet() *SimulatedNode {
+	return &SimulatedNode{
+		simulatedChain:      s.simulatedChain,
+		walletAddresses:     make(map[string]bool),
+		privateKeysDisabled: true,
+		failures:            make(map[string][]error),
+	}
+}
+
+// FailNext makes the next call of the BitcoinNode method with the given name return err
+func (s *SimulatedNode) FailNext(method string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method] = append(s.failures[method], err)
+}
+
+// SetFeeRate changes the result of EstimateSmartFee
+func (s *SimulatedNode) SetFeeRate(feeRate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.feeRate = feeRate
+}
+
+// SetMiningFeeRate makes blocks leave out transactions of the wallet paying less than feeRate in BTC/kvB,
+// e.g. to let a forwarding transaction get stuck. Transactions of external wallets are always mined.
+func (s *SimulatedNode) SetMiningFeeRate(feeRate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.miningFeeRate = feeRate
+}
+
+// NewExternalAddress returns an address which does not belong to the wallet, e.g. for a merchant
+func (s *SimulatedNode) NewExternalAddress() btcutil.Address {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.externalCount++
+	return s.newAddress("external", s.externalCount)
+}
+
+// Pay adds a transaction of an external wallet paying amount to address to the mempool
+func (s *SimulatedNode) Pay(address btcutil.Address, amount btcutil.Amount) (*chainhash.Hash, error) {
+	return s.pay(address, amount, wire.MaxTxInSequenceNum)
+}
+
+// PayReplaceable is Pay with a transaction signaling BIP125 replaceability
+func (s *SimulatedNode) PayReplaceable(address btcutil.Address, amount btcutil.Amount) (*chainhash.Hash, error) {
+	return s.pay(address, amount, rbfSequence-1)
+}
+
+// DoubleSpend replaces the unconfirmed transaction with an external transaction spending its first input.
+// The replaced transaction and its descendants become conflicted.
+func (s *SimulatedNode) DoubleSpend(txHash *chainhash.Hash) (*chainhash.Hash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.txs[*txHash]
+	if !ok || st.conflicted {
+		return nil, fmt.Errorf("unknown transaction %s", txHash)
+	}
+	if _, ok := s.confirmedIn[*txHash]; ok {
+		return nil, fmt.Errorf("transaction %s is confirmed, disconnect its block first", txHash)
+	}
+
+	s.externalCount++
+	pkScript, err := txscript.PayToAddrScript(s.newAddress("external", s.externalCount))
+	if err != nil {
+		return nil, err
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(&st.tx.TxIn[0].PreviousOutPoint, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(st.tx.TxOut[0].Value, pkScript))
+
+	s.conflict(*txHash)
+	return s.addToMempool(tx), nil
+}
+
+// Mine appends n blocks, the first one contains all mempool transactions paying the mining fee rate
+func (s *SimulatedNode) Mine(n int) []chainhash.Hash {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mine(n)
+}
+
+// Disconnect removes the last depth blocks, their transactions go back to the mempool
+func (s *SimulatedNode) Disconnect(depth int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnect(depth)
+}
+
+// Reorg replaces the last depth blocks by depth+1 new blocks containing the same transactions
+func (s *SimulatedNode) Reorg(depth int) []chainhash.Hash {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnect(depth)
+	return s.mine(depth + 1)
+}
+
+// Height returns the height of the best block
+func (s *SimulatedNode) Height() int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tip().height
+}
+
+func (s *SimulatedNode) GetTransaction(txHash *chainhash.Hash) (*btcjson.GetTransactionResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("GetTransaction"); err != nil {
+		return nil, err
+	}
+
+	st, ok := s.txs[*txHash]
+	if !ok {
+		return nil, invalidTransactionError()
+	}
+	entries, amount, fee := s.walletEntries(st)
+	if entries == nil {
+		return nil, invalidTransactionError()
+	}
+
+	var buf bytes.Buffer
+	err := st.tx.Serialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &btcjson.GetTransactionResult{
+		Amount:          amount,
+		Fee:             fee,
+		Confirmations:   s.confirmations(st),
+		TxID:            st.hash.String(),
+		WalletConflicts: s.walletConflicts(st),
+		Time:            st.received.Unix(),
+		TimeReceived:    st.received.Unix(),
+		Hex:             hex.EncodeToString(buf.Bytes()),
+	}
+	if block, ok := s.confirmedIn[st.hash]; ok {
+		result.BlockHash = block.hash.String()
+		result.BlockIndex = blockIndex(block, st.hash)
+		result.BlockTime = block.time.Unix()
+	}
+	for _, entry := range entries {
+		result.Details = append(result.Details, btcjson.GetTransactionDetailsResult{
+			Address:  entry.Address,
+			Amount:   entry.Amount,
+			Category: entry.Category,
+			Fee:      entry.Fee,
+			Vout:     entry.Vout,
+		})
+	}
+	return result, nil
+}
+
+func (s *SimulatedNode) ListUnspentMinMaxAddresses(minConf, maxConf int, addrs []btcutil.Address) ([]btcjson.ListUnspentResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("ListUnspentMinMaxAddresses"); err != nil {
+		return nil, err
+	}
+
+	filter := make(map[string]bool)
+	for _, addr := range addrs {
+		filter[addr.EncodeAddress()] = true
+	}
+
+	spent := s.spentOutPoints()
+	var results []btcjson.ListUnspentResult
+	for _, st := range s.liveTxs() {
+		confirmations := s.confirmations(st)
+		if confirmations < int64(minConf) || confirmations > int64(maxConf) {
+			continue
+		}
+		for vout, out := range st.tx.TxOut {
+			address, ok := s.walletAddress(out.PkScript)
+			if !ok || (len(filter) > 0 && !filter[address]) {
+				continue
+			}
+			if _, ok := spent[wire.OutPoint{Hash: st.hash, Index: uint32(vout)}]; ok {
+				continue
+			}
+			results = append(results, btcjson.ListUnspentResult{
+				TxID:          st.hash.String(),
+				Vout:          uint32(vout),
+				Address:       address,
+				ScriptPubKey:  hex.EncodeToString(out.PkScript),
+				Amount:        btcutil.Amount(out.Value).ToBTC(),
+				Confirmations: confirmations,
+				Spendable:     true,
+			})
+		}
+	}
+	return results, nil
+}
+
+func (s *SimulatedNode) CreateRawTransaction(inputs []btcjson.TransactionInput, amounts map[btcutil.Address]btcutil.Amount, lockTime *int64) (*wire.MsgTx, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("CreateRawTransaction"); err != nil {
+		return nil, err
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	for _, input := range inputs {
+		hash, err := chainhash.NewHashFromStr(input.Txid)
+		if err != nil {
+			return nil, err
+		}
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, input.Vout), nil, nil))
+	}
+
+	// map order is random, sort the outputs to stay deterministic
+	addresses := make([]btcutil.Address, 0, len(amounts))
+	for address := range amounts {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i].EncodeAddress() < addresses[j].EncodeAddress()
+	})
+	for _, address := range addresses {
+		pkScript, err := txscript.PayToAddrScript(address)
+		if err != nil {
+			return nil, err
+		}
+		tx.AddTxOut(wire.NewTxOut(int64(amounts[address]), pkScript))
+	}
+
+	if lockTime != nil {
+		tx.LockTime = uint32(*lockTime)
+	}
+	return tx, nil
+}
+
+func (s *SimulatedNode) FundRawTransaction(tx *wire.MsgTx, opts btcjson.FundRawTransactionOpts, _ *bool) (*btcjson.FundRawTransactionResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("FundRawTransaction"); err != nil {
+		return nil, err
+	}
+
+	funded := tx.Copy()
+	feeRate := s.feeRate
+	if opts.FeeRate != nil {
+		feeRate = *opts.FeeRate
+	}
+	if feeRate == 0 {
+		return nil, rpcError(btcjson.ErrRPCWallet, "Fee estimation failed")
+	}
+
+	var outputAmount int64
+	for _, out := range funded.TxOut {
+		outputAmount += out.Value
+	}
+
+	spent := s.spentOutPoints()
+	var inputAmount int64
+	for _, in := range funded.TxIn {
+		// like bitcoind the wallet can only fund inputs of its own addresses
+		out, ok := s.output(in.PreviousOutPoint)
+		if !ok {
+			return nil, rpcError(btcjson.ErrRPCInvalidParameter, "Insufficient funds")
+		}
+		if _, ok := s.walletAddress(out.PkScript); !ok {
+			return nil, rpcError(btcjson.ErrRPCWallet, "Insufficient funds")
+		}
+		inputAmount += out.Value
+	}
+
+	subtractFee := len(opts.SubtractFeeFromOutputs) > 0
+	if len(funded.TxIn) == 0 {
+		for _, st := range s.liveTxs() {
+			for vout, out := range st.tx.TxOut {
+				op := wire.OutPoint{Hash: st.hash, Index: uint32(vout)}
+				if _, ok := s.walletAddress(out.PkScript); !ok {
+					continue
+				}
+				if _, ok := spent[op]; ok {
+					continue
+				}
+				funded.AddTxIn(wire.NewTxIn(&op, nil, nil))
+				inputAmount += out.Value
+			}
+			if inputAmount >= outputAmount+estimateFee(feeRate, len(funded.TxIn), len(funded.TxOut)+1) {
+				break
+			}
+		}
+	}
+
+	fee := estimateFee(feeRate, len(funded.TxIn), len(funded.TxOut)+1)
+	if subtractFee {
+		share := fee / int64(len(opts.SubtractFeeFromOutputs))
+		remainder := fee - share*int64(len(opts.SubtractFeeFromOutputs))
+		for i, index := range opts.SubtractFeeFromOutputs {
+			if index < 0 || index >= len(funded.TxOut) {
+				return nil, rpcError(btcjson.ErrRPCInvalidParameter, "Invalid subtractFeeFromOutputs index")
+			}
+			deduct := share
+			if i == 0 {
+				deduct += remainder
+			}
+			if funded.TxOut[index].Value <= deduct {
+				return nil, rpcError(btcjson.ErrRPCWallet, "The transaction amount is too small to pay the fee")
+			}
+			funded.TxOut[index].Value -= deduct
+		}
+		outputAmount -= fee
+	}
+
+	change := inputAmount - outputAmount - fee
+	if change < 0 {
+		return nil, rpcError(btcjson.ErrRPCWallet, "Insufficient funds")
+	}
+
+	changePosition := -1
+	if change > 0 {
+		var changeAddress btcutil.Address
+		if opts.ChangeAddress != nil {
+			address, err := btcutil.DecodeAddress(*opts.ChangeAddress, s.params)
+			if err != nil {
+				return nil, rpcError(btcjson.ErrRPCInvalidAddressOrKey, "Change address must be a valid bitcoin address")
+			}
+			changeAddress = address
+		} else if s.privateKeysDisabled {
+			return nil, rpcError(btcjson.ErrRPCWallet, "Can't generate a change-address key. Private keys are disabled for this wallet.")
+		} else {
+			changeAddress = s.newWalletAddress()
+		}
+		pkScript, err := txscript.PayToAddrScript(changeAddress)
+		if err != nil {
+			return nil, err
+		}
+
+		changePosition = len(funded.TxOut)
+		if opts.ChangePosition != nil && *opts.ChangePosition >= 0 && *opts.ChangePosition < changePosition {
+			changePosition = *opts.ChangePosition
+		}
+		outputs := append([]*wire.TxOut{}, funded.TxOut[:changePosition]...)
+		outputs = append(outputs, wire.NewTxOut(change, pkScript))
+		funded.TxOut = append(outputs, funded.TxOut[changePosition:]...)
+	}
+
+	if opts.Replaceable != nil && *opts.Replaceable {
+		for _, in := range funded.TxIn {
+			in.Sequence = rbfSequence - 1
+		}
+	}
+
+	return &btcjson.FundRawTransactionResult{
+		Transaction:    funded,
+		Fee:            btcutil.Amount(fee),
+		ChangePosition: changePosition,
+	}, nil
+}
+
+func (s *SimulatedNode) SignRawTransactionWithWallet(tx *wire.MsgTx) (*wire.MsgTx, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("SignRawTransactionWithWallet"); err != nil {
+		return nil, false, err
+	}
+
+	if s.passphrase != "" && !s.unlocked {
+		return nil, false, rpcError(btcjson.ErrRPCWalletUnlockNeeded, "Please enter the wallet passphrase with walletpassphrase first.")
+	}
+
+	complete := true
+	for _, in := range tx.TxIn {
+		// inputs signed before, e.g. with the account xprv, are kept
+		if len(in.Witness) > 0 || len(in.SignatureScript) > 0 {
+			continue
+		}
+		out, ok := s.output(in.PreviousOutPoint)
+		if !ok {
+			complete = false
+			continue
+		}
+		// the wallet has no key for watch-only addresses
+		if address, ok := s.walletAddress(out.PkScript); !ok || !s.walletAddresses[address] {
+			complete = false
+		}
+	}
+	return tx.Copy(), complete, nil
+}
+
+// SendRawTransaction accepts transactions spending unspent outputs.
+// A conflicting mempool transaction is replaced when it signals BIP125 and pays a lower fee.
+func (s *SimulatedNode) SendRawTransaction(tx *wire.MsgTx, _ bool) (*chainhash.Hash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("SendRawTransaction"); err != nil {
+		return nil, err
+	}
+
+	hash := tx.TxHash()
+	if st, ok := s.txs[hash]; ok && !st.conflicted {
+		return nil, rpcError(btcjson.ErrRPCTxAlreadyInChain, "txn-already-known")
+	}
+
+	spent := s.spentOutPoints()
+	var inputAmount int64
+	replaced := make(map[chainhash.Hash]bool)
+	for _, in := range tx.TxIn {
+		out, ok := s.output(in.PreviousOutPoint)
+		if !ok {
+			return nil, rpcError(btcjson.ErrRPCTxError, "bad-txns-inputs-missingorspent")
+		}
+		inputAmount += out.Value
+
+		spender, ok := spent[in.PreviousOutPoint]
+		if !ok {
+			continue
+		}
+		if _, confirmed := s.confirmedIn[spender]; confirmed || !signalsReplacement(s.txs[spender].tx) {
+			return nil, rpcError(btcjson.ErrRPCTxRejected, "txn-mempool-conflict")
+		}
+		replaced[spender] = true
+	}
+
+	var outputAmount int64
+	for _, out := range tx.TxOut {
+		outputAmount += out.Value
+	}
+	if outputAmount > inputAmount {
+		return nil, rpcError(btcjson.ErrRPCTxError, "bad-txns-in-belowout")
+	}
+
+	for spender := range replaced {
+		if s.fee(s.txs[spender]) >= inputAmount-outputAmount {
+			return nil, rpcError(btcjson.ErrRPCTxRejected, "insufficient fee")
+		}
+	}
+	for spender := range replaced {
+		s.conflict(spender)
+	}
+
+	result := s.addToMempool(tx.Copy())
+	return result, nil
+}
+
+func (s *SimulatedNode) EstimateSmartFee(confTarget int64, _ *btcjson.EstimateSmartFeeMode) (*btcjson.EstimateSmartFeeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("EstimateSmartFee"); err != nil {
+		return nil, err
+	}
+
+	if s.feeRate == 0 {
+		return &btcjson.EstimateSmartFeeResult{Errors: []string{"Insufficient data or no feerate found"}, Blocks: confTarget}, nil
+	}
+	feeRate := s.feeRate
+	return &btcjson.EstimateSmartFeeResult{FeeRate: &feeRate, Blocks: confTarget}, nil
+}
+
+func (s *SimulatedNode) GetNewAddress(_ string) (btcutil.Address, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("GetNewAddress"); err != nil {
+		return nil, err
+	}
+	if s.privateKeysDisabled {
+		return nil, rpcError(btcjson.ErrRPCWalletKeypoolRanOut, "Error: This wallet has no available keys")
+	}
+	return s.newWalletAddress(), nil
+}
+
+// ListTransactions returns all wallet transactions, not only the last 10 like bitcoind
+func (s *SimulatedNode) ListTransactions(_ string) ([]btcjson.ListTransactionsResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("ListTransactions"); err != nil {
+		return nil, err
+	}
+
+	var results []btcjson.ListTransactionsResult
+	for _, hash := range s.txOrder {
+		entries, _, _ := s.walletEntries(s.txs[hash])
+		results = append(results, entries...)
+	}
+	return results, nil
+}
+
+func (s *SimulatedNode) ListSinceBlock(blockHash *chainhash.Hash) (*btcjson.ListSinceBlockResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("ListSinceBlock"); err != nil {
+		return nil, err
+	}
+
+	var sinceHeight int32 = -1
+	if blockHash != nil {
+		block, ok := s.blocks[*blockHash]
+		if !ok {
+			return nil, rpcError(btcjson.ErrRPCInvalidAddressOrKey, "Block not found")
+		}
+		// a block of a stale branch is replaced by its fork point
+		for !s.isActive(block) {
+			block = s.blocks[block.prev]
+		}
+		sinceHeight = block.height
+	}
+
+	result := &btcjson.ListSinceBlockResult{
+		Transactions: []btcjson.ListTransactionsResult{},
+		LastBlock:    s.tip().hash.String(),
+	}
+	for _, hash := range s.txOrder {
+		st := s.txs[hash]
+		if block, ok := s.confirmedIn[hash]; ok && block.height <= sinceHeight {
+			continue
+		}
+		entries, _, _ := s.walletEntries(st)
+		result.Transactions = append(result.Transactions, entries...)
+	}
+	return result, nil
+}
+
+func (s *SimulatedNode) GetBlockChainInfo() (*btcjson.GetBlockChainInfoResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("GetBlockChainInfo"); err != nil {
+		return nil, err
+	}
+
+	tip := s.tip()
+	return &btcjson.GetBlockChainInfoResult{
+		Chain:         chainName(s.params),
+		Blocks:        tip.height,
+		Headers:       tip.height,
+		BestBlockHash: tip.hash.String(),
+		MedianTime:    tip.time.Unix(),
+	}, nil
+}
+
+func (s *SimulatedNode) WalletPassphrase(passphrase string, _ int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("WalletPassphrase"); err != nil {
+		return err
+	}
+
+	if s.passphrase == "" {
+		return rpcError(btcjson.ErrRPCWalletWrongEncState, "Error: running with an unencrypted wallet, but walletpassphrase was called.")
+	}
+	if passphrase != s.passphrase {
+		return rpcError(btcjson.ErrRPCWalletPassphraseIncorrect, "Error: The wallet passphrase entered was incorrect.")
+	}
+	s.unlocked = true
+	return nil
+}
+
+func (s *SimulatedNode) WalletLock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("WalletLock"); err != nil {
+		return err
+	}
+
+	if s.passphrase == "" {
+		return rpcError(btcjson.ErrRPCWalletWrongEncState, "Error: running with an unencrypted wallet, but walletlock was called.")
+	}
+	s.unlocked = false
+	return nil
+}
+
+// RawRequest supports importdescriptors with wpkh descriptors of an extended key, e.g. wpkh(tpub.../0/*).
+// Like bitcoind, descriptors of an extended public key are only accepted by a wallet created with NewWatchOnlyWallet.
+func (s *SimulatedNode) RawRequest(method string, params []json.RawMessage) (json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.takeFailure("RawRequest"); err != nil {
+		return nil, err
+	}
+	if method != "importdescriptors" || len(params) != 1 {
+		return nil, rpcError(btcjson.ErrRPCMethodNotFound.Code, "Method not found")
+	}
+
+	var requests []ImportDescriptorRequest
+	err := json.Unmarshal(params[0], &requests)
+	if err != nil {
+		return nil, rpcError(btcjson.ErrRPCInvalidParameter, err.Error())
+	}
+	var results []importDescriptorResult
+	for _, request := range requests {
+		err = s.importDescriptor(request)
+		if err != nil {
+			results = append(results, importDescriptorResult{Error: btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, err.Error())})
+			continue
+		}
+		results = append(results, importDescriptorResult{Success: true})
+	}
+	return json.Marshal(results)
+}
+
+func (s *SimulatedNode) importDescriptor(request ImportDescriptorRequest) error {
+	descriptor := strings.SplitN(request.Descriptor, "#", 2)[0]
+	if !strings.HasPrefix(descriptor, "wpkh(") || !strings.HasSuffix(descriptor, "/*)") {
+		return fmt.Errorf("unsupported descriptor %s", request.Descriptor)
+	}
+	path := strings.Split(strings.TrimSuffix(strings.TrimPrefix(descriptor, "wpkh("), "/*)"), "/")
+	key, err := hdkeychain.NewKeyFromString(path[0])
+	if err != nil {
+		return err
+	}
+	for _, step := range path[1:] {
+		index, err := strconv.ParseUint(step, 10, 32)
+		if err != nil {
+			return fmt.Errorf("unsupported path %s", step)
+		}
+		key, err = key.Derive(uint32(index))
+		if err != nil {
+			return err
+		}
+	}
+	if len(request.Range) != 2 {
+		return errors.New("range is required for a ranged descriptor")
+	}
+	if key.IsPrivate() && s.privateKeysDisabled {
+		return errors.New("Cannot import private keys to a wallet with private keys disabled")
+	}
+	if !key.IsPrivate() && !s.privateKeysDisabled {
+		return errors.New("Cannot import descriptor without private keys to a wallet with private keys enabled")
+	}
+
+	for i := request.Range[0]; i <= request.Range[1]; i++ {
+		child, err := key.Derive(uint32(i))
+		if err != nil {
+			return err
+		}
+		publicKey, err := child.ECPubKey()
+		if err != nil {
+			return err
+		}
+		address, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(publicKey.SerializeCompressed()), s.params)
+		if err != nil {
+			return err
+		}
+		if !s.walletAddresses[address.EncodeAddress()] {
+			s.walletAddresses[address.EncodeAddress()] = key.IsPrivate()
+		}
+	}
+	return nil
+}
+
+func (s *SimulatedNode) takeFailure(method string) error {
+	failures := s.failures[method]
+	if len(failures) == 0 {
+		return nil
+	}
+	s.failures[method] = failures[1:]
+	return failures[0]
+}
+
+func (s *SimulatedNode) tip() *simulatedBlock {
+	return s.chain[len(s.chain)-1]
+}
+
+func (s *SimulatedNode) isActive(block *simulatedBlock) bool {
+	return block.height < int32(len(s.chain)) && s.chain[block.height] == block
+}
+
+func (s *SimulatedNode) mine(n int) []chainhash.Hash {
+	var hashes []chainhash.Hash
+	for i := 0; i < n; i++ {
+		prev := s.tip()
+		block := &simulatedBlock{
+			prev:   prev.hash,
+			height: prev.height + 1,
+			time:   prev.time.Add(simulatedBlockInterval),
+		}
+		block.txIds, s.mempool = s.selectMempool()
+
+		// the number of known blocks keeps the hash unique when a height is mined again after a reorg
+		var data bytes.Buffer
+		data.Write(prev.hash[:])
+		_ = binary.Write(&data, binary.LittleEndian, int64(len(s.blocks)))
+		for _, txId := range block.txIds {
+			data.Write(txId[:])
+		}
+		block.hash = chainhash.DoubleHashH(data.Bytes())
+
+		s.blocks[block.hash] = block
+		s.chain = append(s.chain, block)
+		for _, txId := range block.txIds {
+			s.confirmedIn[txId] = block
+		}
+		hashes = append(hashes, block.hash)
+	}
+	return hashes
+}
+
+// selectMempool splits the mempool into the transactions of the next block and the ones left behind
+func (s *SimulatedNode) selectMempool() ([]chainhash.Hash, []chainhash.Hash) {
+	var included, left []chainhash.Hash
+	leftBehind := make(map[chainhash.Hash]bool)
+	for _, txId := range s.mempool {
+		st := s.txs[txId]
+		mineable := s.miningFeeRate == 0 || !s.knownInputs(st) ||
+			s.fee(st) >= estimateFee(s.miningFeeRate, len(st.tx.TxIn), len(st.tx.TxOut))
+		for _, in := range st.tx.TxIn {
+			mineable = mineable && !leftBehind[in.PreviousOutPoint.Hash]
+		}
+		if mineable {
+			included = append(included, txId)
+		} else {
+			left = append(left, txId)
+			leftBehind[txId] = true
+		}
+	}
+	return included, left
+}
+
+func (s *SimulatedNode) knownInputs(st *simulatedTx) bool {
+	for _, in := range st.tx.TxIn {
+		if _, ok := s.txs[in.PreviousOutPoint.Hash]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *SimulatedNode) disconnect(depth int) {
+	if depth > len(s.chain)-1 {
+		depth = len(s.chain) - 1
+	}
+	var txIds []chainhash.Hash
+	for _, block := range s.chain[len(s.chain)-depth:] {
+		for _, txId := range block.txIds {
+			delete(s.confirmedIn, txId)
+		}
+		txIds = append(txIds, block.txIds...)
+	}
+	s.chain = s.chain[:len(s.chain)-depth]
+	s.mempool = append(txIds, s.mempool...)
+}
+
+func (s *SimulatedNode) pay(address btcutil.Address, amount btcutil.Amount, sequence uint32) (*chainhash.Hash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pkScript, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		return nil, err
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	in := wire.NewTxIn(s.newExternalOutPoint(), nil, nil)
+	in.Sequence = sequence
+	tx.AddTxIn(in)
+	tx.AddTxOut(wire.NewTxOut(int64(amount), pkScript))
+	return s.addToMempool(tx), nil
+}
+
+func (s *SimulatedNode) addToMempool(tx *wire.MsgTx) *chainhash.Hash {
+	hash := tx.TxHash()
+	// like bitcoind the wallet stamps the first arrival with the clock, only the blocks have simulated times
+	received := time.Now()
+	if st, ok := s.txs[hash]; ok {
+		received = st.received
+	} else {
+		s.txOrder = append(s.txOrder, hash)
+	}
+	s.txs[hash] = &simulatedTx{tx: tx, hash: hash, received: received}
+	s.mempool = append(s.mempool, hash)
+	return &hash
+}
+
+// conflict removes the transaction and everything spending its outputs from the mempool
+func (s *SimulatedNode) conflict(hash chainhash.Hash) {
+	st := s.txs[hash]
+	if st == nil || st.conflicted {
+		return
+	}
+	st.conflicted = true
+	for i, txId := range s.mempool {
+		if txId == hash {
+			s.mempool = append(s.mempool[:i], s.mempool[i+1:]...)
+			break
+		}
+	}
+	for _, other := range s.liveTxs() {
+		for _, in := range other.tx.TxIn {
+			if in.PreviousOutPoint.Hash == hash {
+				s.conflict(other.hash)
+				break
+			}
+		}
+	}
+}
+
+// liveTxs returns the transactions of the active chain followed by the mempool
+func (s *SimulatedNode) liveTxs() []*simulatedTx {
+	var txs []*simulatedTx
+	for _, block := range s.chain {
+		for _, txId := range block.txIds {
+			txs = append(txs, s.txs[txId])
+		}
+	}
+	for _, txId := range s.mempool {
+		txs = append(txs, s.txs[txId])
+	}
+	return txs
+}
+
+func (s *SimulatedNode) spentOutPoints() map[wire.OutPoint]chainhash.Hash {
+	spent := make(map[wire.OutPoint]chainhash.Hash)
+	for _, st := range s.liveTxs() {
+		for _, in := range st.tx.TxIn {
+			spent[in.PreviousOutPoint] = st.hash
+		}
+	}
+	return spent
+}
+
+func (s *SimulatedNode) output(op wire.OutPoint) (*wire.TxOut, bool) {
+	st, ok := s.txs[op.Hash]
+	if !ok || st.conflicted || int(op.Index) >= len(st.tx.TxOut) {
+		return nil, false
+	}
+	return st.tx.TxOut[op.Index], true
+}
+
+func (s *SimulatedNode) confirmations(st *simulatedTx) int64 {
+	if block, ok := s.confirmedIn[st.hash]; ok {
+		return int64(s.tip().height - block.height + 1)
+	}
+	if !st.conflicted {
+		return 0
+	}
+	// like bitcoind a conflicted transaction has the negative confirmations of the conflicting one
+	for _, other := range s.liveTxs() {
+		if sharesInput(st.tx, other.tx) {
+			return -s.confirmations(other)
+		}
+	}
+	return 0
+}
+
+func (s *SimulatedNode) walletConflicts(st *simulatedTx) []string {
+	conflicts := []string{}
+	for _, hash := range s.txOrder {
+		if hash != st.hash && sharesInput(st.tx, s.txs[hash].tx) {
+			conflicts = append(conflicts, hash.String())
+		}
+	}
+	return conflicts
+}
+
+// fee is only known when all inputs are known
+func (s *SimulatedNode) fee(st *simulatedTx) int64 {
+	var amount int64
+	for _, in := range st.tx.TxIn {
+		prev, ok := s.txs[in.PreviousOutPoint.Hash]
+		if !ok || int(in.PreviousOutPoint.Index) >= len(prev.tx.TxOut) {
+			return 0
+		}
+		amount += prev.tx.TxOut[in.PreviousOutPoint.Index].Value
+	}
+	for _, out := range st.tx.TxOut {
+		amount -= out.Value
+	}
+	return amount
+}
+
+// walletEntries describes the transaction from the wallet's point of view like listtransactions.
+// Outputs back to the wallet of a sending transaction are treated as change and omitted.
+func (s *SimulatedNode) walletEntries(st *simulatedTx) ([]btcjson.ListTransactionsResult, float64, float64) {
+	var debit int64
+	for _, in := range st.tx.TxIn {
+		prev, ok := s.txs[in.PreviousOutPoint.Hash]
+		if !ok || int(in.PreviousOutPoint.Index) >= len(prev.tx.TxOut) {
+			continue
+		}
+		out := prev.tx.TxOut[in.PreviousOutPoint.Index]
+		if _, ok := s.walletAddress(out.PkScript); ok {
+			debit += out.Value
+		}
+	}
+
+	var external, owned []int
+	for vout, out := range st.tx.TxOut {
+		if _, ok := s.walletAddress(out.PkScript); ok {
+			owned = append(owned, vout)
+		} else {
+			external = append(external, vout)
+		}
+	}
+
+	base := btcjson.ListTransactionsResult{
+		Confirmations:     s.confirmations(st),
+		TxID:              st.hash.String(),
+		WalletConflicts:   s.walletConflicts(st),
+		Time:              st.received.Unix(),
+		TimeReceived:      st.received.Unix(),
+		Trusted:           debit > 0 && !st.conflicted,
+		BIP125Replaceable: "no",
+	}
+	if signalsReplacement(st.tx) {
+		base.BIP125Replaceable = "yes"
+	}
+	if block, ok := s.confirmedIn[st.hash]; ok {
+		height := block.height
+		index := blockIndex(block, st.hash)
+		base.BlockHash = block.hash.String()
+		base.BlockHeight = &height
+		base.BlockIndex = &index
+		base.BlockTime = block.time.Unix()
+		base.BIP125Replaceable = "no"
+	}
+
+	var entries []btcjson.ListTransactionsResult
+	var amount, fee float64
+	if debit > 0 && len(external) > 0 {
+		fee = -btcutil.Amount(s.fee(st)).ToBTC()
+		for _, vout := range external {
+			out := st.tx.TxOut[vout]
+			entry := base
+			entry.Category = "send"
+			entry.Address = s.address(out.PkScript)
+			entry.Amount = -btcutil.Amount(out.Value).ToBTC()
+			entry.Fee = &fee
+			entry.Vout = uint32(vout)
+			entries = append(entries, entry)
+			amount += entry.Amount
+		}
+		return entries, amount, fee
+	}
+
+	for _, vout := range owned {
+		out := st.tx.TxOut[vout]
+		entry := base
+		entry.Category = "receive"
+		entry.Address = s.address(out.PkScript)
+		entry.Amount = btcutil.Amount(out.Value).ToBTC()
+		entry.Vout = uint32(vout)
+		entries = append(entries, entry)
+		amount += entry.Amount
+	}
+	return entries, amount, fee
+}
+
+// walletAddress returns the address of pkScript if it belongs to the wallet, including watch-only addresses
+func (s *SimulatedNode) walletAddress(pkScript []byte) (string, bool) {
+	address := s.address(pkScript)
+	_, ok := s.walletAddresses[address]
+	return address, address != "" && ok
+}
+
+func (s *SimulatedNode) address(pkScript []byte) string {
+	_, addresses, _, err := txscript.ExtractPkScriptAddrs(pkScript, s.params)
+	if err != nil || len(addresses) != 1 {
+		return ""
+	}
+	return addresses[0].EncodeAddress()
+}
+
+func (s *SimulatedNode) newWalletAddress() btcutil.Address {
+	s.addressCount++
+	address := s.newAddress("wallet", s.addressCount)
+	s.walletAddresses[address.EncodeAddress()] = true
+	return address
+}
+
+func (s *SimulatedNode) newAddress(kind string, n uint32) btcutil.Address {
+	seed := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seed, n)
+	address, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(append([]byte(kind), seed...)), s.params)
+	if err != nil {
+		panic(err) // a 20 byte hash is always a valid witness program
+	}
+	return address
+}
+
+func (s *SimulatedNode) newExternalOutPoint() *wire.OutPoint {
+	s.externalCount++
+	seed := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seed, s.externalCount)
+	hash := chainhash.DoubleHashH(append([]byte("coin"), seed...))
+	return wire.NewOutPoint(&hash, 0)
+}
+
+// estimateFee uses the size of p2wpkh inputs and outputs, feeRate is in BTC/kvB
+func estimateFee(feeRate float64, inputs int, outputs int) int64 {
+	size := 11 + 68*inputs + 31*outputs
+	return int64(math.Ceil(feeRate * btcutil.SatoshiPerBitcoin * float64(size) / 1000))
+}
+
+func signalsReplacement(tx *wire.MsgTx) bool {
+	for _, in := range tx.TxIn {
+		if in.Sequence < rbfSequence {
+			return true
+		}
+	}
+	return false
+}
+
+func sharesInput(a *wire.MsgTx, b *wire.MsgTx) bool {
+	if a.TxHash() == b.TxHash() {
+		return false
+	}
+	for _, inA := range a.TxIn {
+		for _, inB := range b.TxIn {
+			if inA.PreviousOutPoint == inB.PreviousOutPoint {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func blockIndex(block *simulatedBlock, hash chainhash.Hash) int64 {
+	for i, txId := range block.txIds {
+		if txId == hash {
+			return int64(i)
+		}
+	}
+	return -1
+}
+
+func chainName(params *chaincfg.Params) string {
+	switch params.Name {
+	case chaincfg.MainNetParams.Name:
+		return "main"
+	case chaincfg.TestNet3Params.Name:
+		return "test"
+	default:
+		return params.Name
+	}
+}
+
+func rpcError(code btcjson.RPCErrorCode, message string) error {
+	return btcjson.NewRPCError(code, message)
+}
+
+func invalidTransactionError() error {
+	return rpcError(btcjson.ErrRPCInvalidAddressOrKey, "Invalid or non-wallet transaction id")
+}
@@ -0,0 +1,365 @@
+package node
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+)
+
+const testFeeRate = 0.0001
+
+func newTestNode(t *testing.T) (*SimulatedNode, btcutil.Address) {
+	s := NewSimulatedNode(&chaincfg.RegressionNetParams, testFeeRate, "secret")
+	address, err := s.GetNewAddress("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, address
+}
+
+func TestSimulatedNode_Pay(t *testing.T) {
+	// Arrange
+	s, address := newTestNode(t)
+
+	// Act
+	txHash, err := s.Pay(address, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unconfirmed, err := s.GetTransaction(txHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Mine(6)
+	confirmed, err := s.GetTransaction(txHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unspent, err := s.ListUnspentMinMaxAddresses(6, 9999999, []btcutil.Address{address})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	if unconfirmed.Confirmations != 0 || unconfirmed.Amount != 0.001 || unconfirmed.Details[0].Address != address.EncodeAddress() {
+		t.Errorf("Expected unconfirmed receive of 0.001 to %s, but got %v", address, unconfirmed)
+	}
+	if confirmed.Confirmations != 6 || confirmed.BlockHash == "" {
+		t.Errorf("Expected 6 confirmations, but got %d", confirmed.Confirmations)
+	}
+	if len(unspent) != 1 || unspent[0].Amount != 0.001 {
+		t.Errorf("Expected one unspent output of 0.001, but got %v", unspent)
+	}
+}
+
+func TestSimulatedNode_SendTransaction(t *testing.T) {
+	// Arrange
+	s, address := newTestNode(t)
+	changeAddress, _ := s.GetNewAddress("")
+	merchant := s.NewExternalAddress()
+	txHash, _ := s.Pay(address, 100000)
+	s.Mine(1)
+
+	raw, err := s.CreateRawTransaction([]btcjson.TransactionInput{{Txid: txHash.String(), Vout: 0}}, map[btcutil.Address]btcutil.Amount{merchant: 99000}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := changeAddress.EncodeAddress()
+	position := 1
+	replaceable := true
+	funded, err := s.FundRawTransaction(raw, btcjson.FundRawTransactionOpts{
+		ChangeAddress:          &change,
+		ChangePosition:         &position,
+		Replaceable:            &replaceable,
+		SubtractFeeFromOutputs: []int{0},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	_, _, lockedErr := s.SignRawTransactionWithWallet(funded.Transaction)
+	err = s.WalletPassphrase("secret", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, complete, err := s.SignRawTransactionWithWallet(funded.Transaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sentHash, err := s.SendRawTransaction(signed, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, doubleSpendErr := s.SendRawTransaction(raw, false)
+	sent, err := s.GetTransaction(sentHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unspent, err := s.ListUnspentMinMaxAddresses(0, 9999999, []btcutil.Address{address})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	if lockedErr == nil {
+		t.Errorf("Expected signing with a locked wallet to fail")
+	}
+	if !complete {
+		t.Errorf("Expected all inputs to be signed")
+	}
+	fee := int64(funded.Fee)
+	if len(signed.TxOut) != 2 || signed.TxOut[0].Value != 99000-fee || signed.TxOut[1].Value != 1000 {
+		t.Errorf("Expected merchant output %d and change 1000, but got %v", 99000-fee, signed.TxOut)
+	}
+	if sent.Details[0].Category != "send" || sent.Details[0].Address != merchant.EncodeAddress() || sent.Fee != -btcutil.Amount(fee).ToBTC() {
+		t.Errorf("Expected send to %s with fee %d, but got %v", merchant, fee, sent.Details)
+	}
+	if doubleSpendErr == nil {
+		t.Errorf("Expected double spend to be rejected")
+	}
+	if len(unspent) != 0 {
+		t.Errorf("Expected the pay address to be spent, but got %v", unspent)
+	}
+}
+
+func TestSimulatedNode_ImportDescriptors(t *testing.T) {
+	// Arrange
+	s, _ := newTestNode(t)
+	master, err := hdkeychain.NewMaster(make([]byte, hdkeychain.RecommendedSeedLen), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountKey, err := master.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiveKey, err := accountKey.Derive(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childKey, err := receiveKey.Derive(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := childKey.ECPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(publicKey.SerializeCompressed()), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wallet := s.NewWatchOnlyWallet()
+
+	// Act
+	err = ImportDescriptors(wallet, []ImportDescriptorRequest{{Descriptor: "wpkh(" + accountKey.String() + "/0/*)", Range: []int64{0, 4}, Timestamp: "now"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyWalletErr := ImportDescriptors(s, []ImportDescriptorRequest{{Descriptor: "wpkh(" + accountKey.String() + "/0/*)", Range: []int64{0, 4}, Timestamp: "now"}})
+	unsupportedErr := ImportDescriptors(wallet, []ImportDescriptorRequest{{Descriptor: "pkh(" + accountKey.String() + "/0/*)", Range: []int64{0, 4}, Timestamp: "now"}})
+	txHash, err := s.Pay(address, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Mine(1)
+	unspent, err := wallet.ListUnspentMinMaxAddresses(1, 9999999, []btcutil.Address{address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyWalletUnspent, err := s.ListUnspentMinMaxAddresses(1, 9999999, []btcutil.Address{address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := s.CreateRawTransaction([]btcjson.TransactionInput{{Txid: txHash.String(), Vout: 0}}, map[btcutil.Address]btcutil.Amount{s.NewExternalAddress(): 99000}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, complete, err := wallet.SignRawTransactionWithWallet(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	if keyWalletErr == nil {
+		t.Errorf("Expected the wallet with private keys to reject the xpub descriptor")
+	}
+	if unsupportedErr == nil {
+		t.Errorf("Expected the pkh descriptor to be rejected")
+	}
+	if len(unspent) != 1 || unspent[0].Amount != 0.001 {
+		t.Errorf("Expected the watch-only address to have one unspent output of 0.001, but got %v", unspent)
+	}
+	if len(keyWalletUnspent) != 0 {
+		t.Errorf("Expected the wallet with private keys not to watch the address, but got %v", keyWalletUnspent)
+	}
+	if complete {
+		t.Errorf("Expected the wallet to leave the input of the watch-only address unsigned")
+	}
+}
+
+func TestSimulatedNode_Reorg(t *testing.T) {
+	// Arrange
+	s, address := newTestNode(t)
+	txHash, _ := s.Pay(address, 100000)
+	first := s.Mine(1)
+
+	// Act
+	second := s.Reorg(1)
+	reorged, _ := s.GetTransaction(txHash)
+	since, err := s.ListSinceBlock(&first[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Disconnect(2)
+	disconnected, _ := s.GetTransaction(txHash)
+	_, err = s.DoubleSpend(txHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Mine(1)
+	conflicted, _ := s.GetTransaction(txHash)
+
+	// Assert
+	if len(second) != 2 || second[0] == first[0] || reorged.BlockHash != second[0].String() || reorged.Confirmations != 2 {
+		t.Errorf("Expected transaction in new block %s with 2 confirmations, but got %v", second[0], reorged)
+	}
+	if len(since.Transactions) != 1 || since.LastBlock != second[1].String() {
+		t.Errorf("Expected the reorged transaction since the stale block, but got %v", since)
+	}
+	if disconnected.Confirmations != 0 {
+		t.Errorf("Expected 0 confirmations after disconnect, but got %d", disconnected.Confirmations)
+	}
+	if conflicted.Confirmations != -1 || len(conflicted.WalletConflicts) != 1 {
+		t.Errorf("Expected conflicted transaction with -1 confirmations, but got %v", conflicted)
+	}
+}
+
+func TestSimulatedNode_ReplaceByFee(t *testing.T) {
+	// Arrange
+	s, address := newTestNode(t)
+	merchant := s.NewExternalAddress()
+	txHash, _ := s.Pay(address, 100000)
+	s.Mine(1)
+	_ = s.WalletPassphrase("secret", 60)
+
+	send := func(feeRate float64) (string, error) {
+		raw, _ := s.CreateRawTransaction([]btcjson.TransactionInput{{Txid: txHash.String(), Vout: 0}}, map[btcutil.Address]btcutil.Amount{merchant: 100000}, nil)
+		replaceable := true
+		funded, err := s.FundRawTransaction(raw, btcjson.FundRawTransactionOpts{FeeRate: &feeRate, Replaceable: &replaceable, SubtractFeeFromOutputs: []int{0}}, nil)
+		if err != nil {
+			return "", err
+		}
+		hash, err := s.SendRawTransaction(funded.Transaction, false)
+		if err != nil {
+			return "", err
+		}
+		return hash.String(), nil
+	}
+
+	// Act
+	original, err := send(0.0001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, lowerErr := send(0.00005)
+	replacement, err := send(0.0002)
+
+	// Assert
+	if lowerErr == nil {
+		t.Errorf("Expected replacement with a lower fee to be rejected")
+	}
+	if err != nil || replacement == original {
+		t.Errorf("Expected replacement with a higher fee, but got %v", err)
+	}
+}
+
+func TestSimulatedNode_MiningFeeRate(t *testing.T) {
+	// Arrange
+	s, address := newTestNode(t)
+	merchant := s.NewExternalAddress()
+	txHash, _ := s.Pay(address, 100000)
+	s.Mine(1)
+	_ = s.WalletPassphrase("secret", 60)
+	raw, _ := s.CreateRawTransaction([]btcjson.TransactionInput{{Txid: txHash.String(), Vout: 0}}, map[btcutil.Address]btcutil.Amount{merchant: 100000}, nil)
+	feeRate := testFeeRate
+	funded, _ := s.FundRawTransaction(raw, btcjson.FundRawTransactionOpts{FeeRate: &feeRate, SubtractFeeFromOutputs: []int{0}}, nil)
+	sendHash, err := s.SendRawTransaction(funded.Transaction, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	s.SetMiningFeeRate(testFeeRate * 2)
+	payHash, _ := s.Pay(address, 100000)
+	s.Mine(1)
+	stuck, _ := s.GetTransaction(sendHash)
+	paid, _ := s.GetTransaction(payHash)
+	s.SetMiningFeeRate(0)
+	s.Mine(1)
+	mined, _ := s.GetTransaction(sendHash)
+
+	// Assert
+	if stuck.Confirmations != 0 {
+		t.Errorf("Expected the transaction below the mining fee rate to stay unconfirmed, but got %d confirmations", stuck.Confirmations)
+	}
+	if paid.Confirmations != 1 {
+		t.Errorf("Expected the external payment to be mined, but got %d confirmations", paid.Confirmations)
+	}
+	if mined.Confirmations != 1 {
+		t.Errorf("Expected the transaction to be mined without mining fee rate, but got %d confirmations", mined.Confirmations)
+	}
+}
+
+func TestSimulatedNode_FailNext(t *testing.T) {
+	// Arrange
+	s, _ := newTestNode(t)
+	s.FailNext("GetBlockChainInfo", ErrSimulated)
+
+	// Act
+	_, failed := s.GetBlockChainInfo()
+	info, err := s.GetBlockChainInfo()
+
+	// Assert
+	if !errors.Is(failed, ErrSimulated) {
+		t.Errorf("Expected %v, but got %v", ErrSimulated, failed)
+	}
+	if err != nil || info.Chain != "regtest" {
+		t.Errorf("Expected regtest chain info, but got %v, %v", info, err)
+	}
+}
+
+func TestSimulatedNode_EstimateSmartFee(t *testing.T) {
+	s, _ := newTestNode(t)
+
+	estimate, _ := s.EstimateSmartFee(6, &btcjson.EstimateModeConservative)
+	if estimate.FeeRate == nil || *estimate.FeeRate != testFeeRate {
+		t.Errorf("Expected fee rate %f, but got %v", testFeeRate, estimate.FeeRate)
+	}
+
+	s.SetFeeRate(0)
+	estimate, _ = s.EstimateSmartFee(6, &btcjson.EstimateModeConservative)
+	if estimate.FeeRate != nil || len(estimate.Errors) != 1 {
+		t.Errorf("Expected no fee rate, but got %v", estimate)
+	}
+}
+
+func TestSimulatedNode_Deterministic(t *testing.T) {
+	run := func() string {
+		s, address := newTestNode(t)
+		_, _ = s.Pay(address, 5000)
+		s.Mine(3)
+		return s.Reorg(2)[2].String()
+	}
+
+	if run() != run() {
+		t.Errorf("Expected the same block hashes for the same operations")
+	}
+}
@@ -1,19 +1,35 @@
 package repository
 
 import (
+	"database/sql"
 	"errors"
-	"github.com/CHainGate/backend/pkg/enum"
+	"fmt"
 	"github.com/CHainGate/bitcoin-service/internal/model"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
 )
 
+// ErrDerivationIndexTaken is returned by Create if another account of the network has the derivation index
+var ErrDerivationIndexTaken = errors.New("derivation index is taken by another account of the network")
+
+// derivationLockNamespace keeps the advisory locks of the derivation apart from other advisory locks on the database
+const derivationLockNamespace int64 = 0x646572697665 << 16
+
 type accountRepository struct {
 	DB *gorm.DB
 }
 
 type IAccountRepository interface {
-	FindUnusedByMode(mode enum.Mode) (*model.Account, error)
+	FindUnusedByNetwork(network model.Network) (*model.Account, error)
+	ClaimUnusedByNetwork(network model.Network) (*model.Account, error)
 	FindByAddress(address string) (*model.Account, error)
+	FindLastDerivationIndex(network model.Network) (*int64, error)
+	FindLastFundedDerivationIndex(network model.Network) (*int64, error)
+	// LockDerivation makes concurrent transactions deriving an account of the network wait until the transaction ends,
+	// so FindLastDerivationIndex includes the accounts they derived
+	LockDerivation(network model.Network) error
+	CountByAddresses(addresses []string) (int64, error)
 	Create(account *model.Account) error
 	Update(account *model.Account) error
 	FindAll() ([]model.Account, error)
@@ -23,9 +39,9 @@ func NewAccountRepository(db *gorm.DB) IAccountRepository {
 	return &accountRepository{db}
 }
 
-func (r *accountRepository) FindUnusedByMode(mode enum.Mode) (*model.Account, error) {
+func (r *accountRepository) FindUnusedByNetwork(network model.Network) (*model.Account, error) {
 	var unusedAccount model.Account
-	result := r.DB.Where("used = false AND mode = ?", mode).First(&unusedAccount)
+	result := r.DB.Where("used = false AND network = ?", network).First(&unusedAccount)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return nil, nil
@@ -35,6 +51,30 @@ func (r *accountRepository) FindUnusedByMode(mode enum.Mode) (*model.Account, er
 	return &unusedAccount, nil
 }
 
+// ClaimUnusedByNetwork marks an unused account of the network as used and returns it, nil if there is none.
+// Accounts locked by a concurrent claim are skipped instead of waited for, so no account is handed out twice.
+func (r *accountRepository) ClaimUnusedByNetwork(network model.Network) (*model.Account, error) {
+	var unusedAccount model.Account
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("used = false AND network = ?", network).
+			First(&unusedAccount)
+		if result.Error != nil {
+			return result.Error
+		}
+		unusedAccount.Used = true
+		return tx.Save(&unusedAccount).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &unusedAccount, nil
+}
+
 func (r *accountRepository) FindByAddress(address string) (*model.Account, error) {
 	var account model.Account
 	result := r.DB.
@@ -48,10 +88,61 @@ func (r *accountRepository) FindByAddress(address string) (*model.Account, error
 	return &account, nil
 }
 
+// FindLastDerivationIndex returns the highest derivation index of the accounts of the network, nil if none is derived
+func (r *accountRepository) FindLastDerivationIndex(network model.Network) (*int64, error) {
+	var index sql.NullInt64
+	err := r.DB.
+		Model(&model.Account{}).
+		Select("MAX(derivation_index)").
+		Where("network = ?", network).
+		Row().
+		Scan(&index)
+	if err != nil || !index.Valid {
+		return nil, err
+	}
+	return &index.Int64, nil
+}
+
+// FindLastFundedDerivationIndex returns the highest derivation index of an account which received funds for one of
+// its payments, nil if none did
+func (r *accountRepository) FindLastFundedDerivationIndex(network model.Network) (*int64, error) {
+	var index sql.NullInt64
+	err := r.DB.
+		Model(&model.Account{}).
+		Select("MAX(derivation_index)").
+		Where("network = ? AND EXISTS (?)", network, r.DB.
+			Table("payments").
+			Select("1").
+			Joins("JOIN payment_states ON payment_states.payment_id = payments.id").
+			Where("payments.account_id = accounts.id AND payment_states.amount_received > 0")).
+		Row().
+		Scan(&index)
+	if err != nil || !index.Valid {
+		return nil, err
+	}
+	return &index.Int64, nil
+}
+
+func (r *accountRepository) LockDerivation(network model.Network) error {
+	return r.DB.Exec("SELECT pg_advisory_xact_lock(?)", derivationLockNamespace|int64(network)).Error
+}
+
+func (r *accountRepository) CountByAddresses(addresses []string) (int64, error) {
+	var count int64
+	result := r.DB.
+		Model(&model.Account{}).
+		Where("address IN ?", addresses).
+		Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return count, nil
+}
+
 func (r *accountRepository) Create(account *model.Account) error {
 	result := r.DB.Create(&account)
 	if result.Error != nil {
-		return result.Error
+		return derivationIndexError(result.Error)
 	}
 	return nil
 }
@@ -76,3 +167,11 @@ func (r *accountRepository) FindAll() ([]model.Account, error) {
 	}
 	return acc, nil
 }
+
+// derivationIndexError reports a violation of idx_accounts_network_derivation_index as ErrDerivationIndexTaken
+func derivationIndexError(err error) error {
+	if strings.Contains(err.Error(), "idx_accounts_network_derivation_index") {
+		return fmt.Errorf("%w: %v", ErrDerivationIndexTaken, err)
+	}
+	return err
+}
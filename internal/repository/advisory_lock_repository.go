@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"log"
+
+	"gorm.io/gorm"
+)
+
+type advisoryLockRepository struct {
+	DB *gorm.DB
+}
+
+type IAdvisoryLockRepository interface {
+	// WithLock runs fn while holding the postgres advisory lock of the key, it waits while another session holds it.
+	// The lock is bound to a connection of its own, so it can't be taken in a transaction.
+	WithLock(key int64, fn func()) error
+}
+
+func NewAdvisoryLockRepository(db *gorm.DB) IAdvisoryLockRepository {
+	return &advisoryLockRepository{db}
+}
+
+func (r *advisoryLockRepository) WithLock(key int64, fn func()) error {
+	return r.DB.Connection(func(conn *gorm.DB) error {
+		err := conn.Exec("SELECT pg_advisory_lock(?)", key).Error
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// closing the connection returns it to the pool, the lock is only released by the unlock
+			err := conn.Exec("SELECT pg_advisory_unlock(?)", key).Error
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+
+		fn()
+		return nil
+	})
+}
@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"errors"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"gorm.io/gorm"
+)
+
+type chainCursorRepository struct {
+	DB *gorm.DB
+}
+
+type IChainCursorRepository interface {
+	FindByNetwork(network model.Network) (*model.ChainCursor, error)
+	Save(cursor *model.ChainCursor) error
+}
+
+func NewChainCursorRepository(db *gorm.DB) IChainCursorRepository {
+	return &chainCursorRepository{db}
+}
+
+func (r *chainCursorRepository) FindByNetwork(network model.Network) (*model.ChainCursor, error) {
+	var cursor model.ChainCursor
+	result := r.DB.Where("network = ?", network).First(&cursor)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &cursor, nil
+}
+
+func (r *chainCursorRepository) Save(cursor *model.ChainCursor) error {
+	result := r.DB.Save(&cursor)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
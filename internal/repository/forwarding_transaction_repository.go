@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type forwardingTransactionRepository struct {
+	DB *gorm.DB
+}
+
+type IForwardingTransactionRepository interface {
+	Create(transaction *model.ForwardingTransaction) error
+	FindByPayment(paymentId uuid.UUID) ([]model.ForwardingTransaction, error)
+}
+
+func NewForwardingTransactionRepository(db *gorm.DB) IForwardingTransactionRepository {
+	return &forwardingTransactionRepository{db}
+}
+
+func (r *forwardingTransactionRepository) Create(transaction *model.ForwardingTransaction) error {
+	result := r.DB.Create(&transaction)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *forwardingTransactionRepository) FindByPayment(paymentId uuid.UUID) ([]model.ForwardingTransaction, error) {
+	var transactions []model.ForwardingTransaction
+	result := r.DB.
+		Where("payment_id = ?", paymentId).
+		Order("created_at").
+		Find(&transactions)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return transactions, nil
+}
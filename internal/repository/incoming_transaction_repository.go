@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"errors"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type incomingTransactionRepository struct {
+	DB *gorm.DB
+}
+
+type IIncomingTransactionRepository interface {
+	Create(transaction *model.IncomingTransaction) error
+	Update(transaction *model.IncomingTransaction) error
+	FindByPaymentAndTxHash(paymentId uuid.UUID, txHash string) (*model.IncomingTransaction, error)
+	FindByPayment(paymentId uuid.UUID) ([]model.IncomingTransaction, error)
+	FindByTxHash(txHash string) ([]model.IncomingTransaction, error)
+}
+
+func NewIncomingTransactionRepository(db *gorm.DB) IIncomingTransactionRepository {
+	return &incomingTransactionRepository{db}
+}
+
+func (r *incomingTransactionRepository) Create(transaction *model.IncomingTransaction) error {
+	result := r.DB.Create(&transaction)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *incomingTransactionRepository) Update(transaction *model.IncomingTransaction) error {
+	result := r.DB.Save(&transaction)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *incomingTransactionRepository) FindByPaymentAndTxHash(paymentId uuid.UUID, txHash string) (*model.IncomingTransaction, error) {
+	var transaction model.IncomingTransaction
+	result := r.DB.
+		Where("payment_id = ? AND tx_hash = ?", paymentId, txHash).
+		First(&transaction)
+
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &transaction, nil
+}
+
+func (r *incomingTransactionRepository) FindByPayment(paymentId uuid.UUID) ([]model.IncomingTransaction, error) {
+	var transactions []model.IncomingTransaction
+	result := r.DB.
+		Where("payment_id = ?", paymentId).
+		Order("created_at").
+		Find(&transactions)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return transactions, nil
+}
+
+// FindByTxHash returns the rows of the transaction of all payments, e.g. of earlier payments on a reused address
+func (r *incomingTransactionRepository) FindByTxHash(txHash string) ([]model.IncomingTransaction, error) {
+	var transactions []model.IncomingTransaction
+	result := r.DB.
+		Where("tx_hash = ?", txHash).
+		Order("created_at").
+		Find(&transactions)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return transactions, nil
+}
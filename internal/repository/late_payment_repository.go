@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"errors"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type latePaymentRepository struct {
+	DB *gorm.DB
+}
+
+type ILatePaymentRepository interface {
+	Create(latePayment *model.LatePayment) error
+	Update(latePayment *model.LatePayment) error
+	FindByID(id uuid.UUID) (*model.LatePayment, error)
+	FindByAccountAndTxHash(accountId uuid.UUID, txHash string) (*model.LatePayment, error)
+	FindByStatus(status model.LatePaymentStatus) ([]model.LatePayment, error)
+	CountPendingByAccount(accountId uuid.UUID) (int64, error)
+}
+
+func NewLatePaymentRepository(db *gorm.DB) ILatePaymentRepository {
+	return &latePaymentRepository{db}
+}
+
+func (r *latePaymentRepository) Create(latePayment *model.LatePayment) error {
+	result := r.DB.Create(&latePayment)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *latePaymentRepository) Update(latePayment *model.LatePayment) error {
+	result := r.DB.Omit("Payment").Save(&latePayment)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *latePaymentRepository) FindByID(id uuid.UUID) (*model.LatePayment, error) {
+	var latePayment model.LatePayment
+	result := r.DB.
+		Preload("Payment.CurrentPaymentState").
+		Where("id = ?", id).
+		First(&latePayment)
+
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &latePayment, nil
+}
+
+func (r *latePaymentRepository) FindByAccountAndTxHash(accountId uuid.UUID, txHash string) (*model.LatePayment, error) {
+	var latePayment model.LatePayment
+	result := r.DB.
+		Where("account_id = ? AND tx_hash = ?", accountId, txHash).
+		First(&latePayment)
+
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &latePayment, nil
+}
+
+func (r *latePaymentRepository) FindByStatus(status model.LatePaymentStatus) ([]model.LatePayment, error) {
+	var latePayments []model.LatePayment
+	result := r.DB.
+		Where("status = ?", status).
+		Order("created_at").
+		Find(&latePayments)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return latePayments, nil
+}
+
+func (r *latePaymentRepository) CountPendingByAccount(accountId uuid.UUID) (int64, error) {
+	var count int64
+	result := r.DB.
+		Model(&model.LatePayment{}).
+		Where("account_id = ? AND status = ?", accountId, model.LatePaymentPending).
+		Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return count, nil
+}
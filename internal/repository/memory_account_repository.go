@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+)
+
+type memoryAccountRepository struct {
+	store *MemoryStore
+}
+
+// NewMemoryAccountRepository returns an IAccountRepository which keeps its rows in the given store instead of postgres
+func NewMemoryAccountRepository(store *MemoryStore) IAccountRepository {
+	return &memoryAccountRepository{store}
+}
+
+func (r *memoryAccountRepository) FindUnusedByNetwork(network model.Network) (*model.Account, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, account := range r.store.sortedAccounts() {
+		if !account.Used && account.Network == network {
+			unusedAccount := accountRow(account)
+			return &unusedAccount, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memoryAccountRepository) ClaimUnusedByNetwork(network model.Network) (*model.Account, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, account := range r.store.sortedAccounts() {
+		if !account.Used && account.Network == network {
+			claimed := accountRow(account)
+			claimed.Used = true
+			err := r.store.saveAccount(&claimed)
+			if err != nil {
+				return nil, err
+			}
+			return &claimed, nil
+		}
+	}
+	return nil, nil
+}
+
+// FindByAddress returns an empty account if the address is unknown, the same as the gorm repository
+func (r *memoryAccountRepository) FindByAddress(address string) (*model.Account, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, account := range r.store.sortedAccounts() {
+		if account.Address == address {
+			loaded := r.store.loadAccount(account)
+			return &loaded, nil
+		}
+	}
+	return &model.Account{}, nil
+}
+
+func (r *memoryAccountRepository) FindLastDerivationIndex(network model.Network) (*int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var last *int64
+	for _, account := range r.store.accounts {
+		if account.Network == network && account.DerivationIndex != nil && (last == nil || *account.DerivationIndex > *last) {
+			index := *account.DerivationIndex
+			last = &index
+		}
+	}
+	return last, nil
+}
+
+func (r *memoryAccountRepository) FindLastFundedDerivationIndex(network model.Network) (*int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	funded := make(map[uuid.UUID]bool)
+	for _, payment := range r.store.payments {
+		for _, state := range r.store.statesOfPayment(payment.ID) {
+			if state.AmountReceived != nil && state.AmountReceived.Sign() > 0 {
+				funded[payment.AccountID] = true
+			}
+		}
+	}
+	var last *int64
+	for _, account := range r.store.accounts {
+		if account.Network == network && account.DerivationIndex != nil && funded[account.ID] && (last == nil || *account.DerivationIndex > *last) {
+			index := *account.DerivationIndex
+			last = &index
+		}
+	}
+	return last, nil
+}
+
+// LockDerivation has nothing to lock, the memory unit of work runs one transaction at a time
+func (r *memoryAccountRepository) LockDerivation(_ model.Network) error {
+	return nil
+}
+
+func (r *memoryAccountRepository) CountByAddresses(addresses []string) (int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	lookup := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		lookup[address] = true
+	}
+	var count int64
+	for _, account := range r.store.accounts {
+		if lookup[account.Address] {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *memoryAccountRepository) Create(account *model.Account) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	err := r.store.createAccount(account, conflictError)
+	if err != nil {
+		return derivationIndexError(err)
+	}
+	return nil
+}
+
+func (r *memoryAccountRepository) Update(account *model.Account) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	return r.store.saveAccount(account)
+}
+
+func (r *memoryAccountRepository) FindAll() ([]model.Account, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var accounts []model.Account
+	for _, account := range r.store.sortedAccounts() {
+		accounts = append(accounts, r.store.loadAccount(account))
+	}
+	return accounts, nil
+}
@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"sync"
+)
+
+type memoryAdvisoryLockRepository struct {
+	store *MemoryStore
+}
+
+// NewMemoryAdvisoryLockRepository returns an IAdvisoryLockRepository whose locks are shared by the repositories of the store
+func NewMemoryAdvisoryLockRepository(store *MemoryStore) IAdvisoryLockRepository {
+	return &memoryAdvisoryLockRepository{store}
+}
+
+func (r *memoryAdvisoryLockRepository) WithLock(key int64, fn func()) error {
+	r.store.locksMu.Lock()
+	lock, ok := r.store.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		r.store.locks[key] = lock
+	}
+	r.store.locksMu.Unlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+	fn()
+	return nil
+}
@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+)
+
+type memoryChainCursorRepository struct {
+	store *MemoryStore
+}
+
+// NewMemoryChainCursorRepository returns an IChainCursorRepository which keeps its rows in the given store instead of postgres
+func NewMemoryChainCursorRepository(store *MemoryStore) IChainCursorRepository {
+	return &memoryChainCursorRepository{store}
+}
+
+func (r *memoryChainCursorRepository) FindByNetwork(network model.Network) (*model.ChainCursor, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, cursor := range r.store.chainCursors {
+		if cursor.Network == network {
+			cursor.Base = baseRow(cursor.Base)
+			return &cursor, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memoryChainCursorRepository) Save(cursor *model.ChainCursor) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, row := range r.store.chainCursors {
+		if row.ID != cursor.ID && row.Network == cursor.Network {
+			return uniqueKeyError("chain_cursors", "network")
+		}
+	}
+	if _, ok := r.store.chainCursors[cursor.ID]; cursor.ID == uuid.Nil || !ok {
+		setCreateDefaults(&cursor.Base)
+	}
+	cursor.UpdatedAt = time.Now()
+	row := *cursor
+	row.Base = baseRow(row.Base)
+	r.store.chainCursors[cursor.ID] = row
+	return nil
+}
@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"sort"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+)
+
+type memoryForwardingTransactionRepository struct {
+	store *MemoryStore
+}
+
+// NewMemoryForwardingTransactionRepository returns an IForwardingTransactionRepository which keeps its rows in the given store instead of postgres
+func NewMemoryForwardingTransactionRepository(store *MemoryStore) IForwardingTransactionRepository {
+	return &memoryForwardingTransactionRepository{store}
+}
+
+func (r *memoryForwardingTransactionRepository) Create(transaction *model.ForwardingTransaction) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	setCreateDefaults(&transaction.Base)
+	if _, ok := r.store.forwardingTransactions[transaction.ID]; ok {
+		return duplicateKeyError("forwarding_transactions")
+	}
+	row := *transaction
+	row.Base = baseRow(row.Base)
+	r.store.forwardingTransactions[transaction.ID] = row
+	return nil
+}
+
+func (r *memoryForwardingTransactionRepository) FindByPayment(paymentId uuid.UUID) ([]model.ForwardingTransaction, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var transactions []model.ForwardingTransaction
+	for _, transaction := range r.store.forwardingTransactions {
+		if transaction.PaymentID == paymentId {
+			transactions = append(transactions, transaction)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		return lessCreated(transactions[i].Base, transactions[j].Base)
+	})
+	return transactions, nil
+}
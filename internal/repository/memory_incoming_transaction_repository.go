@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"sort"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+)
+
+type memoryIncomingTransactionRepository struct {
+	store *MemoryStore
+}
+
+// NewMemoryIncomingTransactionRepository returns an IIncomingTransactionRepository which keeps its rows in the given store instead of postgres
+func NewMemoryIncomingTransactionRepository(store *MemoryStore) IIncomingTransactionRepository {
+	return &memoryIncomingTransactionRepository{store}
+}
+
+func (r *memoryIncomingTransactionRepository) Create(transaction *model.IncomingTransaction) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	setCreateDefaults(&transaction.Base)
+	if _, ok := r.store.incomingTransactions[transaction.ID]; ok {
+		return duplicateKeyError("incoming_transactions")
+	}
+	return r.save(transaction)
+}
+
+func (r *memoryIncomingTransactionRepository) Update(transaction *model.IncomingTransaction) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if _, ok := r.store.incomingTransactions[transaction.ID]; transaction.ID == uuid.Nil || !ok {
+		setCreateDefaults(&transaction.Base)
+	}
+	transaction.UpdatedAt = time.Now()
+	return r.save(transaction)
+}
+
+func (r *memoryIncomingTransactionRepository) FindByPaymentAndTxHash(paymentId uuid.UUID, txHash string) (*model.IncomingTransaction, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, transaction := range r.store.incomingTransactions {
+		if transaction.PaymentID == paymentId && transaction.TxHash == txHash {
+			transaction = incomingTransactionRow(transaction)
+			return &transaction, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memoryIncomingTransactionRepository) FindByPayment(paymentId uuid.UUID) ([]model.IncomingTransaction, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var transactions []model.IncomingTransaction
+	for _, transaction := range r.store.incomingTransactions {
+		if transaction.PaymentID == paymentId {
+			transactions = append(transactions, incomingTransactionRow(transaction))
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		return lessCreated(transactions[i].Base, transactions[j].Base)
+	})
+	return transactions, nil
+}
+
+func (r *memoryIncomingTransactionRepository) FindByTxHash(txHash string) ([]model.IncomingTransaction, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var transactions []model.IncomingTransaction
+	for _, transaction := range r.store.incomingTransactions {
+		if transaction.TxHash == txHash {
+			transactions = append(transactions, incomingTransactionRow(transaction))
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		return lessCreated(transactions[i].Base, transactions[j].Base)
+	})
+	return transactions, nil
+}
+
+// save rejects a second row of the transaction for the payment, like idx_incoming_transactions_payment_tx
+func (r *memoryIncomingTransactionRepository) save(transaction *model.IncomingTransaction) error {
+	for _, row := range r.store.incomingTransactions {
+		if row.ID != transaction.ID && row.PaymentID == transaction.PaymentID && row.TxHash == transaction.TxHash {
+			return uniqueKeyError("incoming_transactions", "payment_tx")
+		}
+	}
+	r.store.incomingTransactions[transaction.ID] = incomingTransactionRow(*transaction)
+	return nil
+}
+
+func incomingTransactionRow(transaction model.IncomingTransaction) model.IncomingTransaction {
+	transaction.Base = baseRow(transaction.Base)
+	transaction.BlockHash = copyString(transaction.BlockHash)
+	return transaction
+}
@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"sort"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+)
+
+type memoryLatePaymentRepository struct {
+	store *MemoryStore
+}
+
+// NewMemoryLatePaymentRepository returns an ILatePaymentRepository which keeps its rows in the given store instead of postgres
+func NewMemoryLatePaymentRepository(store *MemoryStore) ILatePaymentRepository {
+	return &memoryLatePaymentRepository{store}
+}
+
+func (r *memoryLatePaymentRepository) Create(latePayment *model.LatePayment) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	setCreateDefaults(&latePayment.Base)
+	if _, ok := r.store.latePayments[latePayment.ID]; ok {
+		return duplicateKeyError("late_payments")
+	}
+	err := r.checkUniqueColumns(latePayment)
+	if err != nil {
+		return err
+	}
+	// the payment is inserted if it does not exist yet, like a belongs to association of gorm
+	if latePayment.Payment != nil {
+		if _, ok := r.store.payments[latePayment.Payment.ID]; !ok {
+			err = r.store.createPayment(latePayment.Payment, conflictDoNothing)
+			if err != nil {
+				return err
+			}
+		}
+		latePayment.PaymentID = latePayment.Payment.ID
+	}
+	r.store.latePayments[latePayment.ID] = latePaymentRow(*latePayment)
+	return nil
+}
+
+// Update saves the columns of the late payment, the payment is omitted
+func (r *memoryLatePaymentRepository) Update(latePayment *model.LatePayment) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if _, ok := r.store.latePayments[latePayment.ID]; latePayment.ID == uuid.Nil || !ok {
+		setCreateDefaults(&latePayment.Base)
+	}
+	err := r.checkUniqueColumns(latePayment)
+	if err != nil {
+		return err
+	}
+	latePayment.UpdatedAt = time.Now()
+	r.store.latePayments[latePayment.ID] = latePaymentRow(*latePayment)
+	return nil
+}
+
+// FindByID preloads the payment with its current state
+func (r *memoryLatePaymentRepository) FindByID(id uuid.UUID) (*model.LatePayment, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	row, ok := r.store.latePayments[id]
+	if !ok {
+		return nil, nil
+	}
+	latePayment := latePaymentRow(row)
+	if payment, ok := r.store.payments[row.PaymentID]; ok {
+		loaded := r.store.loadPayment(payment, false)
+		loaded.Account = nil
+		latePayment.Payment = &loaded
+	}
+	return &latePayment, nil
+}
+
+func (r *memoryLatePaymentRepository) FindByAccountAndTxHash(accountId uuid.UUID, txHash string) (*model.LatePayment, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, latePayment := range r.sortedLatePayments() {
+		if latePayment.AccountID == accountId && latePayment.TxHash == txHash {
+			return &latePayment, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memoryLatePaymentRepository) FindByStatus(status model.LatePaymentStatus) ([]model.LatePayment, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var latePayments []model.LatePayment
+	for _, latePayment := range r.sortedLatePayments() {
+		if latePayment.Status == status {
+			latePayments = append(latePayments, latePayment)
+		}
+	}
+	return latePayments, nil
+}
+
+func (r *memoryLatePaymentRepository) CountPendingByAccount(accountId uuid.UUID) (int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var count int64
+	for _, latePayment := range r.store.latePayments {
+		if latePayment.AccountID == accountId && latePayment.Status == model.LatePaymentPending {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// checkUniqueColumns rejects a second late payment of the same transaction to the account, like idx_late_payments_account_tx
+func (r *memoryLatePaymentRepository) checkUniqueColumns(latePayment *model.LatePayment) error {
+	for _, row := range r.store.latePayments {
+		if row.ID != latePayment.ID && row.AccountID == latePayment.AccountID && row.TxHash == latePayment.TxHash {
+			return uniqueKeyError("late_payments", "account_tx")
+		}
+	}
+	return nil
+}
+
+func (r *memoryLatePaymentRepository) sortedLatePayments() []model.LatePayment {
+	latePayments := make([]model.LatePayment, 0, len(r.store.latePayments))
+	for _, latePayment := range r.store.latePayments {
+		latePayments = append(latePayments, latePaymentRow(latePayment))
+	}
+	sort.Slice(latePayments, func(i, j int) bool {
+		return lessCreated(latePayments[i].Base, latePayments[j].Base)
+	})
+	return latePayments
+}
+
+func latePaymentRow(latePayment model.LatePayment) model.LatePayment {
+	latePayment.Base = baseRow(latePayment.Base)
+	latePayment.Payment = nil
+	latePayment.Amount = bigIntRow(latePayment.Amount)
+	latePayment.ResolvingTransactionHash = copyString(latePayment.ResolvingTransactionHash)
+	return latePayment
+}
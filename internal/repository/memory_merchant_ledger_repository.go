@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+)
+
+type memoryMerchantLedgerRepository struct {
+	store *MemoryStore
+}
+
+// NewMemoryMerchantLedgerRepository returns an IMerchantLedgerRepository which keeps its rows in the given store instead of postgres
+func NewMemoryMerchantLedgerRepository(store *MemoryStore) IMerchantLedgerRepository {
+	return &memoryMerchantLedgerRepository{store}
+}
+
+func (r *memoryMerchantLedgerRepository) Create(entry *model.MerchantLedgerEntry) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	setCreateDefaults(&entry.Base)
+	if _, ok := r.store.ledgerEntries[entry.ID]; ok {
+		return duplicateKeyError("merchant_ledger_entries")
+	}
+	r.store.ledgerEntries[entry.ID] = ledgerEntryRow(*entry)
+	return nil
+}
+
+func (r *memoryMerchantLedgerRepository) FindByPayment(paymentId uuid.UUID) ([]model.MerchantLedgerEntry, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var entries []model.MerchantLedgerEntry
+	for _, entry := range r.sortedEntries() {
+		if entry.PaymentID == paymentId {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (r *memoryMerchantLedgerRepository) FindByWallet(wallet string, network model.Network) ([]model.MerchantLedgerEntry, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var entries []model.MerchantLedgerEntry
+	for _, entry := range r.sortedEntries() {
+		if entry.Wallet == wallet && entry.Network == network {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (r *memoryMerchantLedgerRepository) FindLastPayout(wallet string, network model.Network) (*model.MerchantLedgerEntry, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var last *model.MerchantLedgerEntry
+	for _, entry := range r.sortedEntries() {
+		if entry.Wallet == wallet && entry.Network == network && entry.Kind == model.LedgerPayout {
+			entry := entry
+			last = &entry
+		}
+	}
+	return last, nil
+}
+
+func (r *memoryMerchantLedgerRepository) GetBalance(wallet string, network model.Network) (*big.Int, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	balance := new(big.Int)
+	for _, entry := range r.store.ledgerEntries {
+		if entry.Wallet == wallet && entry.Network == network {
+			balance.Add(balance, &entry.Amount.Int)
+		}
+	}
+	return balance, nil
+}
+
+func (r *memoryMerchantLedgerRepository) sortedEntries() []model.MerchantLedgerEntry {
+	entries := make([]model.MerchantLedgerEntry, 0, len(r.store.ledgerEntries))
+	for _, entry := range r.store.ledgerEntries {
+		entries = append(entries, ledgerEntryRow(entry))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return lessCreated(entries[i].Base, entries[j].Base)
+	})
+	return entries
+}
+
+func ledgerEntryRow(entry model.MerchantLedgerEntry) model.MerchantLedgerEntry {
+	entry.Base = baseRow(entry.Base)
+	entry.Amount = bigIntRow(entry.Amount)
+	entry.TxHash = copyString(entry.TxHash)
+	return entry
+}
@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+)
+
+type memoryMerchantSettingsRepository struct {
+	store *MemoryStore
+}
+
+// NewMemoryMerchantSettingsRepository returns an IMerchantSettingsRepository which keeps its rows in the given store instead of postgres
+func NewMemoryMerchantSettingsRepository(store *MemoryStore) IMerchantSettingsRepository {
+	return &memoryMerchantSettingsRepository{store}
+}
+
+func (r *memoryMerchantSettingsRepository) Create(settings *model.MerchantSettings) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	setCreateDefaults(&settings.Base)
+	if _, ok := r.store.merchantSettings[settings.ID]; ok {
+		return duplicateKeyError("merchant_settings")
+	}
+	return r.save(settings)
+}
+
+func (r *memoryMerchantSettingsRepository) Update(settings *model.MerchantSettings) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if _, ok := r.store.merchantSettings[settings.ID]; settings.ID == uuid.Nil || !ok {
+		setCreateDefaults(&settings.Base)
+	}
+	settings.UpdatedAt = time.Now()
+	return r.save(settings)
+}
+
+func (r *memoryMerchantSettingsRepository) FindByWallet(wallet string) (*model.MerchantSettings, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, settings := range r.store.merchantSettings {
+		if settings.Wallet == wallet {
+			settings = merchantSettingsRow(settings)
+			return &settings, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memoryMerchantSettingsRepository) save(settings *model.MerchantSettings) error {
+	for _, row := range r.store.merchantSettings {
+		if row.ID != settings.ID && row.Wallet == settings.Wallet {
+			return uniqueKeyError("merchant_settings", "wallet")
+		}
+	}
+	r.store.merchantSettings[settings.ID] = merchantSettingsRow(*settings)
+	return nil
+}
+
+func merchantSettingsRow(settings model.MerchantSettings) model.MerchantSettings {
+	settings.Base = baseRow(settings.Base)
+	if settings.PayoutSchedule == 0 {
+		settings.PayoutSchedule = model.PayoutImmediate
+	}
+	settings.MinimumPayout = bigIntRow(settings.MinimumPayout)
+	return settings
+}
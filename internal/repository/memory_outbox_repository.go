@@ -0,0 +1,146 @@
+package repository
+
+import (
+	"sort"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+)
+
+type memoryOutboxRepository struct {
+	store *MemoryStore
+}
+
+// NewMemoryOutboxRepository returns an IOutboxRepository which keeps its rows in the given store instead of postgres
+func NewMemoryOutboxRepository(store *MemoryStore) IOutboxRepository {
+	return &memoryOutboxRepository{store}
+}
+
+func (r *memoryOutboxRepository) Create(notification *model.OutboxNotification) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	setCreateDefaults(&notification.Base)
+	if _, ok := r.store.outbox[notification.ID]; ok {
+		return duplicateKeyError("outbox_notifications")
+	}
+	r.store.outboxSequence++
+	notification.Sequence = r.store.outboxSequence
+	r.store.outbox[notification.ID] = outboxRow(*notification)
+	return nil
+}
+
+func (r *memoryOutboxRepository) Update(notification *model.OutboxNotification) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if _, ok := r.store.outbox[notification.ID]; notification.ID == uuid.Nil || !ok {
+		setCreateDefaults(&notification.Base)
+		r.store.outboxSequence++
+		notification.Sequence = r.store.outboxSequence
+	}
+	notification.UpdatedAt = time.Now()
+	r.store.outbox[notification.ID] = outboxRow(*notification)
+	return nil
+}
+
+func (r *memoryOutboxRepository) FindByID(id uuid.UUID) (*model.OutboxNotification, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	notification, ok := r.store.outbox[id]
+	if !ok {
+		return nil, nil
+	}
+	notification = outboxRow(notification)
+	return &notification, nil
+}
+
+func (r *memoryOutboxRepository) FindPending(limit int) ([]model.OutboxNotification, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	firstDead := make(map[uuid.UUID]int64)
+	for _, notification := range r.store.outbox {
+		if notification.Status != model.NotificationDead {
+			continue
+		}
+		if sequence, ok := firstDead[notification.PaymentID]; !ok || notification.Sequence < sequence {
+			firstDead[notification.PaymentID] = notification.Sequence
+		}
+	}
+
+	var notifications []model.OutboxNotification
+	for _, notification := range r.sortedOutbox() {
+		if notification.Status != model.NotificationPending {
+			continue
+		}
+		if sequence, ok := firstDead[notification.PaymentID]; ok && sequence < notification.Sequence {
+			continue
+		}
+		notifications = append(notifications, notification)
+		if len(notifications) == limit {
+			break
+		}
+	}
+	return notifications, nil
+}
+
+func (r *memoryOutboxRepository) FindDue(limit int) ([]model.OutboxNotification, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	now := time.Now()
+	// the first notification of each payment which holds back the later ones
+	firstBlocking := make(map[uuid.UUID]int64)
+	for _, notification := range r.store.outbox {
+		waiting := notification.Status == model.NotificationPending && notification.NextAttemptAt.After(now)
+		if notification.Status != model.NotificationDead && !waiting {
+			continue
+		}
+		if sequence, ok := firstBlocking[notification.PaymentID]; !ok || notification.Sequence < sequence {
+			firstBlocking[notification.PaymentID] = notification.Sequence
+		}
+	}
+
+	var notifications []model.OutboxNotification
+	for _, notification := range r.sortedOutbox() {
+		if notification.Status != model.NotificationPending || notification.NextAttemptAt.After(now) {
+			continue
+		}
+		if sequence, ok := firstBlocking[notification.PaymentID]; ok && sequence < notification.Sequence {
+			continue
+		}
+		notifications = append(notifications, notification)
+		if len(notifications) == limit {
+			break
+		}
+	}
+	return notifications, nil
+}
+
+func (r *memoryOutboxRepository) FindByStatus(status model.NotificationStatus) ([]model.OutboxNotification, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var notifications []model.OutboxNotification
+	for _, notification := range r.sortedOutbox() {
+		if notification.Status == status {
+			notifications = append(notifications, notification)
+		}
+	}
+	return notifications, nil
+}
+
+func (r *memoryOutboxRepository) sortedOutbox() []model.OutboxNotification {
+	notifications := make([]model.OutboxNotification, 0, len(r.store.outbox))
+	for _, notification := range r.store.outbox {
+		notifications = append(notifications, outboxRow(notification))
+	}
+	sort.Slice(notifications, func(i, j int) bool {
+		return notifications[i].Sequence < notifications[j].Sequence
+	})
+	return notifications
+}
+
+func outboxRow(notification model.OutboxNotification) model.OutboxNotification {
+	notification.Base = baseRow(notification.Base)
+	notification.NextAttemptAt = databaseTime(notification.NextAttemptAt)
+	notification.TxHash = copyString(notification.TxHash)
+	return notification
+}
@@ -0,0 +1,234 @@
+package repository
+
+import (
+	"sort"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"github.com/google/uuid"
+)
+
+type memoryPaymentRepository struct {
+	store *MemoryStore
+}
+
+// NewMemoryPaymentRepository returns an IPaymentRepository which keeps its rows in the given store instead of postgres
+func NewMemoryPaymentRepository(store *MemoryStore) IPaymentRepository {
+	return &memoryPaymentRepository{store}
+}
+
+func (r *memoryPaymentRepository) Create(payment *model.Payment) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	return r.store.createPayment(payment, conflictError)
+}
+
+func (r *memoryPaymentRepository) Update(payment *model.Payment) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	return r.store.savePayment(payment)
+}
+
+func (r *memoryPaymentRepository) FindByID(id uuid.UUID) (*model.Payment, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	row, ok := r.store.payments[id]
+	if !ok {
+		return nil, nil
+	}
+	payment := r.store.loadPayment(row, true)
+	return &payment, nil
+}
+
+func (r *memoryPaymentRepository) FindByIdempotencyKey(key string) (*model.Payment, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, row := range r.store.payments {
+		if row.IdempotencyKey != nil && *row.IdempotencyKey == key {
+			payment := r.store.loadPayment(row, true)
+			return &payment, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memoryPaymentRepository) FindAll(filter PaymentFilter) ([]model.Payment, int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	payments := []model.Payment{}
+	for _, row := range r.store.payments {
+		payment := r.store.loadPayment(row, false)
+		if matchesPaymentFilter(payment, filter) {
+			payments = append(payments, payment)
+		}
+	}
+	sort.SliceStable(payments, func(i, j int) bool {
+		return payments[i].CreatedAt.After(payments[j].CreatedAt)
+	})
+
+	total := int64(len(payments))
+	if filter.Offset > 0 {
+		if filter.Offset > len(payments) {
+			filter.Offset = len(payments)
+		}
+		payments = payments[filter.Offset:]
+	}
+	if filter.Limit > 0 && filter.Limit < len(payments) {
+		payments = payments[:filter.Limit]
+	}
+	for i := range payments {
+		payments[i].PaymentStates = r.store.statesOfPayment(payments[i].ID)
+	}
+	return payments, total, nil
+}
+
+func (r *memoryPaymentRepository) FindCurrentPaymentByAddress(address string) (*model.Payment, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, row := range r.store.sortedPayments() {
+		payment := r.store.loadPayment(row, false)
+		if payment.Account == nil || payment.Account.Address != address {
+			continue
+		}
+		if isState(payment, enum.Waiting, enum.PartiallyPaid) {
+			return &payment, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memoryPaymentRepository) FindPaidPaymentsByNetwork(network model.Network) ([]model.Payment, error) {
+	return r.findByNetwork(network, func(payment model.Payment) bool {
+		return isState(payment, enum.Paid)
+	}), nil
+}
+
+func (r *memoryPaymentRepository) FindConfirmedPaymentsByNetwork(network model.Network) ([]model.Payment, error) {
+	return r.findByNetwork(network, func(payment model.Payment) bool {
+		return isState(payment, enum.Confirmed)
+	}), nil
+}
+
+func (r *memoryPaymentRepository) FindForwardedPaymentsByNetwork(network model.Network) ([]model.Payment, error) {
+	return r.findByNetwork(network, func(payment model.Payment) bool {
+		return isState(payment, enum.Forwarded)
+	}), nil
+}
+
+func (r *memoryPaymentRepository) FindExpiredPaymentsByNetwork(network model.Network) ([]model.Payment, error) {
+	t := databaseTime(time.Now())
+	return r.findByNetwork(network, func(payment model.Payment) bool {
+		expiresAt := payment.ExpiresAt
+		if expiresAt.IsZero() {
+			expiresAt = payment.CreatedAt.Add(time.Duration(utils.Opts.PaymentExpiry) * time.Minute)
+		}
+		return expiresAt.Before(t) && isState(payment, enum.Waiting, enum.PartiallyPaid)
+	}), nil
+}
+
+func (r *memoryPaymentRepository) FindQuarantined() ([]model.Payment, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	payments := []model.Payment{}
+	for _, row := range r.store.payments {
+		if row.QuarantinedAt != nil {
+			payments = append(payments, r.store.loadPayment(row, true))
+		}
+	}
+	sort.SliceStable(payments, func(i, j int) bool {
+		return payments[i].QuarantinedAt.Before(*payments[j].QuarantinedAt)
+	})
+	return payments, nil
+}
+
+func (r *memoryPaymentRepository) UpdateProcessingStatus(payment *model.Payment) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	row, ok := r.store.payments[payment.ID]
+	if !ok {
+		return nil
+	}
+	row.ProcessingFailures = payment.ProcessingFailures
+	row.LastProcessingError = payment.LastProcessingError
+	row.QuarantinedAt = payment.QuarantinedAt
+	r.store.payments[payment.ID] = paymentRow(row)
+	return nil
+}
+
+func (r *memoryPaymentRepository) FindByPayoutBatch(batchId uuid.UUID) ([]model.Payment, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	payments := []model.Payment{}
+	for _, row := range r.store.sortedPayments() {
+		if row.PayoutBatchID != nil && *row.PayoutBatchID == batchId {
+			payments = append(payments, r.store.loadPayment(row, false))
+		}
+	}
+	return payments, nil
+}
+
+func (r *memoryPaymentRepository) FindAllOutgoingTransactionIdsByMerchantWalletAndNetwork(merchantWallet string, network model.Network) ([]string, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	txIds := []string{}
+	for _, row := range r.store.sortedPayments() {
+		if row.MerchantWallet == merchantWallet && row.Network == network && row.ForwardingTransactionHash != nil {
+			txIds = append(txIds, *row.ForwardingTransactionHash)
+		}
+	}
+	return txIds, nil
+}
+
+// findByNetwork returns the payments of the network with their account and current state, but without the state history
+func (r *memoryPaymentRepository) findByNetwork(network model.Network, matches func(payment model.Payment) bool) []model.Payment {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	payments := []model.Payment{}
+	for _, row := range r.store.sortedPayments() {
+		if row.Network != network || row.QuarantinedAt != nil {
+			continue
+		}
+		payment := r.store.loadPayment(row, false)
+		if matches(payment) {
+			payments = append(payments, payment)
+		}
+	}
+	return payments
+}
+
+// isState checks the joined current state, payments without a current state never match
+func isState(payment model.Payment, states ...enum.State) bool {
+	if payment.CurrentPaymentStateId == nil || payment.CurrentPaymentState.ID == uuid.Nil {
+		return false
+	}
+	for _, state := range states {
+		if payment.CurrentPaymentState.StateID == state {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesPaymentFilter(payment model.Payment, filter PaymentFilter) bool {
+	if filter.Mode != nil && payment.Mode != *filter.Mode {
+		return false
+	}
+	if filter.Network != nil && payment.Network != *filter.Network {
+		return false
+	}
+	if filter.State != nil && !isState(payment, *filter.State) {
+		return false
+	}
+	if filter.MerchantWallet != "" && payment.MerchantWallet != filter.MerchantWallet {
+		return false
+	}
+	if filter.CreatedFrom != nil && payment.CreatedAt.Before(databaseTime(*filter.CreatedFrom)) {
+		return false
+	}
+	if filter.CreatedTo != nil && !payment.CreatedAt.Before(databaseTime(*filter.CreatedTo)) {
+		return false
+	}
+	return true
+}
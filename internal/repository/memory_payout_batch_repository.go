@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+)
+
+type memoryPayoutBatchRepository struct {
+	store *MemoryStore
+}
+
+// NewMemoryPayoutBatchRepository returns an IPayoutBatchRepository which keeps its rows in the given store instead of postgres
+func NewMemoryPayoutBatchRepository(store *MemoryStore) IPayoutBatchRepository {
+	return &memoryPayoutBatchRepository{store}
+}
+
+func (r *memoryPayoutBatchRepository) Create(batch *model.PayoutBatch) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	setCreateDefaults(&batch.Base)
+	if _, ok := r.store.payoutBatches[batch.ID]; ok {
+		return duplicateKeyError("payout_batches")
+	}
+	r.store.payoutBatches[batch.ID] = payoutBatchRow(*batch)
+	return nil
+}
+
+func (r *memoryPayoutBatchRepository) Update(batch *model.PayoutBatch) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if _, ok := r.store.payoutBatches[batch.ID]; batch.ID == uuid.Nil || !ok {
+		setCreateDefaults(&batch.Base)
+	}
+	batch.UpdatedAt = time.Now()
+	r.store.payoutBatches[batch.ID] = payoutBatchRow(*batch)
+	return nil
+}
+
+// Delete removes the batch, the gorm repository soft deletes it so it is not found anymore either
+func (r *memoryPayoutBatchRepository) Delete(batch *model.PayoutBatch) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	delete(r.store.payoutBatches, batch.ID)
+	return nil
+}
+
+func (r *memoryPayoutBatchRepository) FindByID(id uuid.UUID) (*model.PayoutBatch, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	batch, ok := r.store.payoutBatches[id]
+	if !ok {
+		return nil, nil
+	}
+	batch = payoutBatchRow(batch)
+	return &batch, nil
+}
+
+func payoutBatchRow(batch model.PayoutBatch) model.PayoutBatch {
+	batch.Base = baseRow(batch.Base)
+	batch.TxHash = copyString(batch.TxHash)
+	batch.Fee = bigIntRow(batch.Fee)
+	return batch
+}
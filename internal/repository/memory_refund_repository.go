@@ -0,0 +1,154 @@
+package repository
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+)
+
+type memoryRefundRepository struct {
+	store *MemoryStore
+}
+
+// NewMemoryRefundRepository returns an IRefundRepository which keeps its rows in the given store instead of postgres
+func NewMemoryRefundRepository(store *MemoryStore) IRefundRepository {
+	return &memoryRefundRepository{store}
+}
+
+// Create inserts the refund with its states, the payment is omitted
+func (r *memoryRefundRepository) Create(refund *model.Refund) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	setCreateDefaults(&refund.Base)
+	if _, ok := r.store.refunds[refund.ID]; ok {
+		return duplicateKeyError("refunds")
+	}
+	r.save(refund)
+	return nil
+}
+
+// Update saves the refund and inserts its new states, the payment is omitted
+func (r *memoryRefundRepository) Update(refund *model.Refund) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if _, ok := r.store.refunds[refund.ID]; refund.ID == uuid.Nil || !ok {
+		setCreateDefaults(&refund.Base)
+	}
+	refund.UpdatedAt = time.Now()
+	r.save(refund)
+	return nil
+}
+
+// FindByPayment joins the current state and preloads the states
+func (r *memoryRefundRepository) FindByPayment(paymentId uuid.UUID) ([]model.Refund, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var refunds []model.Refund
+	for _, row := range r.sortedRefunds() {
+		if row.PaymentID != paymentId {
+			continue
+		}
+		refund := r.loadRefund(row)
+		refund.RefundStates = r.statesOfRefund(row.ID)
+		refunds = append(refunds, refund)
+	}
+	return refunds, nil
+}
+
+// FindSentByNetwork joins the current state and preloads the payment with its current state
+func (r *memoryRefundRepository) FindSentByNetwork(network model.Network) ([]model.Refund, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var refunds []model.Refund
+	for _, row := range r.sortedRefunds() {
+		refund := r.loadRefund(row)
+		if refund.Network != network || refund.CurrentRefundState.Status != model.RefundSent {
+			continue
+		}
+		if payment, ok := r.store.payments[row.PaymentID]; ok {
+			loaded := r.store.loadPayment(payment, false)
+			loaded.Account = nil
+			refund.Payment = &loaded
+		}
+		refunds = append(refunds, refund)
+	}
+	return refunds, nil
+}
+
+func (r *memoryRefundRepository) save(refund *model.Refund) {
+	// the current state is inserted if it does not exist yet, like a belongs to association of gorm
+	if !reflect.ValueOf(refund.CurrentRefundState).IsZero() {
+		setCreateDefaults(&refund.CurrentRefundState.Base)
+		if _, ok := r.store.refundStates[refund.CurrentRefundState.ID]; !ok {
+			r.store.refundStates[refund.CurrentRefundState.ID] = refundStateRow(refund.CurrentRefundState)
+		}
+		id := refund.CurrentRefundState.ID
+		refund.CurrentRefundStateId = &id
+	}
+	for i := range refund.RefundStates {
+		state := &refund.RefundStates[i]
+		state.RefundID = refund.ID
+		setCreateDefaults(&state.Base)
+		if row, ok := r.store.refundStates[state.ID]; ok {
+			row.RefundID = refund.ID
+			r.store.refundStates[state.ID] = row
+		} else {
+			r.store.refundStates[state.ID] = refundStateRow(*state)
+		}
+	}
+	r.store.refunds[refund.ID] = refundRow(*refund)
+}
+
+func (r *memoryRefundRepository) loadRefund(row model.Refund) model.Refund {
+	refund := refundRow(row)
+	if row.CurrentRefundStateId != nil {
+		if state, ok := r.store.refundStates[*row.CurrentRefundStateId]; ok {
+			refund.CurrentRefundState = refundStateRow(state)
+		}
+	}
+	return refund
+}
+
+func (r *memoryRefundRepository) statesOfRefund(refundId uuid.UUID) []model.RefundState {
+	states := []model.RefundState{}
+	for _, state := range r.store.refundStates {
+		if state.RefundID == refundId {
+			states = append(states, refundStateRow(state))
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return lessCreated(states[i].Base, states[j].Base)
+	})
+	return states
+}
+
+func (r *memoryRefundRepository) sortedRefunds() []model.Refund {
+	refunds := make([]model.Refund, 0, len(r.store.refunds))
+	for _, refund := range r.store.refunds {
+		refunds = append(refunds, refund)
+	}
+	sort.Slice(refunds, func(i, j int) bool {
+		return lessCreated(refunds[i].Base, refunds[j].Base)
+	})
+	return refunds
+}
+
+func refundRow(refund model.Refund) model.Refund {
+	refund.Base = baseRow(refund.Base)
+	refund.Payment = nil
+	refund.Amount = bigIntRow(refund.Amount)
+	refund.CurrentRefundStateId = copyID(refund.CurrentRefundStateId)
+	refund.CurrentRefundState = model.RefundState{}
+	refund.RefundStates = nil
+	refund.TransactionHash = copyString(refund.TransactionHash)
+	refund.Confirmations = copyInt64(refund.Confirmations)
+	return refund
+}
+
+func refundStateRow(state model.RefundState) model.RefundState {
+	state.Base = baseRow(state.Base)
+	return state
+}
@@ -0,0 +1,518 @@
+package repository
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+)
+
+// MemoryStore holds the tables of the in-memory repositories.
+// Repositories created from the same store see each other's rows like the tables of one database.
+type MemoryStore struct {
+	mu                     sync.Mutex
+	accounts               map[uuid.UUID]model.Account
+	payments               map[uuid.UUID]model.Payment
+	states                 map[uuid.UUID]model.PaymentState
+	outbox                 map[uuid.UUID]model.OutboxNotification
+	outboxSequence         int64
+	chainCursors           map[uuid.UUID]model.ChainCursor
+	latePayments           map[uuid.UUID]model.LatePayment
+	refunds                map[uuid.UUID]model.Refund
+	refundStates           map[uuid.UUID]model.RefundState
+	merchantSettings       map[uuid.UUID]model.MerchantSettings
+	incomingTransactions   map[uuid.UUID]model.IncomingTransaction
+	forwardingTransactions map[uuid.UUID]model.ForwardingTransaction
+	payoutBatches          map[uuid.UUID]model.PayoutBatch
+	ledgerEntries          map[uuid.UUID]model.MerchantLedgerEntry
+
+	locksMu sync.Mutex
+	locks   map[int64]*sync.Mutex // advisory locks
+}
+
+// conflict decides what happens when an association row already exists, like the on conflict clause gorm adds
+type conflict int
+
+const (
+	conflictError conflict = iota
+	conflictDoNothing
+	conflictUpdateForeignKey
+)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts:               map[uuid.UUID]model.Account{},
+		payments:               map[uuid.UUID]model.Payment{},
+		states:                 map[uuid.UUID]model.PaymentState{},
+		outbox:                 map[uuid.UUID]model.OutboxNotification{},
+		chainCursors:           map[uuid.UUID]model.ChainCursor{},
+		latePayments:           map[uuid.UUID]model.LatePayment{},
+		refunds:                map[uuid.UUID]model.Refund{},
+		refundStates:           map[uuid.UUID]model.RefundState{},
+		merchantSettings:       map[uuid.UUID]model.MerchantSettings{},
+		incomingTransactions:   map[uuid.UUID]model.IncomingTransaction{},
+		forwardingTransactions: map[uuid.UUID]model.ForwardingTransaction{},
+		payoutBatches:          map[uuid.UUID]model.PayoutBatch{},
+		ledgerEntries:          map[uuid.UUID]model.MerchantLedgerEntry{},
+		locks:                  map[int64]*sync.Mutex{},
+	}
+}
+
+// NewMemoryRepositories returns in-memory versions of all repositories, which share the tables of the store
+func NewMemoryRepositories(store *MemoryStore) *Repositories {
+	return &Repositories{
+		Account:               NewMemoryAccountRepository(store),
+		Payment:               NewMemoryPaymentRepository(store),
+		Outbox:                NewMemoryOutboxRepository(store),
+		ChainCursor:           NewMemoryChainCursorRepository(store),
+		LatePayment:           NewMemoryLatePaymentRepository(store),
+		Refund:                NewMemoryRefundRepository(store),
+		MerchantSettings:      NewMemoryMerchantSettingsRepository(store),
+		IncomingTransaction:   NewMemoryIncomingTransactionRepository(store),
+		ForwardingTransaction: NewMemoryForwardingTransactionRepository(store),
+		PayoutBatch:           NewMemoryPayoutBatchRepository(store),
+		MerchantLedger:        NewMemoryMerchantLedgerRepository(store),
+		AdvisoryLock:          NewMemoryAdvisoryLockRepository(store),
+	}
+}
+
+// memorySnapshot are the tables at the start of a transaction. Rows are replaced and never changed in place,
+// so copying the maps is enough to restore them.
+type memorySnapshot struct {
+	accounts               map[uuid.UUID]model.Account
+	payments               map[uuid.UUID]model.Payment
+	states                 map[uuid.UUID]model.PaymentState
+	outbox                 map[uuid.UUID]model.OutboxNotification
+	chainCursors           map[uuid.UUID]model.ChainCursor
+	latePayments           map[uuid.UUID]model.LatePayment
+	refunds                map[uuid.UUID]model.Refund
+	refundStates           map[uuid.UUID]model.RefundState
+	merchantSettings       map[uuid.UUID]model.MerchantSettings
+	incomingTransactions   map[uuid.UUID]model.IncomingTransaction
+	forwardingTransactions map[uuid.UUID]model.ForwardingTransaction
+	payoutBatches          map[uuid.UUID]model.PayoutBatch
+	ledgerEntries          map[uuid.UUID]model.MerchantLedgerEntry
+}
+
+func (s *MemoryStore) snapshot() memorySnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return memorySnapshot{
+		accounts:               copyTable(s.accounts).(map[uuid.UUID]model.Account),
+		payments:               copyTable(s.payments).(map[uuid.UUID]model.Payment),
+		states:                 copyTable(s.states).(map[uuid.UUID]model.PaymentState),
+		outbox:                 copyTable(s.outbox).(map[uuid.UUID]model.OutboxNotification),
+		chainCursors:           copyTable(s.chainCursors).(map[uuid.UUID]model.ChainCursor),
+		latePayments:           copyTable(s.latePayments).(map[uuid.UUID]model.LatePayment),
+		refunds:                copyTable(s.refunds).(map[uuid.UUID]model.Refund),
+		refundStates:           copyTable(s.refundStates).(map[uuid.UUID]model.RefundState),
+		merchantSettings:       copyTable(s.merchantSettings).(map[uuid.UUID]model.MerchantSettings),
+		incomingTransactions:   copyTable(s.incomingTransactions).(map[uuid.UUID]model.IncomingTransaction),
+		forwardingTransactions: copyTable(s.forwardingTransactions).(map[uuid.UUID]model.ForwardingTransaction),
+		payoutBatches:          copyTable(s.payoutBatches).(map[uuid.UUID]model.PayoutBatch),
+		ledgerEntries:          copyTable(s.ledgerEntries).(map[uuid.UUID]model.MerchantLedgerEntry),
+	}
+}
+
+// restore rolls the tables back to the snapshot, sequences are not rolled back like in postgres
+func (s *MemoryStore) restore(snapshot memorySnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts = snapshot.accounts
+	s.payments = snapshot.payments
+	s.states = snapshot.states
+	s.outbox = snapshot.outbox
+	s.chainCursors = snapshot.chainCursors
+	s.latePayments = snapshot.latePayments
+	s.refunds = snapshot.refunds
+	s.refundStates = snapshot.refundStates
+	s.merchantSettings = snapshot.merchantSettings
+	s.incomingTransactions = snapshot.incomingTransactions
+	s.forwardingTransactions = snapshot.forwardingTransactions
+	s.payoutBatches = snapshot.payoutBatches
+	s.ledgerEntries = snapshot.ledgerEntries
+}
+
+func copyTable(table interface{}) interface{} {
+	original := reflect.ValueOf(table)
+	copied := reflect.MakeMapWithSize(original.Type(), original.Len())
+	iter := original.MapRange()
+	for iter.Next() {
+		copied.SetMapIndex(iter.Key(), iter.Value())
+	}
+	return copied.Interface()
+}
+
+// createAccount inserts the account and its payments like gorm's Create
+func (s *MemoryStore) createAccount(account *model.Account, onConflict conflict) error {
+	setCreateDefaults(&account.Base)
+	if _, ok := s.accounts[account.ID]; ok {
+		if onConflict == conflictError {
+			return duplicateKeyError("accounts")
+		}
+	} else {
+		err := s.checkUniqueAccountColumns(account)
+		if err != nil {
+			return err
+		}
+		s.accounts[account.ID] = accountRow(*account)
+	}
+	return s.savePaymentsOfAccount(account)
+}
+
+// saveAccount updates all columns of the account and inserts missing payments like gorm's Save
+func (s *MemoryStore) saveAccount(account *model.Account) error {
+	if _, ok := s.accounts[account.ID]; account.ID == uuid.Nil || !ok {
+		return s.createAccount(account, conflictError)
+	}
+	err := s.checkUniqueAccountColumns(account)
+	if err != nil {
+		return err
+	}
+	account.UpdatedAt = time.Now()
+	s.accounts[account.ID] = accountRow(*account)
+	return s.savePaymentsOfAccount(account)
+}
+
+func (s *MemoryStore) savePaymentsOfAccount(account *model.Account) error {
+	for i := range account.Payments {
+		account.Payments[i].AccountID = account.ID
+		err := s.createPayment(&account.Payments[i], conflictUpdateForeignKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createPayment inserts the payment with its account and states like gorm's Create
+func (s *MemoryStore) createPayment(payment *model.Payment, onConflict conflict) error {
+	err := s.checkUniquePaymentColumns(payment)
+	if err != nil {
+		return err
+	}
+	s.savePaymentBelongsTo(payment)
+	setCreateDefaults(&payment.Base)
+	if row, ok := s.payments[payment.ID]; ok {
+		switch onConflict {
+		case conflictError:
+			return duplicateKeyError("payments")
+		case conflictUpdateForeignKey:
+			row.AccountID = payment.AccountID
+			s.payments[payment.ID] = row
+		}
+	} else {
+		s.payments[payment.ID] = paymentRow(*payment)
+	}
+	s.savePaymentStates(payment)
+	return nil
+}
+
+// checkUniquePaymentColumns rejects a payment with the idempotency key or open account of another payment,
+// like the unique indexes of postgres
+func (s *MemoryStore) checkUniqueAccountColumns(account *model.Account) error {
+	for _, row := range s.accounts {
+		if row.ID == account.ID {
+			continue
+		}
+		if account.DerivationIndex != nil && row.DerivationIndex != nil && row.Network == account.Network && *row.DerivationIndex == *account.DerivationIndex {
+			return uniqueKeyError("accounts", "network_derivation_index")
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) checkUniquePaymentColumns(payment *model.Payment) error {
+	for _, row := range s.payments {
+		if row.ID == payment.ID {
+			continue
+		}
+		if payment.IdempotencyKey != nil && row.IdempotencyKey != nil && *row.IdempotencyKey == *payment.IdempotencyKey {
+			return uniqueKeyError("payments", "idempotency_key")
+		}
+		if payment.OpenAccountID != nil && row.OpenAccountID != nil && *row.OpenAccountID == *payment.OpenAccountID {
+			return uniqueKeyError("payments", "open_account_id")
+		}
+	}
+	return nil
+}
+
+// savePayment updates all columns of the payment and inserts missing associations like gorm's Save
+func (s *MemoryStore) savePayment(payment *model.Payment) error {
+	if _, ok := s.payments[payment.ID]; payment.ID == uuid.Nil || !ok {
+		return s.createPayment(payment, conflictError)
+	}
+	err := s.checkUniquePaymentColumns(payment)
+	if err != nil {
+		return err
+	}
+	s.savePaymentBelongsTo(payment)
+	payment.UpdatedAt = time.Now()
+	s.payments[payment.ID] = paymentRow(*payment)
+	s.savePaymentStates(payment)
+	return nil
+}
+
+// savePaymentBelongsTo inserts the account and the current state if they do not exist yet.
+// Existing rows are not updated, the same as gorm does for belongs to associations.
+func (s *MemoryStore) savePaymentBelongsTo(payment *model.Payment) {
+	if payment.Account != nil && !reflect.ValueOf(*payment.Account).IsZero() {
+		setCreateDefaults(&payment.Account.Base)
+		if _, ok := s.accounts[payment.Account.ID]; !ok {
+			s.accounts[payment.Account.ID] = accountRow(*payment.Account)
+		}
+		payment.AccountID = payment.Account.ID
+	}
+	if !reflect.ValueOf(payment.CurrentPaymentState).IsZero() {
+		s.createState(&payment.CurrentPaymentState, conflictDoNothing)
+		id := payment.CurrentPaymentState.ID
+		payment.CurrentPaymentStateId = &id
+	}
+}
+
+func (s *MemoryStore) savePaymentStates(payment *model.Payment) {
+	for i := range payment.PaymentStates {
+		payment.PaymentStates[i].PaymentID = payment.ID
+		s.createState(&payment.PaymentStates[i], conflictUpdateForeignKey)
+	}
+}
+
+func (s *MemoryStore) createState(state *model.PaymentState, onConflict conflict) {
+	setCreateDefaults(&state.Base)
+	if row, ok := s.states[state.ID]; ok {
+		if onConflict == conflictUpdateForeignKey {
+			row.PaymentID = state.PaymentID
+			s.states[state.ID] = row
+		}
+		return
+	}
+	s.states[state.ID] = stateRow(*state)
+}
+
+// loadPayment joins the account and the current state, the states are only loaded if preloadStates is set
+func (s *MemoryStore) loadPayment(row model.Payment, preloadStates bool) model.Payment {
+	payment := paymentRow(row)
+	if account, ok := s.accounts[row.AccountID]; ok {
+		account = accountRow(account)
+		payment.Account = &account
+	}
+	if row.CurrentPaymentStateId != nil {
+		if state, ok := s.states[*row.CurrentPaymentStateId]; ok {
+			payment.CurrentPaymentState = stateRow(state)
+		}
+	}
+	if preloadStates {
+		payment.PaymentStates = s.statesOfPayment(row.ID)
+	}
+	return payment
+}
+
+// loadAccount preloads the payments of the account with their states
+func (s *MemoryStore) loadAccount(row model.Account) model.Account {
+	account := accountRow(row)
+	for _, paymentRow := range s.sortedPayments() {
+		if paymentRow.AccountID != row.ID {
+			continue
+		}
+		payment := s.loadPayment(paymentRow, true)
+		payment.Account = nil
+		account.Payments = append(account.Payments, payment)
+	}
+	return account
+}
+
+func (s *MemoryStore) statesOfPayment(paymentId uuid.UUID) []model.PaymentState {
+	states := []model.PaymentState{}
+	for _, state := range s.states {
+		if state.PaymentID == paymentId {
+			states = append(states, stateRow(state))
+		}
+	}
+	sort.SliceStable(states, func(i, j int) bool {
+		if states[i].CreatedAt.Equal(states[j].CreatedAt) {
+			return lessID(states[i].ID, states[j].ID)
+		}
+		return states[i].CreatedAt.Before(states[j].CreatedAt)
+	})
+	return states
+}
+
+// sortedPayments returns the payment rows ordered by primary key, the order postgres returns for First
+func (s *MemoryStore) sortedPayments() []model.Payment {
+	payments := make([]model.Payment, 0, len(s.payments))
+	for _, payment := range s.payments {
+		payments = append(payments, payment)
+	}
+	sort.Slice(payments, func(i, j int) bool {
+		return lessID(payments[i].ID, payments[j].ID)
+	})
+	return payments
+}
+
+func (s *MemoryStore) sortedAccounts() []model.Account {
+	accounts := make([]model.Account, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return lessID(accounts[i].ID, accounts[j].ID)
+	})
+	return accounts
+}
+
+func lessID(a uuid.UUID, b uuid.UUID) bool {
+	return bytes.Compare(a[:], b[:]) < 0
+}
+
+// setCreateDefaults fills the columns postgres and gorm fill on insert
+func setCreateDefaults(base *model.Base) {
+	if base.ID == uuid.Nil {
+		base.ID = uuid.New()
+	}
+	now := time.Now()
+	if base.CreatedAt.IsZero() {
+		base.CreatedAt = now
+	}
+	if base.UpdatedAt.IsZero() {
+		base.UpdatedAt = now
+	}
+}
+
+func duplicateKeyError(table string) error {
+	return fmt.Errorf("duplicate key value violates unique constraint \"%s_pkey\"", table)
+}
+
+func uniqueKeyError(table string, column string) error {
+	return fmt.Errorf("duplicate key value violates unique constraint \"idx_%s_%s\"", table, column)
+}
+
+// accountRow copies the columns of an account, as they are read back from postgres
+func accountRow(account model.Account) model.Account {
+	account.Base = baseRow(account.Base)
+	account.Remainder = bigIntRow(account.Remainder)
+	if account.DerivationIndex != nil {
+		index := *account.DerivationIndex
+		account.DerivationIndex = &index
+	}
+	account.Payments = nil
+	return account
+}
+
+func paymentRow(payment model.Payment) model.Payment {
+	payment.Base = baseRow(payment.Base)
+	payment.ExpiresAt = databaseTime(payment.ExpiresAt)
+	if payment.OverpaymentPolicy == 0 {
+		payment.OverpaymentPolicy = model.OverpaymentCredit
+	}
+	if payment.Risk == 0 {
+		payment.Risk = model.RiskLow
+	}
+	payment.UnderpaymentTolerance = bigIntRow(payment.UnderpaymentTolerance)
+	payment.Shortfall = bigIntRow(payment.Shortfall)
+	payment.ForwardingFee = bigIntRow(payment.ForwardingFee)
+	payment.Account = nil
+	payment.CurrentPaymentState = model.PaymentState{}
+	payment.PaymentStates = nil
+	if payment.CurrentPaymentStateId != nil {
+		id := *payment.CurrentPaymentStateId
+		payment.CurrentPaymentStateId = &id
+	}
+	if payment.ReceivedConfirmations != nil {
+		confirmations := *payment.ReceivedConfirmations
+		payment.ReceivedConfirmations = &confirmations
+	}
+	if payment.ForwardingTransactionHash != nil {
+		hash := *payment.ForwardingTransactionHash
+		payment.ForwardingTransactionHash = &hash
+	}
+	if payment.ForwardingConfirmations != nil {
+		confirmations := *payment.ForwardingConfirmations
+		payment.ForwardingConfirmations = &confirmations
+	}
+	if payment.ForwardingBlockHash != nil {
+		hash := *payment.ForwardingBlockHash
+		payment.ForwardingBlockHash = &hash
+	}
+	if payment.PayoutBatchID != nil {
+		id := *payment.PayoutBatchID
+		payment.PayoutBatchID = &id
+	}
+	if payment.IdempotencyKey != nil {
+		key := *payment.IdempotencyKey
+		payment.IdempotencyKey = &key
+	}
+	if payment.OpenAccountID != nil {
+		id := *payment.OpenAccountID
+		payment.OpenAccountID = &id
+	}
+	if payment.QuarantinedAt != nil {
+		quarantinedAt := databaseTime(*payment.QuarantinedAt)
+		payment.QuarantinedAt = &quarantinedAt
+	}
+	return payment
+}
+
+func stateRow(state model.PaymentState) model.PaymentState {
+	state.Base = baseRow(state.Base)
+	state.PayAmount = bigIntRow(state.PayAmount)
+	state.AmountReceived = bigIntRow(state.AmountReceived)
+	state.Surplus = bigIntRow(state.Surplus)
+	return state
+}
+
+func baseRow(base model.Base) model.Base {
+	base.CreatedAt = databaseTime(base.CreatedAt)
+	base.UpdatedAt = databaseTime(base.UpdatedAt)
+	return base
+}
+
+// databaseTime truncates to the microseconds postgres stores, query parameters are truncated the same way
+func databaseTime(t time.Time) time.Time {
+	return t.Truncate(time.Microsecond).Local()
+}
+
+// bigIntRow copies the value, missing values get the column default 0
+func bigIntRow(value *model.BigInt) *model.BigInt {
+	if value == nil {
+		return model.NewBigIntFromInt(0)
+	}
+	return model.NewBigInt(new(big.Int).Set(&value.Int))
+}
+
+// lessCreated orders rows by created_at like Order("created_at"), rows created at the same time by primary key
+func lessCreated(a model.Base, b model.Base) bool {
+	if a.CreatedAt.Equal(b.CreatedAt) {
+		return lessID(a.ID, b.ID)
+	}
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+func copyString(value *string) *string {
+	if value == nil {
+		return nil
+	}
+	copied := *value
+	return &copied
+}
+
+func copyInt64(value *int64) *int64 {
+	if value == nil {
+		return nil
+	}
+	copied := *value
+	return &copied
+}
+
+func copyID(value *uuid.UUID) *uuid.UUID {
+	if value == nil {
+		return nil
+	}
+	copied := *value
+	return &copied
+}
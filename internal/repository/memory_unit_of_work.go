@@ -0,0 +1,28 @@
+package repository
+
+import (
+	"sync"
+)
+
+type memoryUnitOfWork struct {
+	store *MemoryStore
+	repos *Repositories
+	mu    sync.Mutex
+}
+
+// NewMemoryUnitOfWork returns an IUnitOfWork for the repositories of the store. Transactions run one at a time and
+// a rollback restores the tables, so writes outside of a transaction must not run concurrently with one.
+func NewMemoryUnitOfWork(store *MemoryStore) IUnitOfWork {
+	return &memoryUnitOfWork{store: store, repos: NewMemoryRepositories(store)}
+}
+
+func (u *memoryUnitOfWork) WithTx(fn func(repos *Repositories) error) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	snapshot := u.store.snapshot()
+	err := fn(u.repos)
+	if err != nil {
+		u.store.restore(snapshot)
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type merchantLedgerRepository struct {
+	DB *gorm.DB
+}
+
+type IMerchantLedgerRepository interface {
+	Create(entry *model.MerchantLedgerEntry) error
+	FindByPayment(paymentId uuid.UUID) ([]model.MerchantLedgerEntry, error)
+	FindByWallet(wallet string, network model.Network) ([]model.MerchantLedgerEntry, error)
+	FindLastPayout(wallet string, network model.Network) (*model.MerchantLedgerEntry, error)
+	GetBalance(wallet string, network model.Network) (*big.Int, error)
+}
+
+func NewMerchantLedgerRepository(db *gorm.DB) IMerchantLedgerRepository {
+	return &merchantLedgerRepository{db}
+}
+
+func (r *merchantLedgerRepository) Create(entry *model.MerchantLedgerEntry) error {
+	result := r.DB.Create(&entry)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *merchantLedgerRepository) FindByPayment(paymentId uuid.UUID) ([]model.MerchantLedgerEntry, error) {
+	var entries []model.MerchantLedgerEntry
+	result := r.DB.
+		Where("payment_id = ?", paymentId).
+		Order("created_at").
+		Find(&entries)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return entries, nil
+}
+
+func (r *merchantLedgerRepository) FindByWallet(wallet string, network model.Network) ([]model.MerchantLedgerEntry, error) {
+	var entries []model.MerchantLedgerEntry
+	result := r.DB.
+		Where("wallet = ? AND network = ?", wallet, network).
+		Order("created_at").
+		Find(&entries)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return entries, nil
+}
+
+func (r *merchantLedgerRepository) FindLastPayout(wallet string, network model.Network) (*model.MerchantLedgerEntry, error) {
+	var entry model.MerchantLedgerEntry
+	result := r.DB.
+		Where("wallet = ? AND network = ? AND kind = ?", wallet, network, model.LedgerPayout).
+		Order("created_at DESC").
+		First(&entry)
+
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &entry, nil
+}
+
+func (r *merchantLedgerRepository) GetBalance(wallet string, network model.Network) (*big.Int, error) {
+	var balance model.BigInt
+	err := r.DB.
+		Model(&model.MerchantLedgerEntry{}).
+		Select("COALESCE(SUM(amount), 0)").
+		Where("wallet = ? AND network = ?", wallet, network).
+		Row().
+		Scan(&balance)
+
+	if err != nil {
+		return nil, err
+	}
+	return &balance.Int, nil
+}
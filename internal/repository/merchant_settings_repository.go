@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"errors"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"gorm.io/gorm"
+)
+
+type merchantSettingsRepository struct {
+	DB *gorm.DB
+}
+
+type IMerchantSettingsRepository interface {
+	Create(settings *model.MerchantSettings) error
+	Update(settings *model.MerchantSettings) error
+	FindByWallet(wallet string) (*model.MerchantSettings, error)
+}
+
+func NewMerchantSettingsRepository(db *gorm.DB) IMerchantSettingsRepository {
+	return &merchantSettingsRepository{db}
+}
+
+func (r *merchantSettingsRepository) Create(settings *model.MerchantSettings) error {
+	result := r.DB.Create(&settings)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *merchantSettingsRepository) Update(settings *model.MerchantSettings) error {
+	result := r.DB.Save(&settings)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *merchantSettingsRepository) FindByWallet(wallet string) (*model.MerchantSettings, error) {
+	var settings model.MerchantSettings
+	result := r.DB.
+		Where("wallet = ?", wallet).
+		First(&settings)
+
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &settings, nil
+}
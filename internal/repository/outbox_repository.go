@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"errors"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type outboxRepository struct {
+	DB *gorm.DB
+}
+
+type IOutboxRepository interface {
+	Create(notification *model.OutboxNotification) error
+	Update(notification *model.OutboxNotification) error
+	FindByID(id uuid.UUID) (*model.OutboxNotification, error)
+	FindPending(limit int) ([]model.OutboxNotification, error)
+	FindDue(limit int) ([]model.OutboxNotification, error)
+	FindByStatus(status model.NotificationStatus) ([]model.OutboxNotification, error)
+}
+
+func NewOutboxRepository(db *gorm.DB) IOutboxRepository {
+	return &outboxRepository{db}
+}
+
+func (r *outboxRepository) Create(notification *model.OutboxNotification) error {
+	result := r.DB.Create(&notification)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *outboxRepository) Update(notification *model.OutboxNotification) error {
+	result := r.DB.Save(&notification)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *outboxRepository) FindByID(id uuid.UUID) (*model.OutboxNotification, error) {
+	var notification model.OutboxNotification
+	result := r.DB.Where("id = ?", id).First(&notification)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &notification, nil
+}
+
+// FindPending returns pending notifications in the order they were written, including the ones which are not due yet.
+// Notifications written after a dead one of the same payment wait until it is requeued.
+func (r *outboxRepository) FindPending(limit int) ([]model.OutboxNotification, error) {
+	var notifications []model.OutboxNotification
+	result := r.DB.
+		Where("status = ?", model.NotificationPending).
+		Where("NOT EXISTS (?)", r.DB.
+			Table("outbox_notifications AS dead").
+			Select("1").
+			Where("dead.payment_id = outbox_notifications.payment_id AND dead.status = ? AND dead.sequence < outbox_notifications.sequence",
+				model.NotificationDead)).
+		Order("sequence").
+		Limit(limit).
+		Find(&notifications)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notifications, nil
+}
+
+// FindDue returns the pending notifications which can be sent now in the order they were written.
+// A notification waits while an earlier one of the same payment is dead or backs off, so the ones in backoff
+// neither overtake each other nor fill the limit before the due notifications of other payments.
+func (r *outboxRepository) FindDue(limit int) ([]model.OutboxNotification, error) {
+	now := time.Now()
+	var notifications []model.OutboxNotification
+	result := r.DB.
+		Where("status = ? AND next_attempt_at <= ?", model.NotificationPending, now).
+		Where("NOT EXISTS (?)", r.DB.
+			Table("outbox_notifications AS earlier").
+			Select("1").
+			Where("earlier.payment_id = outbox_notifications.payment_id AND earlier.sequence < outbox_notifications.sequence").
+			Where("(earlier.status = ? OR (earlier.status = ? AND earlier.next_attempt_at > ?))",
+				model.NotificationDead, model.NotificationPending, now)).
+		Order("sequence").
+		Limit(limit).
+		Find(&notifications)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notifications, nil
+}
+
+func (r *outboxRepository) FindByStatus(status model.NotificationStatus) ([]model.OutboxNotification, error) {
+	var notifications []model.OutboxNotification
+	result := r.DB.
+		Where("status = ?", status).
+		Order("sequence").
+		Find(&notifications)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notifications, nil
+}
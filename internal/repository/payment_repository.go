@@ -1,8 +1,11 @@
 package repository
 
 import (
+	"errors"
 	"github.com/CHainGate/backend/pkg/enum"
 	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 	"time"
 )
@@ -11,15 +14,33 @@ type paymentRepository struct {
 	DB *gorm.DB
 }
 
+// PaymentFilter restricts the result of FindAll. Nil or empty fields are ignored.
+type PaymentFilter struct {
+	Mode           *enum.Mode
+	Network        *model.Network
+	State          *enum.State
+	MerchantWallet string
+	CreatedFrom    *time.Time
+	CreatedTo      *time.Time
+	Offset         int
+	Limit          int
+}
+
 type IPaymentRepository interface {
 	Create(account *model.Payment) error
+	FindByID(id uuid.UUID) (*model.Payment, error)
+	FindByIdempotencyKey(key string) (*model.Payment, error)
+	FindAll(filter PaymentFilter) ([]model.Payment, int64, error)
 	FindCurrentPaymentByAddress(address string) (*model.Payment, error)
 	Update(payment *model.Payment) error
-	FindPaidPaymentsByMode(mode enum.Mode) ([]model.Payment, error)
-	FindConfirmedPaymentsByMode(mode enum.Mode) ([]model.Payment, error)
-	FindForwardedPaymentsByMode(mode enum.Mode) ([]model.Payment, error)
-	FindExpiredPaymentsByMode(mode enum.Mode) ([]model.Payment, error)
-	FindAllOutgoingTransactionIdsByMerchantWalletAndMode(merchantWallet string, mode enum.Mode) ([]string, error)
+	FindPaidPaymentsByNetwork(network model.Network) ([]model.Payment, error)
+	FindConfirmedPaymentsByNetwork(network model.Network) ([]model.Payment, error)
+	FindForwardedPaymentsByNetwork(network model.Network) ([]model.Payment, error)
+	FindExpiredPaymentsByNetwork(network model.Network) ([]model.Payment, error)
+	FindByPayoutBatch(batchId uuid.UUID) ([]model.Payment, error)
+	FindQuarantined() ([]model.Payment, error)
+	UpdateProcessingStatus(payment *model.Payment) error
+	FindAllOutgoingTransactionIdsByMerchantWalletAndNetwork(merchantWallet string, network model.Network) ([]string, error)
 }
 
 func NewPaymentRepository(db *gorm.DB) IPaymentRepository {
@@ -42,6 +63,71 @@ func (r *paymentRepository) Update(payment *model.Payment) error {
 	return nil
 }
 
+func (r *paymentRepository) FindByID(id uuid.UUID) (*model.Payment, error) {
+	var payment model.Payment
+	result := r.DB.
+		Joins("Account").
+		Joins("CurrentPaymentState").
+		Preload("PaymentStates", orderByCreatedAt).
+		Where("payments.id = ?", id).
+		First(&payment)
+
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &payment, nil
+}
+
+func (r *paymentRepository) FindByIdempotencyKey(key string) (*model.Payment, error) {
+	var payment model.Payment
+	result := r.DB.
+		Joins("Account").
+		Joins("CurrentPaymentState").
+		Preload("PaymentStates", orderByCreatedAt).
+		Where("payments.idempotency_key = ?", key).
+		First(&payment)
+
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &payment, nil
+}
+
+func (r *paymentRepository) FindAll(filter PaymentFilter) ([]model.Payment, int64, error) {
+	var total int64
+	result := r.DB.
+		Model(&model.Payment{}).
+		Joins("CurrentPaymentState").
+		Scopes(applyPaymentFilter(filter)).
+		Count(&total)
+
+	if result.Error != nil {
+		return nil, 0, result.Error
+	}
+
+	var payments []model.Payment
+	result = r.DB.
+		Joins("Account").
+		Joins("CurrentPaymentState").
+		Preload("PaymentStates", orderByCreatedAt).
+		Scopes(applyPaymentFilter(filter)).
+		Order("payments.created_at DESC").
+		Offset(filter.Offset).
+		Limit(filter.Limit).
+		Find(&payments)
+
+	if result.Error != nil {
+		return nil, 0, result.Error
+	}
+	return payments, total, nil
+}
+
 func (r *paymentRepository) FindCurrentPaymentByAddress(address string) (*model.Payment, error) {
 	var payment model.Payment
 	result := r.DB.
@@ -51,17 +137,48 @@ func (r *paymentRepository) FindCurrentPaymentByAddress(address string) (*model.
 		First(&payment)
 
 	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
 		return nil, result.Error
 	}
 	return &payment, nil
 }
 
-func (r *paymentRepository) FindPaidPaymentsByMode(mode enum.Mode) ([]model.Payment, error) {
+func (r *paymentRepository) FindPaidPaymentsByNetwork(network model.Network) ([]model.Payment, error) {
+	var payments []model.Payment
+	result := r.DB.
+		Preload("Account").
+		Joins("CurrentPaymentState").
+		Where("\"CurrentPaymentState\".\"state_id\" = ? AND network = ? AND quarantined_at IS NULL", enum.Paid, network).
+		Find(&payments)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return payments, nil
+}
+
+func (r *paymentRepository) FindConfirmedPaymentsByNetwork(network model.Network) ([]model.Payment, error) {
+	var payments []model.Payment
+	result := r.DB.
+		Preload("Account").
+		Joins("CurrentPaymentState").
+		Where("\"CurrentPaymentState\".\"state_id\" = ? AND network = ? AND quarantined_at IS NULL", enum.Confirmed, network).
+		Find(&payments)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return payments, nil
+}
+
+func (r *paymentRepository) FindForwardedPaymentsByNetwork(network model.Network) ([]model.Payment, error) {
 	var payments []model.Payment
 	result := r.DB.
 		Preload("Account").
 		Joins("CurrentPaymentState").
-		Where("\"CurrentPaymentState\".\"state_id\" = ? AND mode = ?", enum.Paid, mode).
+		Where("\"CurrentPaymentState\".\"state_id\" = ? AND network = ? AND quarantined_at IS NULL", enum.Forwarded, network).
 		Find(&payments)
 
 	if result.Error != nil {
@@ -70,12 +187,13 @@ func (r *paymentRepository) FindPaidPaymentsByMode(mode enum.Mode) ([]model.Paym
 	return payments, nil
 }
 
-func (r *paymentRepository) FindConfirmedPaymentsByMode(mode enum.Mode) ([]model.Payment, error) {
+func (r *paymentRepository) FindExpiredPaymentsByNetwork(network model.Network) ([]model.Payment, error) {
 	var payments []model.Payment
 	result := r.DB.
 		Preload("Account").
 		Joins("CurrentPaymentState").
-		Where("\"CurrentPaymentState\".\"state_id\" = ? AND mode = ?", enum.Confirmed, mode).
+		// a payment without an expiry, e.g. stored by a replica not yet migrated, expires after PAYMENT_EXPIRY
+		Where("COALESCE(payments.expires_at, payments.created_at + make_interval(mins => ?)) < ? AND \"CurrentPaymentState\".\"state_id\" IN ? AND network = ? AND quarantined_at IS NULL", utils.Opts.PaymentExpiry, time.Now(), []enum.State{enum.Waiting, enum.PartiallyPaid}, network).
 		Find(&payments)
 
 	if result.Error != nil {
@@ -84,12 +202,14 @@ func (r *paymentRepository) FindConfirmedPaymentsByMode(mode enum.Mode) ([]model
 	return payments, nil
 }
 
-func (r *paymentRepository) FindForwardedPaymentsByMode(mode enum.Mode) ([]model.Payment, error) {
+func (r *paymentRepository) FindQuarantined() ([]model.Payment, error) {
 	var payments []model.Payment
 	result := r.DB.
 		Preload("Account").
 		Joins("CurrentPaymentState").
-		Where("\"CurrentPaymentState\".\"state_id\" = ? AND mode = ?", enum.Forwarded, mode).
+		Preload("PaymentStates", orderByCreatedAt).
+		Where("quarantined_at IS NOT NULL").
+		Order("quarantined_at").
 		Find(&payments)
 
 	if result.Error != nil {
@@ -98,13 +218,28 @@ func (r *paymentRepository) FindForwardedPaymentsByMode(mode enum.Mode) ([]model
 	return payments, nil
 }
 
-func (r *paymentRepository) FindExpiredPaymentsByMode(mode enum.Mode) ([]model.Payment, error) {
-	t := time.Now().Add(time.Minute * -15)
+// UpdateProcessingStatus only saves the failure columns, other changes of a payment whose processing failed are dropped
+func (r *paymentRepository) UpdateProcessingStatus(payment *model.Payment) error {
+	result := r.DB.
+		Model(&model.Payment{}).
+		Where("id = ?", payment.ID).
+		Updates(map[string]interface{}{
+			"processing_failures":   payment.ProcessingFailures,
+			"last_processing_error": payment.LastProcessingError,
+			"quarantined_at":        payment.QuarantinedAt,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *paymentRepository) FindByPayoutBatch(batchId uuid.UUID) ([]model.Payment, error) {
 	var payments []model.Payment
 	result := r.DB.
 		Preload("Account").
 		Joins("CurrentPaymentState").
-		Where("payments.created_at < ? AND \"CurrentPaymentState\".\"state_id\" IN ? AND mode = ?", t, []enum.State{enum.Waiting, enum.PartiallyPaid}, mode).
+		Where("payout_batch_id = ?", batchId).
 		Find(&payments)
 
 	if result.Error != nil {
@@ -113,15 +248,43 @@ func (r *paymentRepository) FindExpiredPaymentsByMode(mode enum.Mode) ([]model.P
 	return payments, nil
 }
 
-func (r *paymentRepository) FindAllOutgoingTransactionIdsByMerchantWalletAndMode(merchantWallet string, mode enum.Mode) ([]string, error) {
+func (r *paymentRepository) FindAllOutgoingTransactionIdsByMerchantWalletAndNetwork(merchantWallet string, network model.Network) ([]string, error) {
 	var txIds []string
 	result := r.DB.
 		Table("payments").
 		Select("forwarding_transaction_hash").
-		Where("merchant_wallet = ? AND mode = ? AND forwarding_transaction_hash IS NOT NULL", merchantWallet, mode).Scan(&txIds)
+		Where("merchant_wallet = ? AND network = ? AND forwarding_transaction_hash IS NOT NULL", merchantWallet, network).Scan(&txIds)
 
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	return txIds, nil
 }
+
+func applyPaymentFilter(filter PaymentFilter) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if filter.Mode != nil {
+			db = db.Where("payments.mode = ?", *filter.Mode)
+		}
+		if filter.Network != nil {
+			db = db.Where("payments.network = ?", *filter.Network)
+		}
+		if filter.State != nil {
+			db = db.Where("\"CurrentPaymentState\".\"state_id\" = ?", *filter.State)
+		}
+		if filter.MerchantWallet != "" {
+			db = db.Where("payments.merchant_wallet = ?", filter.MerchantWallet)
+		}
+		if filter.CreatedFrom != nil {
+			db = db.Where("payments.created_at >= ?", *filter.CreatedFrom)
+		}
+		if filter.CreatedTo != nil {
+			db = db.Where("payments.created_at < ?", *filter.CreatedTo)
+		}
+		return db
+	}
+}
+
+func orderByCreatedAt(db *gorm.DB) *gorm.DB {
+	return db.Order("created_at")
+}
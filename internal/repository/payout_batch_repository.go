@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"errors"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type payoutBatchRepository struct {
+	DB *gorm.DB
+}
+
+type IPayoutBatchRepository interface {
+	Create(batch *model.PayoutBatch) error
+	Update(batch *model.PayoutBatch) error
+	Delete(batch *model.PayoutBatch) error
+	FindByID(id uuid.UUID) (*model.PayoutBatch, error)
+}
+
+func NewPayoutBatchRepository(db *gorm.DB) IPayoutBatchRepository {
+	return &payoutBatchRepository{db}
+}
+
+func (r *payoutBatchRepository) Create(batch *model.PayoutBatch) error {
+	result := r.DB.Create(&batch)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *payoutBatchRepository) Update(batch *model.PayoutBatch) error {
+	result := r.DB.Save(&batch)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *payoutBatchRepository) Delete(batch *model.PayoutBatch) error {
+	result := r.DB.Delete(&batch)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *payoutBatchRepository) FindByID(id uuid.UUID) (*model.PayoutBatch, error) {
+	var batch model.PayoutBatch
+	result := r.DB.Where("id = ?", id).First(&batch)
+
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &batch, nil
+}
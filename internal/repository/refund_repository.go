@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type refundRepository struct {
+	DB *gorm.DB
+}
+
+type IRefundRepository interface {
+	Create(refund *model.Refund) error
+	Update(refund *model.Refund) error
+	FindByPayment(paymentId uuid.UUID) ([]model.Refund, error)
+	FindSentByNetwork(network model.Network) ([]model.Refund, error)
+}
+
+func NewRefundRepository(db *gorm.DB) IRefundRepository {
+	return &refundRepository{db}
+}
+
+func (r *refundRepository) Create(refund *model.Refund) error {
+	result := r.DB.Omit("Payment").Create(&refund)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *refundRepository) Update(refund *model.Refund) error {
+	result := r.DB.Omit("Payment").Save(&refund)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (r *refundRepository) FindByPayment(paymentId uuid.UUID) ([]model.Refund, error) {
+	var refunds []model.Refund
+	result := r.DB.
+		Joins("CurrentRefundState").
+		Preload("RefundStates", orderByCreatedAt).
+		Where("refunds.payment_id = ?", paymentId).
+		Order("refunds.created_at").
+		Find(&refunds)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return refunds, nil
+}
+
+func (r *refundRepository) FindSentByNetwork(network model.Network) ([]model.Refund, error) {
+	var refunds []model.Refund
+	result := r.DB.
+		Joins("CurrentRefundState").
+		Preload("Payment.CurrentPaymentState").
+		Where("\"CurrentRefundState\".\"status\" = ? AND network = ?", model.RefundSent, network).
+		Find(&refunds)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return refunds, nil
+}
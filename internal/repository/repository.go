@@ -3,13 +3,14 @@ package repository
 import (
 	"fmt"
 
+	"github.com/CHainGate/backend/pkg/enum"
 	"github.com/CHainGate/bitcoin-service/internal/model"
 	"github.com/CHainGate/bitcoin-service/internal/utils"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
-func SetupDatabase() (IAccountRepository, IPaymentRepository, error) {
+func SetupDatabase() (*Repositories, IUnitOfWork, error) {
 	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
 		utils.Opts.DbHost,
 		utils.Opts.DbUser,
@@ -28,9 +29,7 @@ func SetupDatabase() (IAccountRepository, IPaymentRepository, error) {
 		return nil, nil, err
 	}
 
-	accountRepo, paymentRepo := createRepositories(db)
-
-	return accountRepo, paymentRepo, nil
+	return createRepositories(db), NewUnitOfWork(db), nil
 }
 
 func autoMigrateDB(db *gorm.DB) error {
@@ -46,12 +45,127 @@ func autoMigrateDB(db *gorm.DB) error {
 	if err != nil {
 		return err
 	}
+	err = db.AutoMigrate(&model.OutboxNotification{})
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&model.ChainCursor{})
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&model.LatePayment{})
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&model.Refund{})
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&model.RefundState{})
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&model.MerchantSettings{})
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&model.IncomingTransaction{})
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&model.ForwardingTransaction{})
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&model.PayoutBatch{})
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&model.MerchantLedgerEntry{})
+	if err != nil {
+		return err
+	}
+	err = migrateNetworks(db)
+	if err != nil {
+		return err
+	}
+	err = migrateOpenAccounts(db)
+	if err != nil {
+		return err
+	}
+	return migrateExpiry(db)
+}
+
+// migrateNetworks assigns rows created before networks existed to the network their mode was served from.
+// The node of a mode didn't have to run its chain, e.g. the docker-compose setup served regtest as main,
+// so LEGACY_MAIN_NETWORK and LEGACY_TEST_NETWORK name the network.
+func migrateNetworks(db *gorm.DB) error {
+	networkByMode, err := getLegacyNetworks()
+	if err != nil {
+		return err
+	}
+	for mode, network := range networkByMode {
+		for _, table := range []interface{}{&model.Payment{}, &model.Account{}} {
+			err := db.Model(table).Where("network IS NULL AND mode = ?", mode).Update("network", network).Error
+			if err != nil {
+				return err
+			}
+		}
+		if db.Migrator().HasColumn(&model.ChainCursor{}, "mode") {
+			err := db.Model(&model.ChainCursor{}).Where("network IS NULL AND mode = ?", mode).Update("network", network).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-func createRepositories(db *gorm.DB) (IAccountRepository, IPaymentRepository) {
-	accountRepo := NewAccountRepository(db)
-	paymentRepo := NewPaymentRepository(db)
-	return accountRepo, paymentRepo
+func getLegacyNetworks() (map[enum.Mode]model.Network, error) {
+	networkByMode := make(map[enum.Mode]model.Network)
+	for mode, name := range map[enum.Mode]string{enum.Main: utils.Opts.LegacyMainNetwork, enum.Test: utils.Opts.LegacyTestNetwork} {
+		network, ok := model.ParseStringToNetworkEnum(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown legacy network of mode %s: %s", mode, name)
+		}
+		networkByMode[mode] = network
+	}
+	return networkByMode, nil
+}
+
+// migrateOpenAccounts sets the open account of the payments which held their account before it was stored, so the unique
+// index covers them. Payments hold the account until they are finished or expired. If an account was handed out twice,
+// only its latest payment holds it, otherwise the index would reject the migration.
+func migrateOpenAccounts(db *gorm.DB) error {
+	closed := []enum.State{enum.Finished, enum.Expired, enum.Failed}
+	return db.Exec(`UPDATE payments SET open_account_id = account_id WHERE id IN (
+		SELECT DISTINCT ON (payments.account_id) payments.id FROM payments
+		JOIN payment_states ON payment_states.id = payments.current_payment_state_id
+		WHERE payments.open_account_id IS NULL AND payment_states.state_id NOT IN ?
+		AND NOT EXISTS (SELECT 1 FROM payments AS holding WHERE holding.open_account_id = payments.account_id)
+		ORDER BY payments.account_id, payments.created_at DESC)`, closed).Error
+}
+
+// migrateExpiry gives payments created before the expiry was stored the default window of PAYMENT_EXPIRY
+func migrateExpiry(db *gorm.DB) error {
+	return db.Model(&model.Payment{}).
+		Where("expires_at IS NULL").
+		Update("expires_at", gorm.Expr("created_at + make_interval(mins => ?)", utils.Opts.PaymentExpiry)).Error
+}
 
+func createRepositories(db *gorm.DB) *Repositories {
+	return &Repositories{
+		Account:               NewAccountRepository(db),
+		Payment:               NewPaymentRepository(db),
+		Outbox:                NewOutboxRepository(db),
+		ChainCursor:           NewChainCursorRepository(db),
+		LatePayment:           NewLatePaymentRepository(db),
+		Refund:                NewRefundRepository(db),
+		MerchantSettings:      NewMerchantSettingsRepository(db),
+		IncomingTransaction:   NewIncomingTransactionRepository(db),
+		ForwardingTransaction: NewForwardingTransactionRepository(db),
+		PayoutBatch:           NewPayoutBatchRepository(db),
+		MerchantLedger:        NewMerchantLedgerRepository(db),
+		AdvisoryLock:          NewAdvisoryLockRepository(db),
+	}
 }
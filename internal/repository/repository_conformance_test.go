@@ -0,0 +1,865 @@
+package repository_test
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"github.com/CHainGate/bitcoin-service/test_utils"
+	"github.com/google/uuid"
+	"github.com/ory/dockertest/v3"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// gormDB is nil if docker is not available, the gorm repositories are skipped then
+var gormDB *gorm.DB
+
+type repositoryFactory func(t *testing.T) (repository.IAccountRepository, repository.IPaymentRepository)
+
+type conformanceTest struct {
+	name string
+	run  func(t *testing.T, accounts repository.IAccountRepository, payments repository.IPaymentRepository)
+}
+
+var conformanceTests = []conformanceTest{
+	{"AccountLookups", testAccountLookups},
+	{"CreateAndFindPayment", testCreateAndFindPayment},
+	{"CurrentStateJoins", testCurrentStateJoins},
+	{"ExpiryCutoff", testExpiryCutoff},
+	{"OutgoingTransactionIds", testOutgoingTransactionIds},
+	{"PayoutBatchPayments", testPayoutBatchPayments},
+	{"IdempotencyKey", testIdempotencyKey},
+	{"ConcurrentAccountClaims", testConcurrentAccountClaims},
+	{"OpenAccountUnique", testOpenAccountUnique},
+	{"QuarantinedPayments", testQuarantinedPayments},
+	{"DerivationIndexes", testDerivationIndexes},
+	{"FindAllFilter", testFindAllFilter},
+}
+
+func TestMain(m *testing.M) {
+	pool, err := dockertest.NewPool("")
+	if err == nil {
+		err = pool.Client.Ping()
+	}
+	if err != nil {
+		log.Printf("Could not connect to docker, only the memory repositories are tested: %s", err)
+		os.Exit(m.Run())
+	}
+
+	dbRessource, _, _, err := testutils.DbTestSetup(pool, "repository-test-db")
+	if err != nil {
+		log.Fatalf("Could not setup DB: %s", err)
+	}
+	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
+		utils.Opts.DbHost,
+		utils.Opts.DbUser,
+		utils.Opts.DbPassword,
+		utils.Opts.DbName,
+		utils.Opts.DbPort)
+	gormDB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		log.Fatalf("Could not connect to DB: %s", err)
+	}
+
+	code := m.Run()
+
+	// You can't defer this because os.Exit doesn't care for defer
+	if err = pool.Purge(dbRessource); err != nil {
+		log.Fatalf("Could not purge resource: %s", err)
+	}
+	os.Exit(code)
+}
+
+func memoryRepositories(*testing.T) (repository.IAccountRepository, repository.IPaymentRepository) {
+	store := repository.NewMemoryStore()
+	return repository.NewMemoryAccountRepository(store), repository.NewMemoryPaymentRepository(store)
+}
+
+func gormRepositories(t *testing.T) (repository.IAccountRepository, repository.IPaymentRepository) {
+	if gormDB == nil {
+		t.Skip("docker is not available")
+	}
+	err := gormDB.Exec("TRUNCATE payments, payment_states, accounts").Error
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return repository.NewAccountRepository(gormDB), repository.NewPaymentRepository(gormDB)
+}
+
+func TestMemoryRepositories(t *testing.T) {
+	runConformanceTests(t, memoryRepositories)
+}
+
+func TestGormRepositories(t *testing.T) {
+	runConformanceTests(t, gormRepositories)
+}
+
+func runConformanceTests(t *testing.T, factory repositoryFactory) {
+	for _, test := range conformanceTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			accounts, payments := factory(t)
+			test.run(t, accounts, payments)
+		})
+	}
+}
+
+func newAccount(network model.Network, used bool) *model.Account {
+	return &model.Account{
+		Address: "address-" + uuid.NewString(),
+		Used:    used,
+		Mode:    network.Mode(),
+		Network: network,
+	}
+}
+
+// createPayment stores a payment the same way the bitcoin service does
+func createPayment(t *testing.T, payments repository.IPaymentRepository, account *model.Account, wallet string, stateId enum.State, createdAt time.Time) *model.Payment {
+	state := model.PaymentState{
+		Base:           model.Base{ID: uuid.New(), CreatedAt: createdAt},
+		PayAmount:      model.NewBigIntFromInt(340300),
+		AmountReceived: model.NewBigIntFromInt(0),
+		StateID:        stateId,
+	}
+	payment := &model.Payment{
+		Base:                  model.Base{CreatedAt: createdAt},
+		Account:               account,
+		MerchantWallet:        wallet,
+		Mode:                  account.Network.Mode(),
+		Network:               account.Network,
+		PriceAmount:           100,
+		PriceCurrency:         enum.USD,
+		ExpiresAt:             createdAt.Add(15 * time.Minute),
+		CurrentPaymentState:   state,
+		CurrentPaymentStateId: &state.ID,
+		PaymentStates:         []model.PaymentState{state},
+	}
+	err := payments.Create(payment)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return payment
+}
+
+// transition appends a new current state the same way the bitcoin service does
+func transition(t *testing.T, payments repository.IPaymentRepository, payment *model.Payment, stateId enum.State) {
+	state := model.PaymentState{
+		// explicit timestamps keep the history order stable on fast stores
+		Base:           model.Base{ID: uuid.New(), CreatedAt: payment.CurrentPaymentState.CreatedAt.Add(time.Second)},
+		PayAmount:      payment.CurrentPaymentState.PayAmount,
+		AmountReceived: payment.CurrentPaymentState.PayAmount,
+		StateID:        stateId,
+		PaymentID:      payment.ID,
+	}
+	payment.PaymentStates = append(payment.PaymentStates, state)
+	payment.CurrentPaymentState = state
+	payment.CurrentPaymentStateId = &state.ID
+	err := payments.Update(payment)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func paymentIds(payments []model.Payment) map[uuid.UUID]bool {
+	ids := map[uuid.UUID]bool{}
+	for _, payment := range payments {
+		ids[payment.ID] = true
+	}
+	return ids
+}
+
+func assertPaymentIds(t *testing.T, name string, actual []model.Payment, expected ...*model.Payment) {
+	ids := paymentIds(actual)
+	if len(actual) != len(expected) {
+		t.Errorf("Expected %d %s payments, but got %d", len(expected), name, len(actual))
+	}
+	for _, payment := range expected {
+		if !ids[payment.ID] {
+			t.Errorf("Expected %s payments to contain %s", name, payment.ID)
+		}
+	}
+}
+
+func testAccountLookups(t *testing.T, accounts repository.IAccountRepository, _ repository.IPaymentRepository) {
+	// Arrange
+	used := newAccount(model.Regtest, true)
+	unused := newAccount(model.Regtest, false)
+	signet := newAccount(model.Signet, true)
+	for _, account := range []*model.Account{used, unused, signet} {
+		err := accounts.Create(account)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// Act
+	unusedRegtest, err := accounts.FindUnusedByNetwork(model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	unusedSignet, err := accounts.FindUnusedByNetwork(model.Signet)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	byAddress, err := accounts.FindByAddress(used.Address)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	unknown, err := accounts.FindByAddress("unknown")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	count, err := accounts.CountByAddresses([]string{used.Address, signet.Address, "unknown"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	unused.Used = true
+	err = accounts.Update(unused)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	unusedAfterUpdate, err := accounts.FindUnusedByNetwork(model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	all, err := accounts.FindAll()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Assert
+	if unusedRegtest == nil || unusedRegtest.ID != unused.ID {
+		t.Errorf("Expected unused account %s, but got %v", unused.ID, unusedRegtest)
+	}
+	if unusedSignet != nil {
+		t.Errorf("Expected no unused signet account, but got %s", unusedSignet.ID)
+	}
+	if byAddress.ID != used.ID || byAddress.Remainder == nil || byAddress.Remainder.Sign() != 0 {
+		t.Errorf("Expected account %s with remainder 0, but got %s with %v", used.ID, byAddress.ID, byAddress.Remainder)
+	}
+	if unknown == nil || unknown.ID != uuid.Nil {
+		t.Errorf("Expected an empty account for an unknown address, but got %v", unknown)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 known addresses, but got %d", count)
+	}
+	if unusedAfterUpdate != nil {
+		t.Errorf("Expected no unused account after the update, but got %s", unusedAfterUpdate.ID)
+	}
+	if len(all) != 3 {
+		t.Errorf("Expected 3 accounts, but got %d", len(all))
+	}
+}
+
+func testCreateAndFindPayment(t *testing.T, accounts repository.IAccountRepository, payments repository.IPaymentRepository) {
+	// Arrange
+	account := newAccount(model.Regtest, true)
+
+	// Act
+	payment := createPayment(t, payments, account, "wallet", enum.Waiting, time.Now())
+	found, err := payments.FindByID(payment.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	missing, err := payments.FindByID(uuid.New())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	withPayments, err := accounts.FindByAddress(account.Address)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Assert
+	if account.ID == uuid.Nil || payment.AccountID != account.ID {
+		t.Errorf("Expected the account to be created with the payment, but got account id %s", payment.AccountID)
+	}
+	if found == nil {
+		t.Fatalf("Expected payment %s", payment.ID)
+	}
+	if found.Account == nil || found.Account.Address != account.Address {
+		t.Errorf("Expected account %s to be joined, but got %v", account.Address, found.Account)
+	}
+	if found.CurrentPaymentState.StateID != enum.Waiting || found.CurrentPaymentState.PayAmount.Int64() != 340300 {
+		t.Errorf("Expected current state %s with pay amount 340300, but got %s with %v", enum.Waiting, found.CurrentPaymentState.StateID, found.CurrentPaymentState.PayAmount)
+	}
+	if len(found.PaymentStates) != 1 || found.PaymentStates[0].PaymentID != payment.ID {
+		t.Errorf("Expected 1 state of payment %s, but got %v", payment.ID, found.PaymentStates)
+	}
+	if found.Network != model.Regtest || found.Mode != enum.Test {
+		t.Errorf("Expected network %s in mode %s, but got %s in mode %s", model.Regtest, enum.Test, found.Network, found.Mode)
+	}
+	if missing != nil {
+		t.Errorf("Expected no payment for an unknown id, but got %s", missing.ID)
+	}
+	if len(withPayments.Payments) != 1 || withPayments.Payments[0].CurrentPaymentState.StateID != enum.Waiting {
+		t.Errorf("Expected the account to preload 1 waiting payment, but got %v", withPayments.Payments)
+	}
+}
+
+func testCurrentStateJoins(t *testing.T, _ repository.IAccountRepository, payments repository.IPaymentRepository) {
+	// Arrange
+	account := newAccount(model.Regtest, true)
+	payment := createPayment(t, payments, account, "wallet", enum.Waiting, time.Now())
+
+	// Act
+	waiting, err := payments.FindCurrentPaymentByAddress(account.Address)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	transition(t, payments, payment, enum.Paid)
+	paid, err := payments.FindPaidPaymentsByNetwork(model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	paidSignet, err := payments.FindPaidPaymentsByNetwork(model.Signet)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	currentAfterPaid, err := payments.FindCurrentPaymentByAddress(account.Address)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	transition(t, payments, payment, enum.Confirmed)
+	confirmed, err := payments.FindConfirmedPaymentsByNetwork(model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	paidAfterConfirmed, err := payments.FindPaidPaymentsByNetwork(model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	transition(t, payments, payment, enum.Forwarded)
+	forwarded, err := payments.FindForwardedPaymentsByNetwork(model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	nextPayment := createPayment(t, payments, account, "wallet", enum.Waiting, time.Now())
+	next, err := payments.FindCurrentPaymentByAddress(account.Address)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	history, err := payments.FindByID(payment.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Assert
+	if waiting == nil || waiting.ID != payment.ID || waiting.Account == nil {
+		t.Errorf("Expected waiting payment %s with its account, but got %v", payment.ID, waiting)
+	}
+	assertPaymentIds(t, "paid", paid, payment)
+	if len(paid) == 1 && (paid[0].Account == nil || paid[0].CurrentPaymentState.StateID != enum.Paid) {
+		t.Errorf("Expected paid payment with account and current state, but got %v", paid[0])
+	}
+	assertPaymentIds(t, "paid signet", paidSignet)
+	if currentAfterPaid != nil {
+		t.Errorf("Expected no current payment after it was paid, but got %s", currentAfterPaid.ID)
+	}
+	assertPaymentIds(t, "confirmed", confirmed, payment)
+	assertPaymentIds(t, "paid after confirmation", paidAfterConfirmed)
+	assertPaymentIds(t, "forwarded", forwarded, payment)
+	if next == nil || next.ID != nextPayment.ID {
+		t.Errorf("Expected the next payment %s on the reused account, but got %v", nextPayment.ID, next)
+	}
+	expectedHistory := []enum.State{enum.Waiting, enum.Paid, enum.Confirmed, enum.Forwarded}
+	if len(history.PaymentStates) != len(expectedHistory) {
+		t.Fatalf("Expected %d states, but got %d", len(expectedHistory), len(history.PaymentStates))
+	}
+	for i, state := range expectedHistory {
+		if history.PaymentStates[i].StateID != state {
+			t.Errorf("Expected state %d to be %s, but got %s", i, state, history.PaymentStates[i].StateID)
+		}
+	}
+}
+
+func testExpiryCutoff(t *testing.T, _ repository.IAccountRepository, payments repository.IPaymentRepository) {
+	// Arrange
+	old := time.Now().Add(-16 * time.Minute)
+	expiredWaiting := createPayment(t, payments, newAccount(model.Regtest, true), "wallet", enum.Waiting, old)
+	expiredPartially := createPayment(t, payments, newAccount(model.Regtest, true), "wallet", enum.PartiallyPaid, old)
+	createPayment(t, payments, newAccount(model.Regtest, true), "wallet", enum.Waiting, time.Now().Add(-14*time.Minute))
+	createPayment(t, payments, newAccount(model.Regtest, true), "wallet", enum.Paid, old)
+	createPayment(t, payments, newAccount(model.Signet, true), "wallet", enum.Waiting, old)
+	longWindow := createPayment(t, payments, newAccount(model.Regtest, true), "wallet", enum.Waiting, old)
+	longWindow.ExpiresAt = old.Add(time.Hour)
+	shortWindow := createPayment(t, payments, newAccount(model.Regtest, true), "wallet", enum.Waiting, time.Now().Add(-2*time.Minute))
+	shortWindow.ExpiresAt = time.Now().Add(-time.Minute)
+	for _, payment := range []*model.Payment{longWindow, shortWindow} {
+		err := payments.Update(payment)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// Act
+	expired, err := payments.FindExpiredPaymentsByNetwork(model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Assert
+	assertPaymentIds(t, "expired", expired, expiredWaiting, expiredPartially, shortWindow)
+}
+
+func testOutgoingTransactionIds(t *testing.T, _ repository.IAccountRepository, payments repository.IPaymentRepository) {
+	// Arrange
+	forwarded := createPayment(t, payments, newAccount(model.Regtest, true), "merchant", enum.Forwarded, time.Now())
+	hash := "forwarding-hash"
+	forwarded.ForwardingTransactionHash = &hash
+	err := payments.Update(forwarded)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	createPayment(t, payments, newAccount(model.Regtest, true), "merchant", enum.Confirmed, time.Now())
+	for _, other := range []*model.Payment{
+		createPayment(t, payments, newAccount(model.Regtest, true), "other-merchant", enum.Forwarded, time.Now()),
+		createPayment(t, payments, newAccount(model.Signet, true), "merchant", enum.Forwarded, time.Now()),
+	} {
+		otherHash := "other-hash-" + other.ID.String()
+		other.ForwardingTransactionHash = &otherHash
+		err = payments.Update(other)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// Act
+	txIds, err := payments.FindAllOutgoingTransactionIdsByMerchantWalletAndNetwork("merchant", model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Assert
+	if len(txIds) != 1 || txIds[0] != hash {
+		t.Errorf("Expected transaction ids [%s], but got %v", hash, txIds)
+	}
+}
+
+func testPayoutBatchPayments(t *testing.T, _ repository.IAccountRepository, payments repository.IPaymentRepository) {
+	// Arrange
+	batchId := uuid.New()
+	otherBatchId := uuid.New()
+	first := createPayment(t, payments, newAccount(model.Regtest, true), "merchant", enum.Confirmed, time.Now())
+	second := createPayment(t, payments, newAccount(model.Regtest, true), "other-merchant", enum.Confirmed, time.Now())
+	other := createPayment(t, payments, newAccount(model.Regtest, true), "merchant", enum.Confirmed, time.Now())
+	createPayment(t, payments, newAccount(model.Regtest, true), "merchant", enum.Confirmed, time.Now())
+	for _, payment := range []*model.Payment{first, second} {
+		payment.PayoutBatchID = &batchId
+		payment.ForwardingFee = model.NewBigIntFromInt(150)
+	}
+	other.PayoutBatchID = &otherBatchId
+	for _, payment := range []*model.Payment{first, second, other} {
+		err := payments.Update(payment)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// Act
+	batched, err := payments.FindByPayoutBatch(batchId)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Assert
+	assertPaymentIds(t, "batched", batched, first, second)
+	for _, payment := range batched {
+		if payment.Account == nil || payment.CurrentPaymentState.StateID != enum.Confirmed {
+			t.Errorf("Expected batched payment with account and current state, but got %v", payment.ID)
+		}
+		if payment.ForwardingFee.Int64() != 150 {
+			t.Errorf("Expected forwarding fee 150, but got %s", payment.ForwardingFee)
+		}
+	}
+}
+
+func testIdempotencyKey(t *testing.T, _ repository.IAccountRepository, payments repository.IPaymentRepository) {
+	// Arrange
+	key := "key-" + uuid.NewString()
+	payment := createPayment(t, payments, newAccount(model.Regtest, true), "merchant", enum.Waiting, time.Now())
+	payment.IdempotencyKey = &key
+	payment.RequestFingerprint = "fingerprint"
+	err := payments.Update(payment)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	other := createPayment(t, payments, newAccount(model.Regtest, true), "merchant", enum.Waiting, time.Now())
+	other.IdempotencyKey = &key
+
+	// Act
+	found, err := payments.FindByIdempotencyKey(key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	missing, err := payments.FindByIdempotencyKey("key-" + uuid.NewString())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	duplicateErr := payments.Update(other)
+
+	// Assert
+	if found == nil || found.ID != payment.ID || found.RequestFingerprint != "fingerprint" {
+		t.Fatalf("Expected payment %s for the idempotency key, but got %v", payment.ID, found)
+	}
+	if found.Account == nil || len(found.PaymentStates) != 1 {
+		t.Errorf("Expected the payment with account and states, but got %v", found)
+	}
+	if missing != nil {
+		t.Errorf("Expected no payment for an unknown idempotency key, but got %s", missing.ID)
+	}
+	if duplicateErr == nil {
+		t.Errorf("Expected the idempotency key of another payment to be rejected")
+	}
+}
+
+func testConcurrentAccountClaims(t *testing.T, accounts repository.IAccountRepository, _ repository.IPaymentRepository) {
+	// Arrange
+	unused := make(map[uuid.UUID]bool)
+	for i := 0; i < 5; i++ {
+		account := newAccount(model.Regtest, false)
+		err := accounts.Create(account)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		unused[account.ID] = true
+	}
+
+	// Act
+	var wg sync.WaitGroup
+	claimed := make([]*model.Account, 10)
+	errs := make([]error, len(claimed))
+	for i := range claimed {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			claimed[i], errs[i] = accounts.ClaimUnusedByNetwork(model.Regtest)
+		}(i)
+	}
+	wg.Wait()
+	remaining, err := accounts.FindUnusedByNetwork(model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Assert
+	seen := make(map[uuid.UUID]bool)
+	for i, account := range claimed {
+		if errs[i] != nil {
+			t.Fatalf("%v", errs[i])
+		}
+		if account == nil {
+			continue
+		}
+		if !unused[account.ID] || !account.Used {
+			t.Errorf("Expected a claimed unused account, but got %v", account)
+		}
+		if seen[account.ID] {
+			t.Errorf("Expected account %s to be claimed once", account.ID)
+		}
+		seen[account.ID] = true
+	}
+	if len(seen) != len(unused) {
+		t.Errorf("Expected %d claimed accounts, but got %d", len(unused), len(seen))
+	}
+	if remaining != nil {
+		t.Errorf("Expected no unused account after the claims, but got %s", remaining.ID)
+	}
+}
+
+func testOpenAccountUnique(t *testing.T, _ repository.IAccountRepository, payments repository.IPaymentRepository) {
+	// Arrange
+	account := newAccount(model.Regtest, true)
+	first := createPayment(t, payments, account, "merchant", enum.Waiting, time.Now())
+	first.OpenAccountID = &account.ID
+	err := payments.Update(first)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	second := createPayment(t, payments, account, "merchant", enum.Expired, time.Now())
+
+	// Act
+	second.OpenAccountID = &account.ID
+	whileOpenErr := payments.Update(second)
+	first.OpenAccountID = nil
+	err = payments.Update(first)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	afterReleaseErr := payments.Update(second)
+
+	// Assert
+	if whileOpenErr == nil {
+		t.Errorf("Expected a second open payment on account %s to be rejected", account.ID)
+	}
+	if afterReleaseErr != nil {
+		t.Errorf("Expected the account to be open for a payment after the release, but got %v", afterReleaseErr)
+	}
+}
+
+func testQuarantinedPayments(t *testing.T, _ repository.IAccountRepository, payments repository.IPaymentRepository) {
+	// Arrange
+	healthy := createPayment(t, payments, newAccount(model.Regtest, true), "merchant", enum.Confirmed, time.Now())
+	failing := createPayment(t, payments, newAccount(model.Regtest, true), "merchant", enum.Confirmed, time.Now())
+	quarantinedAt := time.Now()
+	failing.ProcessingFailures = 3
+	failing.LastProcessingError = "forwarding failed"
+	failing.QuarantinedAt = &quarantinedAt
+
+	// Act
+	err := payments.UpdateProcessingStatus(failing)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	confirmed, err := payments.FindConfirmedPaymentsByNetwork(model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	quarantined, err := payments.FindQuarantined()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Assert
+	if len(confirmed) != 1 || confirmed[0].ID != healthy.ID {
+		t.Errorf("Expected only payment %s to be processed, but got %d payments", healthy.ID, len(confirmed))
+	}
+	if len(quarantined) != 1 || quarantined[0].ID != failing.ID {
+		t.Fatalf("Expected payment %s to be quarantined, but got %d payments", failing.ID, len(quarantined))
+	}
+	if quarantined[0].ProcessingFailures != 3 || quarantined[0].LastProcessingError != "forwarding failed" {
+		t.Errorf("Expected the failures to be saved, but got %d %q", quarantined[0].ProcessingFailures, quarantined[0].LastProcessingError)
+	}
+	if len(quarantined[0].PaymentStates) != 1 {
+		t.Errorf("Expected the payment states to be loaded, but got %d", len(quarantined[0].PaymentStates))
+	}
+}
+
+func testDerivationIndexes(t *testing.T, accounts repository.IAccountRepository, payments repository.IPaymentRepository) {
+	// Arrange
+	derivedAccount := func(network model.Network, index int64) *model.Account {
+		account := newAccount(network, true)
+		account.DerivationIndex = &index
+		return account
+	}
+	funded := createPayment(t, payments, derivedAccount(model.Regtest, 0), "merchant", enum.Waiting, time.Now())
+	transition(t, payments, funded, enum.Paid)
+	createPayment(t, payments, derivedAccount(model.Regtest, 1), "merchant", enum.Expired, time.Now())
+	for _, account := range []*model.Account{derivedAccount(model.Regtest, 3), derivedAccount(model.Signet, 5), newAccount(model.Regtest, false)} {
+		err := accounts.Create(account)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// Act
+	last, err := accounts.FindLastDerivationIndex(model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lastFunded, err := accounts.FindLastFundedDerivationIndex(model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	noneDerived, err := accounts.FindLastDerivationIndex(model.Testnet)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	noneFunded, err := accounts.FindLastFundedDerivationIndex(model.Signet)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	duplicateErr := accounts.Create(derivedAccount(model.Regtest, 3))
+	otherNetworkErr := accounts.Create(derivedAccount(model.Signet, 3))
+
+	// Assert
+	if last == nil || *last != 3 {
+		t.Errorf("Expected last derivation index 3, but got %v", last)
+	}
+	if lastFunded == nil || *lastFunded != 0 {
+		t.Errorf("Expected last funded derivation index 0, but got %v", lastFunded)
+	}
+	if noneDerived != nil || noneFunded != nil {
+		t.Errorf("Expected no derivation index, but got %v and %v", noneDerived, noneFunded)
+	}
+	if !errors.Is(duplicateErr, repository.ErrDerivationIndexTaken) {
+		t.Errorf("Expected a derivation index to be unique per network, but got %v", duplicateErr)
+	}
+	if otherNetworkErr != nil {
+		t.Errorf("Expected the derivation index to be free on another network, but got %v", otherNetworkErr)
+	}
+}
+
+func testFindAllFilter(t *testing.T, _ repository.IAccountRepository, payments repository.IPaymentRepository) {
+	// Arrange
+	now := time.Now()
+	oldest := createPayment(t, payments, newAccount(model.Regtest, true), "merchant", enum.Finished, now.Add(-3*time.Hour))
+	middle := createPayment(t, payments, newAccount(model.Regtest, true), "merchant", enum.Waiting, now.Add(-2*time.Hour))
+	newest := createPayment(t, payments, newAccount(model.Mainnet, true), "other-merchant", enum.Waiting, now.Add(-time.Hour))
+	regtest := model.Regtest
+	waiting := enum.Waiting
+	mainMode := enum.Main
+	from := now.Add(-150 * time.Minute)
+	to := now.Add(-time.Hour)
+
+	// Act
+	byNetwork, networkTotal, err := payments.FindAll(repository.PaymentFilter{Network: &regtest})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	byState, stateTotal, err := payments.FindAll(repository.PaymentFilter{State: &waiting, Limit: 10})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	byMode, _, err := payments.FindAll(repository.PaymentFilter{Mode: &mainMode})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	byWallet, _, err := payments.FindAll(repository.PaymentFilter{MerchantWallet: "merchant"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	byCreated, _, err := payments.FindAll(repository.PaymentFilter{CreatedFrom: &from, CreatedTo: &to})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	page, pageTotal, err := payments.FindAll(repository.PaymentFilter{Offset: 1, Limit: 1})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Assert
+	assertPaymentIds(t, "regtest", byNetwork, oldest, middle)
+	if networkTotal != 2 {
+		t.Errorf("Expected 2 regtest payments in total, but got %d", networkTotal)
+	}
+	assertPaymentIds(t, "waiting", byState, middle, newest)
+	if stateTotal != 2 || len(byState) == 2 && byState[0].ID != newest.ID {
+		t.Errorf("Expected 2 waiting payments starting with the newest, but got %d", stateTotal)
+	}
+	assertPaymentIds(t, "main", byMode, newest)
+	assertPaymentIds(t, "merchant", byWallet, oldest, middle)
+	assertPaymentIds(t, "created between", byCreated, middle)
+	assertPaymentIds(t, "page", page, middle)
+	if pageTotal != 3 {
+		t.Errorf("Expected 3 payments in total, but got %d", pageTotal)
+	}
+	if len(page) == 1 && (page[0].Account == nil || len(page[0].PaymentStates) != 1) {
+		t.Errorf("Expected the page to load account and states, but got %v", page[0])
+	}
+}
+
+func TestGormMissingExpiry(t *testing.T) {
+	// Arrange
+	_, payments := gormRepositories(t)
+	expired := createPayment(t, payments, newAccount(model.Regtest, true), "wallet", enum.Waiting, time.Now().Add(-time.Duration(utils.Opts.PaymentExpiry+1)*time.Minute))
+	open := createPayment(t, payments, newAccount(model.Regtest, true), "wallet", enum.Waiting, time.Now())
+	err := gormDB.Exec("UPDATE payments SET expires_at = NULL").Error
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Act
+	expiredBeforeMigration, err := payments.FindExpiredPaymentsByNetwork(model.Regtest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, _, err = repository.SetupDatabase()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	migrated, err := payments.FindByID(open.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Assert
+	assertPaymentIds(t, "expired", expiredBeforeMigration, expired)
+	expiresAt := migrated.CreatedAt.Add(time.Duration(utils.Opts.PaymentExpiry) * time.Minute)
+	if !migrated.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Expected the migration to set the expiry to %s, but got %s", expiresAt, migrated.ExpiresAt)
+	}
+}
+
+func TestGormLegacyNetwork(t *testing.T) {
+	// Arrange
+	accounts, payments := gormRepositories(t)
+	account := newAccount(model.Mainnet, true)
+	payment := createPayment(t, payments, account, "wallet", enum.Waiting, time.Now())
+	err := gormDB.Exec("UPDATE payments SET network = NULL WHERE id = ?", payment.ID).Error
+	if err == nil {
+		err = gormDB.Exec("UPDATE accounts SET network = NULL WHERE id = ?", account.ID).Error
+	}
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func(network string) { utils.Opts.LegacyMainNetwork = network }(utils.Opts.LegacyMainNetwork)
+	utils.Opts.LegacyMainNetwork = model.Regtest.String()
+
+	// Act
+	_, _, err = repository.SetupDatabase()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	migratedPayment, err := payments.FindByID(payment.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	migratedAccount, err := accounts.FindByAddress(account.Address)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Assert
+	if migratedPayment.Network != model.Regtest || migratedAccount.Network != model.Regtest {
+		t.Errorf("Expected the main rows to be migrated to regtest, but got %s and %s", migratedPayment.Network, migratedAccount.Network)
+	}
+}
+
+func TestGormMissingOpenAccount(t *testing.T) {
+	// Arrange
+	_, payments := gormRepositories(t)
+	shared := newAccount(model.Regtest, true)
+	older := createPayment(t, payments, shared, "wallet", enum.Waiting, time.Now().Add(-time.Minute))
+	newer := createPayment(t, payments, shared, "wallet", enum.PartiallyPaid, time.Now())
+	expired := createPayment(t, payments, newAccount(model.Regtest, false), "wallet", enum.Expired, time.Now())
+	err := gormDB.Exec("UPDATE payments SET open_account_id = NULL").Error
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Act
+	_, _, err = repository.SetupDatabase()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	migratedOlder, err := payments.FindByID(older.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	migratedNewer, err := payments.FindByID(newer.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	migratedExpired, err := payments.FindByID(expired.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Assert
+	if migratedNewer.OpenAccountID == nil || *migratedNewer.OpenAccountID != shared.ID {
+		t.Errorf("Expected the latest open payment to hold account %s, but got %v", shared.ID, migratedNewer.OpenAccountID)
+	}
+	if migratedOlder.OpenAccountID != nil || migratedExpired.OpenAccountID != nil {
+		t.Errorf("Expected only one open payment to hold an account, but got %v and %v", migratedOlder.OpenAccountID, migratedExpired.OpenAccountID)
+	}
+}
@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"gorm.io/gorm"
+)
+
+// Repositories groups the repositories which share one database connection or transaction
+type Repositories struct {
+	Account               IAccountRepository
+	Payment               IPaymentRepository
+	Outbox                IOutboxRepository
+	ChainCursor           IChainCursorRepository
+	LatePayment           ILatePaymentRepository
+	Refund                IRefundRepository
+	MerchantSettings      IMerchantSettingsRepository
+	IncomingTransaction   IIncomingTransactionRepository
+	ForwardingTransaction IForwardingTransactionRepository
+	PayoutBatch           IPayoutBatchRepository
+	MerchantLedger        IMerchantLedgerRepository
+	AdvisoryLock          IAdvisoryLockRepository
+}
+
+type unitOfWork struct {
+	DB *gorm.DB
+}
+
+type IUnitOfWork interface {
+	// WithTx runs fn in a database transaction. The transaction is rolled back if fn returns an error.
+	WithTx(fn func(repos *Repositories) error) error
+}
+
+func NewUnitOfWork(db *gorm.DB) IUnitOfWork {
+	return &unitOfWork{db}
+}
+
+func (u *unitOfWork) WithTx(fn func(repos *Repositories) error) error {
+	return u.DB.Transaction(func(tx *gorm.DB) error {
+		return fn(createRepositories(tx))
+	})
+}
@@ -0,0 +1,112 @@
+/*
+ * OpenAPI bitcoin service
+ *
+ * This is the OpenAPI definition of the bitcoin service.
+ *
+ * API version: 1.0.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+
+	"github.com/CHainGate/bitcoin-service/openApi"
+)
+
+// LatePaymentApiService is a service that implements the logic for the LatePaymentApiServicer
+// This service should implement the business logic for every endpoint for the LatePaymentApi API.
+// Include any external packages or services that will be required by this service.
+type LatePaymentApiService struct {
+	bitcoinService IBitcoinService
+}
+
+// NewLatePaymentApiService creates a default api service
+func NewLatePaymentApiService(bitcoinService IBitcoinService) openApi.LatePaymentApiServicer {
+	return &LatePaymentApiService{bitcoinService}
+}
+
+// GetLatePayments - list funds which arrived after their payment expired
+func (s *LatePaymentApiService) GetLatePayments(_ context.Context, status string) (openApi.ImplResponse, error) {
+	latePaymentStatus := model.LatePaymentPending
+	if status != "" {
+		st, ok := model.ParseStringToLatePaymentStatusEnum(status)
+		if !ok {
+			return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong status: %s", status))
+		}
+		latePaymentStatus = st
+	}
+
+	latePayments, err := s.bitcoinService.GetLatePayments(latePaymentStatus)
+	if err != nil {
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+
+	result := []openApi.LatePaymentDto{}
+	for _, latePayment := range latePayments {
+		result = append(result, toLatePaymentDto(latePayment))
+	}
+
+	return openApi.Response(http.StatusOK, result), nil
+}
+
+// HonorLatePayment - forward a late payment to the merchant
+func (s *LatePaymentApiService) HonorLatePayment(_ context.Context, latePaymentId string) (openApi.ImplResponse, error) {
+	id, err := uuid.Parse(latePaymentId)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong late payment id: %s", latePaymentId))
+	}
+
+	latePayment, err := s.bitcoinService.HonorLatePayment(id)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), err
+	}
+	if latePayment == nil {
+		return openApi.Response(http.StatusNotFound, nil), errors.New(fmt.Sprintf("Late payment not found: %s", latePaymentId))
+	}
+
+	return openApi.Response(http.StatusOK, toLatePaymentDto(*latePayment)), nil
+}
+
+// RefundLatePayment - send a late payment back to the buyer
+func (s *LatePaymentApiService) RefundLatePayment(_ context.Context, latePaymentId string, latePaymentRefundDto openApi.LatePaymentRefundDto) (openApi.ImplResponse, error) {
+	id, err := uuid.Parse(latePaymentId)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong late payment id: %s", latePaymentId))
+	}
+
+	latePayment, err := s.bitcoinService.RefundLatePayment(id, latePaymentRefundDto.RefundAddress)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), err
+	}
+	if latePayment == nil {
+		return openApi.Response(http.StatusNotFound, nil), errors.New(fmt.Sprintf("Late payment not found: %s", latePaymentId))
+	}
+
+	return openApi.Response(http.StatusOK, toLatePaymentDto(*latePayment)), nil
+}
+
+func toLatePaymentDto(latePayment model.LatePayment) openApi.LatePaymentDto {
+	result := openApi.LatePaymentDto{
+		LatePaymentId: latePayment.ID.String(),
+		PaymentId:     latePayment.PaymentID.String(),
+		Address:       latePayment.Address,
+		TxHash:        latePayment.TxHash,
+		Network:       latePayment.Network.String(),
+		Amount:        latePayment.Amount.String(),
+		Status:        latePayment.Status.String(),
+		RefundAddress: latePayment.RefundAddress,
+		CreatedAt:     latePayment.CreatedAt,
+	}
+	if latePayment.ResolvingTransactionHash != nil {
+		result.ResolvingTxHash = *latePayment.ResolvingTransactionHash
+	}
+	return result
+}
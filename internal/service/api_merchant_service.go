@@ -0,0 +1,149 @@
+/*
+ * OpenAPI bitcoin service
+ *
+ * This is the OpenAPI definition of the bitcoin service.
+ *
+ * API version: 1.0.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+
+	"github.com/CHainGate/bitcoin-service/openApi"
+)
+
+// MerchantApiService is a service that implements the logic for the MerchantApiServicer
+// This service should implement the business logic for every endpoint for the MerchantApi API.
+// Include any external packages or services that will be required by this service.
+type MerchantApiService struct {
+	bitcoinService IBitcoinService
+}
+
+// NewMerchantApiService creates a default api service
+func NewMerchantApiService(bitcoinService IBitcoinService) openApi.MerchantApiServicer {
+	return &MerchantApiService{bitcoinService}
+}
+
+// GetMerchantSettings - get the settings of a merchant wallet
+func (s *MerchantApiService) GetMerchantSettings(_ context.Context, wallet string) (openApi.ImplResponse, error) {
+	wallet, err := normalizeWallet(wallet)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), err
+	}
+
+	settings, err := s.bitcoinService.GetMerchantSettings(wallet)
+	if err != nil {
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+
+	return openApi.Response(http.StatusOK, toMerchantSettingsDto(*settings)), nil
+}
+
+// UpdateMerchantSettings - update the settings of a merchant wallet
+func (s *MerchantApiService) UpdateMerchantSettings(_ context.Context, wallet string, merchantSettingsDto openApi.MerchantSettingsDto) (openApi.ImplResponse, error) {
+	// payments store the normalized wallet, the payouts look the settings up with it
+	wallet, err := normalizeWallet(wallet)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), err
+	}
+
+	policy, ok := model.ParseStringToOverpaymentPolicyEnum(merchantSettingsDto.OverpaymentPolicy)
+	if !ok {
+		return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong overpayment policy: %s", merchantSettingsDto.OverpaymentPolicy))
+	}
+
+	schedule := model.PayoutImmediate
+	if merchantSettingsDto.PayoutSchedule != "" {
+		schedule, ok = model.ParseStringToPayoutScheduleEnum(merchantSettingsDto.PayoutSchedule)
+		if !ok {
+			return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong payout schedule: %s", merchantSettingsDto.PayoutSchedule))
+		}
+	}
+
+	minimumPayout := big.NewInt(0)
+	if merchantSettingsDto.MinimumPayout != "" {
+		minimumPayout, ok = new(big.Int).SetString(merchantSettingsDto.MinimumPayout, 10)
+		if !ok || minimumPayout.Sign() < 0 {
+			return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong minimum payout: %s", merchantSettingsDto.MinimumPayout))
+		}
+	}
+	if schedule == model.PayoutThreshold && minimumPayout.Sign() == 0 {
+		return openApi.Response(http.StatusBadRequest, nil), errors.New("the threshold payout schedule needs a minimum payout")
+	}
+
+	settings, err := s.bitcoinService.SaveMerchantSettings(model.MerchantSettings{
+		Wallet:            wallet,
+		OverpaymentPolicy: policy,
+		PayoutSchedule:    schedule,
+		MinimumPayout:     model.NewBigInt(minimumPayout),
+	})
+	if err != nil {
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+
+	return openApi.Response(http.StatusOK, toMerchantSettingsDto(*settings)), nil
+}
+
+// GetMerchantLedger - get the balance and ledger entries of a merchant wallet
+func (s *MerchantApiService) GetMerchantLedger(_ context.Context, wallet string, network string) (openApi.ImplResponse, error) {
+	n, ok := model.ParseStringToNetworkEnum(network)
+	if !ok {
+		return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong network: %s", network))
+	}
+	address, err := decodeWallet(wallet, getChainParams(n))
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), err
+	}
+	wallet = address.EncodeAddress()
+
+	entries, balance, err := s.bitcoinService.GetMerchantLedger(wallet, n)
+	if err != nil {
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+
+	result := openApi.MerchantLedgerDto{
+		Wallet:  wallet,
+		Network: n.String(),
+		Balance: balance.String(),
+		Entries: []openApi.MerchantLedgerEntryDto{},
+	}
+	for _, entry := range entries {
+		result.Entries = append(result.Entries, toMerchantLedgerEntryDto(entry))
+	}
+	return openApi.Response(http.StatusOK, result), nil
+}
+
+func toMerchantSettingsDto(settings model.MerchantSettings) openApi.MerchantSettingsDto {
+	result := openApi.MerchantSettingsDto{
+		Wallet:            settings.Wallet,
+		OverpaymentPolicy: settings.OverpaymentPolicy.String(),
+		PayoutSchedule:    settings.PayoutSchedule.String(),
+		MinimumPayout:     "0",
+	}
+	if settings.MinimumPayout != nil {
+		result.MinimumPayout = settings.MinimumPayout.String()
+	}
+	return result
+}
+
+func toMerchantLedgerEntryDto(entry model.MerchantLedgerEntry) openApi.MerchantLedgerEntryDto {
+	result := openApi.MerchantLedgerEntryDto{
+		PaymentId: entry.PaymentID.String(),
+		Kind:      entry.Kind.String(),
+		Amount:    entry.Amount.String(),
+		CreatedAt: entry.CreatedAt,
+	}
+	if entry.TxHash != nil {
+		result.TxHash = *entry.TxHash
+	}
+	return result
+}
@@ -32,23 +32,31 @@ func NewNotificationApiService(bitcoinService IBitcoinService) openApi.Notificat
 }
 
 // BlockNotify - New block notification from bitcoin node
-func (s *NotificationApiService) BlockNotify(_ context.Context, blockHash string, mode string) (openApi.ImplResponse, error) {
+func (s *NotificationApiService) BlockNotify(_ context.Context, blockHash string, mode string, network string) (openApi.ImplResponse, error) {
 	m, ok := enum.ParseStringToModeEnum(mode)
 	if !ok {
 		return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong mode: %s", mode))
 	}
-	s.bitcoinService.HandleBlockNotify(blockHash, m)
+	n, err := s.bitcoinService.ResolveNetwork(m, network)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), err
+	}
+	s.bitcoinService.HandleBlockNotify(blockHash, n)
 
 	return openApi.Response(http.StatusOK, nil), nil
 }
 
 // WalletNotify - New wallet notification from Bitcoin Node
-func (s *NotificationApiService) WalletNotify(_ context.Context, txId string, mode string) (openApi.ImplResponse, error) {
+func (s *NotificationApiService) WalletNotify(_ context.Context, txId string, mode string, network string) (openApi.ImplResponse, error) {
 	m, ok := enum.ParseStringToModeEnum(mode)
 	if !ok {
 		return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong mode: %s", mode))
 	}
-	s.bitcoinService.HandleWalletNotify(txId, m)
+	n, err := s.bitcoinService.ResolveNetwork(m, network)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), err
+	}
+	s.bitcoinService.HandleWalletNotify(txId, n)
 
 	return openApi.Response(http.StatusOK, nil), nil
 }
@@ -0,0 +1,107 @@
+/*
+ * OpenAPI bitcoin service
+ *
+ * This is the OpenAPI definition of the bitcoin service.
+ *
+ * API version: 1.0.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/google/uuid"
+
+	"github.com/CHainGate/bitcoin-service/openApi"
+)
+
+// OutboxApiService is a service that implements the logic for the OutboxApiServicer
+// This service should implement the business logic for every endpoint for the OutboxApi API.
+// Include any external packages or services that will be required by this service.
+type OutboxApiService struct {
+	outboxDispatcher IOutboxDispatcher
+}
+
+// NewOutboxApiService creates a default api service
+func NewOutboxApiService(outboxDispatcher IOutboxDispatcher) openApi.OutboxApiServicer {
+	return &OutboxApiService{outboxDispatcher}
+}
+
+// GetOutboxNotifications - list backend notifications by status
+func (s *OutboxApiService) GetOutboxNotifications(_ context.Context, status string) (openApi.ImplResponse, error) {
+	notificationStatus := model.NotificationDead
+	if status != "" {
+		st, ok := model.ParseStringToNotificationStatusEnum(status)
+		if !ok {
+			return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong status: %s", status))
+		}
+		notificationStatus = st
+	}
+
+	notifications, err := s.outboxDispatcher.GetNotifications(notificationStatus)
+	if err != nil {
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+
+	result := []openApi.OutboxNotificationDto{}
+	for _, notification := range notifications {
+		result = append(result, toOutboxNotificationDto(notification))
+	}
+
+	return openApi.Response(http.StatusOK, result), nil
+}
+
+// RetryOutboxNotification - requeue a dead notification
+func (s *OutboxApiService) RetryOutboxNotification(_ context.Context, notificationId string) (openApi.ImplResponse, error) {
+	id, err := uuid.Parse(notificationId)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong notification id: %s", notificationId))
+	}
+
+	notification, err := s.outboxDispatcher.Requeue(id)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), err
+	}
+	if notification == nil {
+		return openApi.Response(http.StatusNotFound, nil), errors.New(fmt.Sprintf("Notification not found: %s", notificationId))
+	}
+
+	return openApi.Response(http.StatusOK, toOutboxNotificationDto(*notification)), nil
+}
+
+func toOutboxNotificationDto(notification model.OutboxNotification) openApi.OutboxNotificationDto {
+	result := openApi.OutboxNotificationDto{
+		NotificationId: notification.ID.String(),
+		PaymentId:      notification.PaymentID.String(),
+		PaymentState:   notification.PaymentState,
+		PayAmount:      notification.PayAmount,
+		ActuallyPaid:   notification.ActuallyPaid,
+		RiskLevel:      notification.RiskLevel,
+		Event:          notification.Event,
+		Surplus:        notification.Surplus,
+		LateAmount:     notification.LateAmount,
+		RefundStatus:   notification.RefundStatus,
+		RefundAmount:   notification.RefundAmount,
+		Status:         notification.Status.String(),
+		Attempts:       int32(notification.Attempts),
+		NextAttemptAt:  notification.NextAttemptAt,
+		LastError:      notification.LastError,
+		CreatedAt:      notification.CreatedAt,
+	}
+	if notification.TxHash != nil {
+		result.TxHash = *notification.TxHash
+	}
+	if notification.RefundID != nil {
+		result.RefundId = notification.RefundID.String()
+	}
+	if notification.RefundTxHash != nil {
+		result.RefundTxHash = *notification.RefundTxHash
+	}
+	return result
+}
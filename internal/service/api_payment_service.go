@@ -11,13 +11,25 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/big"
 	"net/http"
+	"time"
 
 	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/google/uuid"
 
 	"github.com/CHainGate/bitcoin-service/openApi"
 )
 
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
 // PaymentApiService is a service that implements the logic for the PaymentApiServicer
 // This service should implement the business logic for every endpoint for the PaymentApi API.
 // Include any external packages or services that will be required by this service.
@@ -33,6 +45,12 @@ func NewPaymentApiService(bitcoinService IBitcoinService) openApi.PaymentApiServ
 // CreatePayment - create new payment
 func (s *PaymentApiService) CreatePayment(_ context.Context, paymentRequestDto openApi.PaymentRequestDto) (openApi.ImplResponse, error) {
 	payment, err := s.bitcoinService.CreateNewPayment(paymentRequestDto)
+	if errors.Is(err, ErrIdempotencyConflict) {
+		return openApi.Response(http.StatusConflict, nil), err
+	}
+	if errors.Is(err, ErrGapLimitReached) {
+		return openApi.Response(http.StatusServiceUnavailable, nil), err
+	}
 	if err != nil {
 		return openApi.Response(http.StatusBadRequest, nil), err
 	}
@@ -45,7 +63,262 @@ func (s *PaymentApiService) CreatePayment(_ context.Context, paymentRequestDto o
 		PayAmount:     payment.PaymentStates[0].PayAmount.String(),
 		PayCurrency:   enum.BTC.String(),
 		PaymentState:  payment.PaymentStates[0].StateID.String(),
+		Network:       payment.Network.String(),
+		ExpiresAt:     payment.ExpiresAt,
 	}
 
 	return openApi.Response(http.StatusCreated, result), nil
 }
+
+// GetPayment - get payment by id
+func (s *PaymentApiService) GetPayment(_ context.Context, paymentId string) (openApi.ImplResponse, error) {
+	id, err := uuid.Parse(paymentId)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong payment id: %s", paymentId))
+	}
+
+	payment, err := s.bitcoinService.GetPayment(id)
+	if err != nil {
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+	if payment == nil {
+		return openApi.Response(http.StatusNotFound, nil), errors.New(fmt.Sprintf("Payment not found: %s", paymentId))
+	}
+
+	return openApi.Response(http.StatusOK, toPaymentDto(*payment)), nil
+}
+
+// GetPayments - list payments
+func (s *PaymentApiService) GetPayments(_ context.Context, mode string, network string, state string, wallet string, createdFrom string, createdTo string, page int32, pageSize int32) (openApi.ImplResponse, error) {
+	filter := repository.PaymentFilter{}
+
+	if mode != "" {
+		m, ok := enum.ParseStringToModeEnum(mode)
+		if !ok {
+			return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong mode: %s", mode))
+		}
+		filter.Mode = &m
+	}
+
+	if network != "" {
+		n, ok := model.ParseStringToNetworkEnum(network)
+		if !ok {
+			return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong network: %s", network))
+		}
+		filter.Network = &n
+	}
+
+	// payments store the normalized wallet, e.g. lower case for bech32
+	if wallet != "" {
+		normalized, err := normalizeWallet(wallet)
+		if err != nil {
+			return openApi.Response(http.StatusBadRequest, nil), err
+		}
+		filter.MerchantWallet = normalized
+	}
+
+	if state != "" {
+		st, ok := enum.ParseStringToStateEnum(state)
+		if !ok {
+			return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong state: %s", state))
+		}
+		filter.State = &st
+	}
+
+	if createdFrom != "" {
+		from, err := time.Parse(time.RFC3339, createdFrom)
+		if err != nil {
+			return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong created_from: %s", createdFrom))
+		}
+		filter.CreatedFrom = &from
+	}
+
+	if createdTo != "" {
+		to, err := time.Parse(time.RFC3339, createdTo)
+		if err != nil {
+			return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong created_to: %s", createdTo))
+		}
+		filter.CreatedTo = &to
+	}
+
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	// multiplied in int, a large page overflows int32
+	filter.Offset = (int(page) - 1) * int(pageSize)
+	filter.Limit = int(pageSize)
+
+	payments, total, err := s.bitcoinService.GetPayments(filter)
+	if err != nil {
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+
+	result := openApi.PaymentListDto{
+		Payments: []openApi.PaymentDto{},
+		Page:     page,
+		PageSize: pageSize,
+		Total:    total,
+	}
+	for _, payment := range payments {
+		result.Payments = append(result.Payments, toPaymentDto(payment))
+	}
+
+	return openApi.Response(http.StatusOK, result), nil
+}
+
+// RefundPayment - send funds received for a payment back to the buyer
+func (s *PaymentApiService) RefundPayment(_ context.Context, paymentId string, refundRequestDto openApi.RefundRequestDto) (openApi.ImplResponse, error) {
+	id, err := uuid.Parse(paymentId)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong payment id: %s", paymentId))
+	}
+
+	amount, ok := new(big.Int).SetString(refundRequestDto.Amount, 10)
+	if !ok {
+		return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong amount: %s", refundRequestDto.Amount))
+	}
+
+	refund, err := s.bitcoinService.RefundPayment(id, refundRequestDto.RefundAddress, amount)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), err
+	}
+	if refund == nil {
+		return openApi.Response(http.StatusNotFound, nil), errors.New(fmt.Sprintf("Payment not found: %s", paymentId))
+	}
+
+	return openApi.Response(http.StatusCreated, toRefundDto(*refund)), nil
+}
+
+// GetQuarantinedPayments - list quarantined payments
+func (s *PaymentApiService) GetQuarantinedPayments(_ context.Context) (openApi.ImplResponse, error) {
+	payments, err := s.bitcoinService.GetQuarantinedPayments()
+	if err != nil {
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+
+	result := []openApi.PaymentDto{}
+	for _, payment := range payments {
+		result = append(result, toPaymentDto(payment))
+	}
+
+	return openApi.Response(http.StatusOK, result), nil
+}
+
+// RetryQuarantinedPayment - retry a quarantined payment
+func (s *PaymentApiService) RetryQuarantinedPayment(_ context.Context, paymentId string) (openApi.ImplResponse, error) {
+	id, err := uuid.Parse(paymentId)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), errors.New(fmt.Sprintf("Wrong payment id: %s", paymentId))
+	}
+
+	payment, err := s.bitcoinService.RetryQuarantinedPayment(id)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), err
+	}
+	if payment == nil {
+		return openApi.Response(http.StatusNotFound, nil), errors.New(fmt.Sprintf("Payment not found: %s", paymentId))
+	}
+
+	return openApi.Response(http.StatusOK, toPaymentDto(*payment)), nil
+}
+
+func toPaymentDto(payment model.Payment) openApi.PaymentDto {
+	result := openApi.PaymentDto{
+		PaymentId:           payment.ID.String(),
+		Mode:                payment.Mode.String(),
+		Network:             payment.Network.String(),
+		MerchantWallet:      payment.MerchantWallet,
+		PriceAmount:         payment.PriceAmount,
+		PriceCurrency:       payment.PriceCurrency.String(),
+		PayAddress:          payment.Account.Address,
+		PayAmount:           payment.CurrentPaymentState.PayAmount.String(),
+		AmountReceived:      payment.CurrentPaymentState.AmountReceived.String(),
+		PayCurrency:         enum.BTC.String(),
+		PaymentState:        payment.CurrentPaymentState.StateID.String(),
+		PaymentStates:       []openApi.PaymentStateDto{},
+		OverpaymentPolicy:   payment.OverpaymentPolicy.String(),
+		RefundAddress:       payment.RefundAddress,
+		RiskLevel:           payment.Risk.String(),
+		ProcessingFailures:  int32(payment.ProcessingFailures),
+		LastProcessingError: payment.LastProcessingError,
+		CreatedAt:           payment.CreatedAt,
+	}
+
+	if payment.UnderpaymentTolerance != nil {
+		result.UnderpaymentTolerance = payment.UnderpaymentTolerance.String()
+	}
+	if payment.Shortfall != nil {
+		result.Shortfall = payment.Shortfall.String()
+	}
+
+	if payment.ReceivedConfirmations != nil {
+		result.ReceivedConfirmations = *payment.ReceivedConfirmations
+	}
+	if payment.ForwardingTransactionHash != nil {
+		result.ForwardingTransactionHash = *payment.ForwardingTransactionHash
+	}
+	if payment.ForwardingConfirmations != nil {
+		result.ForwardingConfirmations = *payment.ForwardingConfirmations
+	}
+	if payment.PayoutBatchID != nil {
+		result.PayoutBatchId = payment.PayoutBatchID.String()
+	}
+	if payment.ForwardingFee != nil {
+		result.ForwardingFee = payment.ForwardingFee.String()
+	}
+	if payment.QuarantinedAt != nil {
+		result.QuarantinedAt = *payment.QuarantinedAt
+	}
+
+	for _, state := range payment.PaymentStates {
+		stateDto := openApi.PaymentStateDto{
+			PaymentState:   state.StateID.String(),
+			PayAmount:      state.PayAmount.String(),
+			AmountReceived: state.AmountReceived.String(),
+			Overpaid:       state.Overpaid,
+			CreatedAt:      state.CreatedAt,
+		}
+		if state.Surplus != nil {
+			stateDto.Surplus = state.Surplus.String()
+		}
+		result.PaymentStates = append(result.PaymentStates, stateDto)
+	}
+
+	return result
+}
+
+func toRefundDto(refund model.Refund) openApi.RefundDto {
+	result := openApi.RefundDto{
+		RefundId:      refund.ID.String(),
+		PaymentId:     refund.PaymentID.String(),
+		Address:       refund.Address,
+		RefundAddress: refund.RefundAddress,
+		Network:       refund.Network.String(),
+		Amount:        refund.Amount.String(),
+		Status:        refund.CurrentRefundState.Status.String(),
+		RefundStates:  []openApi.RefundStateDto{},
+		CreatedAt:     refund.CreatedAt,
+	}
+
+	if refund.TransactionHash != nil {
+		result.TxHash = *refund.TransactionHash
+	}
+	if refund.Confirmations != nil {
+		result.Confirmations = *refund.Confirmations
+	}
+
+	for _, state := range refund.RefundStates {
+		result.RefundStates = append(result.RefundStates, openApi.RefundStateDto{
+			Status:    state.Status.String(),
+			CreatedAt: state.CreatedAt,
+		})
+	}
+
+	return result
+}
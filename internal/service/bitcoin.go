@@ -2,55 +2,147 @@ package service
 
 import (
 	"errors"
-	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"fmt"
 	"github.com/google/uuid"
 	"log"
 	"math/big"
+	"time"
 
 	"github.com/CHainGate/backend/pkg/enum"
 	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/node"
 	"github.com/CHainGate/bitcoin-service/internal/repository"
 	"github.com/CHainGate/bitcoin-service/openApi"
-	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 )
 
+const (
+	walletSyncRetries = 5
+	walletSyncDelay   = 200 * time.Millisecond
+
+	// derivationAttempts limits the retries of a payment whose derivation index was taken concurrently
+	derivationAttempts = 3
+)
+
 type IBitcoinService interface {
 	CreateNewPayment(paymentRequest openApi.PaymentRequestDto) (*model.Payment, error)
-	HandleWalletNotify(txId string, mode enum.Mode)
-	HandleBlockNotify(blockHash string, mode enum.Mode)
+	GetPayment(paymentId uuid.UUID) (*model.Payment, error)
+	GetPayments(filter repository.PaymentFilter) ([]model.Payment, int64, error)
+	HandleWalletNotify(txId string, network model.Network)
+	HandleBlockNotify(blockHash string, network model.Network)
+	HandleRawTransaction(transaction *wire.MsgTx, network model.Network)
+	Resync(network model.Network)
+	ResolveNetwork(mode enum.Mode, network string) (model.Network, error)
+	GetLatePayments(status model.LatePaymentStatus) ([]model.LatePayment, error)
+	HonorLatePayment(latePaymentId uuid.UUID) (*model.LatePayment, error)
+	RefundLatePayment(latePaymentId uuid.UUID, refundAddress string) (*model.LatePayment, error)
+	RefundPayment(paymentId uuid.UUID, refundAddress string, amount *big.Int) (*model.Refund, error)
+	GetMerchantSettings(wallet string) (*model.MerchantSettings, error)
+	SaveMerchantSettings(settings model.MerchantSettings) (*model.MerchantSettings, error)
+	GetMerchantLedger(wallet string, network model.Network) ([]model.MerchantLedgerEntry, *big.Int, error)
+	GetQuarantinedPayments() ([]model.Payment, error)
+	RetryQuarantinedPayment(paymentId uuid.UUID) (*model.Payment, error)
 }
 
 type bitcoinService struct {
-	regtestClient     *rpcclient.Client
-	testClient        *rpcclient.Client
-	mainClient        *rpcclient.Client
-	accountRepository repository.IAccountRepository
-	paymentRepository repository.IPaymentRepository
+	clients                    map[model.Network]node.BitcoinNode
+	accountRepository          repository.IAccountRepository
+	paymentRepository          repository.IPaymentRepository
+	chainCursorRepository      repository.IChainCursorRepository
+	latePaymentRepository      repository.ILatePaymentRepository
+	refundRepository           repository.IRefundRepository
+	merchantSettingsRepository repository.IMerchantSettingsRepository
+	incomingRepository         repository.IIncomingTransactionRepository
+	forwardingRepository       repository.IForwardingTransactionRepository
+	payoutBatchRepository      repository.IPayoutBatchRepository
+	merchantLedgerRepository   repository.IMerchantLedgerRepository
+	advisoryLockRepository     repository.IAdvisoryLockRepository
+	unitOfWork                 repository.IUnitOfWork
+	keychains                  map[model.Network]*AccountKeychain
+	watchOnlyWallets           map[model.Network]node.BitcoinNode
 }
 
 func NewBitcoinService(
-	accountRepository repository.IAccountRepository,
-	paymentRepository repository.IPaymentRepository,
-	testClient *rpcclient.Client,
-	mainClient *rpcclient.Client,
+	repos *repository.Repositories,
+	unitOfWork repository.IUnitOfWork,
+	clients map[model.Network]node.BitcoinNode,
+	keychains map[model.Network]*AccountKeychain,
+	watchOnlyWallets map[model.Network]node.BitcoinNode,
 ) IBitcoinService {
+	// the payment addresses of a network with a keychain are watched by the watch-only wallet, the service signs their inputs
+	wrappedClients := make(map[model.Network]node.BitcoinNode, len(clients))
+	for network, client := range clients {
+		wrappedClients[network] = client
+		if keychain := keychains[network]; keychain != nil {
+			wrappedClients[network] = &watchOnlyNode{BitcoinNode: client, wallet: watchOnlyWallets[network], keychain: keychain, accounts: repos.Account}
+		}
+	}
 	return &bitcoinService{
-		accountRepository: accountRepository,
-		paymentRepository: paymentRepository,
-		testClient:        testClient,
-		mainClient:        mainClient}
+		accountRepository:          repos.Account,
+		paymentRepository:          repos.Payment,
+		chainCursorRepository:      repos.ChainCursor,
+		latePaymentRepository:      repos.LatePayment,
+		refundRepository:           repos.Refund,
+		merchantSettingsRepository: repos.MerchantSettings,
+		incomingRepository:         repos.IncomingTransaction,
+		forwardingRepository:       repos.ForwardingTransaction,
+		payoutBatchRepository:      repos.PayoutBatch,
+		merchantLedgerRepository:   repos.MerchantLedger,
+		advisoryLockRepository:     repos.AdvisoryLock,
+		unitOfWork:                 unitOfWork,
+		keychains:                  keychains,
+		watchOnlyWallets:           watchOnlyWallets,
+		clients:                    wrappedClients}
 }
 
 func (s *bitcoinService) CreateNewPayment(paymentRequest openApi.PaymentRequestDto) (*model.Payment, error) {
+	// a repeated request gets the original payment, its pay amount must not be converted again
+	existing, err := s.findIdempotentPayment(paymentRequest)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
+
 	mode, ok := enum.ParseStringToModeEnum(paymentRequest.Mode)
 	if !ok {
 		return nil, errors.New("wrong mode")
 	}
+	network, err := s.ResolveNetwork(mode, paymentRequest.Network)
+	if err != nil {
+		return nil, err
+	}
 	priceCurrency, ok := enum.ParseStringToFiatCurrencyEnum(paymentRequest.PriceCurrency)
 	if !ok {
 		return nil, errors.New("wrong price currency")
 	}
+	expiry, err := getPaymentExpiry(paymentRequest.ExpiresInMinutes)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.getClientByNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	wallet, err := s.validateMerchantWallet(client, paymentRequest.Wallet, network)
+	if err != nil {
+		return nil, err
+	}
+	if paymentRequest.RefundAddress != "" {
+		err = validateAddress(client, paymentRequest.RefundAddress, network)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the policy is fixed when the payment is created, later changes of the settings don't apply
+	settings, err := s.GetMerchantSettings(wallet)
+	if err != nil {
+		return nil, err
+	}
 
 	payAmountInBtc, err := getPayAmount(paymentRequest.PriceAmount, priceCurrency)
 	if err != nil {
@@ -62,7 +154,7 @@ func (s *bitcoinService) CreateNewPayment(paymentRequest openApi.PaymentRequestD
 		return nil, err
 	}
 
-	enough, err := s.isPayAmountEnough(mode, payAmountInSatoshi)
+	enough, err := s.isPayAmountEnough(network, payAmountInSatoshi)
 	if err != nil {
 		return nil, err
 	}
@@ -71,7 +163,7 @@ func (s *bitcoinService) CreateNewPayment(paymentRequest openApi.PaymentRequestD
 		return nil, errors.New("Pay amount is too low ")
 	}
 
-	account, err := s.getFreeAccount(mode)
+	tolerance, err := getUnderpaymentTolerance(payAmountInSatoshi, paymentRequest.UnderpaymentTolerance, paymentRequest.UnderpaymentTolerancePercent)
 	if err != nil {
 		return nil, err
 	}
@@ -84,26 +176,76 @@ func (s *bitcoinService) CreateNewPayment(paymentRequest openApi.PaymentRequestD
 	}
 
 	payment := model.Payment{
-		Account:               account,
-		MerchantWallet:        paymentRequest.Wallet,
+		MerchantWallet:        wallet,
 		Mode:                  mode,
+		Network:               network,
 		PriceAmount:           paymentRequest.PriceAmount,
 		PriceCurrency:         priceCurrency,
+		ExpiresAt:             time.Now().Add(expiry),
+		OverpaymentPolicy:     settings.OverpaymentPolicy,
+		RefundAddress:         paymentRequest.RefundAddress,
+		UnderpaymentTolerance: model.NewBigInt(tolerance),
+		Risk:                  model.RiskLow,
 		CurrentPaymentState:   state,
 		CurrentPaymentStateId: &state.ID,
 		PaymentStates:         []model.PaymentState{state},
 	}
+	if paymentRequest.IdempotencyKey != "" {
+		fingerprint, err := getRequestFingerprint(paymentRequest)
+		if err != nil {
+			return nil, err
+		}
+		payment.IdempotencyKey = &paymentRequest.IdempotencyKey
+		payment.RequestFingerprint = fingerprint
+	}
 
-	err = s.paymentRepository.Create(&payment)
+	err = s.createPayment(&payment, network)
 	if err != nil {
+		// a concurrent request with the same key created the payment first, the account is released by the rollback
+		existing, findErr := s.findIdempotentPayment(paymentRequest)
+		if findErr == nil && existing != nil {
+			return existing, nil
+		}
+		if errors.Is(findErr, ErrIdempotencyConflict) {
+			return nil, findErr
+		}
 		return nil, err
 	}
 
 	return &payment, nil
 }
 
-func (s *bitcoinService) HandleWalletNotify(txId string, mode enum.Mode) {
-	client, err := s.getClientByMode(mode)
+// createPayment stores the payment with a free account of the network. A derivation index taken by a concurrent
+// transaction, e.g. of a replica without the derivation lock, is retried with the next index.
+func (s *bitcoinService) createPayment(payment *model.Payment, network model.Network) error {
+	var err error
+	for attempt := 0; attempt < derivationAttempts; attempt++ {
+		err = s.unitOfWork.WithTx(func(tx *repository.Repositories) error {
+			account, err := s.getFreeAccount(tx, network)
+			if err != nil {
+				return err
+			}
+			payment.Account = account
+			payment.OpenAccountID = &account.ID
+			return tx.Payment.Create(payment)
+		})
+		if !errors.Is(err, repository.ErrDerivationIndexTaken) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *bitcoinService) GetPayment(paymentId uuid.UUID) (*model.Payment, error) {
+	return s.paymentRepository.FindByID(paymentId)
+}
+
+func (s *bitcoinService) GetPayments(filter repository.PaymentFilter) ([]model.Payment, int64, error) {
+	return s.paymentRepository.FindAll(filter)
+}
+
+func (s *bitcoinService) HandleWalletNotify(txId string, network model.Network) {
+	client, err := s.getClientByNetwork(network)
 	if err != nil {
 		log.Println(err)
 		return
@@ -115,12 +257,17 @@ func (s *bitcoinService) HandleWalletNotify(txId string, mode enum.Mode) {
 		return
 	}
 
-	// only conf 0 is relevant (first user pay in)
+	// only conf 0 is relevant (first user pay in), negative conf means it was double spent
 	// if amount is negative it is a sending payment
-	if transaction.Confirmations != 0 || transaction.Amount < 0 {
+	if transaction.Confirmations > 0 || transaction.Amount < 0 {
 		return
 	}
 
+	s.handleIncomingTransaction(transaction, network)
+}
+
+// handleIncomingTransaction updates the open payment on the receiving address with the amount received so far
+func (s *bitcoinService) handleIncomingTransaction(transaction *btcjson.GetTransactionResult, network model.Network) {
 	address := transaction.Details[0].Address
 	currentPayment, err := s.paymentRepository.FindCurrentPaymentByAddress(address)
 	if err != nil {
@@ -128,12 +275,56 @@ func (s *bitcoinService) HandleWalletNotify(txId string, mode enum.Mode) {
 		return
 	}
 
+	if currentPayment == nil {
+		// a paid payment is not open anymore, but a replaced or double spent transaction may still take away its funds
+		rechecked, err := s.recheckPaidPayment(transaction, address, network)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if rechecked || transaction.Confirmations < 0 {
+			return
+		}
+		if !s.handleLatePayment(transaction, address, network) {
+			log.Printf("no open payment for address %s", address)
+		}
+		return
+	}
+
+	earlier, err := s.isEarlierTransaction(currentPayment, transaction)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if earlier {
+		log.Printf("transaction %s belongs to an earlier payment on address %s", transaction.TxID, address)
+		return
+	}
+
+	err = s.trackIncomingTransaction(currentPayment, transaction)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	risk, err := getTransactionRisk(transaction)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// the risk is only raised, a confirmed transaction doesn't make an earlier replaceable one safe
+	raisedRisk := risk > currentPayment.Risk
+	if raisedRisk {
+		currentPayment.Risk = risk
+	}
+
 	if currentPayment.ReceivedConfirmations != nil && *currentPayment.ReceivedConfirmations >= 0 && currentPayment.CurrentPaymentState.StateID == enum.Paid {
 		log.Println("payment already handled")
+		s.saveRaisedRisk(currentPayment, raisedRisk)
 		return
 	}
 
-	amountReceived, err := s.getUnspentByAddress(address, 0, mode)
+	amountReceived, err := s.getUnspentByAddress(address, 0, network)
 	if err != nil {
 		log.Println(err)
 		return
@@ -141,7 +332,7 @@ func (s *bitcoinService) HandleWalletNotify(txId string, mode enum.Mode) {
 
 	currentPayment.ReceivedConfirmations = &transaction.Confirmations
 	amountReceived.Sub(amountReceived, &currentPayment.Account.Remainder.Int)
-	var diff = currentPayment.CurrentPaymentState.PayAmount.Cmp(amountReceived)
+	var diff = getRequiredAmount(currentPayment).Cmp(amountReceived)
 
 	newState := model.PaymentState{
 		Base:           model.Base{ID: uuid.New()},
@@ -154,6 +345,15 @@ func (s *bitcoinService) HandleWalletNotify(txId string, mode enum.Mode) {
 		newState.StateID = enum.PartiallyPaid
 	} else {
 		newState.StateID = enum.Paid
+		setShortfall(currentPayment, amountReceived)
+	}
+	setSurplus(&newState)
+
+	// the transaction was already handled, e.g. when it is replayed
+	if newState.StateID == currentPayment.CurrentPaymentState.StateID &&
+		newState.AmountReceived.Cmp(&currentPayment.CurrentPaymentState.AmountReceived.Int) == 0 {
+		s.saveRaisedRisk(currentPayment, raisedRisk)
+		return
 	}
 
 	currentPayment.PaymentStates = append(currentPayment.PaymentStates, newState)
@@ -161,374 +361,505 @@ func (s *bitcoinService) HandleWalletNotify(txId string, mode enum.Mode) {
 	currentPayment.CurrentPaymentState = newState
 	currentPayment.CurrentPaymentStateId = &newState.ID
 
-	err = sendNotificationToBackend(currentPayment.ID.String(),
-		currentPayment.CurrentPaymentState.PayAmount.String(),
-		currentPayment.CurrentPaymentState.AmountReceived.String(),
-		currentPayment.CurrentPaymentState.StateID.String(),
-		currentPayment.ForwardingTransactionHash)
-
+	err = s.savePayment(currentPayment)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+}
 
-	err = s.paymentRepository.Update(currentPayment)
+// saveRaisedRisk saves the payment if an incoming transaction raised its risk without changing its state
+func (s *bitcoinService) saveRaisedRisk(payment *model.Payment, raised bool) {
+	if !raised {
+		return
+	}
+	err := s.savePayment(payment)
 	if err != nil {
 		log.Println(err)
-		return
 	}
 }
 
-func (s *bitcoinService) HandleBlockNotify(blockHash string, mode enum.Mode) {
-	s.handlePaidPayments(mode)
-	s.handleConfirmedPayments(mode)
-	s.handleForwardedTransactions(mode)
+// recheckPaidPayment rolls back the paid payment on the address if the transaction was replaced or double spent.
+// It reports if there was such a payment.
+func (s *bitcoinService) recheckPaidPayment(transaction *btcjson.GetTransactionResult, address string, network model.Network) (bool, error) {
+	risk, err := getTransactionRisk(transaction)
+	if err != nil || risk != model.RiskHigh {
+		return false, err
+	}
+	payments, err := s.paymentRepository.FindPaidPaymentsByNetwork(network)
+	if err != nil {
+		return false, err
+	}
+	for i := range payments {
+		if payments[i].Account != nil && payments[i].Account.Address == address {
+			return true, s.recheckPayment(&payments[i], network)
+		}
+	}
+	return false, nil
+}
+
+// HandleBlockNotify runs the block handlers of the network. They hold the block lock of the network, so concurrent
+// notifications and other replicas of the service can't forward a payment twice.
+func (s *bitcoinService) HandleBlockNotify(_ string, network model.Network) {
+	err := s.advisoryLockRepository.WithLock(getBlockLockKey(network), func() {
+		s.handleBlock(network)
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
 
-	// TODO: if this runes parallel with the other jobs we need to be careful
-	// maybe open transactions where time.now() - created <= 0
-	s.handleExpiredTransactions(mode)
+// handleBlock runs the block handlers, the caller holds the block lock of the network
+func (s *bitcoinService) handleBlock(network model.Network) {
+	s.handleReorgs(network)
+	s.handlePaidPayments(network)
+	s.handleConfirmedPayments(network)
+	s.handlePayoutBatches(network)
+	s.handleStuckForwardings(network)
+	s.handleForwardedTransactions(network)
+	s.handleSentRefunds(network)
+	s.handleExpiredTransactions(network)
 }
 
-func (s *bitcoinService) handlePaidPayments(mode enum.Mode) {
-	payments, err := s.paymentRepository.FindPaidPaymentsByMode(mode)
+// HandleRawTransaction is called for every transaction the node sees, not only for wallet transactions.
+// Only transactions paying to one of our addresses are passed to HandleWalletNotify.
+func (s *bitcoinService) HandleRawTransaction(transaction *wire.MsgTx, network model.Network) {
+	client, err := s.getClientByNetwork(network)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	params, err := getNetParams(client)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	for _, payment := range payments {
-		amountReceived, err := s.getUnspentByAddress(payment.Account.Address, utils.Opts.MinimumConfirmations, mode)
+	var addresses []string
+	for _, out := range transaction.TxOut {
+		_, outAddresses, _, err := txscript.ExtractPkScriptAddrs(out.PkScript, params)
 		if err != nil {
-			log.Println(err)
-			return
+			continue
+		}
+		for _, address := range outAddresses {
+			addresses = append(addresses, address.EncodeAddress())
 		}
+	}
+
+	if len(addresses) == 0 {
+		return
+	}
 
-		amountReceived.Sub(amountReceived, &payment.Account.Remainder.Int)
-		var diff = payment.CurrentPaymentState.PayAmount.Cmp(amountReceived)
+	count, err := s.accountRepository.CountByAddresses(addresses)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-		if diff > 0 {
-			return // not enough funds, or we need to wait for 6 confirmations
-		}
+	if count == 0 {
+		return
+	}
 
-		confirmedState := model.PaymentState{
-			Base:           model.Base{ID: uuid.New()},
-			PayAmount:      payment.CurrentPaymentState.PayAmount,
-			AmountReceived: model.NewBigInt(amountReceived),
-			StateID:        enum.Confirmed,
+	// the wallet might not have processed the transaction yet
+	txId := transaction.TxHash().String()
+	for i := 0; i < walletSyncRetries; i++ {
+		_, err = getTransaction(client, txId)
+		if err == nil {
+			break
 		}
+		time.Sleep(walletSyncDelay)
+	}
 
-		receivedConfirmations := int64(utils.Opts.MinimumConfirmations)
-		payment.ReceivedConfirmations = &receivedConfirmations
-		payment.CurrentPaymentStateId = &confirmedState.ID
-		payment.CurrentPaymentState = confirmedState
-		payment.PaymentStates = append(payment.PaymentStates, confirmedState)
+	s.HandleWalletNotify(txId, network)
+}
 
-		err = sendNotificationToBackend(payment.ID.String(),
-			payment.CurrentPaymentState.PayAmount.String(),
-			payment.CurrentPaymentState.AmountReceived.String(),
-			payment.CurrentPaymentState.StateID.String(),
-			payment.ForwardingTransactionHash)
+func (s *bitcoinService) handlePaidPayments(network model.Network) {
+	payments, err := s.paymentRepository.FindPaidPaymentsByNetwork(network)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-		if err != nil {
-			log.Println(err)
-			return
-		}
+	for i := range payments {
+		err = s.handlePaidPayment(&payments[i], network)
+		s.trackPaymentProcessing(&payments[i], err)
+	}
+}
 
-		err = s.paymentRepository.Update(&payment)
-		if err != nil {
-			log.Println(err)
-			return
-		}
+func (s *bitcoinService) handlePaidPayment(payment *model.Payment, network model.Network) error {
+	amountReceived, err := s.getUnspentByAddress(payment.Account.Address, getMinimumConfirmations(network), network)
+	if err != nil {
+		return err
+	}
 
-		forwardAmount := calculateForwardAmount(&payment.CurrentPaymentState.PayAmount.Int)
-		//TODO: if multiple blocknotify at the same time we send multiple times, but should in reality never happen
-		txHash, err := s.createTransaction(payment.Account.Address, payment.MerchantWallet, forwardAmount, mode)
+	amountReceived.Sub(amountReceived, &payment.Account.Remainder.Int)
+	var diff = getRequiredAmount(payment).Cmp(amountReceived)
+
+	if diff > 0 {
+		return nil // not enough funds, or we need to wait for 6 confirmations
+	}
+
+	confirmedState := model.PaymentState{
+		Base:           model.Base{ID: uuid.New()},
+		PayAmount:      payment.CurrentPaymentState.PayAmount,
+		AmountReceived: model.NewBigInt(amountReceived),
+		StateID:        enum.Confirmed,
+	}
+	setSurplus(&confirmedState)
+	setShortfall(payment, amountReceived)
+	// confirmed funds can't be replaced anymore
+	payment.Risk = model.RiskLow
+
+	receivedConfirmations := int64(getMinimumConfirmations(network))
+	payment.ReceivedConfirmations = &receivedConfirmations
+	payment.CurrentPaymentStateId = &confirmedState.ID
+	payment.CurrentPaymentState = confirmedState
+	payment.PaymentStates = append(payment.PaymentStates, confirmedState)
+
+	err = s.unitOfWork.WithTx(func(tx *repository.Repositories) error {
+		err := tx.Payment.Update(payment)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
-		var conf int64 = 0
-		payment.ForwardingTransactionHash = &txHash
-		payment.ForwardingConfirmations = &conf
-
-		err = s.paymentRepository.Update(&payment)
+		err = tx.Outbox.Create(newOutboxNotification(payment))
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
+		return creditMerchant(tx.MerchantLedger, payment)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the pay amount is forwarded by handleConfirmedPayments once the change of the refund is confirmed
+	if confirmedState.Overpaid && s.handleOverpayment(payment) {
+		return nil
 	}
+
+	// forwarded on the payout schedule of the merchant or with other payments by handlePayoutBatches
+	deferred, err := s.isPayoutDeferred(payment)
+	if err != nil {
+		return err
+	}
+	if deferred {
+		return nil
+	}
+
+	forwardAmount := getPayoutAmount(payment)
+	txHash, err := s.createTransaction(payment.Account.Address, payment.MerchantWallet, forwardAmount, network)
+	if err != nil {
+		return err
+	}
+	return s.saveForwardingTransaction(payment, txHash, network)
 }
 
-func (s *bitcoinService) handleConfirmedPayments(mode enum.Mode) {
-	client, err := s.getClientByMode(mode)
+func (s *bitcoinService) handleConfirmedPayments(network model.Network) {
+	client, err := s.getClientByNetwork(network)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	payments, err := s.paymentRepository.FindConfirmedPaymentsByMode(mode)
+	payments, err := s.paymentRepository.FindConfirmedPaymentsByNetwork(network)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	for _, payment := range payments {
-		amount, err := s.getUnspentByAddress(payment.Account.Address, utils.Opts.MinimumConfirmations, mode)
+	for i := range payments {
+		err = s.handleConfirmedPayment(client, &payments[i], network)
+		s.trackPaymentProcessing(&payments[i], err)
+	}
+}
+
+func (s *bitcoinService) handleConfirmedPayment(client node.BitcoinNode, payment *model.Payment, network model.Network) error {
+	// forwarded by handlePayoutBatches
+	if payment.ForwardingTransactionHash == nil {
+		deferred, err := s.isPayoutDeferred(payment)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
-
-		amount.Sub(amount, &payment.Account.Remainder.Int)
-
-		// sending failed try to send again
-		if payment.ForwardingTransactionHash == nil && amount.Cmp(&payment.CurrentPaymentState.PayAmount.Int) >= 0 {
-			forwardAmount := calculateForwardAmount(&payment.CurrentPaymentState.PayAmount.Int)
-			//TODO: if multiple blocknotify at the same time we send multiple times, but should in reality never happen
-			txHash, err := s.createTransaction(payment.Account.Address, payment.MerchantWallet, forwardAmount, mode)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			var conf int64 = 0
-			payment.ForwardingTransactionHash = &txHash
-			payment.ForwardingConfirmations = &conf
-
-			err = s.paymentRepository.Update(&payment)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			return
+		if payment.PayoutBatchID != nil || deferred {
+			return s.resumePayoutBatch(client, payment, network)
 		}
+	}
 
-		// already sent but could not save txId to db
-		if payment.ForwardingTransactionHash == nil && amount.Cmp(big.NewInt(0)) == 0 {
-			transactions, err := s.findMissingTransaction(payment.MerchantWallet, mode)
-			if err != nil {
-				log.Println(err)
-				return
-			}
+	amount, err := s.getUnspentByAddress(payment.Account.Address, getMinimumConfirmations(network), network)
+	if err != nil {
+		return err
+	}
 
-			forwardAmount := calculateForwardAmount(&payment.CurrentPaymentState.PayAmount.Int)
-			forwardAmountInBtc := btcutil.Amount(forwardAmount.Int64()).ToBTC()
-			for _, tx := range transactions {
-				if forwardAmountInBtc == tx.amount+tx.fee {
-					payment.ForwardingTransactionHash = &tx.txId
-					break
-				}
-			}
-		}
+	amount.Sub(amount, &payment.Account.Remainder.Int)
 
-		transaction, err := getTransaction(client, *payment.ForwardingTransactionHash)
+	// sending failed try to send again
+	if payment.ForwardingTransactionHash == nil && amount.Cmp(getForwardBase(payment)) >= 0 {
+		forwardAmount := getPayoutAmount(payment)
+		txHash, err := s.createTransaction(payment.Account.Address, payment.MerchantWallet, forwardAmount, network)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
+		return s.saveForwardingTransaction(payment, txHash, network)
+	}
 
-		// transaction not confirmed
-		if transaction.Confirmations <= 0 {
-			return
+	// already sent but could not save txId to db
+	if payment.ForwardingTransactionHash == nil && amount.Cmp(big.NewInt(0)) == 0 {
+		transactions, err := s.findMissingTransaction(payment.MerchantWallet, network)
+		if err != nil {
+			return err
 		}
 
-		sentState := model.PaymentState{
-			Base:           model.Base{ID: uuid.New()},
-			PayAmount:      payment.CurrentPaymentState.PayAmount,
-			AmountReceived: payment.CurrentPaymentState.AmountReceived,
-			StateID:        enum.Forwarded,
+		forwardAmount := getPayoutAmount(payment)
+		forwardAmountInBtc := btcutil.Amount(forwardAmount.Int64()).ToBTC()
+		for _, tx := range transactions {
+			if forwardAmountInBtc == tx.amount+tx.fee {
+				err = s.saveForwardingTransaction(payment, tx.txId, network)
+				if err != nil {
+					return err
+				}
+				break
+			}
 		}
+	}
 
-		payment.ForwardingConfirmations = &transaction.Confirmations
-		payment.CurrentPaymentStateId = &sentState.ID
-		payment.CurrentPaymentState = sentState
-		payment.PaymentStates = append(payment.PaymentStates, sentState)
+	// the funds are not confirmed yet, e.g. the change of a refund
+	if payment.ForwardingTransactionHash == nil {
+		return nil
+	}
 
-		err = sendNotificationToBackend(payment.ID.String(),
-			payment.CurrentPaymentState.PayAmount.String(),
-			payment.CurrentPaymentState.AmountReceived.String(),
-			payment.CurrentPaymentState.StateID.String(),
-			payment.ForwardingTransactionHash)
+	transaction, err := getTransaction(client, *payment.ForwardingTransactionHash)
+	if err != nil {
+		return err
+	}
 
+	// a replaced version of the forwarding transaction confirmed instead
+	if transaction.Confirmations < 0 {
+		transaction, err = s.findConfirmedForwarding(client, payment, transaction)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
+	}
 
-		err = s.paymentRepository.Update(&payment)
-		if err != nil {
-			log.Println(err)
-			return
-		}
+	// transaction not confirmed
+	if transaction.Confirmations <= 0 {
+		return nil
+	}
+
+	sentState := model.PaymentState{
+		Base:           model.Base{ID: uuid.New()},
+		PayAmount:      payment.CurrentPaymentState.PayAmount,
+		AmountReceived: payment.CurrentPaymentState.AmountReceived,
+		StateID:        enum.Forwarded,
+		Overpaid:       payment.CurrentPaymentState.Overpaid,
+		Surplus:        payment.CurrentPaymentState.Surplus,
 	}
+
+	payment.ForwardingConfirmations = &transaction.Confirmations
+	payment.CurrentPaymentStateId = &sentState.ID
+	payment.CurrentPaymentState = sentState
+	payment.PaymentStates = append(payment.PaymentStates, sentState)
+
+	return s.savePayment(payment)
 }
 
-func (s *bitcoinService) handleForwardedTransactions(mode enum.Mode) {
-	client, err := s.getClientByMode(mode)
+func (s *bitcoinService) handleForwardedTransactions(network model.Network) {
+	client, err := s.getClientByNetwork(network)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	payments, err := s.paymentRepository.FindForwardedPaymentsByMode(mode)
+	payments, err := s.paymentRepository.FindForwardedPaymentsByNetwork(network)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	for _, payment := range payments {
-		transaction, err := getTransaction(client, *payment.ForwardingTransactionHash)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		if transaction.Confirmations >= int64(utils.Opts.MinimumConfirmations) {
-			finishState := model.PaymentState{
-				Base:           model.Base{ID: uuid.New()},
-				PayAmount:      payment.CurrentPaymentState.PayAmount,
-				AmountReceived: payment.CurrentPaymentState.AmountReceived,
-				StateID:        enum.Finished,
-			}
+	for i := range payments {
+		err = s.handleForwardedPayment(client, &payments[i], network)
+		s.trackPaymentProcessing(&payments[i], err)
+	}
+}
 
-			payment.ForwardingConfirmations = &transaction.Confirmations
-			payment.CurrentPaymentStateId = &finishState.ID
-			payment.CurrentPaymentState = finishState
-			payment.PaymentStates = append(payment.PaymentStates, finishState)
-			payment.Account.Used = false
+func (s *bitcoinService) handleForwardedPayment(client node.BitcoinNode, payment *model.Payment, network model.Network) error {
+	transaction, err := getTransaction(client, *payment.ForwardingTransactionHash)
+	if err != nil {
+		return err
+	}
 
-			if payment.Account.Remainder.Cmp(big.NewInt(0)) > 0 {
-				unspentAmount, err := s.getUnspentByAddress(payment.Account.Address, 0, mode)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				payment.Account.Remainder = model.NewBigInt(unspentAmount)
-			}
+	if transaction.Confirmations < int64(getMinimumConfirmations(network)) {
+		return nil
+	}
 
-			err = sendNotificationToBackend(payment.ID.String(),
-				payment.CurrentPaymentState.PayAmount.String(),
-				payment.CurrentPaymentState.AmountReceived.String(),
-				payment.CurrentPaymentState.StateID.String(),
-				payment.ForwardingTransactionHash)
+	finishState := model.PaymentState{
+		Base:           model.Base{ID: uuid.New()},
+		PayAmount:      payment.CurrentPaymentState.PayAmount,
+		AmountReceived: payment.CurrentPaymentState.AmountReceived,
+		StateID:        enum.Finished,
+		Overpaid:       payment.CurrentPaymentState.Overpaid,
+		Surplus:        payment.CurrentPaymentState.Surplus,
+	}
 
-			if err != nil {
-				log.Println(err)
-				return
-			}
+	payment.ForwardingConfirmations = &transaction.Confirmations
+	payment.CurrentPaymentStateId = &finishState.ID
+	payment.CurrentPaymentState = finishState
+	payment.PaymentStates = append(payment.PaymentStates, finishState)
+	releaseAccount(payment)
 
-			//TODO: update account and payment should be in one transaction
-			err = s.paymentRepository.Update(&payment)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			//TODO: update account and payment should be in one transaction
-			err = s.accountRepository.Update(payment.Account)
-			if err != nil {
-				log.Println(err)
-				return
-			}
+	if payment.Account.Remainder.Cmp(big.NewInt(0)) > 0 {
+		unspentAmount, err := s.getUnspentByAddress(payment.Account.Address, 0, network)
+		if err != nil {
+			return err
 		}
+		payment.Account.Remainder = model.NewBigInt(unspentAmount)
 	}
+
+	return s.savePaymentAndAccount(payment)
 }
 
-func (s *bitcoinService) handleExpiredTransactions(mode enum.Mode) {
-	payments, err := s.paymentRepository.FindExpiredPaymentsByMode(mode)
+func (s *bitcoinService) handleExpiredTransactions(network model.Network) {
+	payments, err := s.paymentRepository.FindExpiredPaymentsByNetwork(network)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	for _, payment := range payments {
-		receivedAmount, err := s.getUnspentByAddress(payment.Account.Address, 0, mode)
-		if err != nil {
-			log.Println(err)
-			return
-		}
+	for i := range payments {
+		err = s.handleExpiredPayment(&payments[i], network)
+		s.trackPaymentProcessing(&payments[i], err)
+	}
+}
 
-		receivedAmount.Sub(receivedAmount, &payment.Account.Remainder.Int)
-		var newState model.PaymentState
+func (s *bitcoinService) handleExpiredPayment(payment *model.Payment, network model.Network) error {
+	receivedAmount, err := s.getUnspentByAddress(payment.Account.Address, 0, network)
+	if err != nil {
+		return err
+	}
 
-		// he has paid but we did not get the notifications
-		if receivedAmount.Cmp(&payment.CurrentPaymentState.PayAmount.Int) >= 0 {
-			newState = model.PaymentState{
-				Base:           model.Base{ID: uuid.New()},
-				PayAmount:      payment.CurrentPaymentState.PayAmount,
-				AmountReceived: model.NewBigInt(receivedAmount),
-				PaymentID:      payment.CurrentPaymentState.PaymentID,
-				StateID:        enum.Paid,
-			}
-		} else {
-			newState = model.PaymentState{
-				Base:           model.Base{ID: uuid.New()},
-				PayAmount:      payment.CurrentPaymentState.PayAmount,
-				AmountReceived: payment.CurrentPaymentState.AmountReceived,
-				PaymentID:      payment.CurrentPaymentState.PaymentID,
-				StateID:        enum.Expired,
-			}
-			payment.Account.Used = false
-			// if the buyer has partially_paid but the transaction is expired
-			if receivedAmount.Cmp(big.NewInt(0)) > 0 {
-				newRemainder := payment.Account.Remainder.Add(&payment.Account.Remainder.Int, receivedAmount)
-				payment.Account.Remainder = model.NewBigInt(newRemainder)
-			}
+	receivedAmount.Sub(receivedAmount, &payment.Account.Remainder.Int)
+	var newState model.PaymentState
+
+	// he has paid but we did not get the notifications
+	if receivedAmount.Cmp(getRequiredAmount(payment)) >= 0 {
+		setShortfall(payment, receivedAmount)
+		newState = model.PaymentState{
+			Base:           model.Base{ID: uuid.New()},
+			PayAmount:      payment.CurrentPaymentState.PayAmount,
+			AmountReceived: model.NewBigInt(receivedAmount),
+			PaymentID:      payment.CurrentPaymentState.PaymentID,
+			StateID:        enum.Paid,
+		}
+		setSurplus(&newState)
+	} else {
+		newState = model.PaymentState{
+			Base:           model.Base{ID: uuid.New()},
+			PayAmount:      payment.CurrentPaymentState.PayAmount,
+			AmountReceived: payment.CurrentPaymentState.AmountReceived,
+			PaymentID:      payment.CurrentPaymentState.PaymentID,
+			StateID:        enum.Expired,
 		}
+		releaseAccount(payment)
+		// if the buyer has partially_paid but the transaction is expired
+		if receivedAmount.Cmp(big.NewInt(0)) > 0 {
+			newRemainder := payment.Account.Remainder.Add(&payment.Account.Remainder.Int, receivedAmount)
+			payment.Account.Remainder = model.NewBigInt(newRemainder)
+		}
+	}
 
-		payment.CurrentPaymentStateId = &newState.ID
-		payment.CurrentPaymentState = newState
-		payment.PaymentStates = append(payment.PaymentStates, newState)
+	payment.CurrentPaymentStateId = &newState.ID
+	payment.CurrentPaymentState = newState
+	payment.PaymentStates = append(payment.PaymentStates, newState)
 
-		err = sendNotificationToBackend(payment.ID.String(),
-			payment.CurrentPaymentState.PayAmount.String(),
-			payment.CurrentPaymentState.AmountReceived.String(),
-			payment.CurrentPaymentState.StateID.String(),
-			payment.ForwardingTransactionHash)
+	return s.savePaymentAndAccount(payment)
+}
 
+// savePayment persists a state transition of the payment together with its backend notification
+func (s *bitcoinService) savePayment(payment *model.Payment) error {
+	return s.unitOfWork.WithTx(func(tx *repository.Repositories) error {
+		err := tx.Payment.Update(payment)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
+		return tx.Outbox.Create(newOutboxNotification(payment))
+	})
+}
 
-		//TODO: update account and payment should be in one transaction
-		err = s.paymentRepository.Update(&payment)
+// releaseAccount frees the account of the payment for new payments
+func releaseAccount(payment *model.Payment) {
+	payment.Account.Used = false
+	payment.OpenAccountID = nil
+}
+
+// savePaymentAndAccount is savePayment for transitions which also change the account, e.g. free it
+func (s *bitcoinService) savePaymentAndAccount(payment *model.Payment) error {
+	return s.unitOfWork.WithTx(func(tx *repository.Repositories) error {
+		err := tx.Payment.Update(payment)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
-
-		//TODO: update account and payment should be in one transaction
-		err = s.accountRepository.Update(payment.Account)
+		err = tx.Account.Update(payment.Account)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
-	}
+		return tx.Outbox.Create(newOutboxNotification(payment))
+	})
 }
 
-func (s *bitcoinService) createTransaction(fromAddress string, toAddress string, amount *big.Int, mode enum.Mode) (string, error) {
-	client, err := s.getClientByMode(mode)
+func (s *bitcoinService) createTransaction(fromAddress string, toAddress string, amount *big.Int, network model.Network) (string, error) {
+	return s.createTransactionFromTx(fromAddress, toAddress, amount, "", network)
+}
+
+// createTransactionFromTx only spends the outputs of sourceTxId, the other coins on the address are kept
+func (s *bitcoinService) createTransactionFromTx(fromAddress string, toAddress string, amount *big.Int, sourceTxId string, network model.Network) (string, error) {
+	client, err := s.getClientByNetwork(network)
 	if err != nil {
 		return "", err
 	}
 
-	rawTransaction, err := createRawTransaction(client, fromAddress, toAddress, amount)
+	rawTransaction, err := createRawTransaction(client, fromAddress, toAddress, amount, getMinimumConfirmations(network), sourceTxId)
 	if err != nil {
 		return "", err
 	}
 
-	fundedTransaction, err := fundTransaction(client, rawTransaction, mode)
+	fundedTransaction, err := fundTransaction(client, rawTransaction, network)
 	if err != nil {
 		return "", err
 	}
 
-	txHash, err := signTransaction(client, fundedTransaction, mode)
+	txHash, err := signTransaction(client, fundedTransaction, network)
 	if err != nil {
 		return "", err
 	}
 	return txHash.String(), nil
 }
 
-func (s *bitcoinService) getUnspentByAddress(address string, minConf int, mode enum.Mode) (*big.Int, error) {
-	client, err := s.getClientByMode(mode)
+// validateMerchantWallet returns the wallet encoded like the node reports it, e.g. lower case for bech32, so the
+// payouts and settings of a merchant are found under one address. Funds must not be forwarded to our own wallet.
+func (s *bitcoinService) validateMerchantWallet(client node.BitcoinNode, wallet string, network model.Network) (string, error) {
+	params, err := getNetParams(client)
+	if err != nil {
+		return "", err
+	}
+	address, err := decodeWallet(wallet, params)
+	if err != nil {
+		return "", err
+	}
+	normalizedWallet := address.EncodeAddress()
+
+	if normalizedWallet == encodeWallet(getNetworkOpts(network).changeAddress, params) {
+		return "", fmt.Errorf("wallet address is the change address of the service: %s", wallet)
+	}
+	account, err := s.accountRepository.FindByAddress(normalizedWallet)
+	if err != nil {
+		return "", err
+	}
+	if account.ID != uuid.Nil {
+		return "", fmt.Errorf("wallet address is a payment address of the service: %s", wallet)
+	}
+	return normalizedWallet, nil
+}
+
+func (s *bitcoinService) getUnspentByAddress(address string, minConf int, network model.Network) (*big.Int, error) {
+	client, err := s.getClientByNetwork(network)
 	if err != nil {
 		return nil, err
 	}
@@ -556,17 +887,22 @@ func (s *bitcoinService) getUnspentByAddress(address string, minConf int, mode e
 	return convertBtcToSatoshi(amount)
 }
 
-func (s *bitcoinService) getFreeAccount(mode enum.Mode) (*model.Account, error) {
-	freeAccount, err := s.accountRepository.FindUnusedByMode(mode)
+// getFreeAccount claims an unused account of the network or creates a new one. Concurrent payments never get the same
+// account, the claim skips accounts locked by other transactions and a payment holding the account is unique.
+func (s *bitcoinService) getFreeAccount(tx *repository.Repositories, network model.Network) (*model.Account, error) {
+	freeAccount, err := tx.Account.ClaimUnusedByNetwork(network)
 	if err != nil {
 		return nil, err
 	}
 
 	if freeAccount == nil {
-		client, err := s.getClientByMode(mode)
+		client, err := s.getClientByNetwork(network)
 		if err != nil {
 			return nil, err
 		}
+		if keychain := s.keychains[network]; keychain != nil {
+			return deriveAccount(tx, s.watchOnlyWallets[network], keychain, network)
+		}
 
 		newAddress, err := client.GetNewAddress("")
 		if err != nil {
@@ -575,21 +911,58 @@ func (s *bitcoinService) getFreeAccount(mode enum.Mode) (*model.Account, error)
 		newAccount := &model.Account{
 			Address: newAddress.String(),
 			Used:    true,
-			Mode:    mode,
+			Mode:    network.Mode(),
+			Network: network,
 		}
-		err = s.accountRepository.Create(newAccount)
+		err = tx.Account.Create(newAccount)
 		if err != nil {
 			return nil, err
 		}
 		return newAccount, nil
 	}
+	return freeAccount, nil
+}
 
-	freeAccount.Used = true
-	err = s.accountRepository.Update(freeAccount)
+// deriveAccount creates the account of the next receive address of the account xpub and makes the watch-only wallet watch it.
+// The derivation lock makes concurrent payments wait until the account is committed, so they derive the next index.
+func deriveAccount(tx *repository.Repositories, wallet node.BitcoinNode, keychain *AccountKeychain, network model.Network) (*model.Account, error) {
+	err := tx.Account.LockDerivation(network)
 	if err != nil {
 		return nil, err
 	}
-	return freeAccount, nil
+	lastDerived, err := tx.Account.FindLastDerivationIndex(network)
+	if err != nil {
+		return nil, err
+	}
+	lastFunded, err := tx.Account.FindLastFundedDerivationIndex(network)
+	if err != nil {
+		return nil, err
+	}
+	index, err := nextIndex(lastDerived, lastFunded)
+	if err != nil {
+		return nil, err
+	}
+	address, err := keychain.address(index)
+	if err != nil {
+		return nil, err
+	}
+	err = keychain.importAddresses(wallet, index)
+	if err != nil {
+		return nil, err
+	}
+
+	newAccount := &model.Account{
+		Address:         address.EncodeAddress(),
+		Used:            true,
+		Mode:            network.Mode(),
+		Network:         network,
+		DerivationIndex: &index,
+	}
+	err = tx.Account.Create(newAccount)
+	if err != nil {
+		return nil, err
+	}
+	return newAccount, nil
 }
 
 type recoverSentTransactionResult struct {
@@ -598,8 +971,8 @@ type recoverSentTransactionResult struct {
 	fee    float64
 }
 
-func (s *bitcoinService) findMissingTransaction(merchantWallet string, mode enum.Mode) ([]recoverSentTransactionResult, error) {
-	client, err := s.getClientByMode(mode)
+func (s *bitcoinService) findMissingTransaction(merchantWallet string, network model.Network) ([]recoverSentTransactionResult, error) {
+	client, err := s.getClientByNetwork(network)
 	if err != nil {
 		return nil, err
 	}
@@ -609,7 +982,7 @@ func (s *bitcoinService) findMissingTransaction(merchantWallet string, mode enum
 		return nil, err
 	}
 
-	txIds, err := s.paymentRepository.FindAllOutgoingTransactionIdsByMerchantWalletAndMode(merchantWallet, mode)
+	txIds, err := s.paymentRepository.FindAllOutgoingTransactionIdsByMerchantWalletAndNetwork(merchantWallet, network)
 	if err != nil {
 		return nil, err
 	}
@@ -632,8 +1005,8 @@ func (s *bitcoinService) findMissingTransaction(merchantWallet string, mode enum
 
 // the pay amount is heigh enough if payAmount > 2 * txFee
 // and changeAmount > changeCost
-func (s *bitcoinService) isPayAmountEnough(mode enum.Mode, payAmount *big.Int) (bool, error) {
-	client, err := s.getClientByMode(mode)
+func (s *bitcoinService) isPayAmountEnough(network model.Network, payAmount *big.Int) (bool, error) {
+	client, err := s.getClientByNetwork(network)
 	if err != nil {
 		return false, err
 	}
@@ -672,13 +1045,35 @@ func (s *bitcoinService) isPayAmountEnough(mode enum.Mode, payAmount *big.Int) (
 	return false, nil
 }
 
-func (s *bitcoinService) getClientByMode(mode enum.Mode) (*rpcclient.Client, error) {
-	switch mode {
-	case enum.Test:
-		return s.testClient, nil
-	case enum.Main:
-		return s.mainClient, nil
-	default:
-		return nil, errors.New("mode not implemented")
+func (s *bitcoinService) getClientByNetwork(network model.Network) (node.BitcoinNode, error) {
+	client, ok := s.clients[network]
+	if !ok {
+		return nil, fmt.Errorf("network not configured: %s", network)
+	}
+	return client, nil
+}
+
+// ResolveNetwork returns the requested network or the default network of the mode.
+// The default of the test mode is the first configured of testnet, signet and regtest.
+func (s *bitcoinService) ResolveNetwork(mode enum.Mode, network string) (model.Network, error) {
+	if network != "" {
+		n, ok := model.ParseStringToNetworkEnum(network)
+		if !ok {
+			return 0, fmt.Errorf("wrong network: %s", network)
+		}
+		if n.Mode() != mode {
+			return 0, fmt.Errorf("network %s is not available in mode %s", n, mode)
+		}
+		if _, ok := s.clients[n]; !ok {
+			return 0, fmt.Errorf("network not configured: %s", n)
+		}
+		return n, nil
+	}
+
+	for _, n := range []model.Network{model.Mainnet, model.Testnet, model.Signet, model.Regtest} {
+		if _, ok := s.clients[n]; ok && n.Mode() == mode {
+			return n, nil
+		}
 	}
+	return 0, fmt.Errorf("no network configured for mode %s", mode)
 }
@@ -1,15 +1,21 @@
+//go:build !simulated
+// +build !simulated
+
 package service
 
 import (
 	"github.com/CHainGate/backend/pkg/enum"
 	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/node"
 	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
 	"github.com/CHainGate/bitcoin-service/openApi"
 	"github.com/CHainGate/bitcoin-service/test_utils"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcutil"
+	"github.com/google/uuid"
 	"github.com/ory/dockertest/v3"
 	"gopkg.in/h2non/gock.v1"
 	"log"
@@ -20,18 +26,12 @@ import (
 )
 
 var (
-	accountRepo     repository.IAccountRepository
-	paymentRepo     repository.IPaymentRepository
 	chaingateClient *rpcclient.Client
 	buyerClient     *rpcclient.Client
 	service         IBitcoinService
 	payAddress      string
 )
 
-const factor = 100000000
-const payAmount = 0.003403
-
-//const payAmount = 0.000141
 const chaingateProfit = payAmount * 0.01
 
 var testPaymentState = model.PaymentState{
@@ -44,6 +44,7 @@ var testPayment = model.Payment{
 	Account:               nil,
 	MerchantWallet:        "",
 	Mode:                  enum.Test,
+	Network:               model.Regtest,
 	PriceAmount:           100,
 	PriceCurrency:         enum.USD,
 	CurrentPaymentState:   testPaymentState,
@@ -58,12 +59,11 @@ func TestMain(m *testing.M) {
 	}
 
 	//setup db
-	dbRessource, r1, r2, err := testutils.DbTestSetup(pool)
+	dbRessource, repos, uow, err := testutils.DbTestSetup(pool, "test-db")
 	if err != nil {
 		log.Fatalf("Could not setup DB: %s", err)
 	}
-	accountRepo = r1
-	paymentRepo = r2
+	setRepositories(repos, uow)
 
 	//setup bitcoin node
 	bitcoinSetupResult, err := testutils.BitcoinNodeTestSetup(pool)
@@ -78,7 +78,7 @@ func TestMain(m *testing.M) {
 		return
 	}
 	testPayment.MerchantWallet = merchantAddress.String()
-	service = NewBitcoinService(accountRepo, paymentRepo, chaingateClient, nil)
+	service = NewBitcoinService(repos, unitOfWork, map[model.Network]node.BitcoinNode{model.Regtest: chaingateClient}, nil, nil)
 
 	//Run tests
 	code := m.Run()
@@ -126,6 +126,7 @@ func TestBitcoinService_CreateNewPayment(t *testing.T) {
 	if payment.Account.Address == "" ||
 		payment.MerchantWallet != testPayment.MerchantWallet ||
 		payment.Mode != testPayment.Mode ||
+		payment.Network != testPayment.Network ||
 		payment.PriceAmount != testPayment.PriceAmount ||
 		payment.PriceCurrency != testPayment.PriceCurrency ||
 		payment.CurrentPaymentStateId.String() == "" ||
@@ -133,6 +134,7 @@ func TestBitcoinService_CreateNewPayment(t *testing.T) {
 		t.Errorf("Expected address to not be empty, but got %s", payment.Account.Address)
 		t.Errorf("Expected %s, but got %s", testPayment.MerchantWallet, payment.MerchantWallet)
 		t.Errorf("Expected %d, but got %d", testPayment.Mode, payment.Mode)
+		t.Errorf("Expected %s, but got %s", testPayment.Network, payment.Network)
 		t.Errorf("Expected %f, but got %f", testPayment.PriceAmount, payment.PriceAmount)
 		t.Errorf("Expected %d, but got %d", testPayment.PriceCurrency, payment.PriceCurrency)
 		t.Errorf("Expected CurrentPaymentStateId to not be ampty, but got %s", payment.CurrentPaymentStateId.String())
@@ -149,9 +151,33 @@ func TestBitcoinService_CreateNewPayment(t *testing.T) {
 		t.Errorf("Expected payment state to be: %v but got %v", testPaymentState, payment.PaymentStates[0])
 	}
 
+	expiresIn := time.Until(payment.ExpiresAt)
+	if expiresIn <= 14*time.Minute || expiresIn > 15*time.Minute {
+		t.Errorf("Expected payment to expire in 15 minutes, but got %s", expiresIn)
+	}
+
 	payAddress = payment.Account.Address
 }
 
+func TestBitcoinService_CreateNewPaymentExpiryOutOfBounds(t *testing.T) {
+	// Arrange
+	request := openApi.PaymentRequestDto{
+		PriceCurrency:    "usd",
+		PriceAmount:      100,
+		Wallet:           testPayment.MerchantWallet,
+		Mode:             "test",
+		ExpiresInMinutes: int32(utils.Opts.PaymentExpiryMax + 1),
+	}
+
+	// Act
+	payment, err := service.CreateNewPayment(request)
+
+	// Assert
+	if err == nil || payment != nil {
+		t.Errorf("Expected expiry of %d minutes to be rejected, but got %v", request.ExpiresInMinutes, payment)
+	}
+}
+
 func TestBitcoinService_HandleWalletNotify(t *testing.T) {
 	// Arrange
 	defer gock.Off()
@@ -175,7 +201,7 @@ func TestBitcoinService_HandleWalletNotify(t *testing.T) {
 	time.Sleep(10 * time.Second)
 
 	// Act
-	service.HandleWalletNotify(txId.String(), enum.Test)
+	service.HandleWalletNotify(txId.String(), model.Regtest)
 
 	// Assert
 	account, err := accountRepo.FindByAddress(payAddress)
@@ -232,7 +258,7 @@ func TestBitcoinService_HandleBlockNotify(t *testing.T) {
 	}
 
 	// Act
-	service.HandleBlockNotify("", enum.Test)
+	service.HandleBlockNotify("", model.Regtest)
 
 	// Assert
 	account, err := accountRepo.FindByAddress(payAddress)
@@ -349,7 +375,7 @@ func TestBitcoinService_HandleBlockNotify2(t *testing.T) {
 	}
 
 	// Act
-	service.HandleBlockNotify("", enum.Test)
+	service.HandleBlockNotify("", model.Regtest)
 
 	// Assert
 	account, err := accountRepo.FindByAddress(payAddress)
@@ -444,3 +470,149 @@ func TestBitcoinService_HandleBlockNotify2(t *testing.T) {
 		t.Errorf("Expected account to be free")
 	}
 }
+
+func TestBitcoinService_GetPayment(t *testing.T) {
+	// Arrange
+	account, err := accountRepo.FindByAddress(payAddress)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	// Act
+	payment, err := service.GetPayment(account.Payments[0].ID)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	// Assert
+	if payment.Account.Address != payAddress ||
+		payment.CurrentPaymentState.StateID != enum.Finished ||
+		len(payment.PaymentStates) != 5 ||
+		payment.PaymentStates[0].StateID != enum.Waiting ||
+		payment.ForwardingTransactionHash == nil {
+		t.Errorf("Expected finished payment on address %s with 5 states, but got %v", payAddress, payment)
+	}
+
+	notFound, err := service.GetPayment(uuid.New())
+	if err != nil || notFound != nil {
+		t.Errorf("Expected no payment and no error, but got %v, %v", notFound, err)
+	}
+}
+
+func TestBitcoinService_GetPayments(t *testing.T) {
+	// Arrange
+	mode := enum.Test
+	finished := enum.Finished
+	waiting := enum.Waiting
+	from := time.Now().Add(-time.Hour)
+
+	// Act
+	payments, total, err := service.GetPayments(repository.PaymentFilter{
+		Mode:           &mode,
+		State:          &finished,
+		MerchantWallet: testPayment.MerchantWallet,
+		CreatedFrom:    &from,
+		Limit:          10,
+	})
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	_, waitingTotal, err := service.GetPayments(repository.PaymentFilter{State: &waiting, Limit: 10})
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	// Assert
+	if total != 1 || len(payments) != 1 || payments[0].Account.Address != payAddress {
+		t.Errorf("Expected 1 finished payment, but got %d", total)
+	}
+	if waitingTotal != 0 {
+		t.Errorf("Expected 0 waiting payments, but got %d", waitingTotal)
+	}
+}
+
+func TestBitcoinService_Resync(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		Reply(200).
+		JSON(map[string]interface{}{"src_currency": "usd", "dst_currency": "btc", "price": payAmount})
+
+	payment, err := service.CreateNewPayment(openApi.PaymentRequestDto{
+		PriceCurrency: "usd",
+		PriceAmount:   100,
+		Wallet:        testPayment.MerchantWallet,
+		Mode:          "test",
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	decodedAddress, err := btcutil.DecodeAddress(payment.Account.Address, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	amount, err := btcutil.NewAmount(payAmount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// the wallet notification for this transaction is never handled
+	_, err = buyerClient.SendToAddress(decodedAddress, amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// wait for transaction to be published
+	time.Sleep(10 * time.Second)
+
+	// Act
+	service.Resync(model.Regtest)
+
+	// Assert
+	resynced, err := paymentRepo.FindByID(payment.ID)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if resynced.CurrentPaymentState.StateID != enum.Paid ||
+		resynced.CurrentPaymentState.AmountReceived.Cmp(&testPaymentState.PayAmount.Int) != 0 {
+		t.Errorf("Expected missed payment to be paid, but got %s", resynced.CurrentPaymentState.StateID)
+	}
+
+	cursor, err := chainCursorRepo.FindByNetwork(model.Regtest)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if cursor == nil || cursor.LastBlockHash == "" {
+		t.Errorf("Expected last processed block to be saved")
+	}
+}
+
+func TestBitcoinService_ResolveNetwork(t *testing.T) {
+	s := &bitcoinService{clients: map[model.Network]node.BitcoinNode{model.Regtest: nil, model.Signet: nil, model.Mainnet: nil}}
+
+	tests := []struct {
+		mode     enum.Mode
+		network  string
+		expected model.Network
+		valid    bool
+	}{
+		{enum.Test, "", model.Signet, true},
+		{enum.Main, "", model.Mainnet, true},
+		{enum.Test, "regtest", model.Regtest, true},
+		{enum.Test, "mainnet", 0, false},
+		{enum.Main, "signet", 0, false},
+		{enum.Test, "testnet", 0, false},
+		{enum.Test, "unknown", 0, false},
+	}
+
+	for _, tt := range tests {
+		network, err := s.ResolveNetwork(tt.mode, tt.network)
+		if tt.valid && (err != nil || network != tt.expected) {
+			t.Errorf("Expected %s for mode %s and network %q, but got %d, %v", tt.expected, tt.mode, tt.network, network, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("Expected network %q to be rejected in mode %s, but got %s", tt.network, tt.mode, network)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"log"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+)
+
+// blockLockNamespace keeps the advisory locks of the block processing apart from other advisory locks on the database
+const blockLockNamespace int64 = 0x626c6f636b << 24
+
+// getBlockLockKey is the advisory lock of the block processing of the network
+func getBlockLockKey(network model.Network) int64 {
+	return blockLockNamespace | int64(network)
+}
+
+// withBlockLock runs fn while holding the block lock of the network. Operator actions take it as well, so they neither
+// spend the funds of an address the block handlers are forwarding nor change a payment while it is processed.
+// fn has to read what it changes again, the lock is not taken again by the block handlers it calls.
+func (s *bitcoinService) withBlockLock(network model.Network, fn func() error) error {
+	var err error
+	lockErr := s.advisoryLockRepository.WithLock(getBlockLockKey(network), func() {
+		err = fn()
+	})
+	if lockErr != nil {
+		return lockErr
+	}
+	return err
+}
+
+type IBlockWorker interface {
+	IBitcoinService
+	Start()
+}
+
+// blockWorker processes the blocks of each network in the background. HandleBlockNotify only queues the processing
+// and returns, notifications arriving while the network is processed are coalesced into one more run.
+// All other calls go to the wrapped service.
+type blockWorker struct {
+	IBitcoinService
+	pending map[model.Network]chan struct{}
+}
+
+func NewBlockWorker(bitcoinService IBitcoinService, networks ...model.Network) IBlockWorker {
+	pending := make(map[model.Network]chan struct{})
+	for _, network := range networks {
+		pending[network] = make(chan struct{}, 1)
+	}
+	return &blockWorker{IBitcoinService: bitcoinService, pending: pending}
+}
+
+// Start runs one worker per network
+func (w *blockWorker) Start() {
+	for network, pending := range w.pending {
+		go func(network model.Network, pending chan struct{}) {
+			for range pending {
+				w.IBitcoinService.HandleBlockNotify("", network)
+			}
+		}(network, pending)
+	}
+}
+
+func (w *blockWorker) HandleBlockNotify(blockHash string, network model.Network) {
+	pending, ok := w.pending[network]
+	if !ok {
+		log.Printf("block %s of network %s is not processed, the network is not configured", blockHash, network)
+		return
+	}
+	select {
+	case pending <- struct{}{}:
+	default:
+		// a queued run handles the block as well, the handlers don't depend on the block hash
+	}
+}
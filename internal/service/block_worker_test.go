@@ -0,0 +1,68 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+)
+
+// blockingBitcoinService holds every block run until it is released
+type blockingBitcoinService struct {
+	recordingBitcoinService
+	started chan model.Network
+	release chan struct{}
+}
+
+func (b *blockingBitcoinService) HandleBlockNotify(_ string, network model.Network) {
+	b.started <- network
+	<-b.release
+}
+
+func TestBlockWorker_CoalescesNotifications(t *testing.T) {
+	// Arrange
+	blocking := &blockingBitcoinService{started: make(chan model.Network, 10), release: make(chan struct{})}
+	worker := NewBlockWorker(blocking, model.Regtest, model.Signet)
+	worker.Start()
+
+	// Act
+	returned := make(chan struct{})
+	go func() {
+		worker.HandleBlockNotify("first", model.Regtest)
+		returned <- struct{}{}
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the notification to return before the block is processed")
+	}
+	<-blocking.started
+	for i := 0; i < 5; i++ {
+		worker.HandleBlockNotify("later", model.Regtest)
+	}
+	worker.HandleBlockNotify("signet", model.Signet)
+	worker.HandleBlockNotify("unknown", model.Mainnet)
+
+	runs := map[model.Network]int{model.Regtest: 1}
+	timeout := time.After(time.Second)
+	for waiting := true; waiting; {
+		select {
+		case blocking.release <- struct{}{}:
+		case network := <-blocking.started:
+			runs[network]++
+		case <-timeout:
+			waiting = false
+		}
+	}
+
+	// Assert
+	if runs[model.Regtest] != 2 {
+		t.Errorf("Expected the regtest notifications to be coalesced into 2 runs, but got %d", runs[model.Regtest])
+	}
+	if runs[model.Signet] != 1 {
+		t.Errorf("Expected 1 signet run, but got %d", runs[model.Signet])
+	}
+	if runs[model.Mainnet] != 0 {
+		t.Errorf("Expected no run of an unconfigured network, but got %d", runs[model.Mainnet])
+	}
+}
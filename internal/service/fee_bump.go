@@ -0,0 +1,255 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"math"
+	"math/big"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/node"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/google/uuid"
+)
+
+// saveForwardingTransaction sets the sent version of the forwarding transaction on the payment and adds it to the history.
+// The payment is debited from the balance of the merchant.
+func (s *bitcoinService) saveForwardingTransaction(payment *model.Payment, txHash string, network model.Network) error {
+	height := s.getForwardingHeight(network)
+	return s.unitOfWork.WithTx(func(tx *repository.Repositories) error {
+		return saveForwarding(tx, payment, txHash, height)
+	})
+}
+
+// saveForwarding is saveForwardingTransaction in the transaction of tx, the backend is notified of the forwarding transaction
+func saveForwarding(tx *repository.Repositories, payment *model.Payment, txHash string, height *int32) error {
+	var conf int64 = 0
+	payment.ForwardingTransactionHash = &txHash
+	payment.ForwardingConfirmations = &conf
+
+	err := tx.Payment.Update(payment)
+	if err != nil {
+		return err
+	}
+	err = tx.Outbox.Create(newOutboxNotification(payment))
+	if err != nil {
+		return err
+	}
+	// replacements find the payment paid out already
+	err = debitMerchant(tx.MerchantLedger, payment, model.LedgerPayout, &txHash)
+	if err != nil {
+		return err
+	}
+	// the transaction is already sent, a missing history only makes it eligible for a bump earlier
+	if height == nil {
+		return nil
+	}
+	return recordForwardingVersion(tx.ForwardingTransaction, payment, txHash, *height)
+}
+
+// getForwardingHeight is the height a forwarding transaction is sent at, nil if the node can't tell.
+// handleStuckForwardings records the versions without a height later.
+func (s *bitcoinService) getForwardingHeight(network model.Network) *int32 {
+	client, err := s.getClientByNetwork(network)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	info, err := client.GetBlockChainInfo()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return &info.Blocks
+}
+
+func recordForwardingVersion(forwardingRepository repository.IForwardingTransactionRepository, payment *model.Payment, txHash string, height int32) error {
+	return forwardingRepository.Create(&model.ForwardingTransaction{
+		Base:      model.Base{ID: uuid.New()},
+		PaymentID: payment.ID,
+		TxHash:    txHash,
+		Height:    height,
+	})
+}
+
+// handleStuckForwardings replaces forwarding transactions which are not confirmed after FeeBumpBlocks blocks
+// with a version paying a higher fee. The transactions signal BIP125 replaceability when they are funded.
+func (s *bitcoinService) handleStuckForwardings(network model.Network) {
+	if utils.Opts.FeeBumpBlocks <= 0 {
+		return
+	}
+
+	client, err := s.getClientByNetwork(network)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	info, err := client.GetBlockChainInfo()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	payments, err := s.paymentRepository.FindConfirmedPaymentsByNetwork(network)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	bumpedBatches := make(map[uuid.UUID]bool)
+	for _, payment := range payments {
+		if payment.ForwardingTransactionHash == nil {
+			continue
+		}
+		transaction, err := getTransaction(client, *payment.ForwardingTransactionHash)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if transaction.Confirmations != 0 {
+			continue
+		}
+
+		versions, err := s.forwardingRepository.FindByPayment(payment.ID)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		// sent before versions were recorded, the waiting starts now
+		if len(versions) == 0 {
+			err = recordForwardingVersion(s.forwardingRepository, &payment, *payment.ForwardingTransactionHash, info.Blocks)
+			if err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		if info.Blocks-versions[len(versions)-1].Height < int32(utils.Opts.FeeBumpBlocks) {
+			continue
+		}
+
+		// the payments of a batch share the transaction, it is replaced once for all of them
+		if payment.PayoutBatchID != nil {
+			if !bumpedBatches[*payment.PayoutBatchID] {
+				bumpedBatches[*payment.PayoutBatchID] = true
+				err = s.bumpPayoutBatch(client, *payment.PayoutBatchID, transaction, network)
+				if err != nil {
+					log.Println(err)
+				}
+			}
+			continue
+		}
+
+		txHash, err := s.bumpForwardingTransaction(client, &payment, transaction, network)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("forwarding transaction %s of payment %s replaced by %s", *payment.ForwardingTransactionHash, payment.ID, txHash)
+
+		err = s.saveForwardingTransaction(&payment, txHash, network)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// bumpForwardingTransaction sends a version of the transaction spending the same inputs with a higher fee rate.
+// Like the original the fee is subtracted from the amount of the merchant.
+func (s *bitcoinService) bumpForwardingTransaction(client node.BitcoinNode, payment *model.Payment, transaction *btcjson.GetTransactionResult, network model.Network) (string, error) {
+	outputs := map[string]*big.Int{payment.MerchantWallet: getPayoutAmount(payment)}
+	_, txHash, err := replaceTransaction(client, transaction, outputs, network)
+	return txHash, err
+}
+
+// replaceTransaction sends a version of the transaction paying the outputs from the same inputs with a higher fee rate
+func replaceTransaction(client node.BitcoinNode, transaction *btcjson.GetTransactionResult, outputs map[string]*big.Int, network model.Network) (*btcjson.FundRawTransactionResult, string, error) {
+	original, err := decodeTransaction(transaction.Hex)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var inputs []btcjson.TransactionInput
+	for _, in := range original.TxIn {
+		inputs = append(inputs, btcjson.TransactionInput{
+			Txid: in.PreviousOutPoint.Hash.String(),
+			Vout: in.PreviousOutPoint.Index,
+		})
+	}
+
+	rawTransaction, err := createRawTransactionWithOutputs(client, inputs, outputs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	feeRate, err := getBumpedFeeRate(client, transaction, original)
+	if err != nil {
+		return nil, "", err
+	}
+	fundedTransaction, err := fundTransactionWithFeeRate(client, rawTransaction, getNetworkOpts(network).changeAddress, feeRate)
+	if err != nil {
+		return nil, "", err
+	}
+
+	txHash, err := signTransaction(client, fundedTransaction, network)
+	if err != nil {
+		return nil, "", err
+	}
+	return fundedTransaction, txHash.String(), nil
+}
+
+// getBumpedFeeRate raises the fee rate of the stuck transaction by FeeBumpPercentage, or uses the estimate if it is higher.
+// The size without witness is at most the virtual size, so the fee rate of the stuck transaction is not underestimated.
+func getBumpedFeeRate(client node.BitcoinNode, transaction *btcjson.GetTransactionResult, original *wire.MsgTx) (*float64, error) {
+	fee, err := btcutil.NewAmount(math.Abs(transaction.Fee))
+	if err != nil {
+		return nil, err
+	}
+	previous := fee.ToBTC() * 1000 / float64(original.SerializeSizeStripped())
+	bumped := previous * (1 + float64(utils.Opts.FeeBumpPercentage)/100)
+
+	estimate, err := getFeeRate(client)
+	if err != nil {
+		return nil, err
+	}
+	if *estimate > bumped {
+		bumped = *estimate
+	}
+	return &bumped, nil
+}
+
+// findConfirmedForwarding looks for a confirmed version of a replaced forwarding transaction and sets it on the payment
+func (s *bitcoinService) findConfirmedForwarding(client node.BitcoinNode, payment *model.Payment, transaction *btcjson.GetTransactionResult) (*btcjson.GetTransactionResult, error) {
+	versions, err := s.forwardingRepository.FindByPayment(payment.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		versionTransaction, err := getTransaction(client, version.TxHash)
+		if err != nil {
+			return nil, err
+		}
+		if versionTransaction.Confirmations > 0 {
+			txHash := version.TxHash
+			payment.ForwardingTransactionHash = &txHash
+			return versionTransaction, nil
+		}
+	}
+	return transaction, nil
+}
+
+func decodeTransaction(txHex string) (*wire.MsgTx, error) {
+	raw, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, err
+	}
+	var tx wire.MsgTx
+	err = tx.Deserialize(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/openApi"
+)
+
+// ErrIdempotencyConflict is returned if the idempotency key of a payment request was used with a different request
+var ErrIdempotencyConflict = errors.New("idempotency key was used for a different payment request")
+
+// findIdempotentPayment returns the payment created by an earlier request with the same idempotency key, e.g. when
+// the backend retries after a timeout. It returns nil if the request has no key or the key is new.
+func (s *bitcoinService) findIdempotentPayment(paymentRequest openApi.PaymentRequestDto) (*model.Payment, error) {
+	if paymentRequest.IdempotencyKey == "" {
+		return nil, nil
+	}
+	payment, err := s.paymentRepository.FindByIdempotencyKey(paymentRequest.IdempotencyKey)
+	if err != nil || payment == nil {
+		return nil, err
+	}
+
+	fingerprint, err := getRequestFingerprint(paymentRequest)
+	if err != nil {
+		return nil, err
+	}
+	if payment.RequestFingerprint != fingerprint {
+		return nil, ErrIdempotencyConflict
+	}
+	return payment, nil
+}
+
+// getRequestFingerprint hashes the fields of the request except the idempotency key
+func getRequestFingerprint(paymentRequest openApi.PaymentRequestDto) (string, error) {
+	paymentRequest.IdempotencyKey = ""
+	body, err := json.Marshal(paymentRequest)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:]), nil
+}
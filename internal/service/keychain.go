@@ -0,0 +1,247 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/node"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+)
+
+// ErrGapLimitReached is returned if ACCOUNT_GAP_LIMIT addresses after the last funded one are held by open payments
+var ErrGapLimitReached = errors.New("gap limit reached, no payment address can be derived until an open payment is paid or expires")
+
+// BIP84 accounts are often exported with the SLIP-132 versions zpub and vpub instead of xpub and tpub
+var (
+	zpubKeyID = [4]byte{0x04, 0xb2, 0x47, 0x46}
+	zprvKeyID = [4]byte{0x04, 0xb2, 0x43, 0x0c}
+	vpubKeyID = [4]byte{0x04, 0x5f, 0x1c, 0xf6}
+	vprvKeyID = [4]byte{0x04, 0x5f, 0x18, 0xbc}
+)
+
+// accountKeyDepth is the depth of m/84'/coin'/account'
+const accountKeyDepth = 3
+
+// AccountKeychain derives the payment addresses of a network from the BIP84 account xpub, m/84'/coin'/account'/0/i.
+// The node only watches the addresses, the transactions spending them are signed with the account xprv.
+type AccountKeychain struct {
+	params     *chaincfg.Params
+	receiveKey *hdkeychain.ExtendedKey
+	signingKey *hdkeychain.ExtendedKey // nil without an account xprv
+	descriptor string
+
+	mu          sync.Mutex
+	importedEnd int64 // last index imported into the node, -1 before the first import
+}
+
+// NewAccountKeychain returns the keychain of the account xpub configured for the network, nil if there is none
+func NewAccountKeychain(network model.Network) (*AccountKeychain, error) {
+	opts := getNetworkOpts(network)
+	if opts.accountXpub == "" {
+		if opts.accountXprv != "" {
+			return nil, fmt.Errorf("the %s account xprv requires the account xpub", network)
+		}
+		return nil, nil
+	}
+
+	params := getChainParams(network)
+	accountKey, err := parseAccountKey(opts.accountXpub, params, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s account xpub: %v", network, err)
+	}
+	receiveKey, err := accountKey.Derive(0)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := descriptorChecksum(fmt.Sprintf("wpkh(%s/0/*)", accountKey))
+	if err != nil {
+		return nil, err
+	}
+	keychain := &AccountKeychain{
+		params:      params,
+		receiveKey:  receiveKey,
+		descriptor:  fmt.Sprintf("wpkh(%s/0/*)#%s", accountKey, checksum),
+		importedEnd: -1,
+	}
+
+	if opts.accountXprv != "" {
+		privateKey, err := parseAccountKey(opts.accountXprv, params, true)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s account xprv: %v", network, err)
+		}
+		publicKey, err := privateKey.Neuter()
+		if err != nil {
+			return nil, err
+		}
+		if publicKey.String() != accountKey.String() {
+			return nil, fmt.Errorf("the %s account xprv does not belong to the account xpub", network)
+		}
+		keychain.signingKey, err = privateKey.Derive(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keychain, nil
+}
+
+// parseAccountKey returns the account key with the xpub or xprv version of params, so bitcoind accepts it
+func parseAccountKey(key string, params *chaincfg.Params, private bool) (*hdkeychain.ExtendedKey, error) {
+	extendedKey, err := hdkeychain.NewKeyFromString(key)
+	if err != nil {
+		return nil, err
+	}
+	if extendedKey.IsPrivate() != private {
+		return nil, errors.New("wrong key type")
+	}
+	if extendedKey.Depth() != accountKeyDepth {
+		return nil, fmt.Errorf("key of depth %d is not an account key m/84'/coin'/account'", extendedKey.Depth())
+	}
+
+	standard, bip84 := params.HDPublicKeyID, vpubKeyID
+	if private {
+		standard, bip84 = params.HDPrivateKeyID, vprvKeyID
+	}
+	if params.Name == chaincfg.MainNetParams.Name {
+		bip84 = zpubKeyID
+		if private {
+			bip84 = zprvKeyID
+		}
+	}
+	version := extendedKey.Version()
+	if !bytes.Equal(version, standard[:]) && !bytes.Equal(version, bip84[:]) {
+		return nil, fmt.Errorf("key is not for %s", params.Name)
+	}
+	return extendedKey.CloneWithVersion(standard[:])
+}
+
+func getChainParams(network model.Network) *chaincfg.Params {
+	switch network {
+	case model.Mainnet:
+		return &chaincfg.MainNetParams
+	case model.Testnet:
+		return &chaincfg.TestNet3Params
+	case model.Signet:
+		return &chaincfg.SigNetParams
+	default:
+		return &chaincfg.RegressionNetParams
+	}
+}
+
+// nextIndex returns the receive index after the last derived one. An address more than ACCOUNT_GAP_LIMIT after the
+// last funded one is not derived, a wallet restored from the xpub would not find it.
+func nextIndex(lastDerived *int64, lastFunded *int64) (int64, error) {
+	index := int64(0)
+	if lastDerived != nil {
+		index = *lastDerived + 1
+	}
+	funded := int64(-1)
+	if lastFunded != nil {
+		funded = *lastFunded
+	}
+	if utils.Opts.AccountGapLimit > 0 && index-funded > int64(utils.Opts.AccountGapLimit) {
+		return 0, ErrGapLimitReached
+	}
+	return index, nil
+}
+
+// address returns the receive address m/84'/coin'/account'/0/index
+func (k *AccountKeychain) address(index int64) (btcutil.Address, error) {
+	child, err := k.receiveKey.Derive(uint32(index))
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := child.ECPubKey()
+	if err != nil {
+		return nil, err
+	}
+	return btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(publicKey.SerializeCompressed()), k.params)
+}
+
+func (k *AccountKeychain) privateKey(index int64) (*btcec.PrivateKey, error) {
+	if k.signingKey == nil {
+		return nil, fmt.Errorf("no account xprv configured to sign for %s", k.params.Name)
+	}
+	child, err := k.signingKey.Derive(uint32(index))
+	if err != nil {
+		return nil, err
+	}
+	return child.ECPrivKey()
+}
+
+// importAddresses makes the watch-only wallet watch the addresses up to ACCOUNT_GAP_LIMIT after index. New addresses
+// have no history, so the node does not rescan.
+func (k *AccountKeychain) importAddresses(wallet node.BitcoinNode, index int64) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if index <= k.importedEnd {
+		return nil
+	}
+
+	end := index + int64(utils.Opts.AccountGapLimit)
+	err := node.ImportDescriptors(wallet, []node.ImportDescriptorRequest{{
+		Descriptor: k.descriptor,
+		Range:      []int64{k.importedEnd + 1, end},
+		Timestamp:  "now",
+	}})
+	if err != nil {
+		return err
+	}
+	k.importedEnd = end
+	return nil
+}
+
+const (
+	descriptorInputCharset    = "0123456789()[],'/*abcdefgh@:$%{}IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	descriptorChecksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+// descriptorChecksum returns the checksum bitcoind requires for imported descriptors, see BIP 380
+func descriptorChecksum(descriptor string) (string, error) {
+	c := uint64(1)
+	class, classCount := 0, 0
+	for _, ch := range descriptor {
+		position := strings.IndexRune(descriptorInputCharset, ch)
+		if position < 0 {
+			return "", fmt.Errorf("invalid character %q in descriptor", ch)
+		}
+		c = descriptorPolymod(c, position&31)
+		class = class*3 + position>>5
+		classCount++
+		if classCount == 3 {
+			c = descriptorPolymod(c, class)
+			class, classCount = 0, 0
+		}
+	}
+	if classCount > 0 {
+		c = descriptorPolymod(c, class)
+	}
+	for i := 0; i < 8; i++ {
+		c = descriptorPolymod(c, 0)
+	}
+	c ^= 1
+
+	checksum := make([]byte, 8)
+	for i := range checksum {
+		checksum[i] = descriptorChecksumCharset[(c>>(5*(7-i)))&31]
+	}
+	return string(checksum), nil
+}
+
+func descriptorPolymod(c uint64, value int) uint64 {
+	c0 := c >> 35
+	c = ((c & 0x7ffffffff) << 5) ^ uint64(value)
+	for i, generator := range []uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd} {
+		if c0&(1<<i) != 0 {
+			c ^= generator
+		}
+	}
+	return c
+}
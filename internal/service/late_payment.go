@@ -0,0 +1,238 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/google/uuid"
+)
+
+// handleLatePayment records funds which arrive after the latest payment on the address expired,
+// instead of leaving them on the address where the next payment would count them.
+// It returns false if the latest payment on the address is not expired.
+func (s *bitcoinService) handleLatePayment(transaction *btcjson.GetTransactionResult, address string, network model.Network) bool {
+	account, err := s.accountRepository.FindByAddress(address)
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+	if account.ID == uuid.Nil {
+		return false
+	}
+
+	expiredPayment := getLatestPayment(account.Payments)
+	if expiredPayment == nil || expiredPayment.CurrentPaymentState.StateID != enum.Expired {
+		return false
+	}
+	// the funds received before the payment expired were added to the remainder, e.g. when Resync replays them.
+	// TimeReceived has a precision of seconds.
+	expiredAt := expiredPayment.CurrentPaymentState.CreatedAt.Truncate(time.Second)
+	if time.Unix(transaction.TimeReceived, 0).Before(expiredAt) {
+		return true
+	}
+
+	existing, err := s.latePaymentRepository.FindByAccountAndTxHash(account.ID, transaction.TxID)
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+	// the transaction was already handled, e.g. when it is replayed
+	if existing != nil {
+		return true
+	}
+
+	amount, err := getReceivedAmount(transaction, address)
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+
+	latePayment := &model.LatePayment{
+		Base:      model.Base{ID: uuid.New()},
+		PaymentID: expiredPayment.ID,
+		AccountID: account.ID,
+		Address:   address,
+		TxHash:    transaction.TxID,
+		Network:   network,
+		Amount:    model.NewBigInt(amount),
+		Status:    model.LatePaymentPending,
+	}
+
+	// keep the account away from new payments until the late payment is resolved
+	account.Payments = nil
+	account.Used = true
+
+	err = s.unitOfWork.WithTx(func(tx *repository.Repositories) error {
+		err := tx.LatePayment.Create(latePayment)
+		if err != nil {
+			return err
+		}
+		err = tx.Account.Update(account)
+		if err != nil {
+			return err
+		}
+		return tx.Outbox.Create(newLatePaymentNotification(expiredPayment, latePayment))
+	})
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+
+	log.Printf("late payment of %s satoshi for expired payment %s", amount, expiredPayment.ID)
+	return true
+}
+
+func (s *bitcoinService) GetLatePayments(status model.LatePaymentStatus) ([]model.LatePayment, error) {
+	return s.latePaymentRepository.FindByStatus(status)
+}
+
+// HonorLatePayment forwards the late funds to the merchant of the expired payment, minus the chaingate fee
+func (s *bitcoinService) HonorLatePayment(latePaymentId uuid.UUID) (*model.LatePayment, error) {
+	return s.resolveLatePaymentWithLock(latePaymentId, func() (*model.LatePayment, error) {
+		return s.honorLatePayment(latePaymentId)
+	})
+}
+
+func (s *bitcoinService) honorLatePayment(latePaymentId uuid.UUID) (*model.LatePayment, error) {
+	latePayment, err := s.findPendingLatePayment(latePaymentId)
+	if err != nil || latePayment == nil {
+		return nil, err
+	}
+
+	forwardAmount := calculateForwardAmount(&latePayment.Amount.Int)
+	txHash, err := s.createTransactionFromTx(latePayment.Address, latePayment.Payment.MerchantWallet, forwardAmount, latePayment.TxHash, latePayment.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	latePayment.Status = model.LatePaymentHonored
+	latePayment.ResolvingTransactionHash = &txHash
+	err = s.resolveLatePayment(latePayment)
+	if err != nil {
+		return nil, err
+	}
+	return latePayment, nil
+}
+
+// RefundLatePayment sends the late funds back to the buyer, the network fee is paid from the refund
+func (s *bitcoinService) RefundLatePayment(latePaymentId uuid.UUID, refundAddress string) (*model.LatePayment, error) {
+	return s.resolveLatePaymentWithLock(latePaymentId, func() (*model.LatePayment, error) {
+		return s.refundLatePayment(latePaymentId, refundAddress)
+	})
+}
+
+func (s *bitcoinService) refundLatePayment(latePaymentId uuid.UUID, refundAddress string) (*model.LatePayment, error) {
+	latePayment, err := s.findPendingLatePayment(latePaymentId)
+	if err != nil || latePayment == nil {
+		return nil, err
+	}
+
+	client, err := s.getClientByNetwork(latePayment.Network)
+	if err != nil {
+		return nil, err
+	}
+	err = validateAddress(client, refundAddress, latePayment.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	txHash, err := s.createTransactionFromTx(latePayment.Address, refundAddress, &latePayment.Amount.Int, latePayment.TxHash, latePayment.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	latePayment.Status = model.LatePaymentRefunded
+	latePayment.RefundAddress = refundAddress
+	latePayment.ResolvingTransactionHash = &txHash
+	err = s.resolveLatePayment(latePayment)
+	if err != nil {
+		return nil, err
+	}
+	return latePayment, nil
+}
+
+// resolveLatePaymentWithLock runs resolve under the block lock of the network of the late payment. resolve reads the
+// late payment again, so of two concurrent decisions the second one finds it resolved.
+func (s *bitcoinService) resolveLatePaymentWithLock(latePaymentId uuid.UUID, resolve func() (*model.LatePayment, error)) (*model.LatePayment, error) {
+	latePayment, err := s.latePaymentRepository.FindByID(latePaymentId)
+	if err != nil || latePayment == nil {
+		return nil, err
+	}
+
+	var resolved *model.LatePayment
+	err = s.withBlockLock(latePayment.Network, func() (err error) {
+		resolved, err = resolve()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+func (s *bitcoinService) findPendingLatePayment(latePaymentId uuid.UUID) (*model.LatePayment, error) {
+	latePayment, err := s.latePaymentRepository.FindByID(latePaymentId)
+	if err != nil || latePayment == nil {
+		return nil, err
+	}
+	if latePayment.Status != model.LatePaymentPending {
+		return nil, fmt.Errorf("late payment %s is already %s", latePaymentId, latePayment.Status)
+	}
+	return latePayment, nil
+}
+
+// resolveLatePayment saves the decision and frees the account once no late payment on it is pending
+func (s *bitcoinService) resolveLatePayment(latePayment *model.LatePayment) error {
+	return s.unitOfWork.WithTx(func(tx *repository.Repositories) error {
+		err := tx.LatePayment.Update(latePayment)
+		if err != nil {
+			return err
+		}
+
+		pending, err := tx.LatePayment.CountPendingByAccount(latePayment.AccountID)
+		if err != nil {
+			return err
+		}
+		if pending == 0 {
+			account, err := tx.Account.FindByAddress(latePayment.Address)
+			if err != nil {
+				return err
+			}
+			account.Payments = nil
+			account.Used = false
+			err = tx.Account.Update(account)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Outbox.Create(newLatePaymentNotification(latePayment.Payment, latePayment))
+	})
+}
+
+func getLatestPayment(payments []model.Payment) *model.Payment {
+	var latest *model.Payment
+	for i := range payments {
+		if latest == nil || payments[i].CreatedAt.After(latest.CreatedAt) {
+			latest = &payments[i]
+		}
+	}
+	return latest
+}
+
+// getReceivedAmount sums the outputs of the transaction which pay to the address
+func getReceivedAmount(transaction *btcjson.GetTransactionResult, address string) (*big.Int, error) {
+	amount := 0.0
+	for _, detail := range transaction.Details {
+		if detail.Category == "receive" && detail.Address == address {
+			amount = amount + detail.Amount
+		}
+	}
+	return convertBtcToSatoshi(amount)
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/google/uuid"
+)
+
+// GetMerchantLedger returns the entries of the wallet on the network and the balance which is not paid out yet
+func (s *bitcoinService) GetMerchantLedger(wallet string, network model.Network) ([]model.MerchantLedgerEntry, *big.Int, error) {
+	entries, err := s.merchantLedgerRepository.FindByWallet(wallet, network)
+	if err != nil {
+		return nil, nil, err
+	}
+	balance, err := s.merchantLedgerRepository.GetBalance(wallet, network)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entries, balance, nil
+}
+
+// creditMerchant adds the forward amount of a confirmed payment to the balance of the merchant.
+// It does nothing if the payment is credited or paid out already.
+// The ledger is the one of the transaction which saves the confirmed payment.
+func creditMerchant(ledgerRepository repository.IMerchantLedgerRepository, payment *model.Payment) error {
+	entries, err := ledgerRepository.FindByPayment(payment.ID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Kind == model.LedgerPayout {
+			return nil
+		}
+	}
+	if getLedgerBalance(entries).Sign() != 0 {
+		return nil
+	}
+
+	return ledgerRepository.Create(&model.MerchantLedgerEntry{
+		Base:      model.Base{ID: uuid.New()},
+		Wallet:    payment.MerchantWallet,
+		Network:   payment.Network,
+		PaymentID: payment.ID,
+		Kind:      model.LedgerCredit,
+		Amount:    model.NewBigInt(calculateForwardAmount(getForwardBase(payment))),
+	})
+}
+
+// creditSurplus adds the share of the merchant of a surplus kept as credit to the balance of the merchant, it is paid
+// out with the payment. It does nothing if the surplus is credited or the payment is paid out already.
+func creditSurplus(ledgerRepository repository.IMerchantLedgerRepository, payment *model.Payment) error {
+	surplus := calculateForwardAmount(getCreditedSurplus(payment))
+	if surplus.Sign() == 0 {
+		return nil
+	}
+	entries, err := ledgerRepository.FindByPayment(payment.ID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Kind == model.LedgerPayout {
+			return nil
+		}
+	}
+	if getLedgerBalance(entries).Cmp(calculateForwardAmount(getForwardBase(payment))) > 0 {
+		return nil
+	}
+
+	return ledgerRepository.Create(&model.MerchantLedgerEntry{
+		Base:      model.Base{ID: uuid.New()},
+		Wallet:    payment.MerchantWallet,
+		Network:   payment.Network,
+		PaymentID: payment.ID,
+		Kind:      model.LedgerCredit,
+		Amount:    model.NewBigInt(surplus),
+	})
+}
+
+// debitMerchant takes the credited amount of the payment off the balance of the merchant, e.g. when it is paid out.
+// The ledger is the one of the transaction which saves the payout or the rollback.
+func debitMerchant(ledgerRepository repository.IMerchantLedgerRepository, payment *model.Payment, kind model.LedgerEntryKind, txHash *string) error {
+	entries, err := ledgerRepository.FindByPayment(payment.ID)
+	if err != nil {
+		return err
+	}
+	balance := getLedgerBalance(entries)
+	if balance.Sign() <= 0 {
+		return nil
+	}
+
+	return ledgerRepository.Create(&model.MerchantLedgerEntry{
+		Base:      model.Base{ID: uuid.New()},
+		Wallet:    payment.MerchantWallet,
+		Network:   payment.Network,
+		PaymentID: payment.ID,
+		Kind:      kind,
+		Amount:    model.NewBigInt(balance.Neg(balance)),
+		TxHash:    txHash,
+	})
+}
+
+func getLedgerBalance(entries []model.MerchantLedgerEntry) *big.Int {
+	balance := big.NewInt(0)
+	for _, entry := range entries {
+		balance.Add(balance, &entry.Amount.Int)
+	}
+	return balance
+}
+
+// isPayoutDeferred tells if the payment is forwarded by handlePayoutBatches instead of right after its confirmation
+func (s *bitcoinService) isPayoutDeferred(payment *model.Payment) (bool, error) {
+	if isPayoutBatched() {
+		return true, nil
+	}
+	settings, err := s.GetMerchantSettings(payment.MerchantWallet)
+	if err != nil {
+		return false, err
+	}
+	return settings.PayoutSchedule != model.PayoutImmediate, nil
+}
+
+// isMerchantPayoutDue checks the schedule of the merchant. A daily or weekly payout is due a period after the
+// last payout, or after the first payment which waits for it.
+func (s *bitcoinService) isMerchantPayoutDue(settings *model.MerchantSettings, network model.Network, payments []model.Payment) (bool, error) {
+	balance, err := s.merchantLedgerRepository.GetBalance(settings.Wallet, network)
+	if err != nil {
+		return false, err
+	}
+	if balance.Sign() <= 0 || (settings.MinimumPayout != nil && balance.Cmp(&settings.MinimumPayout.Int) < 0) {
+		return false, nil
+	}
+
+	var period time.Duration
+	switch settings.PayoutSchedule {
+	case model.PayoutDaily:
+		period = 24 * time.Hour
+	case model.PayoutWeekly:
+		period = 7 * 24 * time.Hour
+	default:
+		return true, nil
+	}
+
+	lastPayout, err := s.merchantLedgerRepository.FindLastPayout(settings.Wallet, network)
+	if err != nil {
+		return false, err
+	}
+	var start time.Time
+	if lastPayout != nil {
+		start = lastPayout.CreatedAt
+	} else {
+		start = time.Now()
+		for _, payment := range payments {
+			if payment.CurrentPaymentState.CreatedAt.Before(start) {
+				start = payment.CurrentPaymentState.CreatedAt
+			}
+		}
+	}
+	return time.Since(start) >= period, nil
+}
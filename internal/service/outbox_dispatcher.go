@@ -0,0 +1,131 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"github.com/google/uuid"
+)
+
+const outboxBatchSize = 100
+
+// outboxLockKey is the advisory lock of the dispatch, replicas of the service sharing the database dispatch one at a time
+const outboxLockKey int64 = 0x6f7574626f78 << 16
+
+type IOutboxDispatcher interface {
+	Start()
+	DispatchPending()
+	GetNotifications(status model.NotificationStatus) ([]model.OutboxNotification, error)
+	Requeue(notificationId uuid.UUID) (*model.OutboxNotification, error)
+}
+
+type outboxDispatcher struct {
+	outboxRepository       repository.IOutboxRepository
+	advisoryLockRepository repository.IAdvisoryLockRepository
+}
+
+func NewOutboxDispatcher(outboxRepository repository.IOutboxRepository, advisoryLockRepository repository.IAdvisoryLockRepository) IOutboxDispatcher {
+	return &outboxDispatcher{outboxRepository: outboxRepository, advisoryLockRepository: advisoryLockRepository}
+}
+
+// Start delivers the outbox in the background every OutboxDispatchInterval seconds
+func (d *outboxDispatcher) Start() {
+	ticker := time.NewTicker(time.Duration(utils.Opts.OutboxDispatchInterval) * time.Second)
+	go func() {
+		for range ticker.C {
+			d.DispatchPending()
+		}
+	}()
+}
+
+// DispatchPending sends every due notification to the backend.
+// Notifications of a payment are delivered in order, a failed one blocks the later ones of the same payment.
+// A dead one blocks them until it is requeued, so the backend never ends on a stale state.
+// The dispatch holds the outbox lock, so other replicas neither deliver the same notifications nor reorder them.
+func (d *outboxDispatcher) DispatchPending() {
+	err := d.advisoryLockRepository.WithLock(outboxLockKey, d.dispatchPending)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (d *outboxDispatcher) dispatchPending() {
+	notifications, err := d.outboxRepository.FindDue(outboxBatchSize)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	now := time.Now()
+	blocked := make(map[uuid.UUID]bool)
+	for _, notification := range notifications {
+		if blocked[notification.PaymentID] {
+			continue
+		}
+
+		err = sendNotificationToBackend(&notification)
+
+		notification.Attempts++
+		if err != nil {
+			blocked[notification.PaymentID] = true
+			notification.LastError = err.Error()
+			if notification.Attempts >= utils.Opts.OutboxMaxAttempts {
+				log.Printf("notification %s for payment %s is dead: %v", notification.ID, notification.PaymentID, err)
+				notification.Status = model.NotificationDead
+			} else {
+				notification.NextAttemptAt = now.Add(backoff(notification.Attempts))
+			}
+		} else {
+			notification.Status = model.NotificationDelivered
+			notification.LastError = ""
+		}
+
+		err = d.outboxRepository.Update(&notification)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+func (d *outboxDispatcher) GetNotifications(status model.NotificationStatus) ([]model.OutboxNotification, error) {
+	return d.outboxRepository.FindByStatus(status)
+}
+
+// Requeue puts a dead notification back into the outbox with a fresh retry budget
+func (d *outboxDispatcher) Requeue(notificationId uuid.UUID) (*model.OutboxNotification, error) {
+	notification, err := d.outboxRepository.FindByID(notificationId)
+	if err != nil || notification == nil {
+		return nil, err
+	}
+
+	if notification.Status != model.NotificationDead {
+		return nil, errors.New("only dead notifications can be requeued")
+	}
+
+	notification.Status = model.NotificationPending
+	notification.Attempts = 0
+	notification.NextAttemptAt = time.Now()
+	err = d.outboxRepository.Update(notification)
+	if err != nil {
+		return nil, err
+	}
+	return notification, nil
+}
+
+// exponential backoff: base * 2^(attempts-1), capped at OutboxBackoffMax
+func backoff(attempts int) time.Duration {
+	maxDelay := time.Duration(utils.Opts.OutboxBackoffMax) * time.Second
+	delay := time.Duration(utils.Opts.OutboxBackoffBase) * time.Second
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxDelay {
+			return maxDelay
+		}
+	}
+	return delay
+}
@@ -0,0 +1,265 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"github.com/google/uuid"
+	"gopkg.in/h2non/gock.v1"
+)
+
+// newTestOutbox returns an outbox of its own, so the notifications of other tests are neither dispatched nor in the way
+func newTestOutbox() (repository.IOutboxRepository, IOutboxDispatcher) {
+	store := repository.NewMemoryStore()
+	outbox := repository.NewMemoryOutboxRepository(store)
+	return outbox, NewOutboxDispatcher(outbox, repository.NewMemoryAdvisoryLockRepository(store))
+}
+
+func createTestNotification(t *testing.T, outboxRepo repository.IOutboxRepository, paymentId uuid.UUID, state string) *model.OutboxNotification {
+	notification := &model.OutboxNotification{
+		Base:          model.Base{ID: uuid.New()},
+		PaymentID:     paymentId,
+		PayAmount:     "340300",
+		ActuallyPaid:  "0",
+		PaymentState:  state,
+		Status:        model.NotificationPending,
+		NextAttemptAt: time.Now(),
+	}
+	err := outboxRepo.Create(notification)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return notification
+}
+
+func TestOutboxDispatcher_DispatchPending(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	outboxRepo, dispatcher := newTestOutbox()
+	paymentId := uuid.New()
+	first := createTestNotification(t, outboxRepo, paymentId, "partially_paid")
+	second := createTestNotification(t, outboxRepo, paymentId, "paid")
+
+	gock.New("http://localhost:8000").
+		Put("/api/internal/payment/webhook").
+		BodyString(paymentId.String()).
+		Reply(500)
+
+	// Act
+	dispatcher.DispatchPending()
+
+	// Assert
+	failed, err := outboxRepo.FindByID(first.ID)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	blocked, err := outboxRepo.FindByID(second.ID)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if failed.Status != model.NotificationPending || failed.Attempts != 1 || failed.LastError == "" || !failed.NextAttemptAt.After(time.Now()) {
+		t.Errorf("Expected first notification to be retried later, but got %v", failed)
+	}
+	if blocked.Attempts != 0 {
+		t.Errorf("Expected second notification to wait for the first one, but got %d attempts", blocked.Attempts)
+	}
+
+	// Arrange
+	failed.NextAttemptAt = time.Now().Add(-time.Second)
+	err = outboxRepo.Update(failed)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	gock.New("http://localhost:8000").
+		Put("/api/internal/payment/webhook").
+		BodyString(paymentId.String()).
+		Times(2).
+		Reply(200)
+
+	// Act
+	dispatcher.DispatchPending()
+
+	// Assert
+	delivered, err := outboxRepo.FindByID(first.ID)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	deliveredAfter, err := outboxRepo.FindByID(second.ID)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if delivered.Status != model.NotificationDelivered || deliveredAfter.Status != model.NotificationDelivered {
+		t.Errorf("Expected both notifications to be delivered, but got %s and %s", delivered.Status, deliveredAfter.Status)
+	}
+}
+
+func TestOutboxDispatcher_DeadLetter(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	maxAttempts := utils.Opts.OutboxMaxAttempts
+	utils.Opts.OutboxMaxAttempts = 1
+	defer func() { utils.Opts.OutboxMaxAttempts = maxAttempts }()
+
+	outboxRepo, dispatcher := newTestOutbox()
+	paymentId := uuid.New()
+	notification := createTestNotification(t, outboxRepo, paymentId, "paid")
+
+	gock.New("http://localhost:8000").
+		Put("/api/internal/payment/webhook").
+		BodyString(paymentId.String()).
+		Reply(500)
+
+	// Act
+	dispatcher.DispatchPending()
+	later := createTestNotification(t, outboxRepo, paymentId, "confirmed")
+	dispatcher.DispatchPending()
+
+	// Assert
+	blocked, err := outboxRepo.FindByID(later.ID)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if blocked.Status != model.NotificationPending || blocked.Attempts != 0 {
+		t.Errorf("Expected the later notification to wait for the dead one, but got %v", blocked)
+	}
+	dead, err := dispatcher.GetNotifications(model.NotificationDead)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	found := false
+	for _, n := range dead {
+		found = found || n.ID == notification.ID
+	}
+	if !found {
+		t.Errorf("Expected notification %s to be dead", notification.ID)
+	}
+
+	requeued, err := dispatcher.Requeue(notification.ID)
+	if err != nil || requeued == nil {
+		t.Fatalf("Expected notification %s to be requeued, but got %v", notification.ID, err)
+	}
+	if requeued.Status != model.NotificationPending || requeued.Attempts != 0 {
+		t.Errorf("Expected requeued notification to be pending, but got %v", requeued)
+	}
+
+	// Arrange
+	gock.New("http://localhost:8000").
+		Put("/api/internal/payment/webhook").
+		BodyString(paymentId.String()).
+		Times(2).
+		Reply(200)
+
+	// Act
+	dispatcher.DispatchPending()
+
+	// Assert
+	delivered, err := outboxRepo.FindByID(notification.ID)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	deliveredAfter, err := outboxRepo.FindByID(later.ID)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if delivered.Status != model.NotificationDelivered || deliveredAfter.Status != model.NotificationDelivered {
+		t.Errorf("Expected both notifications to be delivered in order, but got %s and %s", delivered.Status, deliveredAfter.Status)
+	}
+}
+
+func TestOutboxDispatcher_RiskLevel(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	outboxRepo, dispatcher := newTestOutbox()
+	paymentId := uuid.New()
+	notification := createTestNotification(t, outboxRepo, paymentId, "paid")
+	notification.RiskLevel = model.RiskHigh.String()
+	err := outboxRepo.Update(notification)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	gock.New("http://localhost:8000").
+		Put("/api/internal/payment/webhook").
+		BodyString(paymentId.String() + `.*"risk_level":"high"`).
+		Reply(200)
+
+	// Act
+	dispatcher.DispatchPending()
+
+	// Assert
+	delivered, err := outboxRepo.FindByID(notification.ID)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if delivered.Status != model.NotificationDelivered {
+		t.Errorf("Expected the risk level to be sent to the backend, but got %s: %s", delivered.Status, delivered.LastError)
+	}
+}
+
+func TestOutboxDispatcher_Overpayment(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	outboxRepo, dispatcher := newTestOutbox()
+	paymentId := uuid.New()
+	notification := createTestNotification(t, outboxRepo, paymentId, "paid")
+	notification.Event = model.OverpaymentCredit.Event()
+	notification.Surplus = "1000"
+	err := outboxRepo.Update(notification)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	gock.New("http://localhost:8000").
+		Put("/api/internal/payment/webhook").
+		BodyString(paymentId.String() + `.*"event":"overpayment_credit","surplus":"1000"`).
+		Reply(200)
+
+	// Act
+	dispatcher.DispatchPending()
+
+	// Assert
+	delivered, err := outboxRepo.FindByID(notification.ID)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if delivered.Status != model.NotificationDelivered {
+		t.Errorf("Expected the surplus to be sent to the backend, but got %s: %s", delivered.Status, delivered.LastError)
+	}
+}
+
+func TestOutboxDispatcher_Backoff(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	outboxRepo, dispatcher := newTestOutbox()
+	for i := 0; i < outboxBatchSize; i++ {
+		backingOff := createTestNotification(t, outboxRepo, uuid.New(), "paid")
+		backingOff.Attempts = 1
+		backingOff.NextAttemptAt = time.Now().Add(time.Hour)
+		err := outboxRepo.Update(backingOff)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	paymentId := uuid.New()
+	due := createTestNotification(t, outboxRepo, paymentId, "paid")
+
+	gock.New("http://localhost:8000").
+		Put("/api/internal/payment/webhook").
+		BodyString(paymentId.String()).
+		Reply(200)
+
+	// Act
+	dispatcher.DispatchPending()
+
+	// Assert
+	delivered, err := outboxRepo.FindByID(due.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if delivered.Status != model.NotificationDelivered {
+		t.Errorf("Expected the due notification to be delivered past the ones in backoff, but got %s: %s", delivered.Status, delivered.LastError)
+	}
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+)
+
+// GetDefaultOverpaymentPolicy parses OVERPAYMENT_POLICY, the policy of merchants without settings
+func GetDefaultOverpaymentPolicy() (model.OverpaymentPolicy, error) {
+	policy, ok := model.ParseStringToOverpaymentPolicyEnum(utils.Opts.OverpaymentPolicy)
+	if !ok {
+		return 0, fmt.Errorf("unknown overpayment policy: %s", utils.Opts.OverpaymentPolicy)
+	}
+	return policy, nil
+}
+
+// GetMerchantSettings returns the settings of the wallet, the defaults if the merchant has none
+func (s *bitcoinService) GetMerchantSettings(wallet string) (*model.MerchantSettings, error) {
+	settings, err := s.merchantSettingsRepository.FindByWallet(wallet)
+	if err != nil {
+		return nil, err
+	}
+	if settings != nil {
+		return settings, nil
+	}
+
+	policy, err := GetDefaultOverpaymentPolicy()
+	if err != nil {
+		return nil, err
+	}
+	return &model.MerchantSettings{
+		Wallet:            wallet,
+		OverpaymentPolicy: policy,
+		PayoutSchedule:    model.PayoutImmediate,
+		MinimumPayout:     model.NewBigIntFromInt(0),
+	}, nil
+}
+
+// SaveMerchantSettings only applies the overpayment policy to payments created afterwards, open payments keep their
+// policy. A changed payout schedule applies to the confirmed payments which are not paid out yet.
+func (s *bitcoinService) SaveMerchantSettings(update model.MerchantSettings) (*model.MerchantSettings, error) {
+	if update.PayoutSchedule == 0 {
+		update.PayoutSchedule = model.PayoutImmediate
+	}
+	if update.MinimumPayout == nil {
+		update.MinimumPayout = model.NewBigIntFromInt(0)
+	}
+
+	settings, err := s.merchantSettingsRepository.FindByWallet(update.Wallet)
+	if err != nil {
+		return nil, err
+	}
+	if settings == nil {
+		settings = &update
+		err = s.merchantSettingsRepository.Create(settings)
+	} else {
+		settings.OverpaymentPolicy = update.OverpaymentPolicy
+		settings.PayoutSchedule = update.PayoutSchedule
+		settings.MinimumPayout = update.MinimumPayout
+		err = s.merchantSettingsRepository.Update(settings)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// handleOverpayment applies the policy of the payment to the surplus once the payment is confirmed and informs the backend.
+// A surplus which can't be refunded is credited to the merchant and paid out with the payment.
+// It returns true if the surplus was refunded.
+func (s *bitcoinService) handleOverpayment(payment *model.Payment) bool {
+	if payment.OverpaymentPolicy == model.OverpaymentRefund {
+		if payment.RefundAddress == "" {
+			log.Printf("no refund address for the surplus of payment %s", payment.ID)
+			payment.OverpaymentPolicy = model.OverpaymentCredit
+		} else if _, err := s.refundPayment(payment.ID, payment.RefundAddress, &payment.CurrentPaymentState.Surplus.Int); err != nil {
+			log.Println(err)
+			payment.OverpaymentPolicy = model.OverpaymentCredit
+		}
+	}
+
+	if payment.OverpaymentPolicy == model.OverpaymentCredit {
+		// a surplus refunded before the payment was confirmed isn't credited, without the refunds nothing is credited
+		if surplus, err := s.getUnrefundedSurplus(payment); err != nil {
+			log.Println(err)
+		} else {
+			payment.CreditedSurplus = model.NewBigInt(surplus)
+		}
+	}
+
+	err := s.unitOfWork.WithTx(func(tx *repository.Repositories) error {
+		err := tx.Payment.Update(payment)
+		if err != nil {
+			return err
+		}
+		err = tx.Outbox.Create(newOverpaymentNotification(payment))
+		if err != nil {
+			return err
+		}
+		return creditSurplus(tx.MerchantLedger, payment)
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return payment.OverpaymentPolicy == model.OverpaymentRefund
+}
+
+// setSurplus records whether more than the pay amount was received
+func setSurplus(state *model.PaymentState) {
+	surplus := new(big.Int).Sub(&state.AmountReceived.Int, &state.PayAmount.Int)
+	if surplus.Sign() < 0 {
+		surplus.SetInt64(0)
+	}
+	state.Overpaid = surplus.Sign() > 0
+	state.Surplus = model.NewBigInt(surplus)
+}
+
+// getForwardBase is the amount the merchant gets a share of, the surplus is only included with the forward policy
+// and a tolerated shortfall is missing
+func getForwardBase(payment *model.Payment) *big.Int {
+	if payment.OverpaymentPolicy == model.OverpaymentForward {
+		return &payment.CurrentPaymentState.AmountReceived.Int
+	}
+	base := new(big.Int).Set(&payment.CurrentPaymentState.PayAmount.Int)
+	if payment.Shortfall != nil {
+		base.Sub(base, &payment.Shortfall.Int)
+	}
+	return base
+}
+
+// getUnrefundedSurplus is the surplus without the refunds which were sent before the payment was confirmed
+func (s *bitcoinService) getUnrefundedSurplus(payment *model.Payment) (*big.Int, error) {
+	refunds, err := s.refundRepository.FindByPayment(payment.ID)
+	if err != nil {
+		return nil, err
+	}
+	surplus := new(big.Int).Set(&payment.CurrentPaymentState.Surplus.Int)
+	for _, refund := range refunds {
+		if refund.CurrentRefundState.Status != model.RefundFailed {
+			surplus.Sub(surplus, &refund.Amount.Int)
+		}
+	}
+	if surplus.Sign() < 0 {
+		surplus.SetInt64(0)
+	}
+	return surplus, nil
+}
+
+// getCreditedSurplus is the surplus kept as credit with the credit policy, it is owed to the merchant like the forward base.
+// Until the payment is confirmed the surplus can still be refunded.
+func getCreditedSurplus(payment *model.Payment) *big.Int {
+	if payment.OverpaymentPolicy != model.OverpaymentCredit || payment.CreditedSurplus == nil {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(&payment.CreditedSurplus.Int)
+}
+
+// getPayoutAmount is the amount forwarded to the merchant, its share of the forward base and of a credited surplus
+func getPayoutAmount(payment *model.Payment) *big.Int {
+	amount := calculateForwardAmount(getForwardBase(payment))
+	return amount.Add(amount, calculateForwardAmount(getCreditedSurplus(payment)))
+}
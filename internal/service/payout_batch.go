@@ -0,0 +1,405 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/node"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/google/uuid"
+)
+
+// isPayoutBatched tells if confirmed payments wait for a payout batch instead of being forwarded on their own
+func isPayoutBatched() bool {
+	return utils.Opts.PayoutBatchInterval > 0 || utils.Opts.PayoutBatchThreshold > 0
+}
+
+// handlePayoutBatches forwards the confirmed payments whose payout is due in one transaction.
+// Payments of merchants with a payout schedule are due according to the schedule. The other payments wait until
+// the oldest waited PayoutBatchInterval minutes or they add up to PayoutBatchThreshold.
+func (s *bitcoinService) handlePayoutBatches(network model.Network) {
+	payments, err := s.findBatchablePayments(network)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	wallets := make(map[string][]model.Payment)
+	var walletOrder []string
+	for _, payment := range payments {
+		if _, ok := wallets[payment.MerchantWallet]; !ok {
+			walletOrder = append(walletOrder, payment.MerchantWallet)
+		}
+		wallets[payment.MerchantWallet] = append(wallets[payment.MerchantWallet], payment)
+	}
+
+	var due, unscheduled []model.Payment
+	for _, wallet := range walletOrder {
+		settings, err := s.GetMerchantSettings(wallet)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if settings.PayoutSchedule == model.PayoutImmediate {
+			unscheduled = append(unscheduled, wallets[wallet]...)
+			continue
+		}
+		isDue, err := s.isMerchantPayoutDue(settings, network, wallets[wallet])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if isDue {
+			due = append(due, wallets[wallet]...)
+		}
+	}
+	if len(unscheduled) > 0 && isPayoutBatchDue(unscheduled) {
+		due = append(due, unscheduled...)
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	err = s.sendPayoutBatch(due, network)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// findBatchablePayments returns the deferred confirmed payments which are not forwarded yet and whose funds can be spent.
+// A payment which can't be checked is left out of the batch.
+func (s *bitcoinService) findBatchablePayments(network model.Network) ([]model.Payment, error) {
+	confirmed, err := s.paymentRepository.FindConfirmedPaymentsByNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+
+	var payments []model.Payment
+	for i := range confirmed {
+		payment := &confirmed[i]
+		if payment.ForwardingTransactionHash != nil || payment.PayoutBatchID != nil {
+			continue
+		}
+		batchable, err := s.isBatchable(payment, network)
+		if err != nil {
+			s.trackPaymentProcessing(payment, err)
+			continue
+		}
+		if batchable {
+			payments = append(payments, *payment)
+		}
+	}
+	return payments, nil
+}
+
+func (s *bitcoinService) isBatchable(payment *model.Payment, network model.Network) (bool, error) {
+	deferred, err := s.isPayoutDeferred(payment)
+	if err != nil || !deferred {
+		return false, err
+	}
+	amount, err := s.getUnspentByAddress(payment.Account.Address, getMinimumConfirmations(network), network)
+	if err != nil {
+		return false, err
+	}
+	amount.Sub(amount, &payment.Account.Remainder.Int)
+
+	// e.g. the change of a refund is not confirmed yet
+	if amount.Cmp(getForwardBase(payment)) < 0 {
+		return false, nil
+	}
+	// the credit is repeated for payments confirmed before the ledger existed
+	err = creditMerchant(s.merchantLedgerRepository, payment)
+	if err != nil {
+		return false, err
+	}
+	err = creditSurplus(s.merchantLedgerRepository, payment)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func isPayoutBatchDue(payments []model.Payment) bool {
+	total := big.NewInt(0)
+	oldest := time.Now()
+	for i := range payments {
+		total.Add(total, getPayoutAmount(&payments[i]))
+		if payments[i].CurrentPaymentState.CreatedAt.Before(oldest) {
+			oldest = payments[i].CurrentPaymentState.CreatedAt
+		}
+	}
+
+	if utils.Opts.PayoutBatchThreshold > 0 && total.Cmp(big.NewInt(int64(utils.Opts.PayoutBatchThreshold))) >= 0 {
+		return true
+	}
+	return utils.Opts.PayoutBatchInterval > 0 && time.Since(oldest) >= time.Duration(utils.Opts.PayoutBatchInterval)*time.Minute
+}
+
+// sendPayoutBatch spends the funds of all payments in one transaction with one output per merchant wallet
+func (s *bitcoinService) sendPayoutBatch(payments []model.Payment, network model.Network) error {
+	client, err := s.getClientByNetwork(network)
+	if err != nil {
+		return err
+	}
+
+	var inputs []btcjson.TransactionInput
+	for _, payment := range payments {
+		unspentList, err := listUnspent(client, payment.Account.Address, getMinimumConfirmations(network))
+		if err != nil {
+			return err
+		}
+		for _, unspent := range unspentList {
+			inputs = append(inputs, btcjson.TransactionInput{
+				Txid: unspent.TxID,
+				Vout: unspent.Vout,
+			})
+		}
+	}
+
+	rawTransaction, err := createRawTransactionWithOutputs(client, inputs, getPayoutOutputs(payments))
+	if err != nil {
+		return err
+	}
+	fundedTransaction, err := fundTransaction(client, rawTransaction, network)
+	if err != nil {
+		return err
+	}
+
+	// the transaction is saved with the batch before it is sent, so a failure to save the forwarding can be resumed
+	// and can't forward the payments twice, see resumePayoutBatch
+	signedTransaction, err := signRawTransaction(client, fundedTransaction, network)
+	if err != nil {
+		return err
+	}
+	txHash := signedTransaction.TxHash()
+	batchTxHash := txHash.String()
+	batch := model.PayoutBatch{
+		Base:    model.Base{ID: uuid.New()},
+		Network: network,
+		TxHash:  &batchTxHash,
+	}
+	err = s.unitOfWork.WithTx(func(repos *repository.Repositories) error {
+		err := repos.PayoutBatch.Create(&batch)
+		if err != nil {
+			return err
+		}
+		for i := range payments {
+			payments[i].PayoutBatchID = &batch.ID
+			err = repos.Payment.Update(&payments[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.SendRawTransaction(signedTransaction, false)
+	if err != nil {
+		// nothing was sent, the payments wait for the next batch. If it is unclear whether the node accepted the
+		// transaction the batch is kept and resumed.
+		known, knownErr := isTransactionKnown(client, &txHash)
+		if knownErr == nil && !known {
+			knownErr = s.dissolvePayoutBatch(&batch, payments)
+		}
+		if knownErr != nil {
+			log.Println(knownErr)
+		}
+		return err
+	}
+	log.Printf("payout batch %s forwards %d payments in %s", batch.ID, len(payments), txHash)
+
+	return s.savePayoutBatch(&batch, payments, fundedTransaction, batchTxHash, network)
+}
+
+func (s *bitcoinService) dissolvePayoutBatch(batch *model.PayoutBatch, payments []model.Payment) error {
+	return s.unitOfWork.WithTx(func(repos *repository.Repositories) error {
+		for i := range payments {
+			payments[i].PayoutBatchID = nil
+			err := repos.Payment.Update(&payments[i])
+			if err != nil {
+				return err
+			}
+		}
+		return repos.PayoutBatch.Delete(batch)
+	})
+}
+
+// savePayoutBatch sets the sent transaction on the batch and its payments with the share of the fee of each payment
+func (s *bitcoinService) savePayoutBatch(batch *model.PayoutBatch, payments []model.Payment, fundedTransaction *btcjson.FundRawTransactionResult, txHash string, network model.Network) error {
+	client, err := s.getClientByNetwork(network)
+	if err != nil {
+		return err
+	}
+	params, err := getNetParams(client)
+	if err != nil {
+		return err
+	}
+
+	batch.TxHash = &txHash
+	batch.Fee = model.NewBigIntFromInt(int64(fundedTransaction.Fee))
+	fees := getPayoutFees(payments, fundedTransaction.Transaction, params)
+	height := s.getForwardingHeight(network)
+	return s.unitOfWork.WithTx(func(tx *repository.Repositories) error {
+		err := tx.PayoutBatch.Update(batch)
+		if err != nil {
+			return err
+		}
+		for i := range payments {
+			payments[i].ForwardingFee = model.NewBigInt(fees[i])
+			err = saveForwarding(tx, &payments[i], txHash, height)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// resumePayoutBatch sets the transaction of the batch on a payment if saving it failed after sending.
+// A transaction the node doesn't know was not sent, the batch is dissolved and its payments wait for the next batch.
+func (s *bitcoinService) resumePayoutBatch(client node.BitcoinNode, payment *model.Payment, network model.Network) error {
+	if payment.PayoutBatchID == nil {
+		return nil
+	}
+	batch, err := s.payoutBatchRepository.FindByID(*payment.PayoutBatchID)
+	if err != nil {
+		return err
+	}
+	if batch == nil {
+		return nil
+	}
+	// batches are saved with their transaction before it is sent
+	if batch.TxHash == nil {
+		return fmt.Errorf("payout batch %s of payment %s has no transaction", batch.ID, payment.ID)
+	}
+
+	txHash, err := chainhash.NewHashFromStr(*batch.TxHash)
+	if err != nil {
+		return err
+	}
+	known, err := isTransactionKnown(client, txHash)
+	if err != nil {
+		return err
+	}
+	if !known {
+		payments, err := s.paymentRepository.FindByPayoutBatch(batch.ID)
+		if err != nil {
+			return err
+		}
+		log.Printf("transaction %s of payout batch %s was not sent, the batch is dissolved", *batch.TxHash, batch.ID)
+		return s.dissolvePayoutBatch(batch, payments)
+	}
+	return s.saveForwardingTransaction(payment, *batch.TxHash, network)
+}
+
+// isTransactionKnown tells if the node knows the wallet transaction, e.g. because it was sent
+func isTransactionKnown(client node.BitcoinNode, txHash *chainhash.Hash) (bool, error) {
+	_, err := client.GetTransaction(txHash)
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) && rpcErr.Code == btcjson.ErrRPCInvalidAddressOrKey {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// bumpPayoutBatch replaces the stuck transaction of the batch, the higher fee is attributed to the payments again
+func (s *bitcoinService) bumpPayoutBatch(client node.BitcoinNode, batchId uuid.UUID, transaction *btcjson.GetTransactionResult, network model.Network) error {
+	batch, err := s.payoutBatchRepository.FindByID(batchId)
+	if err != nil {
+		return err
+	}
+	if batch == nil {
+		return fmt.Errorf("payout batch %s not found", batchId)
+	}
+	payments, err := s.paymentRepository.FindByPayoutBatch(batchId)
+	if err != nil {
+		return err
+	}
+
+	fundedTransaction, txHash, err := replaceTransaction(client, transaction, getPayoutOutputs(payments), network)
+	if err != nil {
+		return err
+	}
+	log.Printf("transaction %s of payout batch %s replaced by %s", transaction.TxID, batchId, txHash)
+
+	return s.savePayoutBatch(batch, payments, fundedTransaction, txHash, network)
+}
+
+// getPayoutOutputs sums up the payout amounts of the payments per merchant wallet
+func getPayoutOutputs(payments []model.Payment) map[string]*big.Int {
+	outputs := make(map[string]*big.Int)
+	for i := range payments {
+		amount, ok := outputs[payments[i].MerchantWallet]
+		if !ok {
+			amount = big.NewInt(0)
+			outputs[payments[i].MerchantWallet] = amount
+		}
+		amount.Add(amount, getPayoutAmount(&payments[i]))
+	}
+	return outputs
+}
+
+// getPayoutFees splits the fee subtracted from the output of each merchant wallet between its payments by their
+// payout amount. The first payment of a wallet pays the rounding remainder.
+func getPayoutFees(payments []model.Payment, transaction *wire.MsgTx, params *chaincfg.Params) []*big.Int {
+	funded := make(map[string]int64)
+	for _, out := range transaction.TxOut {
+		_, addresses, _, err := txscript.ExtractPkScriptAddrs(out.PkScript, params)
+		if err != nil || len(addresses) != 1 {
+			continue
+		}
+		funded[addresses[0].EncodeAddress()] += out.Value
+	}
+
+	outputs := getPayoutOutputs(payments)
+	deducted := make(map[string]*big.Int)
+	remainders := make(map[string]*big.Int)
+	for wallet, amount := range outputs {
+		deducted[wallet] = new(big.Int).Sub(amount, big.NewInt(funded[encodeWallet(wallet, params)]))
+		remainders[wallet] = new(big.Int).Set(deducted[wallet])
+	}
+
+	fees := make([]*big.Int, len(payments))
+	first := make(map[string]int)
+	for i := range payments {
+		wallet := payments[i].MerchantWallet
+		if _, ok := first[wallet]; !ok {
+			first[wallet] = i
+		}
+		fees[i] = new(big.Int).Mul(deducted[wallet], getPayoutAmount(&payments[i]))
+		if outputs[wallet].Sign() > 0 {
+			fees[i].Div(fees[i], outputs[wallet])
+		}
+		remainders[wallet].Sub(remainders[wallet], fees[i])
+	}
+	for wallet, i := range first {
+		fees[i].Add(fees[i], remainders[wallet])
+	}
+	return fees
+}
+
+// encodeWallet returns the address the node reports for the wallet, e.g. lower case for bech32
+func encodeWallet(wallet string, params *chaincfg.Params) string {
+	address, err := btcutil.DecodeAddress(wallet, params)
+	if err != nil {
+		return wallet
+	}
+	return address.EncodeAddress()
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"github.com/google/uuid"
+)
+
+// trackPaymentProcessing counts the failed block runs of the payment in a row. After PaymentMaxFailures failures the
+// payment is quarantined, the block runs skip it until it is retried.
+func (s *bitcoinService) trackPaymentProcessing(payment *model.Payment, processingErr error) {
+	if processingErr == nil {
+		if payment.ProcessingFailures == 0 {
+			return
+		}
+		payment.ProcessingFailures = 0
+		payment.LastProcessingError = ""
+	} else {
+		log.Printf("payment %s: %v", payment.ID, processingErr)
+		payment.ProcessingFailures++
+		payment.LastProcessingError = processingErr.Error()
+		if utils.Opts.PaymentMaxFailures > 0 && payment.ProcessingFailures >= utils.Opts.PaymentMaxFailures {
+			now := time.Now()
+			payment.QuarantinedAt = &now
+			log.Printf("payment %s is quarantined after %d failures", payment.ID, payment.ProcessingFailures)
+		}
+	}
+
+	err := s.paymentRepository.UpdateProcessingStatus(payment)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *bitcoinService) GetQuarantinedPayments() ([]model.Payment, error) {
+	return s.paymentRepository.FindQuarantined()
+}
+
+// RetryQuarantinedPayment resets the failures of the payment, the next block run processes it again.
+// It holds the block lock of the network, so a running block run doesn't count a failure on top of the reset.
+func (s *bitcoinService) RetryQuarantinedPayment(paymentId uuid.UUID) (*model.Payment, error) {
+	payment, err := s.paymentRepository.FindByID(paymentId)
+	if err != nil || payment == nil {
+		return nil, err
+	}
+
+	var retried *model.Payment
+	err = s.withBlockLock(payment.Network, func() (err error) {
+		retried, err = s.retryQuarantinedPayment(paymentId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return retried, nil
+}
+
+func (s *bitcoinService) retryQuarantinedPayment(paymentId uuid.UUID) (*model.Payment, error) {
+	payment, err := s.paymentRepository.FindByID(paymentId)
+	if err != nil || payment == nil {
+		return nil, err
+	}
+	if payment.QuarantinedAt == nil {
+		return nil, fmt.Errorf("payment %s is not quarantined", paymentId)
+	}
+
+	payment.ProcessingFailures = 0
+	payment.QuarantinedAt = nil
+	err = s.paymentRepository.UpdateProcessingStatus(payment)
+	if err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
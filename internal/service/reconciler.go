@@ -0,0 +1,108 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+type IReconciler interface {
+	Start()
+}
+
+// reconciler recovers notifications which were missed while the service was down.
+// It runs on startup and every ReconcileInterval seconds.
+type reconciler struct {
+	bitcoinService IBitcoinService
+	networks       []model.Network
+}
+
+func NewReconciler(bitcoinService IBitcoinService, networks ...model.Network) IReconciler {
+	return &reconciler{bitcoinService: bitcoinService, networks: networks}
+}
+
+func (r *reconciler) Start() {
+	go func() {
+		r.reconcile()
+		ticker := time.NewTicker(time.Duration(utils.Opts.ReconcileInterval) * time.Second)
+		for range ticker.C {
+			r.reconcile()
+		}
+	}()
+}
+
+func (r *reconciler) reconcile() {
+	for _, network := range r.networks {
+		r.bitcoinService.Resync(network)
+	}
+}
+
+// Resync replays every wallet transaction since the last processed block through the handlers.
+// Incoming transactions update the open payments, outgoing ones are matched by the block handlers.
+// It holds the block lock of the network, so the ticker, a ZMQ gap and block notifications don't run concurrently.
+func (s *bitcoinService) Resync(network model.Network) {
+	err := s.advisoryLockRepository.WithLock(getBlockLockKey(network), func() {
+		s.resync(network)
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *bitcoinService) resync(network model.Network) {
+	client, err := s.getClientByNetwork(network)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	cursor, err := s.chainCursorRepository.FindByNetwork(network)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var lastBlock *chainhash.Hash
+	if cursor != nil {
+		lastBlock, err = chainhash.NewHashFromStr(cursor.LastBlockHash)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	} else {
+		cursor = &model.ChainCursor{Network: network}
+	}
+
+	sinceBlock, err := client.ListSinceBlock(lastBlock)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	handled := make(map[string]bool)
+	for _, tx := range sinceBlock.Transactions {
+		if tx.Category != "receive" || handled[tx.TxID] {
+			continue
+		}
+		handled[tx.TxID] = true
+
+		transaction, err := getTransaction(client, tx.TxID)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		s.handleIncomingTransaction(transaction, network)
+	}
+
+	// forwarding transactions which could not be saved are recovered by handleConfirmedPayments
+	s.handleBlock(network)
+
+	cursor.LastBlockHash = sinceBlock.LastBlock
+	err = s.chainCursorRepository.Save(cursor)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,281 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/node"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/google/uuid"
+)
+
+// RefundPayment sends amount satoshi received for the payment back to the buyer.
+// Only funds on the address of the payment which are not owed to the merchant can be refunded.
+// It holds the block lock of the network, so the refund can't spend the funds a forwarding spends.
+func (s *bitcoinService) RefundPayment(paymentId uuid.UUID, refundAddress string, amount *big.Int) (*model.Refund, error) {
+	payment, err := s.paymentRepository.FindByID(paymentId)
+	if err != nil || payment == nil {
+		return nil, err
+	}
+
+	var refund *model.Refund
+	err = s.withBlockLock(payment.Network, func() (err error) {
+		refund, err = s.refundPayment(paymentId, refundAddress, amount)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// refundPayment is RefundPayment for callers which hold the block lock, e.g. handleOverpayment
+func (s *bitcoinService) refundPayment(paymentId uuid.UUID, refundAddress string, amount *big.Int) (*model.Refund, error) {
+	payment, err := s.paymentRepository.FindByID(paymentId)
+	if err != nil || payment == nil {
+		return nil, err
+	}
+
+	state := payment.CurrentPaymentState.StateID
+	if state == enum.Waiting || state == enum.PartiallyPaid {
+		return nil, fmt.Errorf("payment %s is still open", paymentId)
+	}
+	if amount.Sign() <= 0 {
+		return nil, errors.New("refund amount must be positive")
+	}
+
+	client, err := s.getClientByNetwork(payment.Network)
+	if err != nil {
+		return nil, err
+	}
+	err = validateAddress(client, refundAddress, payment.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	// the funds of older payments were taken into account by the payments after them
+	account, err := s.accountRepository.FindByAddress(payment.Account.Address)
+	if err != nil {
+		return nil, err
+	}
+	if latest := getLatestPayment(account.Payments); latest == nil || latest.ID != payment.ID {
+		return nil, fmt.Errorf("payment %s is not the latest payment on %s", paymentId, account.Address)
+	}
+
+	inputs, balance, err := s.getRefundableUnspent(client, account)
+	if err != nil {
+		return nil, err
+	}
+	refunds, err := s.refundRepository.FindByPayment(payment.ID)
+	if err != nil {
+		return nil, err
+	}
+	refundable := getRefundableAmount(payment, account, balance, refunds)
+	if amount.Cmp(refundable) > 0 {
+		return nil, fmt.Errorf("refund of %s satoshi exceeds the refundable %s satoshi", amount, refundable)
+	}
+
+	refund := &model.Refund{
+		Base:          model.Base{ID: uuid.New()},
+		PaymentID:     payment.ID,
+		Address:       account.Address,
+		RefundAddress: refundAddress,
+		Network:       payment.Network,
+		Amount:        model.NewBigInt(amount),
+	}
+	setRefundState(refund, model.RefundPending)
+	err = s.unitOfWork.WithTx(func(tx *repository.Repositories) error {
+		err := tx.Refund.Create(refund)
+		if err != nil {
+			return err
+		}
+		return tx.Outbox.Create(newRefundNotification(payment, refund))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	txHash, err := sendRefund(client, inputs, account.Address, refundAddress, amount, payment.Network)
+	if err != nil {
+		setRefundState(refund, model.RefundFailed)
+		saveErr := s.saveRefund(payment, refund, nil)
+		if saveErr != nil {
+			log.Println(saveErr)
+		}
+		return nil, err
+	}
+
+	refund.TransactionHash = &txHash
+	setRefundState(refund, model.RefundSent)
+
+	// the funds of an expired payment are part of the remainder of the account
+	var changedAccount *model.Account
+	if state == enum.Expired {
+		remainder := new(big.Int).Sub(&account.Remainder.Int, amount)
+		if remainder.Sign() < 0 {
+			remainder.SetInt64(0)
+		}
+		account.Remainder = model.NewBigInt(remainder)
+		account.Payments = nil
+		changedAccount = account
+	}
+
+	err = s.saveRefund(payment, refund, changedAccount)
+	if err != nil {
+		log.Printf("refund %s was sent in transaction %s", refund.ID, txHash)
+		return nil, err
+	}
+	return refund, nil
+}
+
+// handleSentRefunds confirms refunds once their transaction has the minimum confirmations
+func (s *bitcoinService) handleSentRefunds(network model.Network) {
+	client, err := s.getClientByNetwork(network)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	refunds, err := s.refundRepository.FindSentByNetwork(network)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, refund := range refunds {
+		transaction, err := getTransaction(client, *refund.TransactionHash)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if transaction.Confirmations < int64(getMinimumConfirmations(network)) {
+			continue
+		}
+
+		refund.Confirmations = &transaction.Confirmations
+		setRefundState(&refund, model.RefundConfirmed)
+		err = s.saveRefund(refund.Payment, &refund, nil)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// saveRefund persists a state of the refund together with its backend notification.
+// account is updated as well if it is set.
+func (s *bitcoinService) saveRefund(payment *model.Payment, refund *model.Refund, account *model.Account) error {
+	return s.unitOfWork.WithTx(func(tx *repository.Repositories) error {
+		err := tx.Refund.Update(refund)
+		if err != nil {
+			return err
+		}
+		if account != nil {
+			err = tx.Account.Update(account)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Outbox.Create(newRefundNotification(payment, refund))
+	})
+}
+
+// getRefundableUnspent lists the unspent outputs on the address of the account without the funds of pending late payments.
+// A refund only spends these, so the node can't fund it with the coins of other addresses.
+func (s *bitcoinService) getRefundableUnspent(client node.BitcoinNode, account *model.Account) ([]btcjson.TransactionInput, *big.Int, error) {
+	unspentList, err := listUnspent(client, account.Address, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var inputs []btcjson.TransactionInput
+	amount := 0.0
+	for _, unspent := range unspentList {
+		latePayment, err := s.latePaymentRepository.FindByAccountAndTxHash(account.ID, unspent.TxID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if latePayment != nil && latePayment.Status == model.LatePaymentPending {
+			continue
+		}
+		inputs = append(inputs, btcjson.TransactionInput{
+			Txid: unspent.TxID,
+			Vout: unspent.Vout,
+		})
+		amount = amount + unspent.Amount
+	}
+
+	balance, err := convertBtcToSatoshi(amount)
+	if err != nil {
+		return nil, nil, err
+	}
+	return inputs, balance, nil
+}
+
+// getRefundableAmount is the part of the balance which belongs to the payment and is not owed to the merchant
+func getRefundableAmount(payment *model.Payment, account *model.Account, balance *big.Int, refunds []model.Refund) *big.Int {
+	var refundable *big.Int
+	if payment.CurrentPaymentState.StateID == enum.Expired {
+		// the received funds were added to the remainder of the account when the payment expired
+		refundable = new(big.Int).Set(&payment.CurrentPaymentState.AmountReceived.Int)
+		for _, refund := range refunds {
+			if refund.CurrentRefundState.Status != model.RefundFailed {
+				refundable.Sub(refundable, &refund.Amount.Int)
+			}
+		}
+		if refundable.Cmp(&account.Remainder.Int) > 0 {
+			refundable.Set(&account.Remainder.Int)
+		}
+		if refundable.Cmp(balance) > 0 {
+			refundable.Set(balance)
+		}
+	} else {
+		refundable = new(big.Int).Sub(balance, &account.Remainder.Int)
+		// the merchant is owed the pay amount and a credited surplus until it is forwarded
+		state := payment.CurrentPaymentState.StateID
+		if payment.ForwardingTransactionHash == nil && (state == enum.Paid || state == enum.Confirmed) {
+			refundable.Sub(refundable, getForwardBase(payment))
+			refundable.Sub(refundable, getCreditedSurplus(payment))
+		}
+	}
+
+	if refundable.Sign() < 0 {
+		return big.NewInt(0)
+	}
+	return refundable
+}
+
+func setRefundState(refund *model.Refund, status model.RefundStatus) {
+	state := model.RefundState{
+		Base:     model.Base{ID: uuid.New()},
+		RefundID: refund.ID,
+		Status:   status,
+	}
+	refund.RefundStates = append(refund.RefundStates, state)
+	refund.CurrentRefundState = state
+	refund.CurrentRefundStateId = &state.ID
+}
+
+// sendRefund spends the inputs and sends the change back to the address of the payment, the network fee is paid from the refund
+func sendRefund(client node.BitcoinNode, inputs []btcjson.TransactionInput, fromAddress string, refundAddress string, amount *big.Int, network model.Network) (string, error) {
+	rawTransaction, err := createRawTransactionFromInputs(client, inputs, refundAddress, amount)
+	if err != nil {
+		return "", err
+	}
+
+	fundedTransaction, err := fundTransactionWithChange(client, rawTransaction, fromAddress)
+	if err != nil {
+		return "", err
+	}
+
+	txHash, err := signTransaction(client, fundedTransaction, network)
+	if err != nil {
+		return "", err
+	}
+	return txHash.String(), nil
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/node"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/google/uuid"
+)
+
+// trackIncomingTransaction remembers a transaction of the buyer, its block is filled in by handleReorgs
+func (s *bitcoinService) trackIncomingTransaction(payment *model.Payment, transaction *btcjson.GetTransactionResult) error {
+	incoming, err := s.incomingRepository.FindByPaymentAndTxHash(payment.ID, transaction.TxID)
+	if err != nil || incoming != nil {
+		return err
+	}
+	return s.incomingRepository.Create(&model.IncomingTransaction{
+		Base:      model.Base{ID: uuid.New()},
+		PaymentID: payment.ID,
+		TxHash:    transaction.TxID,
+	})
+}
+
+// isEarlierTransaction tells if the transaction belongs to an earlier payment on the reused address of the payment,
+// e.g. when Resync replays it. It was recorded on another payment or received before the payment was created,
+// TimeReceived has a precision of seconds.
+func (s *bitcoinService) isEarlierTransaction(payment *model.Payment, transaction *btcjson.GetTransactionResult) (bool, error) {
+	if transaction.TimeReceived > 0 && time.Unix(transaction.TimeReceived, 0).Before(payment.CreatedAt.Truncate(time.Second)) {
+		return true, nil
+	}
+	recorded, err := s.incomingRepository.FindByTxHash(transaction.TxID)
+	if err != nil {
+		return false, err
+	}
+	for _, incoming := range recorded {
+		if incoming.PaymentID != payment.ID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// handleReorgs compares the blocks the transactions of the open payments confirmed in with the active chain.
+// If a transaction was reorged out, double spent or dropped the payment is rolled back to the state the chain
+// still supports.
+// Finished payments are not checked, their transactions are already MinimumConfirmations deep.
+func (s *bitcoinService) handleReorgs(network model.Network) {
+	client, err := s.getClientByNetwork(network)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var payments []model.Payment
+	for _, find := range []func(model.Network) ([]model.Payment, error){
+		s.paymentRepository.FindPaidPaymentsByNetwork,
+		s.paymentRepository.FindConfirmedPaymentsByNetwork,
+		s.paymentRepository.FindForwardedPaymentsByNetwork,
+	} {
+		found, err := find(network)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		payments = append(payments, found...)
+	}
+
+	for i := range payments {
+		err = s.handlePaymentReorg(client, &payments[i], network)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (s *bitcoinService) handlePaymentReorg(client node.BitcoinNode, payment *model.Payment, network model.Network) error {
+	// once forwarded the buyer's outputs are spent, only the forwarding transaction can still move the payment
+	if payment.ForwardingTransactionHash != nil {
+		transaction, err := getTransaction(client, *payment.ForwardingTransactionHash)
+		if err != nil {
+			return err
+		}
+		reorged, changed := updateBlockHash(&payment.ForwardingBlockHash, transaction)
+		if !changed {
+			return nil
+		}
+		// the state only changes if a forwarded payment loses its block, the backend isn't notified of the block alone
+		if !reorged || payment.CurrentPaymentState.StateID != enum.Forwarded {
+			return s.paymentRepository.Update(payment)
+		}
+
+		var conf int64 = 0
+		payment.ForwardingConfirmations = &conf
+		return s.rollbackPayment(payment, enum.Confirmed, &payment.CurrentPaymentState.AmountReceived.Int)
+	}
+
+	reorged, risk, err := s.updateIncomingTransactions(client, payment)
+	if err != nil {
+		return err
+	}
+	// a zero-conf payment also loses its funds to a double spend or when its transactions are dropped from the mempool
+	if !reorged && payment.CurrentPaymentState.StateID != enum.Paid {
+		return s.updateRisk(payment, risk)
+	}
+
+	state, amountReceived, err := s.getSupportedState(payment, network)
+	if err != nil {
+		return err
+	}
+	if state == payment.CurrentPaymentState.StateID {
+		return s.updateRisk(payment, risk)
+	}
+	payment.Risk = risk
+	return s.rollbackPayment(payment, state, amountReceived)
+}
+
+// recheckPayment is handlePaymentReorg for a single payment, e.g. when one of its transactions was replaced
+func (s *bitcoinService) recheckPayment(payment *model.Payment, network model.Network) error {
+	client, err := s.getClientByNetwork(network)
+	if err != nil {
+		return err
+	}
+	return s.handlePaymentReorg(client, payment, network)
+}
+
+// updateIncomingTransactions records the blocks of the buyer's transactions. It reports if one was reorged out
+// and the highest risk of the transactions.
+func (s *bitcoinService) updateIncomingTransactions(client node.BitcoinNode, payment *model.Payment) (bool, model.RiskLevel, error) {
+	transactions, err := s.incomingRepository.FindByPayment(payment.ID)
+	if err != nil {
+		return false, 0, err
+	}
+
+	anyReorged := false
+	highestRisk := model.RiskLow
+	for i := range transactions {
+		transaction, err := getTransaction(client, transactions[i].TxHash)
+		if err != nil {
+			return false, 0, err
+		}
+		risk, err := getTransactionRisk(transaction)
+		if err != nil {
+			return false, 0, err
+		}
+		if risk > highestRisk {
+			highestRisk = risk
+		}
+
+		reorged, changed := updateBlockHash(&transactions[i].BlockHash, transaction)
+		if !changed {
+			continue
+		}
+		err = s.incomingRepository.Update(&transactions[i])
+		if err != nil {
+			return false, 0, err
+		}
+		anyReorged = anyReorged || reorged
+	}
+	return anyReorged, highestRisk, nil
+}
+
+// updateRisk saves a changed risk together with an outbox notification
+func (s *bitcoinService) updateRisk(payment *model.Payment, risk model.RiskLevel) error {
+	if payment.Risk == risk {
+		return nil
+	}
+	payment.Risk = risk
+	return s.savePayment(payment)
+}
+
+// updateBlockHash sets the block the transaction is confirmed in now. It was reorged out if it was
+// in another block before or if it conflicts with a confirmed transaction.
+func updateBlockHash(blockHash **string, transaction *btcjson.GetTransactionResult) (reorged bool, changed bool) {
+	var current *string
+	if transaction.Confirmations > 0 {
+		hash := transaction.BlockHash
+		current = &hash
+	}
+
+	previous := *blockHash
+	reorged = transaction.Confirmations < 0 || (previous != nil && (current == nil || *current != *previous))
+	changed = reorged || (previous == nil) != (current == nil)
+	*blockHash = current
+	return reorged, changed
+}
+
+// getSupportedState is the state of a not yet forwarded payment according to the active chain
+func (s *bitcoinService) getSupportedState(payment *model.Payment, network model.Network) (enum.State, *big.Int, error) {
+	confirmedAmount, err := s.getUnspentByAddress(payment.Account.Address, getMinimumConfirmations(network), network)
+	if err != nil {
+		return 0, nil, err
+	}
+	confirmedAmount.Sub(confirmedAmount, &payment.Account.Remainder.Int)
+
+	amountReceived, err := s.getUnspentByAddress(payment.Account.Address, 0, network)
+	if err != nil {
+		return 0, nil, err
+	}
+	amountReceived.Sub(amountReceived, &payment.Account.Remainder.Int)
+
+	required := getRequiredAmount(payment)
+	switch {
+	case payment.CurrentPaymentState.StateID == enum.Confirmed && confirmedAmount.Cmp(required) >= 0:
+		return enum.Confirmed, confirmedAmount, nil
+	case amountReceived.Cmp(required) >= 0:
+		return enum.Paid, amountReceived, nil
+	case amountReceived.Sign() > 0:
+		return enum.PartiallyPaid, amountReceived, nil
+	default:
+		return enum.Waiting, big.NewInt(0), nil
+	}
+}
+
+// rollbackPayment adds the earlier state the payment went back to and notifies the backend
+func (s *bitcoinService) rollbackPayment(payment *model.Payment, state enum.State, amountReceived *big.Int) error {
+	log.Printf("reorg: payment %s rolled back from %s to %s", payment.ID, payment.CurrentPaymentState.StateID, state)
+
+	newState := model.PaymentState{
+		Base:           model.Base{ID: uuid.New()},
+		PayAmount:      payment.CurrentPaymentState.PayAmount,
+		AmountReceived: model.NewBigInt(amountReceived),
+		PaymentID:      payment.ID,
+		StateID:        state,
+	}
+	setSurplus(&newState)
+	if state == enum.Waiting || state == enum.PartiallyPaid {
+		payment.Shortfall = model.NewBigIntFromInt(0)
+	}
+	payment.CurrentPaymentStateId = &newState.ID
+	payment.CurrentPaymentState = newState
+	payment.PaymentStates = append(payment.PaymentStates, newState)
+	return s.unitOfWork.WithTx(func(tx *repository.Repositories) error {
+		err := tx.Payment.Update(payment)
+		if err != nil {
+			return err
+		}
+		err = tx.Outbox.Create(newOutboxNotification(payment))
+		if err != nil {
+			return err
+		}
+		// the credit of a payment which is not paid out is taken back until it is confirmed again
+		if state != enum.Confirmed && payment.ForwardingTransactionHash == nil {
+			return debitMerchant(tx.MerchantLedger, payment, model.LedgerReversal, nil)
+		}
+		return nil
+	})
+}
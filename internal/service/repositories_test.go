@@ -0,0 +1,61 @@
+package service
+
+import (
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+)
+
+// the repositories are backed by postgres, or by memory if the tests are built with the simulated tag
+var (
+	accountRepo      repository.IAccountRepository
+	paymentRepo      repository.IPaymentRepository
+	outboxRepo       repository.IOutboxRepository
+	chainCursorRepo  repository.IChainCursorRepository
+	latePaymentRepo  repository.ILatePaymentRepository
+	refundRepo       repository.IRefundRepository
+	settingsRepo     repository.IMerchantSettingsRepository
+	incomingRepo     repository.IIncomingTransactionRepository
+	forwardingRepo   repository.IForwardingTransactionRepository
+	payoutBatchRepo  repository.IPayoutBatchRepository
+	ledgerRepo       repository.IMerchantLedgerRepository
+	advisoryLockRepo repository.IAdvisoryLockRepository
+	unitOfWork       repository.IUnitOfWork
+)
+
+const factor = 100000000
+const payAmount = 0.003403
+
+//const payAmount = 0.000141
+
+func setRepositories(repos *repository.Repositories, uow repository.IUnitOfWork) {
+	accountRepo = repos.Account
+	paymentRepo = repos.Payment
+	outboxRepo = repos.Outbox
+	chainCursorRepo = repos.ChainCursor
+	latePaymentRepo = repos.LatePayment
+	refundRepo = repos.Refund
+	settingsRepo = repos.MerchantSettings
+	incomingRepo = repos.IncomingTransaction
+	forwardingRepo = repos.ForwardingTransaction
+	payoutBatchRepo = repos.PayoutBatch
+	ledgerRepo = repos.MerchantLedger
+	advisoryLockRepo = repos.AdvisoryLock
+	unitOfWork = uow
+}
+
+// getRepositories collects the repositories set by setRepositories for a service
+func getRepositories() *repository.Repositories {
+	return &repository.Repositories{
+		Account:               accountRepo,
+		Payment:               paymentRepo,
+		Outbox:                outboxRepo,
+		ChainCursor:           chainCursorRepo,
+		LatePayment:           latePaymentRepo,
+		Refund:                refundRepo,
+		MerchantSettings:      settingsRepo,
+		IncomingTransaction:   incomingRepo,
+		ForwardingTransaction: forwardingRepo,
+		PayoutBatch:           payoutBatchRepo,
+		MerchantLedger:        ledgerRepo,
+		AdvisoryLock:          advisoryLockRepo,
+	}
+}
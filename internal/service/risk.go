@@ -0,0 +1,37 @@
+package service
+
+import (
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// getTransactionRisk rates how likely an incoming transaction is replaced before it confirms.
+// A transaction with wallet conflicts is high risk, one signaling BIP125 replaceability medium risk.
+func getTransactionRisk(transaction *btcjson.GetTransactionResult) (model.RiskLevel, error) {
+	if transaction.Confirmations > 0 {
+		return model.RiskLow, nil
+	}
+	if transaction.Confirmations < 0 || len(transaction.WalletConflicts) > 0 {
+		return model.RiskHigh, nil
+	}
+
+	tx, err := decodeTransaction(transaction.Hex)
+	if err != nil {
+		return 0, err
+	}
+	if signalsReplacement(tx) {
+		return model.RiskMedium, nil
+	}
+	return model.RiskLow, nil
+}
+
+// signalsReplacement checks for an explicit BIP125 signal, replaceable unconfirmed parents are not considered
+func signalsReplacement(tx *wire.MsgTx) bool {
+	for _, in := range tx.TxIn {
+		if in.Sequence < wire.MaxTxInSequenceNum-1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+//go:build simulated
+// +build simulated
+
+package service
+
+import (
+	"os"
+	"testing"
+
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+)
+
+// TestMain runs the tests against the simulated node and the memory repositories, no docker is needed:
+// go test -tags simulated ./internal/service
+func TestMain(m *testing.M) {
+	utils.NewOpts()
+	store := repository.NewMemoryStore()
+	setRepositories(repository.NewMemoryRepositories(store), repository.NewMemoryUnitOfWork(store))
+	os.Exit(m.Run())
+}
@@ -0,0 +1,1606 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/node"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"github.com/CHainGate/bitcoin-service/openApi"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/google/uuid"
+	"gopkg.in/h2non/gock.v1"
+)
+
+var (
+	simulatedService IBitcoinService
+	simulated        *node.SimulatedNode
+)
+
+// getSimulatedService shares one simulated signet node between the tests, because freed accounts are reused by later payments
+func getSimulatedService(t *testing.T) (IBitcoinService, *node.SimulatedNode) {
+	if simulatedService != nil {
+		return simulatedService, simulated
+	}
+	simulated = node.NewSimulatedNode(&chaincfg.SigNetParams, 0.00001, "secret")
+	changeAddress, err := simulated.GetNewAddress("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.Opts.SignetChangeAddress = changeAddress.EncodeAddress()
+	utils.Opts.SignetWalletPassphrase = "secret"
+
+	simulatedService = NewBitcoinService(getRepositories(), unitOfWork, map[model.Network]node.BitcoinNode{model.Signet: simulated}, nil, nil)
+	return simulatedService, simulated
+}
+
+// createSimulatedPayment creates a payment of 100 usd to the wallet on the simulated signet node.
+// It returns the payment with its address and the amount to pay.
+func createSimulatedPayment(t *testing.T, wallet btcutil.Address) (*model.Payment, btcutil.Address, btcutil.Amount) {
+	return createSimulatedPaymentFromRequest(t, openApi.PaymentRequestDto{
+		PriceCurrency: "usd",
+		PriceAmount:   100,
+		Wallet:        wallet.EncodeAddress(),
+		Mode:          "test",
+	})
+}
+
+// createSimulatedPaymentFromRequest is createSimulatedPayment for a request with further options, the price is payAmount
+func createSimulatedPaymentFromRequest(t *testing.T, request openApi.PaymentRequestDto) (*model.Payment, btcutil.Address, btcutil.Amount) {
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		Reply(200).
+		JSON(map[string]interface{}{"src_currency": "usd", "dst_currency": "btc", "price": payAmount})
+
+	simulatedService, _ := getSimulatedService(t)
+	payment, err := simulatedService.CreateNewPayment(request)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	address, err := btcutil.DecodeAddress(payment.Account.Address, &chaincfg.SigNetParams)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	amount, err := btcutil.NewAmount(payAmount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return payment, address, amount
+}
+
+func TestBitcoinService_SimulatedNode(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	simulatedService, simulated := getSimulatedService(t)
+	merchant := simulated.NewExternalAddress()
+	payment, address, amount := createSimulatedPayment(t, merchant)
+	minimumConfirmations := getMinimumConfirmations(model.Signet)
+
+	// Act
+	txHash, err := simulated.Pay(address, amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	paid, _ := paymentRepo.FindByID(payment.ID)
+
+	// the forwarding attempts of the block fail, the confirmed payment is retried with the next block
+	simulated.FailNext("SendRawTransaction", node.ErrSimulated)
+	simulated.FailNext("SendRawTransaction", node.ErrSimulated)
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	failed, _ := paymentRepo.FindByID(payment.ID)
+
+	simulated.Mine(1)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	simulated.Mine(1)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	forwarded, _ := paymentRepo.FindByID(payment.ID)
+
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	finished, _ := paymentRepo.FindByID(payment.ID)
+
+	// Assert
+	if payment.Network != model.Signet {
+		t.Errorf("Expected network %s, but got %s", model.Signet, payment.Network)
+	}
+	if paid.CurrentPaymentState.StateID != enum.Paid {
+		t.Errorf("Expected state %s, but got %s", enum.Paid, paid.CurrentPaymentState.StateID)
+	}
+	if failed.CurrentPaymentState.StateID != enum.Confirmed || failed.ForwardingTransactionHash != nil {
+		t.Errorf("Expected confirmed payment without forwarding transaction, but got %s", failed.CurrentPaymentState.StateID)
+	}
+	if forwarded.CurrentPaymentState.StateID != enum.Forwarded || forwarded.ForwardingTransactionHash == nil {
+		t.Errorf("Expected forwarded payment, but got %s", forwarded.CurrentPaymentState.StateID)
+	}
+	if finished.CurrentPaymentState.StateID != enum.Finished || finished.Account.Used {
+		t.Errorf("Expected finished payment with a free account, but got %s", finished.CurrentPaymentState.StateID)
+	}
+
+	if !hasWalletSend(t, simulated, merchant, *finished.ForwardingTransactionHash) {
+		t.Errorf("Expected forwarding transaction to %s", merchant)
+	}
+}
+
+func TestBitcoinService_LatePayment(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	simulatedService, simulated := getSimulatedService(t)
+	merchant := simulated.NewExternalAddress()
+	payment, address, amount := createSimulatedPayment(t, merchant)
+	partial, partialAddress, _ := createSimulatedPayment(t, merchant)
+	partialHash, err := simulated.Pay(partialAddress, amount/2)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(partialHash.String(), model.Signet)
+	// TimeReceived has a precision of seconds
+	time.Sleep(time.Second)
+
+	partiallyPaid, err := paymentRepo.FindByID(partial.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, expiring := range []*model.Payment{payment, partiallyPaid} {
+		expiring.ExpiresAt = time.Now().Add(-time.Minute)
+		err = paymentRepo.Update(expiring)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	simulatedService.HandleBlockNotify("", model.Signet)
+
+	minimumConfirmations := getMinimumConfirmations(model.Signet)
+
+	// Act
+	txHash, err := simulated.Pay(address, amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	// replayed notifications are ignored
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	// a resync also replays the transaction received before the partially paid payment expired
+	simulatedService.Resync(model.Signet)
+	replayed, _ := latePaymentRepo.FindByAccountAndTxHash(partial.Account.ID, partialHash.String())
+	expired, _ := paymentRepo.FindByID(partial.ID)
+	latePaid, _ := paymentRepo.FindByID(payment.ID)
+	pending, _ := latePaymentRepo.FindByAccountAndTxHash(payment.Account.ID, txHash.String())
+	if pending == nil {
+		t.Fatalf("Expected a late payment for transaction %s", txHash)
+	}
+	heldAccount, _ := accountRepo.FindByAddress(payment.Account.Address)
+	pendingCount, _ := latePaymentRepo.CountPendingByAccount(payment.Account.ID)
+
+	_, unconfirmedErr := simulatedService.HonorLatePayment(pending.ID)
+	simulated.Mine(minimumConfirmations)
+	honored, honorErr := simulatedService.HonorLatePayment(pending.ID)
+	_, honorAgainErr := simulatedService.HonorLatePayment(pending.ID)
+	freedAccount, _ := accountRepo.FindByAddress(payment.Account.Address)
+
+	refundHash, err := simulated.Pay(address, amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(refundHash.String(), model.Signet)
+	toRefund, _ := latePaymentRepo.FindByAccountAndTxHash(payment.Account.ID, refundHash.String())
+	if toRefund == nil {
+		t.Fatalf("Expected a late payment for transaction %s", refundHash)
+	}
+	simulated.Mine(minimumConfirmations)
+	buyer := simulated.NewExternalAddress()
+	_, invalidAddressErr := simulatedService.RefundLatePayment(toRefund.ID, "invalid")
+	refunded, refundErr := simulatedService.RefundLatePayment(toRefund.ID, buyer.EncodeAddress())
+
+	// Assert
+	if pending.Status != model.LatePaymentPending || pending.PaymentID != payment.ID || pending.Amount.Int64() != int64(amount) {
+		t.Fatalf("Expected a pending late payment of %d for payment %s, but got %v", int64(amount), payment.ID, pending)
+	}
+	if !heldAccount.Used || pendingCount != 1 {
+		t.Errorf("Expected the account to be held by 1 late payment, but got used %t with %d", heldAccount.Used, pendingCount)
+	}
+	lateNotification := assertEventNotification(t, payment.ID, model.LatePaymentPending.Event(), model.LatePaymentPending.PaymentState())
+	if lateNotification != nil && (lateNotification.LateAmount != pending.Amount.String() || lateNotification.ActuallyPaid != latePaid.CurrentPaymentState.AmountReceived.String()) {
+		t.Errorf("Expected the late amount %s apart from the received amount %s, but got %s and %s", pending.Amount, latePaid.CurrentPaymentState.AmountReceived, lateNotification.LateAmount, lateNotification.ActuallyPaid)
+	}
+	if expired.CurrentPaymentState.StateID != enum.Expired || replayed != nil {
+		t.Errorf("Expected the expired payment to keep the funds received before it expired, but got a late payment %v", replayed)
+	}
+	if unconfirmedErr == nil {
+		t.Errorf("Expected unconfirmed late payment not to be forwarded")
+	}
+	if honorErr != nil || honored.Status != model.LatePaymentHonored || honored.ResolvingTransactionHash == nil {
+		t.Fatalf("Expected an honored late payment, but got %v, %v", honored, honorErr)
+	}
+	if !hasWalletSend(t, simulated, merchant, *honored.ResolvingTransactionHash) {
+		t.Errorf("Expected the late payment to be forwarded to %s", merchant)
+	}
+	if honorAgainErr == nil {
+		t.Errorf("Expected an honored late payment not to be honored again")
+	}
+	if freedAccount.Used {
+		t.Errorf("Expected the account to be freed after the late payment was honored")
+	}
+	assertEventNotification(t, payment.ID, model.LatePaymentHonored.Event(), model.LatePaymentHonored.PaymentState())
+	if invalidAddressErr == nil {
+		t.Errorf("Expected an invalid refund address to be rejected")
+	}
+	if refundErr != nil || refunded.Status != model.LatePaymentRefunded || refunded.RefundAddress != buyer.EncodeAddress() {
+		t.Fatalf("Expected a refunded late payment, but got %v, %v", refunded, refundErr)
+	}
+	if !hasWalletSend(t, simulated, buyer, *refunded.ResolvingTransactionHash) {
+		t.Errorf("Expected the late payment to be refunded to %s", buyer)
+	}
+}
+
+func TestBitcoinService_LatePaymentBlockLock(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	simulatedService, simulated := getSimulatedService(t)
+	merchant := simulated.NewExternalAddress()
+	payment, address, amount := createSimulatedPayment(t, merchant)
+	expiring, err := paymentRepo.FindByID(payment.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expiring.ExpiresAt = time.Now().Add(-time.Minute)
+	err = paymentRepo.Update(expiring)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleBlockNotify("", model.Signet)
+	// TimeReceived has a precision of seconds
+	time.Sleep(time.Second)
+	txHash, err := simulated.Pay(address, amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	simulated.Mine(getMinimumConfirmations(model.Signet))
+	pending, _ := latePaymentRepo.FindByAccountAndTxHash(payment.Account.ID, txHash.String())
+	if pending == nil {
+		t.Fatalf("Expected a late payment for transaction %s", txHash)
+	}
+
+	// Act
+	honored := make(chan error, 1)
+	var resolvedWhileLocked bool
+	err = advisoryLockRepo.WithLock(getBlockLockKey(model.Signet), func() {
+		go func() {
+			_, err := simulatedService.HonorLatePayment(pending.ID)
+			honored <- err
+		}()
+		select {
+		case <-honored:
+			resolvedWhileLocked = true
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var honorErr error
+	if !resolvedWhileLocked {
+		honorErr = <-honored
+	}
+	_, refundErr := simulatedService.RefundLatePayment(pending.ID, simulated.NewExternalAddress().EncodeAddress())
+
+	// Assert
+	if resolvedWhileLocked {
+		t.Fatalf("Expected the late payment to wait for the block lock")
+	}
+	if honorErr != nil {
+		t.Fatalf("Expected the late payment to be honored once the lock was released, but got %v", honorErr)
+	}
+	if refundErr == nil || !strings.Contains(refundErr.Error(), "already honored") {
+		t.Errorf("Expected the honored late payment not to be refunded, but got %v", refundErr)
+	}
+}
+
+func TestBitcoinService_Refund(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	simulatedService, simulated := getSimulatedService(t)
+	merchant := simulated.NewExternalAddress()
+	buyer := simulated.NewExternalAddress()
+	overpaid, overpaidAddress, amount := createSimulatedPayment(t, merchant)
+	underpaid, underpaidAddress, _ := createSimulatedPayment(t, merchant)
+	excess := big.NewInt(int64(amount) / 2)
+	partial := big.NewInt(int64(amount) / 2)
+	minimumConfirmations := getMinimumConfirmations(model.Signet)
+
+	// Act
+	txHash, err := simulated.Pay(overpaidAddress, 2*amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	_, tooMuchErr := simulatedService.RefundPayment(overpaid.ID, buyer.EncodeAddress(), big.NewInt(int64(amount)+1))
+	_, invalidAddressErr := simulatedService.RefundPayment(overpaid.ID, "invalid", excess)
+	excessRefund, excessErr := simulatedService.RefundPayment(overpaid.ID, buyer.EncodeAddress(), excess)
+
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	excessRefunds, _ := refundRepo.FindByPayment(overpaid.ID)
+	forwarded, _ := paymentRepo.FindByID(overpaid.ID)
+
+	txHash, err = simulated.Pay(underpaidAddress, btcutil.Amount(partial.Int64()))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	_, openErr := simulatedService.RefundPayment(underpaid.ID, buyer.EncodeAddress(), partial)
+	// reloaded, the created payment would reset the state to waiting
+	partiallyPaid, err := paymentRepo.FindByID(underpaid.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	partiallyPaid.ExpiresAt = time.Now().Add(-time.Minute)
+	err = paymentRepo.Update(partiallyPaid)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleBlockNotify("", model.Signet)
+	expiredAccount, _ := accountRepo.FindByAddress(underpaid.Account.Address)
+	_, tooMuchPartialErr := simulatedService.RefundPayment(underpaid.ID, buyer.EncodeAddress(), big.NewInt(partial.Int64()+1))
+	partialRefund, partialErr := simulatedService.RefundPayment(underpaid.ID, buyer.EncodeAddress(), partial)
+	refundedAccount, _ := accountRepo.FindByAddress(underpaid.Account.Address)
+
+	// Assert
+	if tooMuchErr == nil {
+		t.Errorf("Expected a refund of more than the overpaid amount to be rejected")
+	}
+	if invalidAddressErr == nil {
+		t.Errorf("Expected an invalid refund address to be rejected")
+	}
+	if excessErr != nil || excessRefund.CurrentRefundState.Status != model.RefundSent || excessRefund.TransactionHash == nil {
+		t.Fatalf("Expected a sent refund, but got %v, %v", excessRefund, excessErr)
+	}
+	if !hasWalletSend(t, simulated, buyer, *excessRefund.TransactionHash) {
+		t.Errorf("Expected the excess to be refunded to %s", buyer)
+	}
+	if len(excessRefunds) != 1 || excessRefunds[0].CurrentRefundState.Status != model.RefundConfirmed || len(excessRefunds[0].RefundStates) != 3 {
+		t.Errorf("Expected one confirmed refund with 3 states, but got %v", excessRefunds)
+	}
+	sentNotification := assertEventNotification(t, overpaid.ID, model.RefundSent.Event(), enum.Paid.String())
+	if sentNotification != nil && (sentNotification.RefundStatus != model.RefundSent.String() || sentNotification.RefundAmount != excessRefund.Amount.String() || sentNotification.RefundTxHash == nil || *sentNotification.RefundTxHash != *excessRefund.TransactionHash) {
+		t.Errorf("Expected the sent refund %s in the notification, but got %v", excessRefund.ID, sentNotification)
+	}
+	assertEventNotification(t, overpaid.ID, model.RefundConfirmed.Event(), enum.Confirmed.String())
+	if forwarded.ForwardingTransactionHash == nil {
+		t.Errorf("Expected the pay amount to be forwarded after the refund, but got %s", forwarded.CurrentPaymentState.StateID)
+	}
+	if openErr == nil {
+		t.Errorf("Expected an open payment not to be refunded")
+	}
+	if tooMuchPartialErr == nil {
+		t.Errorf("Expected a refund of more than the received amount to be rejected")
+	}
+	if partialErr != nil || partialRefund.Amount.Cmp(partial) != 0 {
+		t.Fatalf("Expected a refund of %s, but got %v, %v", partial, partialRefund, partialErr)
+	}
+	remainder := new(big.Int).Sub(&expiredAccount.Remainder.Int, partial)
+	if refundedAccount.Remainder.Cmp(remainder) != 0 {
+		t.Errorf("Expected a remainder of %s, but got %s", remainder, refundedAccount.Remainder)
+	}
+}
+
+func TestBitcoinService_Overpayment(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	simulatedService, simulated := getSimulatedService(t)
+	forwardMerchant := simulated.NewExternalAddress()
+	refundMerchant := simulated.NewExternalAddress()
+	buyer := simulated.NewExternalAddress()
+	_, err := simulatedService.SaveMerchantSettings(model.MerchantSettings{Wallet: forwardMerchant.EncodeAddress(), OverpaymentPolicy: model.OverpaymentForward})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = simulatedService.SaveMerchantSettings(model.MerchantSettings{Wallet: refundMerchant.EncodeAddress(), OverpaymentPolicy: model.OverpaymentRefund})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	forward, forwardAddress, amount := createSimulatedPayment(t, forwardMerchant)
+	refund, refundAddress, _ := createSimulatedPaymentFromRequest(t, openApi.PaymentRequestDto{
+		PriceCurrency: "usd",
+		PriceAmount:   100,
+		Wallet:        refundMerchant.EncodeAddress(),
+		Mode:          "test",
+		RefundAddress: buyer.EncodeAddress(),
+	})
+	minimumConfirmations := getMinimumConfirmations(model.Signet)
+
+	// Act
+	txHash, err := simulated.Pay(forwardAddress, 2*amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	txHash, err = simulated.Pay(refundAddress, 2*amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	forwarded, _ := paymentRepo.FindByID(forward.ID)
+	refunded, _ := paymentRepo.FindByID(refund.ID)
+	refunds, _ := refundRepo.FindByPayment(refund.ID)
+
+	// the pay amount is forwarded once the change of the refund is confirmed
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	refundForwarded, _ := paymentRepo.FindByID(refund.ID)
+
+	// Assert
+	if forward.OverpaymentPolicy != model.OverpaymentForward || refund.OverpaymentPolicy != model.OverpaymentRefund {
+		t.Errorf("Expected the policies of the merchants, but got %s and %s", forward.OverpaymentPolicy, refund.OverpaymentPolicy)
+	}
+	for _, payment := range []*model.Payment{forwarded, refunded} {
+		confirmed := payment.PaymentStates[2]
+		if confirmed.StateID != enum.Confirmed || !confirmed.Overpaid || confirmed.Surplus.Cmp(big.NewInt(int64(amount))) != 0 {
+			t.Errorf("Expected a confirmed state with a surplus of %d, but got %s with %s", amount, confirmed.StateID, confirmed.Surplus)
+		}
+	}
+	if forwarded.ForwardingTransactionHash == nil {
+		t.Fatalf("Expected forwarded payment, but got %s", forwarded.CurrentPaymentState.StateID)
+	}
+	forwardedAmount := getWalletSendAmount(t, simulated, forwardMerchant, *forwarded.ForwardingTransactionHash)
+	if forwardedAmount <= amount {
+		t.Errorf("Expected the surplus to be forwarded, but got %s", forwardedAmount)
+	}
+	surplusNotification := assertEventNotification(t, forward.ID, model.OverpaymentForward.Event(), enum.Confirmed.String())
+	if surplusNotification != nil && (surplusNotification.ActuallyPaid != big.NewInt(int64(2*amount)).String() || surplusNotification.Surplus != big.NewInt(int64(amount)).String()) {
+		t.Errorf("Expected %d received with a surplus of %d, but got %s with %s", 2*amount, amount, surplusNotification.ActuallyPaid, surplusNotification.Surplus)
+	}
+
+	if refunded.ForwardingTransactionHash != nil {
+		t.Errorf("Expected the pay amount not to be forwarded before the refund change is confirmed")
+	}
+	if len(refunds) != 1 || refunds[0].CurrentRefundState.Status != model.RefundSent || refunds[0].RefundAddress != buyer.EncodeAddress() {
+		t.Fatalf("Expected one sent refund to %s, but got %v", buyer, refunds)
+	}
+	if refunds[0].Amount.Cmp(big.NewInt(int64(amount))) != 0 {
+		t.Errorf("Expected a refund of %d, but got %s", amount, refunds[0].Amount)
+	}
+	assertEventNotification(t, refund.ID, model.OverpaymentRefund.Event(), enum.Confirmed.String())
+	if refundForwarded.ForwardingTransactionHash == nil {
+		t.Fatalf("Expected the pay amount to be forwarded after the refund, but got %s", refundForwarded.CurrentPaymentState.StateID)
+	}
+	refundForwardedAmount := getWalletSendAmount(t, simulated, refundMerchant, *refundForwarded.ForwardingTransactionHash)
+	if refundForwardedAmount >= amount {
+		t.Errorf("Expected only the pay amount to be forwarded, but got %s", refundForwardedAmount)
+	}
+}
+
+func TestBitcoinService_OverpaymentCredit(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	simulatedService, simulated := getSimulatedService(t)
+	merchant := simulated.NewExternalAddress()
+	_, err := simulatedService.SaveMerchantSettings(model.MerchantSettings{Wallet: merchant.EncodeAddress(), OverpaymentPolicy: model.OverpaymentCredit})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	payment, address, amount := createSimulatedPayment(t, merchant)
+
+	// Act
+	txHash, err := simulated.Pay(address, 2*amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	simulated.Mine(getMinimumConfirmations(model.Signet))
+	simulatedService.HandleBlockNotify("", model.Signet)
+	credited, _ := paymentRepo.FindByID(payment.ID)
+	entries, _ := ledgerRepo.FindByPayment(payment.ID)
+
+	// Assert
+	if credited.ForwardingTransactionHash == nil {
+		t.Fatalf("Expected forwarded payment, but got %s", credited.CurrentPaymentState.StateID)
+	}
+	surplus := calculateForwardAmount(big.NewInt(int64(amount)))
+	if len(entries) != 3 || entries[1].Kind != model.LedgerCredit || entries[1].Amount.Cmp(surplus) != 0 {
+		t.Fatalf("Expected the surplus of %s to be credited before the payout, but got %v", surplus, entries)
+	}
+	if entries[2].Kind != model.LedgerPayout || getLedgerBalance(entries).Sign() != 0 {
+		t.Errorf("Expected the credited surplus to be paid out, but got %v", entries)
+	}
+	forwardedAmount := getWalletSendAmount(t, simulated, merchant, *credited.ForwardingTransactionHash)
+	if forwardedAmount <= amount {
+		t.Errorf("Expected the credited surplus to be paid out with the payment, but got %s", forwardedAmount)
+	}
+	assertEventNotification(t, payment.ID, model.OverpaymentCredit.Event(), enum.Confirmed.String())
+}
+
+func TestBitcoinService_UnderpaymentTolerance(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		Reply(200).
+		JSON(map[string]interface{}{"src_currency": "usd", "dst_currency": "btc", "price": payAmount})
+
+	simulatedService, simulated := getSimulatedService(t)
+	merchant := simulated.NewExternalAddress()
+	request := openApi.PaymentRequestDto{
+		PriceCurrency:         "usd",
+		PriceAmount:           100,
+		Wallet:                merchant.EncodeAddress(),
+		Mode:                  "test",
+		UnderpaymentTolerance: "1000",
+	}
+	_, tooHighErr := simulatedService.CreateNewPayment(openApi.PaymentRequestDto{
+		PriceCurrency:                "usd",
+		PriceAmount:                  100,
+		Wallet:                       merchant.EncodeAddress(),
+		Mode:                         "test",
+		UnderpaymentTolerancePercent: utils.Opts.UnderpaymentToleranceMax + 1,
+	})
+	tolerated, toleratedAddress, amount := createSimulatedPaymentFromRequest(t, request)
+	short, shortAddress, _ := createSimulatedPaymentFromRequest(t, request)
+	minimumConfirmations := getMinimumConfirmations(model.Signet)
+
+	// Act
+	txHash, err := simulated.Pay(toleratedAddress, amount-500)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	txHash, err = simulated.Pay(shortAddress, amount-1001)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	paid, _ := paymentRepo.FindByID(tolerated.ID)
+	partiallyPaid, _ := paymentRepo.FindByID(short.ID)
+
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	forwarded, _ := paymentRepo.FindByID(tolerated.ID)
+
+	// Assert
+	if tooHighErr == nil {
+		t.Errorf("Expected a tolerance above %v percent to be rejected", utils.Opts.UnderpaymentToleranceMax)
+	}
+	if tolerated.UnderpaymentTolerance.Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("Expected a tolerance of 1000, but got %s", tolerated.UnderpaymentTolerance)
+	}
+	if paid.CurrentPaymentState.StateID != enum.Paid || paid.Shortfall.Cmp(big.NewInt(500)) != 0 {
+		t.Errorf("Expected paid payment with a shortfall of 500, but got %s with %s", paid.CurrentPaymentState.StateID, paid.Shortfall)
+	}
+	if partiallyPaid.CurrentPaymentState.StateID != enum.PartiallyPaid || partiallyPaid.Shortfall.Sign() != 0 {
+		t.Errorf("Expected partially paid payment without shortfall, but got %s with %s", partiallyPaid.CurrentPaymentState.StateID, partiallyPaid.Shortfall)
+	}
+	if forwarded.ForwardingTransactionHash == nil {
+		t.Fatalf("Expected forwarded payment, but got %s", forwarded.CurrentPaymentState.StateID)
+	}
+	forwardAmount := calculateForwardAmount(big.NewInt(int64(amount - 500)))
+	forwardedAmount := getWalletSendAmount(t, simulated, merchant, *forwarded.ForwardingTransactionHash)
+	if int64(forwardedAmount) > forwardAmount.Int64() {
+		t.Errorf("Expected at most %s to be forwarded, but got %d", forwardAmount, int64(forwardedAmount))
+	}
+}
+
+func TestBitcoinService_Reorg(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	simulatedService, simulated := getSimulatedService(t)
+	payment, address, amount := createSimulatedPayment(t, simulated.NewExternalAddress())
+	minimumConfirmations := getMinimumConfirmations(model.Signet)
+
+	txHash, err := simulated.Pay(address, amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	// the forwarding fails, so the confirmed payment still depends on the buyer's transaction
+	simulated.FailNext("SendRawTransaction", node.ErrSimulated)
+	simulated.FailNext("SendRawTransaction", node.ErrSimulated)
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	confirmed, _ := paymentRepo.FindByID(payment.ID)
+	incoming, _ := incomingRepo.FindByPaymentAndTxHash(payment.ID, txHash.String())
+
+	// Act
+	simulated.Disconnect(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	paid, _ := paymentRepo.FindByID(payment.ID)
+
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	simulated.Mine(1)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	forwarded, _ := paymentRepo.FindByID(payment.ID)
+
+	simulated.Disconnect(1)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	reconfirmed, _ := paymentRepo.FindByID(payment.ID)
+
+	simulated.Mine(1)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	reforwarded, _ := paymentRepo.FindByID(payment.ID)
+
+	// Assert
+	if confirmed.CurrentPaymentState.StateID != enum.Confirmed || confirmed.ForwardingTransactionHash != nil {
+		t.Fatalf("Expected confirmed payment without forwarding transaction, but got %s", confirmed.CurrentPaymentState.StateID)
+	}
+	if incoming == nil || incoming.BlockHash == nil {
+		t.Errorf("Expected the block of the incoming transaction to be tracked, but got %v", incoming)
+	}
+	if paid.CurrentPaymentState.StateID != enum.Paid {
+		t.Errorf("Expected the payment to be rolled back to %s, but got %s", enum.Paid, paid.CurrentPaymentState.StateID)
+	}
+	if forwarded.CurrentPaymentState.StateID != enum.Forwarded || forwarded.ForwardingBlockHash == nil {
+		t.Errorf("Expected forwarded payment with a tracked block, but got %s", forwarded.CurrentPaymentState.StateID)
+	}
+	if reconfirmed.CurrentPaymentState.StateID != enum.Confirmed || reconfirmed.ForwardingBlockHash != nil {
+		t.Errorf("Expected the payment to be rolled back to %s, but got %s", enum.Confirmed, reconfirmed.CurrentPaymentState.StateID)
+	}
+	if reforwarded.CurrentPaymentState.StateID != enum.Forwarded {
+		t.Errorf("Expected the payment to be forwarded again, but got %s", reforwarded.CurrentPaymentState.StateID)
+	}
+	notifications, err := outboxRepo.FindPending(1000)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var previous *model.OutboxNotification
+	for i, notification := range notifications {
+		if notification.PaymentID != payment.ID {
+			continue
+		}
+		if previous != nil && previous.PaymentState == notification.PaymentState && previous.RiskLevel == notification.RiskLevel &&
+			(previous.TxHash == nil) == (notification.TxHash == nil) {
+			t.Errorf("Expected no update without a change, but got %s twice", notification.PaymentState)
+		}
+		previous = &notifications[i]
+	}
+
+	expectedStates := []enum.State{enum.Waiting, enum.Paid, enum.Confirmed, enum.Paid, enum.Confirmed, enum.Forwarded, enum.Confirmed, enum.Forwarded}
+	if len(reforwarded.PaymentStates) != len(expectedStates) {
+		t.Fatalf("Expected %d states, but got %d", len(expectedStates), len(reforwarded.PaymentStates))
+	}
+	for i, state := range reforwarded.PaymentStates {
+		if state.StateID != expectedStates[i] {
+			t.Errorf("Expected state %d to be %s, but got %s", i, expectedStates[i], state.StateID)
+		}
+	}
+}
+
+func TestBitcoinService_EarlierTransaction(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	simulatedService, simulated := getSimulatedService(t)
+	earlier, address, amount := createSimulatedPayment(t, simulated.NewExternalAddress())
+	txHash, err := simulated.Pay(address, amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	later, _, _ := createSimulatedPayment(t, simulated.NewExternalAddress())
+	transaction, err := simulated.GetTransaction(txHash)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	s := simulatedService.(*bitcoinService)
+
+	// Act
+	own, ownErr := s.isEarlierTransaction(earlier, transaction)
+	recorded, recordedErr := s.isEarlierTransaction(later, transaction)
+	older, olderErr := s.isEarlierTransaction(later, &btcjson.GetTransactionResult{TxID: "older", TimeReceived: later.CreatedAt.Add(-time.Hour).Unix()})
+	newer, newerErr := s.isEarlierTransaction(later, &btcjson.GetTransactionResult{TxID: "newer", TimeReceived: later.CreatedAt.Unix()})
+
+	// Assert
+	if own || ownErr != nil {
+		t.Errorf("Expected the transaction not to be earlier than its own payment, but got %v, %v", own, ownErr)
+	}
+	if !recorded || recordedErr != nil {
+		t.Errorf("Expected a transaction recorded on another payment to be earlier, but got %v, %v", recorded, recordedErr)
+	}
+	if !older || olderErr != nil {
+		t.Errorf("Expected a transaction received before the payment to be earlier, but got %v, %v", older, olderErr)
+	}
+	if newer || newerErr != nil {
+		t.Errorf("Expected a transaction received with the payment not to be earlier, but got %v, %v", newer, newerErr)
+	}
+}
+
+func TestBitcoinService_DoubleSpend(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	simulatedService, simulated := getSimulatedService(t)
+	payment, address, amount := createSimulatedPayment(t, simulated.NewExternalAddress())
+
+	// Act
+	txHash, err := simulated.PayReplaceable(address, amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	paid, _ := paymentRepo.FindByID(payment.ID)
+
+	_, err = simulated.DoubleSpend(txHash)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	downgraded, _ := paymentRepo.FindByID(payment.ID)
+
+	// Assert
+	if paid.CurrentPaymentState.StateID != enum.Paid || paid.Risk != model.RiskMedium {
+		t.Errorf("Expected paid payment with %s risk, but got %s with %s risk", model.RiskMedium, paid.CurrentPaymentState.StateID, paid.Risk)
+	}
+	if downgraded.CurrentPaymentState.StateID != enum.Waiting || downgraded.Risk != model.RiskHigh {
+		t.Errorf("Expected waiting payment with %s risk, but got %s with %s risk", model.RiskHigh, downgraded.CurrentPaymentState.StateID, downgraded.Risk)
+	}
+	assertRiskNotification(t, payment.ID, enum.Paid.String(), model.RiskMedium)
+	assertRiskNotification(t, payment.ID, enum.Waiting.String(), model.RiskHigh)
+}
+
+func TestBitcoinService_RaisedRiskOfHandledAmount(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	simulatedService, simulated := getSimulatedService(t)
+	payment, address, amount := createSimulatedPayment(t, simulated.NewExternalAddress())
+	txHash, err := simulated.Pay(address, amount/2)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	replaceableTxHash, err := simulated.PayReplaceable(address, amount/4)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// the first notification already counts the amount of both transactions
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	partiallyPaid, _ := paymentRepo.FindByID(payment.ID)
+
+	// Act
+	simulatedService.HandleWalletNotify(replaceableTxHash.String(), model.Signet)
+	raised, _ := paymentRepo.FindByID(payment.ID)
+
+	// Assert
+	if partiallyPaid.CurrentPaymentState.StateID != enum.PartiallyPaid || partiallyPaid.Risk != model.RiskLow {
+		t.Fatalf("Expected partially paid payment with %s risk, but got %s with %s risk", model.RiskLow, partiallyPaid.CurrentPaymentState.StateID, partiallyPaid.Risk)
+	}
+	if raised.CurrentPaymentState.ID != partiallyPaid.CurrentPaymentState.ID || raised.Risk != model.RiskMedium {
+		t.Errorf("Expected the same state with %s risk, but got %s with %s risk", model.RiskMedium, raised.CurrentPaymentState.StateID, raised.Risk)
+	}
+	assertRiskNotification(t, payment.ID, enum.PartiallyPaid.String(), model.RiskMedium)
+}
+
+func TestBitcoinService_FeeBump(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	feeBumpBlocks, feeBumpPercentage := utils.Opts.FeeBumpBlocks, utils.Opts.FeeBumpPercentage
+	utils.Opts.FeeBumpBlocks = 2
+	utils.Opts.FeeBumpPercentage = 50
+	defer func() { utils.Opts.FeeBumpBlocks, utils.Opts.FeeBumpPercentage = feeBumpBlocks, feeBumpPercentage }()
+
+	simulatedService, simulated := getSimulatedService(t)
+	defer simulated.SetMiningFeeRate(0)
+	payment, address, amount := createSimulatedPayment(t, simulated.NewExternalAddress())
+	minimumConfirmations := getMinimumConfirmations(model.Signet)
+
+	txHash, err := simulated.Pay(address, amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	simulated.Mine(minimumConfirmations)
+	// the forwarding transaction pays the estimated fee rate, which is too low for the miners now
+	simulated.SetMiningFeeRate(0.000015)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	confirmed, _ := paymentRepo.FindByID(payment.ID)
+
+	// Act
+	simulated.Mine(utils.Opts.FeeBumpBlocks - 1)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	waiting, _ := paymentRepo.FindByID(payment.ID)
+
+	simulated.Mine(1)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	bumped, _ := paymentRepo.FindByID(payment.ID)
+	versions, _ := forwardingRepo.FindByPayment(payment.ID)
+
+	simulated.Mine(1)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	forwarded, _ := paymentRepo.FindByID(payment.ID)
+
+	// Assert
+	if confirmed.CurrentPaymentState.StateID != enum.Confirmed || confirmed.ForwardingTransactionHash == nil {
+		t.Fatalf("Expected confirmed payment with forwarding transaction, but got %s", confirmed.CurrentPaymentState.StateID)
+	}
+	if *waiting.ForwardingTransactionHash != *confirmed.ForwardingTransactionHash {
+		t.Errorf("Expected the forwarding transaction not to be replaced before %d blocks", utils.Opts.FeeBumpBlocks)
+	}
+	if *bumped.ForwardingTransactionHash == *confirmed.ForwardingTransactionHash {
+		t.Fatalf("Expected the stuck forwarding transaction to be replaced")
+	}
+	if len(versions) != 2 || versions[0].TxHash != *confirmed.ForwardingTransactionHash || versions[1].TxHash != *bumped.ForwardingTransactionHash {
+		t.Errorf("Expected both versions of the forwarding transaction to be recorded, but got %d", len(versions))
+	}
+	if forwarded.CurrentPaymentState.StateID != enum.Forwarded || *forwarded.ForwardingTransactionHash != *bumped.ForwardingTransactionHash {
+		t.Errorf("Expected the payment to be forwarded by the replacement, but got %s", forwarded.CurrentPaymentState.StateID)
+	}
+
+	merchant, err := btcutil.DecodeAddress(payment.MerchantWallet, &chaincfg.SigNetParams)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	original := getWalletSendAmount(t, simulated, merchant, *confirmed.ForwardingTransactionHash)
+	replacement := getWalletSendAmount(t, simulated, merchant, *bumped.ForwardingTransactionHash)
+	if replacement >= original {
+		t.Errorf("Expected the higher fee to be subtracted from the merchant's amount, but got %v instead of %v", replacement, original)
+	}
+}
+
+func TestBitcoinService_PayoutBatch(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	forwardAmount := calculateForwardAmount(big.NewInt(payAmount * factor))
+	interval, threshold := utils.Opts.PayoutBatchInterval, utils.Opts.PayoutBatchThreshold
+	utils.Opts.PayoutBatchInterval = 0
+	utils.Opts.PayoutBatchThreshold = int(forwardAmount.Int64() * 3)
+	defer func() { utils.Opts.PayoutBatchInterval, utils.Opts.PayoutBatchThreshold = interval, threshold }()
+
+	simulatedService, simulated := getSimulatedService(t)
+	merchant := simulated.NewExternalAddress()
+	otherMerchant := simulated.NewExternalAddress()
+	minimumConfirmations := getMinimumConfirmations(model.Signet)
+	pay := func(wallet btcutil.Address) *model.Payment {
+		payment, address, amount := createSimulatedPayment(t, wallet)
+		txHash, err := simulated.Pay(address, amount)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+		return payment
+	}
+
+	// Act
+	first := pay(merchant)
+	second := pay(merchant)
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	waiting, _ := paymentRepo.FindByID(first.ID)
+
+	third := pay(otherMerchant)
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+
+	simulated.Mine(1)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	var forwarded []*model.Payment
+	for _, payment := range []*model.Payment{first, second, third} {
+		found, _ := paymentRepo.FindByID(payment.ID)
+		forwarded = append(forwarded, found)
+	}
+
+	// Assert
+	if waiting.CurrentPaymentState.StateID != enum.Confirmed || waiting.ForwardingTransactionHash != nil || waiting.PayoutBatchID != nil {
+		t.Errorf("Expected the confirmed payment to wait for the batch threshold, but got %s", waiting.CurrentPaymentState.StateID)
+	}
+	if forwarded[0].PayoutBatchID == nil || forwarded[0].ForwardingTransactionHash == nil {
+		t.Fatalf("Expected the payments to be forwarded in a batch")
+	}
+	batchId := *forwarded[0].PayoutBatchID
+	txHash := *forwarded[0].ForwardingTransactionHash
+	for i, payment := range forwarded {
+		if payment.CurrentPaymentState.StateID != enum.Forwarded {
+			t.Errorf("Expected payment %d to be forwarded, but got %s", i, payment.CurrentPaymentState.StateID)
+		}
+		if payment.PayoutBatchID == nil || *payment.PayoutBatchID != batchId || *payment.ForwardingTransactionHash != txHash {
+			t.Errorf("Expected payment %d to be forwarded by batch %s", i, batchId)
+		}
+	}
+
+	merchantFee := new(big.Int).Mul(forwardAmount, big.NewInt(2))
+	merchantFee.Sub(merchantFee, big.NewInt(int64(getWalletSendAmount(t, simulated, merchant, txHash))))
+	merchantPaymentsFee := new(big.Int).Add(&forwarded[0].ForwardingFee.Int, &forwarded[1].ForwardingFee.Int)
+	if merchantPaymentsFee.Cmp(merchantFee) != 0 {
+		t.Errorf("Expected the payments of the merchant to be attributed a fee of %s, but got %s", merchantFee, merchantPaymentsFee)
+	}
+	otherMerchantFee := new(big.Int).Sub(forwardAmount, big.NewInt(int64(getWalletSendAmount(t, simulated, otherMerchant, txHash))))
+	if forwarded[2].ForwardingFee.Cmp(otherMerchantFee) != 0 {
+		t.Errorf("Expected the payment of the other merchant to be attributed a fee of %s, but got %s", otherMerchantFee, forwarded[2].ForwardingFee)
+	}
+
+	batched, _ := paymentRepo.FindByPayoutBatch(batchId)
+	totalFee := big.NewInt(0)
+	for _, payment := range batched {
+		totalFee.Add(totalFee, &payment.ForwardingFee.Int)
+	}
+	batch, _ := payoutBatchRepo.FindByID(batchId)
+	if batch == nil || batch.TxHash == nil || *batch.TxHash != txHash || batch.Fee.Cmp(totalFee) != 0 {
+		t.Errorf("Expected batch with transaction %s and fee %s, but got %v", txHash, totalFee, batch)
+	}
+}
+
+func TestBitcoinService_PayoutBatchNotSent(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	forwardAmount := calculateForwardAmount(big.NewInt(payAmount * factor))
+	interval, threshold := utils.Opts.PayoutBatchInterval, utils.Opts.PayoutBatchThreshold
+	utils.Opts.PayoutBatchInterval = 0
+	utils.Opts.PayoutBatchThreshold = int(forwardAmount.Int64())
+	defer func() { utils.Opts.PayoutBatchInterval, utils.Opts.PayoutBatchThreshold = interval, threshold }()
+
+	simulatedService, simulated := getSimulatedService(t)
+	minimumConfirmations := getMinimumConfirmations(model.Signet)
+	failed, failedAddress, amount := createSimulatedPayment(t, simulated.NewExternalAddress())
+	unsent, unsentAddress, _ := createSimulatedPayment(t, simulated.NewExternalAddress())
+	for _, address := range []btcutil.Address{failedAddress, unsentAddress} {
+		txHash, err := simulated.Pay(address, amount)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	}
+	// e.g. saved by an earlier version, which linked the payment before signing
+	unsentTxHash := chainhash.DoubleHashH([]byte(unsent.ID.String())).String()
+	unsentBatch := &model.PayoutBatch{Base: model.Base{ID: uuid.New()}, Network: model.Signet, TxHash: &unsentTxHash}
+	err := payoutBatchRepo.Create(unsentBatch)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	linked, _ := paymentRepo.FindByID(unsent.ID)
+	linked.PayoutBatchID = &unsentBatch.ID
+	err = paymentRepo.Update(linked)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Act
+	simulated.FailNext("SendRawTransaction", node.ErrSimulated)
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	dissolved, _ := paymentRepo.FindByID(failed.ID)
+	resumed, _ := paymentRepo.FindByID(unsent.ID)
+	resumedBatch, _ := payoutBatchRepo.FindByID(unsentBatch.ID)
+
+	// sent with the next block and forwarded with the one after
+	for i := 0; i < 2; i++ {
+		simulated.Mine(1)
+		simulatedService.HandleBlockNotify("", model.Signet)
+	}
+	var forwarded []*model.Payment
+	for _, payment := range []*model.Payment{failed, unsent} {
+		found, _ := paymentRepo.FindByID(payment.ID)
+		forwarded = append(forwarded, found)
+	}
+
+	// Assert
+	if dissolved.CurrentPaymentState.StateID != enum.Confirmed || dissolved.PayoutBatchID != nil {
+		t.Errorf("Expected the batch of the failed transaction to be dissolved, but got %s in %v", dissolved.CurrentPaymentState.StateID, dissolved.PayoutBatchID)
+	}
+	if resumed.PayoutBatchID != nil && *resumed.PayoutBatchID == unsentBatch.ID || resumedBatch != nil {
+		t.Errorf("Expected the batch of the unsent transaction to be dissolved, but got %v", resumedBatch)
+	}
+	for i, payment := range forwarded {
+		if payment.CurrentPaymentState.StateID != enum.Forwarded || payment.PayoutBatchID == nil || payment.ForwardingTransactionHash == nil {
+			t.Fatalf("Expected payment %d to be forwarded by a new batch, but got %s", i, payment.CurrentPaymentState.StateID)
+		}
+		batch, _ := payoutBatchRepo.FindByID(*payment.PayoutBatchID)
+		if batch == nil || batch.TxHash == nil || *batch.TxHash != *payment.ForwardingTransactionHash {
+			t.Errorf("Expected the batch of payment %d to have the forwarding transaction %s, but got %v", i, *payment.ForwardingTransactionHash, batch)
+		}
+	}
+}
+
+func TestBitcoinService_PayoutSchedule(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	forwardAmount := calculateForwardAmount(big.NewInt(payAmount * factor))
+	simulatedService, simulated := getSimulatedService(t)
+	merchant := simulated.NewExternalAddress()
+	minimumConfirmations := getMinimumConfirmations(model.Signet)
+	_, err := simulatedService.SaveMerchantSettings(model.MerchantSettings{
+		Wallet:         merchant.EncodeAddress(),
+		PayoutSchedule: model.PayoutThreshold,
+		MinimumPayout:  model.NewBigInt(new(big.Int).Sub(new(big.Int).Mul(forwardAmount, big.NewInt(2)), big.NewInt(1))),
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	pay := func() *model.Payment {
+		payment, address, amount := createSimulatedPayment(t, merchant)
+		txHash, err := simulated.Pay(address, amount)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+		return payment
+	}
+
+	// Act
+	first := pay()
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	waiting, _ := paymentRepo.FindByID(first.ID)
+	_, creditedBalance, _ := simulatedService.GetMerchantLedger(merchant.EncodeAddress(), model.Signet)
+
+	second := pay()
+	simulated.Mine(minimumConfirmations)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	entries, balance, _ := simulatedService.GetMerchantLedger(merchant.EncodeAddress(), model.Signet)
+
+	simulated.Mine(1)
+	simulatedService.HandleBlockNotify("", model.Signet)
+	firstForwarded, _ := paymentRepo.FindByID(first.ID)
+	secondForwarded, _ := paymentRepo.FindByID(second.ID)
+
+	// Assert
+	if waiting.CurrentPaymentState.StateID != enum.Confirmed || waiting.ForwardingTransactionHash != nil {
+		t.Errorf("Expected the confirmed payment to wait for the minimum payout, but got %s", waiting.CurrentPaymentState.StateID)
+	}
+	if creditedBalance == nil || creditedBalance.Cmp(forwardAmount) != 0 {
+		t.Errorf("Expected balance %s after the first payment, but got %s", forwardAmount, creditedBalance)
+	}
+	if balance == nil || balance.Sign() != 0 {
+		t.Errorf("Expected the balance to be paid out, but got %s", balance)
+	}
+
+	var credits, payouts int
+	for _, entry := range entries {
+		switch entry.Kind {
+		case model.LedgerCredit:
+			credits++
+		case model.LedgerPayout:
+			payouts++
+			if entry.TxHash == nil || secondForwarded.ForwardingTransactionHash == nil || *entry.TxHash != *secondForwarded.ForwardingTransactionHash {
+				t.Errorf("Expected the payout entry to reference the forwarding transaction")
+			}
+		}
+	}
+	if credits != 2 || payouts != 2 {
+		t.Errorf("Expected 2 credits and 2 payouts, but got %d credits and %d payouts", credits, payouts)
+	}
+
+	for i, payment := range []*model.Payment{firstForwarded, secondForwarded} {
+		if payment.CurrentPaymentState.StateID != enum.Forwarded {
+			t.Errorf("Expected payment %d to be forwarded, but got %s", i, payment.CurrentPaymentState.StateID)
+		}
+	}
+	if firstForwarded.ForwardingTransactionHash == nil || secondForwarded.ForwardingTransactionHash == nil ||
+		*firstForwarded.ForwardingTransactionHash != *secondForwarded.ForwardingTransactionHash {
+		t.Errorf("Expected the payments to be paid out in one transaction")
+	}
+}
+
+func TestBitcoinService_IdempotentPayment(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		Times(1).
+		Reply(200).
+		JSON(map[string]interface{}{"src_currency": "usd", "dst_currency": "btc", "price": payAmount})
+
+	simulatedService, simulated := getSimulatedService(t)
+	request := openApi.PaymentRequestDto{
+		PriceCurrency:  "usd",
+		PriceAmount:    100,
+		Wallet:         simulated.NewExternalAddress().EncodeAddress(),
+		Mode:           "test",
+		IdempotencyKey: uuid.NewString(),
+	}
+	conflicting := request
+	conflicting.PriceAmount = 200
+
+	// Act
+	payment, err := simulatedService.CreateNewPayment(request)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	retried, retryErr := simulatedService.CreateNewPayment(request)
+	rejected, conflictErr := simulatedService.CreateNewPayment(conflicting)
+
+	// Assert
+	if retryErr != nil || retried == nil || retried.ID != payment.ID {
+		t.Fatalf("Expected the retried request to return payment %s, but got %v", payment.ID, retryErr)
+	}
+	if retried.Account == nil || retried.Account.Address != payment.Account.Address {
+		t.Errorf("Expected the retried request to keep the account of the payment")
+	}
+	if retried.PaymentStates[0].PayAmount.Cmp(&payment.PaymentStates[0].PayAmount.Int) != 0 {
+		t.Errorf("Expected pay amount %s, but got %s", payment.PaymentStates[0].PayAmount, retried.PaymentStates[0].PayAmount)
+	}
+	if !errors.Is(conflictErr, ErrIdempotencyConflict) || rejected != nil {
+		t.Errorf("Expected the conflicting request to be rejected, but got %v", conflictErr)
+	}
+	if !gock.IsDone() {
+		t.Errorf("Expected the price to be converted once")
+	}
+}
+
+func TestBitcoinService_MerchantWallet(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		Times(2).
+		Reply(200).
+		JSON(map[string]interface{}{"src_currency": "usd", "dst_currency": "btc", "price": payAmount})
+
+	simulatedService, simulated := getSimulatedService(t)
+	request := openApi.PaymentRequestDto{PriceCurrency: "usd", PriceAmount: 100, Mode: "test"}
+	merchant := simulated.NewExternalAddress().EncodeAddress()
+	request.Wallet = strings.ToUpper(merchant)
+	payment, err := simulatedService.CreateNewPayment(request)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	mainnetWallet, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	regtestWallet, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	rejectedWallets := map[string]string{
+		"garbage":        "wallet",
+		"mainnet":        mainnetWallet.EncodeAddress(),
+		"regtest":        regtestWallet.EncodeAddress(),
+		"taproot":        "tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c",
+		"public key":     "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		"change address": utils.Opts.SignetChangeAddress,
+		"pay address":    payment.Account.Address,
+	}
+
+	// Act
+	request.Wallet = merchant
+	other, err := simulatedService.CreateNewPayment(request)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	listed, listErr := NewPaymentApiService(simulatedService).GetPayments(context.Background(), "", "", "", strings.ToUpper(merchant), "", "", 1, 10)
+	errs := make(map[string]error)
+	for name, wallet := range rejectedWallets {
+		request.Wallet = wallet
+		rejected, err := simulatedService.CreateNewPayment(request)
+		if rejected != nil {
+			t.Errorf("Expected no payment for the %s wallet, but got %s", name, rejected.ID)
+		}
+		errs[name] = err
+	}
+
+	// Assert
+	if payment.MerchantWallet != merchant || other.MerchantWallet != merchant {
+		t.Errorf("Expected the normalized wallet %s, but got %s and %s", merchant, payment.MerchantWallet, other.MerchantWallet)
+	}
+	if listErr != nil || listed.Body.(openApi.PaymentListDto).Total != 2 {
+		t.Errorf("Expected the 2 payments of %s to be listed by the upper case wallet, but got %v: %v", merchant, listed.Body, listErr)
+	}
+	for name, err := range errs {
+		if err == nil {
+			t.Errorf("Expected the %s wallet to be rejected", name)
+		}
+	}
+	if !gock.IsDone() {
+		t.Errorf("Expected the price to be converted for the valid wallets only")
+	}
+}
+
+func TestMerchantApiService_NormalizedWallet(t *testing.T) {
+	// Arrange
+	simulatedService, simulated := getSimulatedService(t)
+	merchantApi := NewMerchantApiService(simulatedService)
+	merchant := simulated.NewExternalAddress().EncodeAddress()
+	dto := openApi.MerchantSettingsDto{OverpaymentPolicy: model.OverpaymentRefund.String(), PayoutSchedule: model.PayoutDaily.String()}
+
+	// Act
+	updated, updateErr := merchantApi.UpdateMerchantSettings(context.Background(), strings.ToUpper(merchant), dto)
+	settings, err := simulatedService.GetMerchantSettings(merchant)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	ledger, ledgerErr := merchantApi.GetMerchantLedger(context.Background(), strings.ToUpper(merchant), model.Signet.String())
+	invalid, invalidErr := merchantApi.UpdateMerchantSettings(context.Background(), "wallet", dto)
+	invalidLedger, invalidLedgerErr := merchantApi.GetMerchantLedger(context.Background(), "wallet", model.Signet.String())
+
+	// Assert
+	if updateErr != nil || updated.Code != http.StatusOK {
+		t.Fatalf("Expected the settings to be saved, but got %d: %v", updated.Code, updateErr)
+	}
+	if settings.Wallet != merchant || settings.OverpaymentPolicy != model.OverpaymentRefund || settings.PayoutSchedule != model.PayoutDaily {
+		t.Errorf("Expected the settings under the normalized wallet %s, but got %v", merchant, settings)
+	}
+	if ledgerErr != nil || ledger.Code != http.StatusOK || ledger.Body.(openApi.MerchantLedgerDto).Wallet != merchant {
+		t.Errorf("Expected the ledger of the normalized wallet %s, but got %v: %v", merchant, ledger.Body, ledgerErr)
+	}
+	if invalidErr == nil || invalid.Code != http.StatusBadRequest || invalidLedgerErr == nil || invalidLedger.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid wallet to be rejected, but got %d and %d", invalid.Code, invalidLedger.Code)
+	}
+}
+
+func TestBitcoinService_LedgerInStateTransaction(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	simulatedService, simulated := getSimulatedService(t)
+	failingService := NewBitcoinService(getRepositories(), failingLedgerUnitOfWork{unitOfWork}, map[model.Network]node.BitcoinNode{model.Signet: simulated}, nil, nil).(*bitcoinService)
+	payment, address, amount := createSimulatedPayment(t, simulated.NewExternalAddress())
+	txHash, err := simulated.Pay(address, amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	simulatedService.HandleWalletNotify(txHash.String(), model.Signet)
+	simulated.Mine(getMinimumConfirmations(model.Signet))
+	paid, err := paymentRepo.FindByID(payment.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Act
+	confirmErr := failingService.handlePaidPayment(paid, model.Signet)
+	notConfirmed, _ := paymentRepo.FindByID(payment.ID)
+	notCredited, _ := ledgerRepo.FindByPayment(payment.ID)
+
+	simulatedService.HandleBlockNotify("", model.Signet)
+	confirmed, _ := paymentRepo.FindByID(payment.ID)
+	credited, _ := ledgerRepo.FindByPayment(payment.ID)
+
+	// Assert
+	if confirmErr == nil {
+		t.Errorf("Expected the failed credit to be returned")
+	}
+	if notConfirmed.CurrentPaymentState.StateID != enum.Paid || len(notCredited) != 0 {
+		t.Errorf("Expected the confirmation to be rolled back with the credit, but got %s with %d entries", notConfirmed.CurrentPaymentState.StateID, len(notCredited))
+	}
+	notifications, _ := outboxRepo.FindPending(1000)
+	confirmations := 0
+	for _, notification := range notifications {
+		// the forwarding transaction is sent with the confirmed state as well
+		if notification.PaymentID == payment.ID && notification.PaymentState == enum.Confirmed.String() && notification.TxHash == nil {
+			confirmations++
+		}
+	}
+	if confirmations != 1 {
+		t.Errorf("Expected one confirmed notification, but got %d", confirmations)
+	}
+	if confirmed.CurrentPaymentState.StateID == enum.Paid || len(credited) == 0 || credited[0].Kind != model.LedgerCredit {
+		t.Errorf("Expected the payment to be confirmed and credited, but got %s with %v", confirmed.CurrentPaymentState.StateID, credited)
+	}
+}
+
+// failingLedgerUnitOfWork runs the transactions with a merchant ledger which can't be written
+type failingLedgerUnitOfWork struct {
+	repository.IUnitOfWork
+}
+
+func (u failingLedgerUnitOfWork) WithTx(fn func(repos *repository.Repositories) error) error {
+	return u.IUnitOfWork.WithTx(func(repos *repository.Repositories) error {
+		failing := *repos
+		failing.MerchantLedger = failingLedgerRepository{repos.MerchantLedger}
+		return fn(&failing)
+	})
+}
+
+type failingLedgerRepository struct {
+	repository.IMerchantLedgerRepository
+}
+
+func (failingLedgerRepository) Create(*model.MerchantLedgerEntry) error {
+	return errors.New("ledger not writable")
+}
+
+func TestBitcoinService_ConcurrentPayments(t *testing.T) {
+	// Arrange
+	const concurrentPayments = 10
+	defer gock.Off()
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		Times(concurrentPayments).
+		Reply(200).
+		JSON(map[string]interface{}{"src_currency": "usd", "dst_currency": "btc", "price": payAmount})
+
+	simulatedService, simulated := getSimulatedService(t)
+	merchant := simulated.NewExternalAddress()
+	for i := 0; i < concurrentPayments/2; i++ {
+		address, err := simulated.GetNewAddress("")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		err = accountRepo.Create(&model.Account{
+			Address: address.String(),
+			Mode:    enum.Test,
+			Network: model.Signet,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// Act
+	var wg sync.WaitGroup
+	payments := make([]*model.Payment, concurrentPayments)
+	errs := make([]error, concurrentPayments)
+	for i := range payments {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payments[i], errs[i] = simulatedService.CreateNewPayment(openApi.PaymentRequestDto{
+				PriceCurrency: "usd",
+				PriceAmount:   100,
+				Wallet:        merchant.EncodeAddress(),
+				Mode:          "test",
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	// Assert
+	addresses := make(map[string]bool)
+	for i, payment := range payments {
+		if errs[i] != nil {
+			t.Fatalf("Expected all payments to be created, but got %v", errs[i])
+		}
+		if addresses[payment.Account.Address] {
+			t.Errorf("Expected address %s to be given to one payment", payment.Account.Address)
+		}
+		addresses[payment.Account.Address] = true
+
+		account, _ := accountRepo.FindByAddress(payment.Account.Address)
+		open := 0
+		for _, accountPayment := range account.Payments {
+			if accountPayment.OpenAccountID != nil {
+				open++
+			}
+		}
+		if !account.Used || open != 1 {
+			t.Errorf("Expected account %s to be used by one open payment, but got %d", account.Address, open)
+		}
+	}
+}
+
+func assertStateNotification(t *testing.T, paymentId uuid.UUID, state string) {
+	notifications, err := outboxRepo.FindPending(1000)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, notification := range notifications {
+		if notification.PaymentID == paymentId && notification.PaymentState == state {
+			return
+		}
+	}
+	t.Errorf("Expected a %s notification for payment %s", state, paymentId)
+}
+
+// assertEventNotification finds the notification of the event and checks that the backend is notified with the state
+func assertEventNotification(t *testing.T, paymentId uuid.UUID, event string, state string) *model.OutboxNotification {
+	notifications, err := outboxRepo.FindPending(1000)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i, notification := range notifications {
+		if notification.PaymentID == paymentId && notification.Event == event {
+			if notification.PaymentState != state {
+				t.Errorf("Expected the %s notification to have the state %s, but got %s", event, state, notification.PaymentState)
+			}
+			return &notifications[i]
+		}
+	}
+	t.Errorf("Expected a %s notification for payment %s", event, paymentId)
+	return nil
+}
+
+func assertRiskNotification(t *testing.T, paymentId uuid.UUID, state string, risk model.RiskLevel) {
+	notifications, err := outboxRepo.FindPending(1000)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, notification := range notifications {
+		if notification.PaymentID == paymentId && notification.PaymentState == state && notification.RiskLevel == risk.String() {
+			return
+		}
+	}
+	t.Errorf("Expected a %s notification with %s risk for payment %s", state, risk, paymentId)
+}
+
+func hasWalletSend(t *testing.T, simulated *node.SimulatedNode, to btcutil.Address, txId string) bool {
+	transactions, err := simulated.ListTransactions("*")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, transaction := range transactions {
+		if transaction.Category == "send" && transaction.Address == to.EncodeAddress() && transaction.TxID == txId {
+			return true
+		}
+	}
+	return false
+}
+
+func getWalletSendAmount(t *testing.T, simulated *node.SimulatedNode, to btcutil.Address, txId string) btcutil.Amount {
+	transactions, err := simulated.ListTransactions("*")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, transaction := range transactions {
+		if transaction.Category == "send" && transaction.Address == to.EncodeAddress() && transaction.TxID == txId {
+			amount, err := btcutil.NewAmount(-transaction.Amount)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			return amount
+		}
+	}
+	t.Fatalf("Expected a transaction %s to %s", txId, to)
+	return 0
+}
+
+func TestBitcoinService_AccountXpub(t *testing.T) {
+	// Arrange
+	defer gock.Off()
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		Times(4).
+		Reply(200).
+		JSON(map[string]interface{}{"src_currency": "usd", "dst_currency": "btc", "price": payAmount})
+
+	getSimulatedService(t)
+	testnet := node.NewSimulatedNode(&chaincfg.TestNet3Params, 0.00001, "secret")
+	changeAddress, err := testnet.GetNewAddress("")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	master, err := hdkeychain.NewMaster(make([]byte, hdkeychain.RecommendedSeedLen), &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	accountKey := master
+	for _, index := range []uint32{84, 1, 0} {
+		accountKey, err = accountKey.Derive(hdkeychain.HardenedKeyStart + index)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	accountXpub, err := accountKey.Neuter()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// wallets export BIP84 accounts as vpub
+	vpub, err := accountXpub.CloneWithVersion(vpubKeyID[:])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectedAddresses := make([]string, 3)
+	for i := range expectedAddresses {
+		child, err := accountXpub.Derive(0)
+		if err == nil {
+			child, err = child.Derive(uint32(i))
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		address, err := child.Address(&chaincfg.TestNet3Params)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		witnessAddress, err := btcutil.NewAddressWitnessPubKeyHash(address.Hash160()[:], &chaincfg.TestNet3Params)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		expectedAddresses[i] = witnessAddress.EncodeAddress()
+	}
+
+	defer func(opts utils.OptsType) { *utils.Opts = opts }(*utils.Opts)
+	utils.Opts.TestAccountXpub = vpub.String()
+	utils.Opts.TestAccountXprv = accountKey.String()
+	utils.Opts.TestChangeAddress = changeAddress.EncodeAddress()
+	utils.Opts.TestWalletPassphrase = "secret"
+	utils.Opts.AccountGapLimit = 2
+	keychain, err := NewAccountKeychain(model.Testnet)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	testnetService := NewBitcoinService(getRepositories(), unitOfWork,
+		map[model.Network]node.BitcoinNode{model.Testnet: testnet},
+		map[model.Network]*AccountKeychain{model.Testnet: keychain},
+		map[model.Network]node.BitcoinNode{model.Testnet: testnet.NewWatchOnlyWallet()})
+	merchant := testnet.NewExternalAddress()
+	request := openApi.PaymentRequestDto{PriceCurrency: "usd", PriceAmount: 100, Wallet: merchant.EncodeAddress(), Mode: "test"}
+	amount, err := btcutil.NewAmount(payAmount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	minimumConfirmations := getMinimumConfirmations(model.Testnet)
+
+	// Act
+	first, err := testnetService.CreateNewPayment(request)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	second, err := testnetService.CreateNewPayment(request)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, gapErr := testnetService.CreateNewPayment(request)
+
+	address, err := btcutil.DecodeAddress(second.Account.Address, &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	txHash, err := testnet.Pay(address, amount)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	testnetService.HandleWalletNotify(txHash.String(), model.Testnet)
+	third, thirdErr := testnetService.CreateNewPayment(request)
+
+	testnet.Mine(minimumConfirmations)
+	testnetService.HandleBlockNotify("", model.Testnet)
+	// the payment is forwarded once the forwarding transaction is mined
+	testnet.Mine(1)
+	testnetService.HandleBlockNotify("", model.Testnet)
+	forwarded, _ := paymentRepo.FindByID(second.ID)
+
+	// Assert
+	if first.Account.Address != expectedAddresses[0] || second.Account.Address != expectedAddresses[1] {
+		t.Errorf("Expected the addresses %s, but got %s and %s", expectedAddresses[:2], first.Account.Address, second.Account.Address)
+	}
+	if first.Account.DerivationIndex == nil || *first.Account.DerivationIndex != 0 ||
+		second.Account.DerivationIndex == nil || *second.Account.DerivationIndex != 1 {
+		t.Errorf("Expected the derivation indexes 0 and 1")
+	}
+	if !errors.Is(gapErr, ErrGapLimitReached) {
+		t.Errorf("Expected the gap limit to be reached, but got %v", gapErr)
+	}
+	if thirdErr != nil || third.Account.Address != expectedAddresses[2] {
+		t.Errorf("Expected a payment to %s once a derived address is funded, but got %v", expectedAddresses[2], thirdErr)
+	}
+	if forwarded.CurrentPaymentState.StateID != enum.Forwarded || forwarded.ForwardingTransactionHash == nil {
+		t.Fatalf("Expected forwarded payment, but got %s", forwarded.CurrentPaymentState.StateID)
+	}
+
+	// the node only watches the address, the input must be signed with the account xprv
+	forwardingHash, err := chainhash.NewHashFromStr(*forwarded.ForwardingTransactionHash)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	forwarding, err := testnet.GetTransaction(forwardingHash)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	forwardingTx, err := decodeTransaction(forwarding.Hex)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	payScript, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	verified := 0
+	for i, in := range forwardingTx.TxIn {
+		if in.PreviousOutPoint.Hash != *txHash {
+			continue
+		}
+		verified++
+		engine, err := txscript.NewEngine(payScript, forwardingTx, i, txscript.StandardVerifyFlags, nil,
+			txscript.NewTxSigHashes(forwardingTx), int64(amount))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err = engine.Execute(); err != nil {
+			t.Errorf("Expected a valid signature of the payment input, but got %v", err)
+		}
+	}
+	if verified != 1 {
+		t.Errorf("Expected the forwarding transaction to spend the payment, but got %d inputs", verified)
+	}
+}
@@ -2,17 +2,17 @@ package service
 
 import (
 	"errors"
-	"github.com/CHainGate/backend/pkg/enum"
-	"github.com/CHainGate/bitcoin-service/internal/utils"
+	"fmt"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/node"
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"math/big"
 )
 
-func getTransaction(client *rpcclient.Client, txId string) (*btcjson.GetTransactionResult, error) {
+func getTransaction(client node.BitcoinNode, txId string) (*btcjson.GetTransactionResult, error) {
 	hash, err := chainhash.NewHashFromStr(txId)
 	if err != nil {
 		return nil, err
@@ -24,32 +24,58 @@ func getTransaction(client *rpcclient.Client, txId string) (*btcjson.GetTransact
 	return transaction, nil
 }
 
-func createRawTransaction(client *rpcclient.Client, fromAddress string, toAddress string, amount *big.Int) (*wire.MsgTx, error) {
-	params, err := getNetParams(client)
+// createRawTransaction spends the unspent outputs of fromAddress, only the outputs of sourceTxId if it is set
+func createRawTransaction(client node.BitcoinNode, fromAddress string, toAddress string, amount *big.Int, minConf int, sourceTxId string) (*wire.MsgTx, error) {
+	unspentList, err := listUnspent(client, fromAddress, minConf)
 	if err != nil {
 		return nil, err
 	}
 
-	decodedFromAddress, err := btcutil.DecodeAddress(fromAddress, params)
+	var inputs []btcjson.TransactionInput
+	for _, unspent := range unspentList {
+		if sourceTxId != "" && unspent.TxID != sourceTxId {
+			continue
+		}
+		input := btcjson.TransactionInput{
+			Txid: unspent.TxID,
+			Vout: unspent.Vout,
+		}
+		inputs = append(inputs, input)
+	}
+
+	// without inputs the node would fund the transaction with any coins of the wallet
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("no unspent outputs with %d confirmations on %s", minConf, fromAddress)
+	}
+
+	return createRawTransactionFromInputs(client, inputs, toAddress, amount)
+}
+
+func listUnspent(client node.BitcoinNode, address string, minConf int) ([]btcjson.ListUnspentResult, error) {
+	params, err := getNetParams(client)
 	if err != nil {
 		return nil, err
 	}
 
-	unspentList, err := client.ListUnspentMinMaxAddresses(utils.Opts.MinimumConfirmations, 9999999, []btcutil.Address{decodedFromAddress})
+	decodedAddress, err := btcutil.DecodeAddress(address, params)
 	if err != nil {
 		return nil, err
 	}
 
-	var inputs []btcjson.TransactionInput
-	for _, unspent := range unspentList {
-		input := btcjson.TransactionInput{
-			Txid: unspent.TxID,
-			Vout: unspent.Vout,
-		}
-		inputs = append(inputs, input)
+	return client.ListUnspentMinMaxAddresses(minConf, 9999999, []btcutil.Address{decodedAddress})
+}
+
+// createRawTransactionFromInputs pays amount to toAddress. The network fee is subtracted from it when funding.
+func createRawTransactionFromInputs(client node.BitcoinNode, inputs []btcjson.TransactionInput, toAddress string, amount *big.Int) (*wire.MsgTx, error) {
+	params, err := getNetParams(client)
+	if err != nil {
+		return nil, err
 	}
 
 	decodedToAddress, err := btcutil.DecodeAddress(toAddress, params)
+	if err != nil {
+		return nil, err
+	}
 	payAmount := btcutil.Amount(amount.Int64())
 	amounts := map[btcutil.Address]btcutil.Amount{decodedToAddress: payAmount}
 
@@ -60,19 +86,51 @@ func createRawTransaction(client *rpcclient.Client, fromAddress string, toAddres
 	return rawTransaction, nil
 }
 
-func fundTransaction(client *rpcclient.Client, rawTransaction *wire.MsgTx, mode enum.Mode) (*btcjson.FundRawTransactionResult, error) {
+// createRawTransactionWithOutputs pays the amounts to their addresses, e.g. the merchants of a payout batch.
+// The network fee is subtracted from all of them when funding.
+func createRawTransactionWithOutputs(client node.BitcoinNode, inputs []btcjson.TransactionInput, outputs map[string]*big.Int) (*wire.MsgTx, error) {
+	params, err := getNetParams(client)
+	if err != nil {
+		return nil, err
+	}
+
+	amounts := make(map[btcutil.Address]btcutil.Amount)
+	for address, amount := range outputs {
+		decodedAddress, err := btcutil.DecodeAddress(address, params)
+		if err != nil {
+			return nil, err
+		}
+		amounts[decodedAddress] = btcutil.Amount(amount.Int64())
+	}
+
+	rawTransaction, err := client.CreateRawTransaction(inputs, amounts, nil)
+	if err != nil {
+		return nil, err
+	}
+	return rawTransaction, nil
+}
+
+func fundTransaction(client node.BitcoinNode, rawTransaction *wire.MsgTx, network model.Network) (*btcjson.FundRawTransactionResult, error) {
+	return fundTransactionWithChange(client, rawTransaction, getNetworkOpts(network).changeAddress)
+}
+
+// fundTransactionWithChange is fundTransaction for transactions whose change must not go to the change address of the network
+func fundTransactionWithChange(client node.BitcoinNode, rawTransaction *wire.MsgTx, changeAddress string) (*btcjson.FundRawTransactionResult, error) {
 	feeRate, err := getFeeRate(client)
 	if err != nil {
 		return nil, err
 	}
+	return fundTransactionWithFeeRate(client, rawTransaction, changeAddress, feeRate)
+}
 
-	var changeAddress string
+// fundTransactionWithFeeRate is fundTransactionWithChange with a given fee rate in BTC/kvB, e.g. to replace a stuck transaction
+func fundTransactionWithFeeRate(client node.BitcoinNode, rawTransaction *wire.MsgTx, changeAddress string, feeRate *float64) (*btcjson.FundRawTransactionResult, error) {
 	replaceable := true
-	changePosition := 1
-	if mode == enum.Test {
-		changeAddress = utils.Opts.TestChangeAddress
-	} else {
-		changeAddress = utils.Opts.MainChangeAddress
+	// the fee is paid by the outputs of the raw transaction, the change is added after them
+	changePosition := len(rawTransaction.TxOut)
+	var subtractFeeFromOutputs []int
+	for i := range rawTransaction.TxOut {
+		subtractFeeFromOutputs = append(subtractFeeFromOutputs, i)
 	}
 
 	opts := btcjson.FundRawTransactionOpts{
@@ -80,7 +138,7 @@ func fundTransaction(client *rpcclient.Client, rawTransaction *wire.MsgTx, mode
 		FeeRate:                feeRate,
 		Replaceable:            &replaceable,
 		ChangePosition:         &changePosition,
-		SubtractFeeFromOutputs: []int{0},
+		SubtractFeeFromOutputs: subtractFeeFromOutputs,
 	}
 	fundedTransaction, err := client.FundRawTransaction(rawTransaction, opts, nil)
 	if err != nil {
@@ -89,15 +147,23 @@ func fundTransaction(client *rpcclient.Client, rawTransaction *wire.MsgTx, mode
 	return fundedTransaction, nil
 }
 
-func signTransaction(client *rpcclient.Client, fundedTransaction *btcjson.FundRawTransactionResult, mode enum.Mode) (*chainhash.Hash, error) {
-	var passphrase string
-	if mode == enum.Test {
-		passphrase = utils.Opts.TestWalletPassphrase
-	} else {
-		passphrase = utils.Opts.MainWalletPassphrase
+func signTransaction(client node.BitcoinNode, fundedTransaction *btcjson.FundRawTransactionResult, network model.Network) (*chainhash.Hash, error) {
+	signedTransaction, err := signRawTransaction(client, fundedTransaction, network)
+	if err != nil {
+		return nil, err
+	}
+
+	txHash, err := client.SendRawTransaction(signedTransaction, false)
+	if err != nil {
+		return nil, err
 	}
 
-	err := client.WalletPassphrase(passphrase, 60)
+	return txHash, nil
+}
+
+// signRawTransaction signs the funded transaction without sending it, its hash is final once all inputs are signed
+func signRawTransaction(client node.BitcoinNode, fundedTransaction *btcjson.FundRawTransactionResult, network model.Network) (*wire.MsgTx, error) {
+	err := client.WalletPassphrase(getNetworkOpts(network).walletPassphrase, 60)
 	if err != nil {
 		return nil, err
 	}
@@ -112,11 +178,5 @@ func signTransaction(client *rpcclient.Client, fundedTransaction *btcjson.FundRa
 	if !areAllInputsSigned {
 		return nil, errors.New("not all inputs signed")
 	}
-
-	txHash, err := client.SendRawTransaction(signedTransaction, false)
-	if err != nil {
-		return nil, err
-	}
-
-	return txHash, nil
+	return signedTransaction, nil
 }
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/utils"
+)
+
+// getUnderpaymentTolerance is the shortfall in satoshi a payment may have and still count as paid.
+// If both an absolute and a percentage tolerance are requested the smaller one applies.
+func getUnderpaymentTolerance(payAmount *big.Int, satoshi string, percent float64) (*big.Int, error) {
+	if percent < 0 || percent > utils.Opts.UnderpaymentToleranceMax {
+		return nil, fmt.Errorf("underpayment tolerance must be between 0 and %v percent", utils.Opts.UnderpaymentToleranceMax)
+	}
+	maxTolerance := percentOf(payAmount, utils.Opts.UnderpaymentToleranceMax)
+
+	var tolerance *big.Int
+	if satoshi != "" {
+		absolute, ok := new(big.Int).SetString(satoshi, 10)
+		if !ok || absolute.Sign() < 0 {
+			return nil, fmt.Errorf("wrong underpayment tolerance: %s", satoshi)
+		}
+		if absolute.Cmp(maxTolerance) > 0 {
+			return nil, fmt.Errorf("underpayment tolerance must be at most %s satoshi", maxTolerance)
+		}
+		tolerance = absolute
+	}
+	if percent > 0 {
+		relative := percentOf(payAmount, percent)
+		if tolerance == nil || relative.Cmp(tolerance) < 0 {
+			tolerance = relative
+		}
+	}
+
+	if tolerance == nil {
+		return big.NewInt(0), nil
+	}
+	return tolerance, nil
+}
+
+// getRequiredAmount is the least amount which counts as paid
+func getRequiredAmount(payment *model.Payment) *big.Int {
+	required := new(big.Int).Set(&payment.CurrentPaymentState.PayAmount.Int)
+	if payment.UnderpaymentTolerance != nil {
+		required.Sub(required, &payment.UnderpaymentTolerance.Int)
+	}
+	return required
+}
+
+// setShortfall records how much less than the pay amount was accepted
+func setShortfall(payment *model.Payment, amountReceived *big.Int) {
+	shortfall := new(big.Int).Sub(&payment.CurrentPaymentState.PayAmount.Int, amountReceived)
+	if shortfall.Sign() < 0 {
+		shortfall.SetInt64(0)
+	}
+	payment.Shortfall = model.NewBigInt(shortfall)
+}
+
+func percentOf(amount *big.Int, percent float64) *big.Int {
+	result, _ := new(big.Float).Mul(new(big.Float).SetInt(amount), big.NewFloat(percent/100)).Int(nil)
+	return result
+}
@@ -0,0 +1,133 @@
+//go:build !simulated
+// +build !simulated
+
+package service
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/google/uuid"
+)
+
+// main mode payments are never touched by the block and wallet notify tests
+func createRollbackTestPayment(t *testing.T) *model.Payment {
+	state := model.PaymentState{
+		Base:           model.Base{ID: uuid.New()},
+		StateID:        enum.Waiting,
+		PayAmount:      model.NewBigIntFromInt(340300),
+		AmountReceived: model.NewBigIntFromInt(0),
+	}
+	payment := &model.Payment{
+		Account: &model.Account{
+			Address:   "rollback-" + uuid.NewString(),
+			Used:      true,
+			Mode:      enum.Main,
+			Network:   model.Mainnet,
+			Remainder: model.NewBigIntFromInt(0),
+		},
+		MerchantWallet:        testPayment.MerchantWallet,
+		Mode:                  enum.Main,
+		Network:               model.Mainnet,
+		PriceAmount:           100,
+		PriceCurrency:         enum.USD,
+		CurrentPaymentState:   state,
+		CurrentPaymentStateId: &state.ID,
+		PaymentStates:         []model.PaymentState{state},
+	}
+	err := paymentRepo.Create(payment)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return payment
+}
+
+func expirePayment(payment *model.Payment) {
+	expiredState := model.PaymentState{
+		Base:           model.Base{ID: uuid.New()},
+		PayAmount:      payment.CurrentPaymentState.PayAmount,
+		AmountReceived: payment.CurrentPaymentState.AmountReceived,
+		PaymentID:      payment.ID,
+		StateID:        enum.Expired,
+	}
+	payment.CurrentPaymentStateId = &expiredState.ID
+	payment.CurrentPaymentState = expiredState
+	payment.PaymentStates = append(payment.PaymentStates, expiredState)
+	payment.Account.Used = false
+}
+
+func assertPaymentUntouched(t *testing.T, paymentId uuid.UUID) {
+	payment, err := paymentRepo.FindByID(paymentId)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if payment.CurrentPaymentState.StateID != enum.Waiting || len(payment.PaymentStates) != 1 {
+		t.Errorf("Expected payment to stay waiting with 1 state, but got %s with %d states", payment.CurrentPaymentState.StateID, len(payment.PaymentStates))
+	}
+	if !payment.Account.Used {
+		t.Errorf("Expected account to stay used")
+	}
+
+	notifications, err := outboxRepo.FindPending(1000)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, notification := range notifications {
+		if notification.PaymentID == paymentId {
+			t.Errorf("Expected no notification for payment %s, but got %s", paymentId, notification.PaymentState)
+		}
+	}
+}
+
+func TestUnitOfWork_WithTxRollback(t *testing.T) {
+	// Arrange
+	payment := createRollbackTestPayment(t)
+	expirePayment(payment)
+	expectedErr := errors.New("crash after update")
+
+	// Act
+	err := unitOfWork.WithTx(func(tx *repository.Repositories) error {
+		err := tx.Payment.Update(payment)
+		if err != nil {
+			return err
+		}
+		err = tx.Account.Update(payment.Account)
+		if err != nil {
+			return err
+		}
+		err = tx.Outbox.Create(newOutboxNotification(payment))
+		if err != nil {
+			return err
+		}
+		return expectedErr
+	})
+
+	// Assert
+	if !errors.Is(err, expectedErr) {
+		t.Errorf("Expected error %v, but got %v", expectedErr, err)
+	}
+	assertPaymentUntouched(t, payment.ID)
+}
+
+func TestBitcoinService_SavePaymentAndAccountRollback(t *testing.T) {
+	// Arrange
+	payment := createRollbackTestPayment(t)
+	expirePayment(payment)
+	// does not fit into numeric(30), the account update fails after the payment update
+	tooLarge := new(big.Int).Exp(big.NewInt(10), big.NewInt(31), nil)
+	payment.Account.Remainder = model.NewBigInt(tooLarge)
+	s := service.(*bitcoinService)
+
+	// Act
+	err := s.savePaymentAndAccount(payment)
+
+	// Assert
+	if err == nil {
+		t.Errorf("Expected account update to fail")
+	}
+	assertPaymentUntouched(t, payment.ID)
+}
@@ -6,36 +6,119 @@ import (
 	"fmt"
 	"github.com/CHainGate/backend/pkg/enum"
 	"github.com/CHainGate/bitcoin-service/backendClientApi"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/node"
 	"github.com/CHainGate/bitcoin-service/internal/utils"
 	"github.com/CHainGate/bitcoin-service/proxyClientApi"
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcutil"
+	"github.com/google/uuid"
 	"math/big"
+	"net/url"
 	"strings"
+	"time"
 )
 
-func CreateBitcoinTestClient() (*rpcclient.Client, error) {
-	connCfg := &rpcclient.ConnConfig{
-		Host:         utils.Opts.BitcoinTestHost,
-		User:         utils.Opts.BitcoinTestUser,
-		Pass:         utils.Opts.BitcoinTestPass,
-		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
-		DisableTLS:   true, // Bitcoin core does not provide TLS by default
+// networkOpts is the configuration of the node serving a network
+type networkOpts struct {
+	host                 string
+	user                 string
+	pass                 string
+	walletPassphrase     string
+	changeAddress        string
+	minimumConfirmations int
+	zmqAddress           string
+	accountXpub          string
+	accountXprv          string
+	wallet               string
+	watchOnlyWallet      string
+}
+
+// testnet and mainnet keep the TEST_ and MAIN_ settings
+func getNetworkOpts(network model.Network) networkOpts {
+	var opts networkOpts
+	switch network {
+	case model.Regtest:
+		opts = networkOpts{utils.Opts.BitcoinRegtestHost, utils.Opts.BitcoinRegtestUser, utils.Opts.BitcoinRegtestPass,
+			utils.Opts.RegtestWalletPassphrase, utils.Opts.RegtestChangeAddress, utils.Opts.RegtestMinimumConfirmations, utils.Opts.ZmqRegtestAddress,
+			utils.Opts.RegtestAccountXpub, utils.Opts.RegtestAccountXprv, utils.Opts.RegtestWallet, utils.Opts.RegtestWatchOnlyWallet}
+	case model.Signet:
+		opts = networkOpts{utils.Opts.BitcoinSignetHost, utils.Opts.BitcoinSignetUser, utils.Opts.BitcoinSignetPass,
+			utils.Opts.SignetWalletPassphrase, utils.Opts.SignetChangeAddress, utils.Opts.SignetMinimumConfirmations, utils.Opts.ZmqSignetAddress,
+			utils.Opts.SignetAccountXpub, utils.Opts.SignetAccountXprv, utils.Opts.SignetWallet, utils.Opts.SignetWatchOnlyWallet}
+	case model.Testnet:
+		opts = networkOpts{utils.Opts.BitcoinTestHost, utils.Opts.BitcoinTestUser, utils.Opts.BitcoinTestPass,
+			utils.Opts.TestWalletPassphrase, utils.Opts.TestChangeAddress, utils.Opts.TestMinimumConfirmations, utils.Opts.ZmqTestAddress,
+			utils.Opts.TestAccountXpub, utils.Opts.TestAccountXprv, utils.Opts.TestWallet, utils.Opts.TestWatchOnlyWallet}
+	case model.Mainnet:
+		opts = networkOpts{utils.Opts.BitcoinMainHost, utils.Opts.BitcoinMainUser, utils.Opts.BitcoinMainPass,
+			utils.Opts.MainWalletPassphrase, utils.Opts.MainChangeAddress, utils.Opts.MainMinimumConfirmations, utils.Opts.ZmqMainAddress,
+			utils.Opts.MainAccountXpub, utils.Opts.MainAccountXprv, utils.Opts.MainWallet, utils.Opts.MainWatchOnlyWallet}
 	}
-	client, err := rpcclient.New(connCfg, nil)
-	if err != nil {
-		return nil, err
+	if opts.minimumConfirmations == 0 {
+		opts.minimumConfirmations = utils.Opts.MinimumConfirmations
 	}
-	return client, nil
+	return opts
+}
+
+func getMinimumConfirmations(network model.Network) int {
+	return getNetworkOpts(network).minimumConfirmations
+}
+
+func GetZmqAddress(network model.Network) string {
+	return getNetworkOpts(network).zmqAddress
+}
+
+// GetConfiguredNetworks parses BITCOIN_NETWORKS
+func GetConfiguredNetworks() ([]model.Network, error) {
+	var networks []model.Network
+	for _, name := range strings.Split(utils.Opts.BitcoinNetworks, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		network, ok := model.ParseStringToNetworkEnum(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown network: %s", name)
+		}
+		networks = append(networks, network)
+	}
+	if len(networks) == 0 {
+		return nil, errors.New("no network configured")
+	}
+	return networks, nil
 }
 
-func CreateBitcoinMainClient() (*rpcclient.Client, error) {
+func CreateBitcoinClient(network model.Network) (*rpcclient.Client, error) {
+	opts := getNetworkOpts(network)
+	return createClient(opts, opts.wallet)
+}
+
+// CreateWatchOnlyWalletClient returns the client of the wallet watching the addresses of the account xpub.
+// bitcoind refuses to import the xpub into a wallet with private keys, so it needs a wallet of its own.
+func CreateWatchOnlyWalletClient(network model.Network) (*rpcclient.Client, error) {
+	opts := getNetworkOpts(network)
+	if opts.watchOnlyWallet == "" {
+		return nil, fmt.Errorf("the %s account xpub requires a watch-only wallet", network)
+	}
+	if opts.watchOnlyWallet == opts.wallet {
+		return nil, fmt.Errorf("the %s watch-only wallet must not be the wallet with the keys", network)
+	}
+	return createClient(opts, opts.watchOnlyWallet)
+}
+
+// createClient connects to the wallet endpoint /wallet/<name> of the node, an empty name uses the default wallet
+func createClient(opts networkOpts, wallet string) (*rpcclient.Client, error) {
+	host := opts.host
+	if wallet != "" {
+		host += "/wallet/" + url.PathEscape(wallet)
+	}
 	connCfg := &rpcclient.ConnConfig{
-		Host:         utils.Opts.BitcoinMainHost,
-		User:         utils.Opts.BitcoinMainUser,
-		Pass:         utils.Opts.BitcoinMainPass,
+		Host:         host,
+		User:         opts.user,
+		Pass:         opts.pass,
 		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
 		DisableTLS:   true, // Bitcoin core does not provide TLS by default
 	}
@@ -63,6 +146,17 @@ func getPayAmount(priceAmount float64, priceCurrency enum.FiatCurrency) (float64
 	return *resp.Price, nil
 }
 
+// getPaymentExpiry returns the requested expiry window, 0 minutes falls back to PAYMENT_EXPIRY
+func getPaymentExpiry(minutes int32) (time.Duration, error) {
+	if minutes == 0 {
+		minutes = int32(utils.Opts.PaymentExpiry)
+	}
+	if int(minutes) < utils.Opts.PaymentExpiryMin || int(minutes) > utils.Opts.PaymentExpiryMax {
+		return 0, fmt.Errorf("expiry must be between %d and %d minutes", utils.Opts.PaymentExpiryMin, utils.Opts.PaymentExpiryMax)
+	}
+	return time.Duration(minutes) * time.Minute, nil
+}
+
 func convertBtcToSatoshi(val float64) (*big.Int, error) {
 	amount, err := btcutil.NewAmount(val)
 	if err != nil {
@@ -86,9 +180,82 @@ func calculateForwardAmount(amount *big.Int) *big.Int {
 	return mul.Div(mul, big.NewInt(100))
 }
 
-func sendNotificationToBackend(paymentId string, payAmount string, actuallyPaid string, paymentState string, forwardingTxHash *string) error {
-	paymentUpdateDto := *backendClientApi.NewPaymentUpdateDto(paymentId, payAmount, enum.BTC.String(), actuallyPaid, paymentState)
-	paymentUpdateDto.TxHash = forwardingTxHash
+// newOutboxNotification captures the current state of the payment for the backend.
+// It has to be written in the same transaction as the payment.
+func newOutboxNotification(payment *model.Payment) *model.OutboxNotification {
+	return &model.OutboxNotification{
+		Base:          model.Base{ID: uuid.New()},
+		PaymentID:     payment.ID,
+		PayAmount:     payment.CurrentPaymentState.PayAmount.String(),
+		ActuallyPaid:  payment.CurrentPaymentState.AmountReceived.String(),
+		PaymentState:  payment.CurrentPaymentState.StateID.String(),
+		TxHash:        payment.ForwardingTransactionHash,
+		RiskLevel:     payment.Risk.String(),
+		Status:        model.NotificationPending,
+		NextAttemptAt: time.Now(),
+	}
+}
+
+// newLatePaymentNotification tells the backend about funds which arrived after the payment expired.
+// The update has the late payment state, the received amount of the payment stays apart from the late funds.
+func newLatePaymentNotification(payment *model.Payment, latePayment *model.LatePayment) *model.OutboxNotification {
+	notification := newOutboxNotification(payment)
+	notification.PaymentState = latePayment.Status.PaymentState()
+	notification.Event = latePayment.Status.Event()
+	notification.LateAmount = latePayment.Amount.String()
+	notification.TxHash = nil
+	if latePayment.Status == model.LatePaymentHonored {
+		notification.TxHash = latePayment.ResolvingTransactionHash
+	}
+	return notification
+}
+
+// newRefundNotification tells the backend about a state of a refund with the current state of the payment
+func newRefundNotification(payment *model.Payment, refund *model.Refund) *model.OutboxNotification {
+	notification := newOutboxNotification(payment)
+	refundId := refund.ID
+	notification.Event = refund.CurrentRefundState.Status.Event()
+	notification.RefundID = &refundId
+	notification.RefundStatus = refund.CurrentRefundState.Status.String()
+	notification.RefundAmount = refund.Amount.String()
+	notification.RefundTxHash = refund.TransactionHash
+	return notification
+}
+
+// newOverpaymentNotification tells the backend about the surplus of a payment and what happened to it.
+// ActuallyPaid is the received amount, the surplus is kept separately.
+func newOverpaymentNotification(payment *model.Payment) *model.OutboxNotification {
+	notification := newOutboxNotification(payment)
+	notification.Event = payment.OverpaymentPolicy.Event()
+	if payment.CurrentPaymentState.Surplus != nil {
+		notification.Surplus = payment.CurrentPaymentState.Surplus.String()
+	}
+	return notification
+}
+
+// sendNotificationToBackend sends the payment update of the notification with the generated client of
+// swaggerui/backend/openapi.yaml, the optional fields are only set if the notification has them
+func sendNotificationToBackend(notification *model.OutboxNotification) error {
+	paymentUpdateDto := *backendClientApi.NewPaymentUpdateDto(notification.PaymentID.String(), notification.PayAmount, enum.BTC.String(), notification.ActuallyPaid, notification.PaymentState)
+	paymentUpdateDto.TxHash = notification.TxHash
+	if notification.RiskLevel != "" {
+		paymentUpdateDto.SetRiskLevel(notification.RiskLevel)
+	}
+	if notification.Event != "" {
+		paymentUpdateDto.SetEvent(notification.Event)
+	}
+	if notification.Surplus != "" {
+		paymentUpdateDto.SetSurplus(notification.Surplus)
+	}
+	if notification.LateAmount != "" {
+		paymentUpdateDto.SetLateAmount(notification.LateAmount)
+	}
+	if notification.RefundID != nil {
+		paymentUpdateDto.SetRefundId(notification.RefundID.String())
+		paymentUpdateDto.SetRefundStatus(notification.RefundStatus)
+		paymentUpdateDto.SetRefundAmount(notification.RefundAmount)
+		paymentUpdateDto.RefundTxHash = notification.RefundTxHash
+	}
 	configuration := backendClientApi.NewConfiguration()
 	configuration.Servers[0].URL = utils.Opts.BackendBaseUrl
 	apiClient := backendClientApi.NewAPIClient(configuration)
@@ -99,7 +266,7 @@ func sendNotificationToBackend(paymentId string, payAmount string, actuallyPaid
 	return nil
 }
 
-func getFeeRate(client *rpcclient.Client) (*float64, error) {
+func getFeeRate(client node.BitcoinNode) (*float64, error) {
 	feeRate, err := client.EstimateSmartFee(6, &btcjson.EstimateModeConservative)
 	if err != nil {
 		return nil, err
@@ -132,7 +299,7 @@ func getFee(feeRate *float64, size int64) (*big.Int, error) {
 	return final, nil
 }
 
-func getNetParams(client *rpcclient.Client) (*chaincfg.Params, error) {
+func getNetParams(client node.BitcoinNode) (*chaincfg.Params, error) {
 	info, err := client.GetBlockChainInfo()
 	if err != nil {
 		return nil, err
@@ -141,6 +308,8 @@ func getNetParams(client *rpcclient.Client) (*chaincfg.Params, error) {
 	switch info.Chain {
 	case "regtest":
 		return &chaincfg.RegressionNetParams, nil
+	case "signet":
+		return &chaincfg.SigNetParams, nil
 	case enum.Test.String():
 		return &chaincfg.TestNet3Params, nil
 	case enum.Main.String():
@@ -150,6 +319,79 @@ func getNetParams(client *rpcclient.Client) (*chaincfg.Params, error) {
 	}
 }
 
+// validateAddress makes sure funds are only sent to addresses of the network of the client
+func validateAddress(client node.BitcoinNode, address string, network model.Network) error {
+	params, err := getNetParams(client)
+	if err != nil {
+		return err
+	}
+	decodedAddress, err := btcutil.DecodeAddress(address, params)
+	if err != nil || !decodedAddress.IsForNet(params) {
+		return fmt.Errorf("invalid %s address: %s", network, address)
+	}
+	return nil
+}
+
+// knownNetParams are tried to tell the merchant which network a wallet of the wrong network belongs to
+var knownNetParams = []*chaincfg.Params{&chaincfg.MainNetParams, &chaincfg.TestNet3Params, &chaincfg.RegressionNetParams}
+
+// decodeWallet decodes the wallet of a merchant with the params of the network. Only addresses the node can pay to
+// with createrawtransaction are accepted: P2PKH, P2SH and segwit version 0.
+func decodeWallet(wallet string, params *chaincfg.Params) (btcutil.Address, error) {
+	// taproot and later witness versions use bech32m, which btcutil reports as a checksum error
+	lowerWallet := strings.ToLower(wallet)
+	separator := strings.LastIndexByte(lowerWallet, '1')
+	if separator > 1 && separator+1 < len(lowerWallet) && chaincfg.IsBech32SegwitPrefix(lowerWallet[:separator+1]) && lowerWallet[separator+1] != 'q' {
+		return nil, fmt.Errorf("unsupported wallet address, only segwit version 0 is supported: %s", wallet)
+	}
+
+	address, err := btcutil.DecodeAddress(wallet, params)
+	if err == nil && !address.IsForNet(params) {
+		err = btcutil.ErrUnknownAddressType
+	}
+	if err != nil {
+		for _, other := range knownNetParams {
+			otherAddress, otherErr := btcutil.DecodeAddress(wallet, other)
+			if otherErr == nil && otherAddress.IsForNet(other) {
+				return nil, fmt.Errorf("wallet address is for %s, not %s: %s", chainName(other), chainName(params), wallet)
+			}
+		}
+		return nil, fmt.Errorf("invalid wallet address %s: %v", wallet, err)
+	}
+
+	switch address.(type) {
+	case *btcutil.AddressPubKeyHash, *btcutil.AddressScriptHash, *btcutil.AddressWitnessPubKeyHash, *btcutil.AddressWitnessScriptHash:
+		return address, nil
+	default:
+		return nil, fmt.Errorf("unsupported wallet address: %s", wallet)
+	}
+}
+
+// normalizeWallet encodes the wallet of a merchant like the payments store it, e.g. lower case for bech32.
+// The settings of a merchant are not bound to a network, so the wallet is decoded with the params it is for.
+func normalizeWallet(wallet string) (string, error) {
+	params := &chaincfg.MainNetParams
+	for _, other := range knownNetParams {
+		address, err := btcutil.DecodeAddress(wallet, other)
+		if err == nil && address.IsForNet(other) {
+			params = other
+			break
+		}
+	}
+	address, err := decodeWallet(wallet, params)
+	if err != nil {
+		return "", err
+	}
+	return address.EncodeAddress(), nil
+}
+
+func chainName(params *chaincfg.Params) string {
+	if params.Name == chaincfg.TestNet3Params.Name {
+		return model.Testnet.String()
+	}
+	return params.Name
+}
+
 func contains(s []string, str string) bool {
 	for _, v := range s {
 		if v == str {
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/CHainGate/bitcoin-service/internal/node"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/google/uuid"
+)
+
+// watchOnlyNode signs the inputs of derived payment addresses with the account xprv, the node only watches them.
+// The other inputs, e.g. of the change address, are still signed by the wallet of the node.
+// The derived addresses are watched by a separate wallet without private keys, so the wallet queries cover both wallets.
+type watchOnlyNode struct {
+	node.BitcoinNode
+	wallet   node.BitcoinNode // the watch-only wallet
+	keychain *AccountKeychain
+	accounts repository.IAccountRepository
+}
+
+// GetTransaction falls back to the wallet with the keys, e.g. for payments created before the xpub was configured
+func (n *watchOnlyNode) GetTransaction(txHash *chainhash.Hash) (*btcjson.GetTransactionResult, error) {
+	transaction, err := n.wallet.GetTransaction(txHash)
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) && rpcErr.Code == btcjson.ErrRPCInvalidAddressOrKey {
+		return n.BitcoinNode.GetTransaction(txHash)
+	}
+	return transaction, err
+}
+
+func (n *watchOnlyNode) ListUnspentMinMaxAddresses(minConf, maxConf int, addrs []btcutil.Address) ([]btcjson.ListUnspentResult, error) {
+	watched, err := n.wallet.ListUnspentMinMaxAddresses(minConf, maxConf, addrs)
+	if err != nil {
+		return nil, err
+	}
+	owned, err := n.BitcoinNode.ListUnspentMinMaxAddresses(minConf, maxConf, addrs)
+	if err != nil {
+		return nil, err
+	}
+	return append(watched, owned...), nil
+}
+
+func (n *watchOnlyNode) ListTransactions(account string) ([]btcjson.ListTransactionsResult, error) {
+	watched, err := n.wallet.ListTransactions(account)
+	if err != nil {
+		return nil, err
+	}
+	owned, err := n.BitcoinNode.ListTransactions(account)
+	if err != nil {
+		return nil, err
+	}
+	return append(watched, owned...), nil
+}
+
+func (n *watchOnlyNode) ListSinceBlock(blockHash *chainhash.Hash) (*btcjson.ListSinceBlockResult, error) {
+	watched, err := n.wallet.ListSinceBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	owned, err := n.BitcoinNode.ListSinceBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	return &btcjson.ListSinceBlockResult{
+		Transactions: append(watched.Transactions, owned.Transactions...),
+		LastBlock:    owned.LastBlock,
+	}, nil
+}
+
+// FundRawTransaction funds a transaction spending derived payment addresses with the watch-only wallet,
+// a wallet can only fund inputs it knows
+func (n *watchOnlyNode) FundRawTransaction(tx *wire.MsgTx, opts btcjson.FundRawTransactionOpts, isWitness *bool) (*btcjson.FundRawTransactionResult, error) {
+	for _, in := range tx.TxIn {
+		prevOut, err := n.previousOutput(in.PreviousOutPoint)
+		if err != nil {
+			return nil, err
+		}
+		_, derived, err := n.derivationIndex(prevOut.PkScript)
+		if err != nil {
+			return nil, err
+		}
+		if derived {
+			return n.wallet.FundRawTransaction(tx, opts, isWitness)
+		}
+	}
+	return n.BitcoinNode.FundRawTransaction(tx, opts, isWitness)
+}
+
+func (n *watchOnlyNode) SignRawTransactionWithWallet(tx *wire.MsgTx) (*wire.MsgTx, bool, error) {
+	signed := tx.Copy()
+	hashes := txscript.NewTxSigHashes(signed)
+	for i, in := range signed.TxIn {
+		if len(in.Witness) > 0 || len(in.SignatureScript) > 0 {
+			continue
+		}
+		prevOut, err := n.previousOutput(in.PreviousOutPoint)
+		if err != nil {
+			return nil, false, err
+		}
+		index, ok, err := n.derivationIndex(prevOut.PkScript)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			continue
+		}
+
+		key, err := n.keychain.privateKey(index)
+		if err != nil {
+			return nil, false, err
+		}
+		witness, err := txscript.WitnessSignature(signed, hashes, i, prevOut.Value, prevOut.PkScript, txscript.SigHashAll, key, true)
+		if err != nil {
+			return nil, false, err
+		}
+		in.Witness = witness
+	}
+
+	// the wallet keeps the signed inputs and signs its own ones
+	return n.BitcoinNode.SignRawTransactionWithWallet(signed)
+}
+
+func (n *watchOnlyNode) previousOutput(outPoint wire.OutPoint) (*wire.TxOut, error) {
+	transaction, err := n.GetTransaction(&outPoint.Hash)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := decodeTransaction(transaction.Hex)
+	if err != nil {
+		return nil, err
+	}
+	if int(outPoint.Index) >= len(previous.TxOut) {
+		return nil, fmt.Errorf("transaction %s has no output %d", outPoint.Hash, outPoint.Index)
+	}
+	return previous.TxOut[outPoint.Index], nil
+}
+
+// derivationIndex returns the index of the derived payment address paid by pkScript
+func (n *watchOnlyNode) derivationIndex(pkScript []byte) (int64, bool, error) {
+	_, addresses, _, err := txscript.ExtractPkScriptAddrs(pkScript, n.keychain.params)
+	if err != nil || len(addresses) != 1 {
+		return 0, false, nil
+	}
+	account, err := n.accounts.FindByAddress(addresses[0].EncodeAddress())
+	if err != nil {
+		return 0, false, err
+	}
+	if account.ID == uuid.Nil || account.DerivationIndex == nil {
+		return 0, false, nil
+	}
+	return *account.DerivationIndex, true, nil
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/lightninglabs/gozmq"
+)
+
+const (
+	zmqTopicHashBlock = "hashblock"
+	zmqTopicRawTx     = "rawtx"
+
+	zmqReadTimeout       = 5 * time.Second
+	zmqMinReconnectDelay = time.Second
+	zmqMaxReconnectDelay = time.Minute
+
+	// zmqQueueSize is how many transactions wait for the worker, more are dropped and found by a resync
+	zmqQueueSize = 1000
+)
+
+type IZmqSubscriber interface {
+	Start()
+	Stop()
+}
+
+// zmqSubscriber drives the bitcoin service from the zmqpubhashblock and zmqpubrawtx feeds of a node.
+// Transactions and resyncs are handled by a worker, so the receive loop keeps up with the node and no message is
+// lost at the high-water mark of the socket. Blocks are handed to the block worker, which only queues them.
+// The http notification endpoints stay available as a fallback.
+type zmqSubscriber struct {
+	bitcoinService IBitcoinService
+	network        model.Network
+	address        string
+	sequences      map[string]uint32
+	transactions   chan *wire.MsgTx
+	resyncs        chan struct{} // a queued resync, requests meanwhile are coalesced into it
+	quit           chan struct{}
+	stopOnce       sync.Once
+
+	mu   sync.Mutex
+	conn *gozmq.Conn // the connection of run, closed by Stop to end a blocking receive
+}
+
+func NewZmqSubscriber(bitcoinService IBitcoinService, network model.Network, address string) IZmqSubscriber {
+	return &zmqSubscriber{
+		bitcoinService: bitcoinService,
+		network:        network,
+		address:        address,
+		sequences:      make(map[string]uint32),
+		transactions:   make(chan *wire.MsgTx, zmqQueueSize),
+		resyncs:        make(chan struct{}, 1),
+		quit:           make(chan struct{}),
+	}
+}
+
+func (z *zmqSubscriber) Start() {
+	go z.work()
+	go z.run()
+}
+
+// Stop ends the subscription, it can be called more than once
+func (z *zmqSubscriber) Stop() {
+	z.stopOnce.Do(func() {
+		close(z.quit)
+		z.mu.Lock()
+		defer z.mu.Unlock()
+		if z.conn != nil {
+			z.conn.Close()
+		}
+	})
+}
+
+func (z *zmqSubscriber) run() {
+	delay := zmqMinReconnectDelay
+	for {
+		conn, err := gozmq.Subscribe(z.address, []string{zmqTopicHashBlock, zmqTopicRawTx}, zmqReadTimeout)
+		if err != nil {
+			log.Printf("zmq %s: could not subscribe to %s: %v", z.network, z.address, err)
+			if !z.sleep(delay) {
+				return
+			}
+			delay *= 2
+			if delay > zmqMaxReconnectDelay {
+				delay = zmqMaxReconnectDelay
+			}
+			continue
+		}
+
+		if !z.setConn(conn) {
+			conn.Close()
+			return
+		}
+		log.Printf("zmq %s: subscribed to %s", z.network, z.address)
+		delay = zmqMinReconnectDelay
+
+		// events might have been published while we were not connected
+		z.sequences = make(map[string]uint32)
+		z.queueResync()
+
+		err = z.receive(conn)
+		z.setConn(nil)
+		conn.Close()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		log.Printf("zmq %s: connection lost: %v", z.network, err)
+	}
+}
+
+// setConn publishes the connection to Stop, it returns false if the subscriber was stopped already
+func (z *zmqSubscriber) setConn(conn *gozmq.Conn) bool {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	select {
+	case <-z.quit:
+		z.conn = nil
+		return false
+	default:
+		z.conn = conn
+		return true
+	}
+}
+
+func (z *zmqSubscriber) receive(conn *gozmq.Conn) error {
+	for {
+		msg, err := conn.Receive(nil)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				select {
+				case <-z.quit:
+					return io.EOF
+				default:
+					continue
+				}
+			}
+			return err
+		}
+		z.handleMessage(msg)
+	}
+}
+
+// bitcoind sends three frames: topic, body and a little endian sequence number per topic
+func (z *zmqSubscriber) handleMessage(msg [][]byte) {
+	if len(msg) != 3 || len(msg[2]) != 4 {
+		log.Printf("zmq %s: unexpected message with %d frames", z.network, len(msg))
+		return
+	}
+
+	topic := string(msg[0])
+	body := msg[1]
+	sequence := binary.LittleEndian.Uint32(msg[2])
+
+	if z.hasGap(topic, sequence) {
+		log.Printf("zmq %s: sequence gap on %s, resyncing", z.network, topic)
+		z.queueResync()
+	}
+
+	switch topic {
+	case zmqTopicHashBlock:
+		z.bitcoinService.HandleBlockNotify(hex.EncodeToString(body), z.network)
+	case zmqTopicRawTx:
+		var transaction wire.MsgTx
+		err := transaction.Deserialize(bytes.NewReader(body))
+		if err != nil {
+			log.Printf("zmq %s: could not decode transaction: %v", z.network, err)
+			return
+		}
+		select {
+		case z.transactions <- &transaction:
+		default:
+			log.Printf("zmq %s: transaction queue is full, resyncing", z.network)
+			z.queueResync()
+		}
+	}
+}
+
+// work handles the queued transactions and resyncs until the subscriber is stopped
+func (z *zmqSubscriber) work() {
+	for {
+		select {
+		case <-z.quit:
+			return
+		case <-z.resyncs:
+			z.bitcoinService.Resync(z.network)
+		case transaction := <-z.transactions:
+			z.bitcoinService.HandleRawTransaction(transaction, z.network)
+		}
+	}
+}
+
+func (z *zmqSubscriber) queueResync() {
+	select {
+	case z.resyncs <- struct{}{}:
+	default:
+		// the queued resync finds the transactions of this request as well
+	}
+}
+
+func (z *zmqSubscriber) hasGap(topic string, sequence uint32) bool {
+	last, ok := z.sequences[topic]
+	z.sequences[topic] = sequence
+	return ok && sequence != last+1
+}
+
+// sleep waits for the given duration and returns false if the subscriber was stopped in the meantime
+func (z *zmqSubscriber) sleep(d time.Duration) bool {
+	select {
+	case <-z.quit:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/repository"
+	"github.com/CHainGate/bitcoin-service/openApi"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/google/uuid"
+)
+
+type recordingBitcoinService struct {
+	blockHashes []string
+	txIds       []string
+	resyncs     int
+}
+
+func (r *recordingBitcoinService) CreateNewPayment(openApi.PaymentRequestDto) (*model.Payment, error) {
+	return nil, nil
+}
+
+func (r *recordingBitcoinService) GetPayment(uuid.UUID) (*model.Payment, error) {
+	return nil, nil
+}
+
+func (r *recordingBitcoinService) GetPayments(repository.PaymentFilter) ([]model.Payment, int64, error) {
+	return nil, 0, nil
+}
+
+func (r *recordingBitcoinService) HandleWalletNotify(txId string, _ model.Network) {
+	r.txIds = append(r.txIds, txId)
+}
+
+func (r *recordingBitcoinService) HandleBlockNotify(blockHash string, _ model.Network) {
+	r.blockHashes = append(r.blockHashes, blockHash)
+}
+
+func (r *recordingBitcoinService) HandleRawTransaction(transaction *wire.MsgTx, _ model.Network) {
+	r.txIds = append(r.txIds, transaction.TxHash().String())
+}
+
+func (r *recordingBitcoinService) Resync(model.Network) {
+	r.resyncs++
+}
+
+func (r *recordingBitcoinService) ResolveNetwork(enum.Mode, string) (model.Network, error) {
+	return model.Regtest, nil
+}
+
+func (r *recordingBitcoinService) GetLatePayments(model.LatePaymentStatus) ([]model.LatePayment, error) {
+	return nil, nil
+}
+
+func (r *recordingBitcoinService) HonorLatePayment(uuid.UUID) (*model.LatePayment, error) {
+	return nil, nil
+}
+
+func (r *recordingBitcoinService) RefundLatePayment(uuid.UUID, string) (*model.LatePayment, error) {
+	return nil, nil
+}
+
+func (r *recordingBitcoinService) RefundPayment(uuid.UUID, string, *big.Int) (*model.Refund, error) {
+	return nil, nil
+}
+
+func (r *recordingBitcoinService) GetMerchantSettings(string) (*model.MerchantSettings, error) {
+	return nil, nil
+}
+
+func (r *recordingBitcoinService) SaveMerchantSettings(model.MerchantSettings) (*model.MerchantSettings, error) {
+	return nil, nil
+}
+
+func (r *recordingBitcoinService) GetMerchantLedger(string, model.Network) ([]model.MerchantLedgerEntry, *big.Int, error) {
+	return nil, nil, nil
+}
+
+func (r *recordingBitcoinService) GetQuarantinedPayments() ([]model.Payment, error) {
+	return nil, nil
+}
+
+func (r *recordingBitcoinService) RetryQuarantinedPayment(uuid.UUID) (*model.Payment, error) {
+	return nil, nil
+}
+
+func zmqMessage(topic string, body []byte, sequence uint32) [][]byte {
+	seq := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seq, sequence)
+	return [][]byte{[]byte(topic), body, seq}
+}
+
+func TestZmqSubscriber_HandleMessage(t *testing.T) {
+	// Arrange
+	recorder := &recordingBitcoinService{}
+	subscriber := NewZmqSubscriber(recorder, model.Regtest, "").(*zmqSubscriber)
+
+	transaction := wire.NewMsgTx(wire.TxVersion)
+	// without inputs the transaction would be decoded as a segwit one
+	transaction.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+	transaction.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+	var rawTx bytes.Buffer
+	err := transaction.Serialize(&rawTx)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	blockHash := bytes.Repeat([]byte{0xab}, 32)
+
+	// Act
+	subscriber.handleMessage(zmqMessage(zmqTopicHashBlock, blockHash, 7))
+	subscriber.handleMessage(zmqMessage(zmqTopicRawTx, rawTx.Bytes(), 0))
+	subscriber.handleMessage(zmqMessage(zmqTopicHashBlock, blockHash, 8))
+
+	// Assert
+	if len(recorder.blockHashes) != 2 || recorder.blockHashes[0] != "abababababababababababababababababababababababababababababababab" {
+		t.Errorf("Expected 2 block notifications, but got %v", recorder.blockHashes)
+	}
+	if len(subscriber.transactions) != 1 {
+		t.Fatalf("Expected transaction %s to be queued, but got %d transactions", transaction.TxHash(), len(subscriber.transactions))
+	}
+	if queued := <-subscriber.transactions; queued.TxHash() != transaction.TxHash() {
+		t.Errorf("Expected transaction %s, but got %s", transaction.TxHash(), queued.TxHash())
+	}
+	if len(recorder.txIds) != 0 {
+		t.Errorf("Expected the transaction to be left to the worker, but got %v", recorder.txIds)
+	}
+	if len(subscriber.resyncs) != 0 {
+		t.Errorf("Expected no resync, but got %d", len(subscriber.resyncs))
+	}
+}
+
+func TestZmqSubscriber_SequenceGap(t *testing.T) {
+	// Arrange
+	recorder := &recordingBitcoinService{}
+	subscriber := NewZmqSubscriber(recorder, model.Regtest, "").(*zmqSubscriber)
+	blockHash := bytes.Repeat([]byte{0x01}, 32)
+
+	// Act
+	subscriber.handleMessage(zmqMessage(zmqTopicHashBlock, blockHash, 1))
+	subscriber.handleMessage(zmqMessage(zmqTopicHashBlock, blockHash, 4))
+	subscriber.handleMessage(zmqMessage(zmqTopicHashBlock, blockHash, 7))
+
+	// Assert
+	if len(subscriber.resyncs) != 1 || recorder.resyncs != 0 {
+		t.Errorf("Expected the resyncs of the gaps to be coalesced for the worker, but got %d queued and %d run", len(subscriber.resyncs), recorder.resyncs)
+	}
+	if len(recorder.blockHashes) != 3 {
+		t.Errorf("Expected the blocks after the gaps to be handled, but got %v", recorder.blockHashes)
+	}
+}
+
+func TestZmqSubscriber_FullQueue(t *testing.T) {
+	// Arrange
+	recorder := &recordingBitcoinService{}
+	subscriber := NewZmqSubscriber(recorder, model.Regtest, "").(*zmqSubscriber)
+	transaction := wire.NewMsgTx(wire.TxVersion)
+	transaction.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+	transaction.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+	var rawTx bytes.Buffer
+	err := transaction.Serialize(&rawTx)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Act
+	for i := 0; i <= zmqQueueSize; i++ {
+		subscriber.handleMessage(zmqMessage(zmqTopicRawTx, rawTx.Bytes(), uint32(i)))
+	}
+
+	// Assert
+	if len(subscriber.transactions) != zmqQueueSize {
+		t.Errorf("Expected %d queued transactions, but got %d", zmqQueueSize, len(subscriber.transactions))
+	}
+	if len(subscriber.resyncs) != 1 {
+		t.Errorf("Expected a resync for the dropped transaction, but got %d", len(subscriber.resyncs))
+	}
+}
+
+func TestZmqSubscriber_Stop(t *testing.T) {
+	// Arrange
+	subscriber := NewZmqSubscriber(&recordingBitcoinService{}, model.Regtest, "127.0.0.1:1")
+	subscriber.Start()
+
+	// Act
+	subscriber.Stop()
+	subscriber.Stop()
+
+	// Assert
+	select {
+	case <-subscriber.(*zmqSubscriber).quit:
+	default:
+		t.Errorf("Expected the subscriber to be stopped")
+	}
+}
@@ -10,27 +10,87 @@ import (
 )
 
 type OptsType struct {
-	ServerPort              int
-	DbHost                  string
-	DbUser                  string
-	DbPassword              string
-	DbName                  string
-	DbPort                  string
-	BitcoinTestHost         string
-	BitcoinTestUser         string
-	BitcoinTestPass         string
-	BitcoinMainHost         string
-	BitcoinMainUser         string
-	BitcoinMainPass         string
-	ProxyBaseUrl            string
-	BackendBaseUrl          string
-	TestWalletPassphrase    string
-	MainWalletPassphrase    string
-	TestChangeAddress       string
-	MainChangeAddress       string
-	ForwardAmountPercentage int
-	FallbackFee             float64
-	MinimumConfirmations    int
+	ServerPort                  int
+	AdminAddress                string
+	BitcoinNetworks             string
+	LegacyMainNetwork           string
+	LegacyTestNetwork           string
+	DbHost                      string
+	DbUser                      string
+	DbPassword                  string
+	DbName                      string
+	DbPort                      string
+	BitcoinTestHost             string
+	BitcoinTestUser             string
+	BitcoinTestPass             string
+	BitcoinMainHost             string
+	BitcoinMainUser             string
+	BitcoinMainPass             string
+	BitcoinRegtestHost          string
+	BitcoinRegtestUser          string
+	BitcoinRegtestPass          string
+	BitcoinSignetHost           string
+	BitcoinSignetUser           string
+	BitcoinSignetPass           string
+	ProxyBaseUrl                string
+	BackendBaseUrl              string
+	TestWalletPassphrase        string
+	MainWalletPassphrase        string
+	RegtestWalletPassphrase     string
+	SignetWalletPassphrase      string
+	TestChangeAddress           string
+	MainChangeAddress           string
+	RegtestChangeAddress        string
+	SignetChangeAddress         string
+	TestAccountXpub             string
+	MainAccountXpub             string
+	RegtestAccountXpub          string
+	SignetAccountXpub           string
+	TestAccountXprv             string
+	MainAccountXprv             string
+	RegtestAccountXprv          string
+	SignetAccountXprv           string
+	TestWallet                  string
+	MainWallet                  string
+	RegtestWallet               string
+	SignetWallet                string
+	TestWatchOnlyWallet         string
+	MainWatchOnlyWallet         string
+	RegtestWatchOnlyWallet      string
+	SignetWatchOnlyWallet       string
+	AccountGapLimit             int
+	ForwardAmountPercentage     int
+	FallbackFee                 float64
+	MinimumConfirmations        int
+	TestMinimumConfirmations    int
+	MainMinimumConfirmations    int
+	RegtestMinimumConfirmations int
+	SignetMinimumConfirmations  int
+	PaymentExpiry               int
+	PaymentExpiryMin            int
+	PaymentExpiryMax            int
+	UnderpaymentToleranceMax    float64
+	FeeBumpBlocks               int
+	FeeBumpPercentage           int
+	PayoutBatchInterval         int
+	PayoutBatchThreshold        int
+	OverpaymentPolicy           string
+	OutboxDispatchInterval      int
+	OutboxMaxAttempts           int
+	OutboxBackoffBase           int
+	OutboxBackoffMax            int
+	PaymentMaxFailures          int
+	ZmqTestAddress              string
+	ZmqMainAddress              string
+	ZmqRegtestAddress           string
+	ZmqSignetAddress            string
+	ReconcileInterval           int
+	NotificationHmacSecret      string
+	NotificationMaxClockSkew    int
+	NotificationAllowedIps      string
+	NotificationClientCa        string
+	ServerTlsCert               string
+	ServerTlsKey                string
 }
 
 var (
@@ -45,6 +105,10 @@ func NewOpts() {
 
 	o := &OptsType{}
 	flag.IntVar(&o.ServerPort, "SERVER_PORT", lookupEnvInt("SERVER_PORT", 9001), "Server PORT")
+	flag.StringVar(&o.AdminAddress, "ADMIN_ADDRESS", lookupEnv("ADMIN_ADDRESS", "127.0.0.1:9002"), "Listen address of the /debug/vars metrics and the operator endpoints, keep it off the public network")
+	flag.StringVar(&o.BitcoinNetworks, "BITCOIN_NETWORKS", lookupEnv("BITCOIN_NETWORKS", "testnet,mainnet"), "Comma separated networks to serve: regtest, signet, testnet, mainnet")
+	flag.StringVar(&o.LegacyMainNetwork, "LEGACY_MAIN_NETWORK", lookupEnv("LEGACY_MAIN_NETWORK", "mainnet"), "Network of the rows saved with mode main before networks existed, e.g. regtest if the main node ran regtest")
+	flag.StringVar(&o.LegacyTestNetwork, "LEGACY_TEST_NETWORK", lookupEnv("LEGACY_TEST_NETWORK", "testnet"), "Network of the rows saved with mode test before networks existed")
 	flag.StringVar(&o.DbHost, "DB_HOST", lookupEnv("DB_HOST", "localhost"), "Database Host")
 	flag.StringVar(&o.DbUser, "DB_USER", lookupEnv("DB_USER", "postgres"), "Database User")
 	flag.StringVar(&o.DbPassword, "DB_PASSWORD", lookupEnv("DB_PASSWORD"), "Database Password")
@@ -56,19 +120,85 @@ func NewOpts() {
 	flag.StringVar(&o.BitcoinMainHost, "BITCOIN_MAIN_HOST", lookupEnv("BITCOIN_MAIN_HOST", "localhost:8333"), "Bitcoin Host")
 	flag.StringVar(&o.BitcoinMainUser, "BITCOIN_MAIN_USER", lookupEnv("BITCOIN_MAIN_USER"), "Bitcoin User")
 	flag.StringVar(&o.BitcoinMainPass, "BITCOIN_MAIN_PASS", lookupEnv("BITCOIN_MAIN_PASS"), "Bitcoin Password")
+	flag.StringVar(&o.BitcoinRegtestHost, "BITCOIN_REGTEST_HOST", lookupEnv("BITCOIN_REGTEST_HOST", "localhost:18443"), "Bitcoin Host")
+	flag.StringVar(&o.BitcoinRegtestUser, "BITCOIN_REGTEST_USER", lookupEnv("BITCOIN_REGTEST_USER"), "Bitcoin User")
+	flag.StringVar(&o.BitcoinRegtestPass, "BITCOIN_REGTEST_PASS", lookupEnv("BITCOIN_REGTEST_PASS"), "Bitcoin Password")
+	flag.StringVar(&o.BitcoinSignetHost, "BITCOIN_SIGNET_HOST", lookupEnv("BITCOIN_SIGNET_HOST", "localhost:38332"), "Bitcoin Host")
+	flag.StringVar(&o.BitcoinSignetUser, "BITCOIN_SIGNET_USER", lookupEnv("BITCOIN_SIGNET_USER"), "Bitcoin User")
+	flag.StringVar(&o.BitcoinSignetPass, "BITCOIN_SIGNET_PASS", lookupEnv("BITCOIN_SIGNET_PASS"), "Bitcoin Password")
 	flag.StringVar(&o.ProxyBaseUrl, "PROXY_BASE_URL", lookupEnv("PROXY_BASE_URL", "http://localhost:8001/api"), "Proxy base url")
 	flag.StringVar(&o.BackendBaseUrl, "BACKEND_BASE_URL", lookupEnv("BACKEND_BASE_URL", "http://localhost:8000/api/internal"), "Backend base url")
 	flag.StringVar(&o.TestWalletPassphrase, "TEST_WALLET_PASSPHRASE", lookupEnv("TEST_WALLET_PASSPHRASE"), "TEST WALLET PASSPHRASE")
 	flag.StringVar(&o.MainWalletPassphrase, "MAIN_WALLET_PASSPHRASE", lookupEnv("MAIN_WALLET_PASSPHRASE"), "MAIN WALLET PASSPHRASE")
+	flag.StringVar(&o.RegtestWalletPassphrase, "REGTEST_WALLET_PASSPHRASE", lookupEnv("REGTEST_WALLET_PASSPHRASE"), "REGTEST WALLET PASSPHRASE")
+	flag.StringVar(&o.SignetWalletPassphrase, "SIGNET_WALLET_PASSPHRASE", lookupEnv("SIGNET_WALLET_PASSPHRASE"), "SIGNET WALLET PASSPHRASE")
 	flag.StringVar(&o.TestChangeAddress, "TEST_CHANGE_ADDRESS", lookupEnv("TEST_CHANGE_ADDRESS"), "TEST_CHANGE_ADDRESS")
 	flag.StringVar(&o.MainChangeAddress, "MAIN_CHANGE_ADDRESS", lookupEnv("MAIN_CHANGE_ADDRESS"), "MAIN_CHANGE_ADDRESS")
+	flag.StringVar(&o.RegtestChangeAddress, "REGTEST_CHANGE_ADDRESS", lookupEnv("REGTEST_CHANGE_ADDRESS"), "REGTEST_CHANGE_ADDRESS")
+	flag.StringVar(&o.SignetChangeAddress, "SIGNET_CHANGE_ADDRESS", lookupEnv("SIGNET_CHANGE_ADDRESS"), "SIGNET_CHANGE_ADDRESS")
+	flag.StringVar(&o.TestAccountXpub, "TEST_ACCOUNT_XPUB", lookupEnv("TEST_ACCOUNT_XPUB"), "BIP84 account xpub the testnet payment addresses are derived from, empty to use addresses of the node wallet")
+	flag.StringVar(&o.MainAccountXpub, "MAIN_ACCOUNT_XPUB", lookupEnv("MAIN_ACCOUNT_XPUB"), "BIP84 account xpub the mainnet payment addresses are derived from, empty to use addresses of the node wallet")
+	flag.StringVar(&o.RegtestAccountXpub, "REGTEST_ACCOUNT_XPUB", lookupEnv("REGTEST_ACCOUNT_XPUB"), "BIP84 account xpub the regtest payment addresses are derived from, empty to use addresses of the node wallet")
+	flag.StringVar(&o.SignetAccountXpub, "SIGNET_ACCOUNT_XPUB", lookupEnv("SIGNET_ACCOUNT_XPUB"), "BIP84 account xpub the signet payment addresses are derived from, empty to use addresses of the node wallet")
+	flag.StringVar(&o.TestAccountXprv, "TEST_ACCOUNT_XPRV", lookupEnv("TEST_ACCOUNT_XPRV"), "Private key of TEST_ACCOUNT_XPUB signing the transactions of the watch-only wallet")
+	flag.StringVar(&o.MainAccountXprv, "MAIN_ACCOUNT_XPRV", lookupEnv("MAIN_ACCOUNT_XPRV"), "Private key of MAIN_ACCOUNT_XPUB signing the transactions of the watch-only wallet")
+	flag.StringVar(&o.RegtestAccountXprv, "REGTEST_ACCOUNT_XPRV", lookupEnv("REGTEST_ACCOUNT_XPRV"), "Private key of REGTEST_ACCOUNT_XPUB signing the transactions of the watch-only wallet")
+	flag.StringVar(&o.SignetAccountXprv, "SIGNET_ACCOUNT_XPRV", lookupEnv("SIGNET_ACCOUNT_XPRV"), "Private key of SIGNET_ACCOUNT_XPUB signing the transactions of the watch-only wallet")
+	flag.StringVar(&o.TestWallet, "TEST_WALLET", lookupEnv("TEST_WALLET"), "Name of the testnet node wallet with the keys, required by bitcoind once TEST_WATCH_ONLY_WALLET is loaded too")
+	flag.StringVar(&o.MainWallet, "MAIN_WALLET", lookupEnv("MAIN_WALLET"), "Name of the mainnet node wallet with the keys, required by bitcoind once MAIN_WATCH_ONLY_WALLET is loaded too")
+	flag.StringVar(&o.RegtestWallet, "REGTEST_WALLET", lookupEnv("REGTEST_WALLET"), "Name of the regtest node wallet with the keys, required by bitcoind once REGTEST_WATCH_ONLY_WALLET is loaded too")
+	flag.StringVar(&o.SignetWallet, "SIGNET_WALLET", lookupEnv("SIGNET_WALLET"), "Name of the signet node wallet with the keys, required by bitcoind once SIGNET_WATCH_ONLY_WALLET is loaded too")
+	flag.StringVar(&o.TestWatchOnlyWallet, "TEST_WATCH_ONLY_WALLET", lookupEnv("TEST_WATCH_ONLY_WALLET"), "Name of the testnet node wallet created with disable_private_keys=true which watches the addresses of TEST_ACCOUNT_XPUB")
+	flag.StringVar(&o.MainWatchOnlyWallet, "MAIN_WATCH_ONLY_WALLET", lookupEnv("MAIN_WATCH_ONLY_WALLET"), "Name of the mainnet node wallet created with disable_private_keys=true which watches the addresses of MAIN_ACCOUNT_XPUB")
+	flag.StringVar(&o.RegtestWatchOnlyWallet, "REGTEST_WATCH_ONLY_WALLET", lookupEnv("REGTEST_WATCH_ONLY_WALLET"), "Name of the regtest node wallet created with disable_private_keys=true which watches the addresses of REGTEST_ACCOUNT_XPUB")
+	flag.StringVar(&o.SignetWatchOnlyWallet, "SIGNET_WATCH_ONLY_WALLET", lookupEnv("SIGNET_WATCH_ONLY_WALLET"), "Name of the signet node wallet created with disable_private_keys=true which watches the addresses of SIGNET_ACCOUNT_XPUB")
+	flag.IntVar(&o.AccountGapLimit, "ACCOUNT_GAP_LIMIT", lookupEnvInt("ACCOUNT_GAP_LIMIT", 20), "Derived addresses after the last funded one before no new address is derived, 0 to disable")
 	flag.IntVar(&o.ForwardAmountPercentage, "FORWARD_AMOUNT_PERCENTAGE", lookupEnvInt("FORWARD_AMOUNT_PERCENTAGE", 99), "FORWARD_AMOUNT_PERCENTAGE")
 	flag.Float64Var(&o.FallbackFee, "FALLBACK_FEE", lookupEnvFloat64("FALLBACK_FEE", 0.00002986), "FALLBACK_FEE")
 	flag.IntVar(&o.MinimumConfirmations, "MINIMUM_CONFIRMATIONS", lookupEnvInt("MINIMUM_CONFIRMATIONS", 6), "MINIMUM_CONFIRMATIONS")
+	flag.IntVar(&o.TestMinimumConfirmations, "TEST_MINIMUM_CONFIRMATIONS", lookupEnvInt("TEST_MINIMUM_CONFIRMATIONS"), "Confirmation target of testnet, defaults to MINIMUM_CONFIRMATIONS")
+	flag.IntVar(&o.MainMinimumConfirmations, "MAIN_MINIMUM_CONFIRMATIONS", lookupEnvInt("MAIN_MINIMUM_CONFIRMATIONS"), "Confirmation target of mainnet, defaults to MINIMUM_CONFIRMATIONS")
+	flag.IntVar(&o.RegtestMinimumConfirmations, "REGTEST_MINIMUM_CONFIRMATIONS", lookupEnvInt("REGTEST_MINIMUM_CONFIRMATIONS"), "Confirmation target of regtest, defaults to MINIMUM_CONFIRMATIONS")
+	flag.IntVar(&o.SignetMinimumConfirmations, "SIGNET_MINIMUM_CONFIRMATIONS", lookupEnvInt("SIGNET_MINIMUM_CONFIRMATIONS"), "Confirmation target of signet, defaults to MINIMUM_CONFIRMATIONS")
+	flag.IntVar(&o.PaymentExpiry, "PAYMENT_EXPIRY", lookupEnvInt("PAYMENT_EXPIRY", 15), "Default minutes until an unpaid payment expires")
+	flag.IntVar(&o.PaymentExpiryMin, "PAYMENT_EXPIRY_MIN", lookupEnvInt("PAYMENT_EXPIRY_MIN", 1), "Shortest expiry in minutes a payment request may ask for")
+	flag.IntVar(&o.PaymentExpiryMax, "PAYMENT_EXPIRY_MAX", lookupEnvInt("PAYMENT_EXPIRY_MAX", 1440), "Longest expiry in minutes a payment request may ask for")
+	flag.Float64Var(&o.UnderpaymentToleranceMax, "UNDERPAYMENT_TOLERANCE_MAX", lookupEnvFloat64("UNDERPAYMENT_TOLERANCE_MAX", 1), "Largest underpayment tolerance in percent of the pay amount a payment request may ask for")
+	flag.IntVar(&o.FeeBumpBlocks, "FEE_BUMP_BLOCKS", lookupEnvInt("FEE_BUMP_BLOCKS", 6), "Blocks without confirmation before a forwarding transaction is replaced with a higher fee, 0 to disable")
+	flag.IntVar(&o.FeeBumpPercentage, "FEE_BUMP_PERCENTAGE", lookupEnvInt("FEE_BUMP_PERCENTAGE", 50), "Percent the fee rate of a replaced forwarding transaction is raised at least")
+	flag.IntVar(&o.PayoutBatchInterval, "PAYOUT_BATCH_INTERVAL", lookupEnvInt("PAYOUT_BATCH_INTERVAL"), "Minutes a confirmed payment waits for a payout batch, 0 and no PAYOUT_BATCH_THRESHOLD forwards every payment on its own")
+	flag.IntVar(&o.PayoutBatchThreshold, "PAYOUT_BATCH_THRESHOLD", lookupEnvInt("PAYOUT_BATCH_THRESHOLD"), "Satoshi of waiting payments which send the payout batch before PAYOUT_BATCH_INTERVAL, 0 to disable")
+	flag.StringVar(&o.OverpaymentPolicy, "OVERPAYMENT_POLICY", lookupEnv("OVERPAYMENT_POLICY", "credit"), "Handling of overpayments for merchants without settings: credit, forward or refund")
+	flag.IntVar(&o.OutboxDispatchInterval, "OUTBOX_DISPATCH_INTERVAL", lookupEnvInt("OUTBOX_DISPATCH_INTERVAL", 5), "Seconds between outbox dispatch runs")
+	flag.IntVar(&o.OutboxMaxAttempts, "OUTBOX_MAX_ATTEMPTS", lookupEnvInt("OUTBOX_MAX_ATTEMPTS", 10), "Delivery attempts before a notification is dead-lettered")
+	flag.IntVar(&o.OutboxBackoffBase, "OUTBOX_BACKOFF_BASE", lookupEnvInt("OUTBOX_BACKOFF_BASE", 5), "Initial retry backoff in seconds")
+	flag.IntVar(&o.OutboxBackoffMax, "OUTBOX_BACKOFF_MAX", lookupEnvInt("OUTBOX_BACKOFF_MAX", 3600), "Maximum retry backoff in seconds")
+	flag.IntVar(&o.PaymentMaxFailures, "PAYMENT_MAX_FAILURES", lookupEnvInt("PAYMENT_MAX_FAILURES", 10), "Failed block runs in a row before a payment is quarantined, 0 to disable")
+	flag.StringVar(&o.ZmqTestAddress, "ZMQ_TEST_ADDRESS", lookupEnv("ZMQ_TEST_ADDRESS"), "ZMQ endpoint of the test node publishing hashblock and rawtx, empty to disable")
+	flag.StringVar(&o.ZmqMainAddress, "ZMQ_MAIN_ADDRESS", lookupEnv("ZMQ_MAIN_ADDRESS"), "ZMQ endpoint of the main node publishing hashblock and rawtx, empty to disable")
+	flag.StringVar(&o.ZmqRegtestAddress, "ZMQ_REGTEST_ADDRESS", lookupEnv("ZMQ_REGTEST_ADDRESS"), "ZMQ endpoint of the regtest node publishing hashblock and rawtx, empty to disable")
+	flag.StringVar(&o.ZmqSignetAddress, "ZMQ_SIGNET_ADDRESS", lookupEnv("ZMQ_SIGNET_ADDRESS"), "ZMQ endpoint of the signet node publishing hashblock and rawtx, empty to disable")
+	flag.IntVar(&o.ReconcileInterval, "RECONCILE_INTERVAL", lookupEnvInt("RECONCILE_INTERVAL", 300), "Seconds between chain reconciliations")
+	flag.StringVar(&o.NotificationHmacSecret, "NOTIFICATION_HMAC_SECRET", lookupEnv("NOTIFICATION_HMAC_SECRET"), "Shared secret for signed node notifications, empty to disable")
+	flag.IntVar(&o.NotificationMaxClockSkew, "NOTIFICATION_MAX_CLOCK_SKEW", lookupEnvInt("NOTIFICATION_MAX_CLOCK_SKEW", 300), "Maximum age in seconds of a signed node notification")
+	flag.StringVar(&o.NotificationAllowedIps, "NOTIFICATION_ALLOWED_IPS", lookupEnv("NOTIFICATION_ALLOWED_IPS"), "Comma separated IPs and CIDRs allowed to notify, empty to disable")
+	flag.StringVar(&o.NotificationClientCa, "NOTIFICATION_CLIENT_CA", lookupEnv("NOTIFICATION_CLIENT_CA"), "PEM file with the CA of the node client certificates, empty to disable")
+	flag.StringVar(&o.ServerTlsCert, "SERVER_TLS_CERT", lookupEnv("SERVER_TLS_CERT"), "Server certificate, required for NOTIFICATION_CLIENT_CA")
+	flag.StringVar(&o.ServerTlsKey, "SERVER_TLS_KEY", lookupEnv("SERVER_TLS_KEY"), "Server key, required for NOTIFICATION_CLIENT_CA")
+
+	// a ticker panics on an interval of 0
+	requirePositive("OUTBOX_DISPATCH_INTERVAL", o.OutboxDispatchInterval)
+	requirePositive("RECONCILE_INTERVAL", o.ReconcileInterval)
 
 	Opts = o
 }
 
+func requirePositive(key string, value int) {
+	if value <= 0 {
+		log.Fatalf("%s must be greater than 0, but is %d", key, value)
+	}
+}
+
 func lookupEnv(key string, defaultValues ...string) string {
 	if val, ok := os.LookupEnv(key); ok {
 		return val
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 
+	"github.com/CHainGate/bitcoin-service/internal/auth"
+	"github.com/CHainGate/bitcoin-service/internal/model"
+	"github.com/CHainGate/bitcoin-service/internal/node"
 	"github.com/CHainGate/bitcoin-service/internal/repository"
 
 	"github.com/CHainGate/bitcoin-service/internal/service"
@@ -15,34 +21,122 @@ import (
 
 func main() {
 	utils.NewOpts()
-	accountRepo, paymentRepo, err := repository.SetupDatabase()
+	repos, unitOfWork, err := repository.SetupDatabase()
 	if err != nil {
 		fmt.Println(err)
 	}
 
-	mainClient, err := service.CreateBitcoinMainClient()
+	networks, err := service.GetConfiguredNetworks()
 	if err != nil {
 		log.Fatal(err)
 	}
-	testClient, err := service.CreateBitcoinTestClient()
+
+	_, err = service.GetDefaultOverpaymentPolicy()
 	if err != nil {
-		return
+		log.Fatal(err)
+	}
+
+	clients := make(map[model.Network]node.BitcoinNode)
+	for _, network := range networks {
+		client, err := service.CreateBitcoinClient(network)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clients[network] = client
+	}
+
+	keychains := make(map[model.Network]*service.AccountKeychain)
+	watchOnlyWallets := make(map[model.Network]node.BitcoinNode)
+	for _, network := range networks {
+		keychain, err := service.NewAccountKeychain(network)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keychains[network] = keychain
+		if keychain == nil {
+			continue
+		}
+		wallet, err := service.CreateWatchOnlyWalletClient(network)
+		if err != nil {
+			log.Fatal(err)
+		}
+		watchOnlyWallets[network] = wallet
 	}
 
-	bitcoinService := service.NewBitcoinService(accountRepo, paymentRepo, testClient, mainClient)
+	bitcoinService := service.NewBitcoinService(repos, unitOfWork, clients, keychains, watchOnlyWallets)
 
-	NotificationApiService := service.NewNotificationApiService(bitcoinService)
+	service.NewReconciler(bitcoinService, networks...).Start()
+
+	// block notifications only queue the processing of the network
+	blockWorker := service.NewBlockWorker(bitcoinService, networks...)
+	blockWorker.Start()
+
+	for _, network := range networks {
+		if address := service.GetZmqAddress(network); address != "" {
+			service.NewZmqSubscriber(blockWorker, network, address).Start()
+		}
+	}
+
+	NotificationApiService := service.NewNotificationApiService(blockWorker)
 	NotificationApiController := openApi.NewNotificationApiController(NotificationApiService)
 
 	PaymentApiService := service.NewPaymentApiService(bitcoinService)
 	PaymentApiController := openApi.NewPaymentApiController(PaymentApiService)
 
-	router := openApi.NewRouter(NotificationApiController, PaymentApiController)
+	outboxDispatcher := service.NewOutboxDispatcher(repos.Outbox, repos.AdvisoryLock)
+	outboxDispatcher.Start()
+
+	OutboxApiService := service.NewOutboxApiService(outboxDispatcher)
+	OutboxApiController := openApi.NewOutboxApiController(OutboxApiService)
+
+	LatePaymentApiService := service.NewLatePaymentApiService(bitcoinService)
+	LatePaymentApiController := openApi.NewLatePaymentApiController(LatePaymentApiService)
+
+	MerchantApiService := service.NewMerchantApiService(bitcoinService)
+	MerchantApiController := openApi.NewMerchantApiController(MerchantApiService)
+
+	router := openApi.NewRouter(NotificationApiController, PaymentApiController, OutboxApiController, LatePaymentApiController, MerchantApiController)
 
 	// https://ribice.medium.com/serve-swaggerui-within-your-golang-application-5486748a5ed4
 	sh := http.StripPrefix("/api/swaggerui/", http.FileServer(http.Dir("./swaggerui/")))
 	router.PathPrefix("/api/swaggerui/").Handler(sh)
 
+	authenticators, err := auth.NewNotificationAuthenticators(utils.Opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	router.Use(auth.NotificationAuthMiddleware(authenticators))
+
+	// the metrics expose the command line and memory stats and the operator endpoints move funds,
+	// they are not served on the public port
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/debug/vars", expvar.Handler())
+	adminMux.Handle("/", router)
+	go func() {
+		log.Println("Serving /debug/vars and the operator endpoints on " + utils.Opts.AdminAddress)
+		log.Fatal(http.ListenAndServe(utils.Opts.AdminAddress, adminMux))
+	}()
+
+	server := &http.Server{Addr: ":" + strconv.Itoa(utils.Opts.ServerPort), Handler: auth.AdminRouteMiddleware(router)}
 	log.Println("Starting bitcoin-service on port " + strconv.Itoa(utils.Opts.ServerPort))
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(utils.Opts.ServerPort), router))
+	if utils.Opts.ServerTlsCert == "" {
+		if utils.Opts.NotificationClientCa != "" {
+			log.Fatal("NOTIFICATION_CLIENT_CA requires SERVER_TLS_CERT and SERVER_TLS_KEY")
+		}
+		log.Fatal(server.ListenAndServe())
+	}
+
+	if utils.Opts.NotificationClientCa != "" {
+		pem, err := os.ReadFile(utils.Opts.NotificationClientCa)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clientCas, err := auth.LoadClientCaPool(pem)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// only the notification endpoints require a certificate, see auth.NewClientCertAuthenticator
+		server.TLSConfig = &tls.Config{ClientCAs: clientCas, ClientAuth: tls.VerifyClientCertIfGiven}
+	}
+	log.Fatal(server.ListenAndServeTLS(utils.Opts.ServerTlsCert, utils.Opts.ServerTlsKey))
 }
@@ -10,9 +10,10 @@ import (
 	"time"
 )
 
-func DbTestSetup(pool *dockertest.Pool) (*dockertest.Resource, repository.IAccountRepository, repository.IPaymentRepository, error) {
+// DbTestSetup starts a postgres container. Every test package needs its own container name, because go test runs packages in parallel.
+func DbTestSetup(pool *dockertest.Pool, name string) (*dockertest.Resource, *repository.Repositories, repository.IUnitOfWork, error) {
 	ressource, err := pool.RunWithOptions(&dockertest.RunOptions{
-		Name:       "test-db",
+		Name:       name,
 		Repository: "postgres",
 		Tag:        "14-alpine",
 		Env: []string{
@@ -35,7 +36,7 @@ func DbTestSetup(pool *dockertest.Pool) (*dockertest.Resource, repository.IAccou
 	utils.Opts.DbPassword = "secret"
 	utils.Opts.DbName = "testdb"
 	utils.Opts.DbPort = ressource.GetPort("5432/tcp")
-	utils.Opts.TestWalletPassphrase = "secret"
+	utils.Opts.RegtestWalletPassphrase = "secret"
 
 	if err != nil {
 		return nil, nil, nil, err
@@ -48,10 +49,10 @@ func DbTestSetup(pool *dockertest.Pool) (*dockertest.Resource, repository.IAccou
 
 	// exponential backoff-retry, because the application in the container might not be ready to accept connections yet
 	pool.MaxWait = 120 * time.Second
-	var accountRepo repository.IAccountRepository
-	var paymentRepo repository.IPaymentRepository
+	var repos *repository.Repositories
+	var unitOfWork repository.IUnitOfWork
 	if err = pool.Retry(func() error {
-		accountRepo, paymentRepo, err = repository.SetupDatabase()
+		repos, unitOfWork, err = repository.SetupDatabase()
 		if err != nil {
 			return err
 		}
@@ -59,7 +60,7 @@ func DbTestSetup(pool *dockertest.Pool) (*dockertest.Resource, repository.IAccou
 	}); err != nil {
 		return nil, nil, nil, err
 	}
-	return ressource, accountRepo, paymentRepo, nil
+	return ressource, repos, unitOfWork, nil
 }
 
 type BitcoinNodeTestSetupResult struct {
@@ -163,7 +164,7 @@ func BitcoinNodeTestSetup(pool *dockertest.Pool) (*BitcoinNodeTestSetupResult, e
 		log.Fatalf("changeAddress: %s", err)
 	}
 
-	utils.Opts.TestChangeAddress = changeAddress.EncodeAddress()
+	utils.Opts.RegtestChangeAddress = changeAddress.EncodeAddress()
 
 	result := &BitcoinNodeTestSetupResult{
 		ChaingateClient:    chaingateClient,